@@ -9,6 +9,8 @@ var (
 	// DefaultAllowedOrigins are the default allowed origins for the api, allowing for access
 	// via both of our internet uplinks when using the web interface.
 	DefaultAllowedOrigins = []string{"https://temporal.cloud", "https://backup.temporal.cloud"}
+	// TusHeaders are the headers sent by clients making resumable uploads following the tus protocol
+	TusHeaders = []string{"Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata"}
 )
 
 // CORSMiddleware is used to load our CORS handling logic
@@ -21,9 +23,12 @@ func CORSMiddleware(devMode bool, allowedOrigins []string) gin.HandlerFunc {
 		// configure allowed origins
 		corsConfig.AllowOrigins = allowedOrigins
 	}
-	// allow the DELETE method, allowed methods are now
-	// DELETE GET POST PUT HEAD
-	corsConfig.AddAllowMethods("DELETE")
-	corsConfig.AddAllowHeaders("cache-control", "Authorization", "Content-Type", "X-Request-ID")
+	// allow the DELETE, and PATCH methods, allowed methods are now
+	// DELETE PATCH GET POST PUT HEAD
+	corsConfig.AddAllowMethods("DELETE", "PATCH")
+	corsConfig.AddAllowHeaders("cache-control", "Authorization", "Content-Type", "X-Request-ID", IdempotencyKeyHeader)
+	// allow browsers to make resumable uploads following the tus protocol
+	corsConfig.AddAllowHeaders(TusHeaders...)
+	corsConfig.AddExposeHeaders(append(TusHeaders, "Location", "Upload-Expires", "Tus-Version", "Tus-Extension", "Tus-Max-Size")...)
 	return cors.New(corsConfig)
 }
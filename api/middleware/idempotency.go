@@ -0,0 +1,256 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/RTradeLtd/gorm"
+	jwt "github.com/appleboy/gin-jwt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header containing a client generated key, used
+	// to ensure a request is processed at most once no matter how many times it is sent
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayHeader is set on responses which were replayed from a previous request
+	IdempotentReplayHeader = "Idempotent-Replayed"
+	// DefaultIdempotencyWindow is the default amount of time responses are stored for
+	DefaultIdempotencyWindow = time.Hour * 24
+	// maxIdempotencyKeyLength is the maximum length of an idempotency key
+	maxIdempotencyKeyLength = 255
+	// maxMultipartMemory is the amount of a multipart form held in memory when fingerprinting
+	// requests, with the remainder stored in temporary files. It matches gin's default
+	maxMultipartMemory = 32 << 20
+)
+
+// IdempotencyKey records a request made with an idempotency key, and its response
+type IdempotencyKey struct {
+	gorm.Model
+	UserName string `gorm:"type:varchar(255);unique_index:idx_idempotency_keys_user_name_key"`
+	Key      string `gorm:"type:varchar(255);unique_index:idx_idempotency_keys_user_name_key"`
+	// Fingerprint is a hash of the request, used to detect keys reused for different requests
+	Fingerprint string `gorm:"type:varchar(255)"`
+	// Completed indicates the response has been stored, otherwise the request is in progress
+	Completed  bool
+	StatusCode int
+	// Headers is the json encoded response headers
+	Headers string `gorm:"type:text"`
+	Body    []byte `gorm:"type:bytea"`
+}
+
+// MigrateIdempotencyKeys is used to create or update the idempotency key table
+func MigrateIdempotencyKeys(db *gorm.DB) error {
+	return db.AutoMigrate(&IdempotencyKey{}).Error
+}
+
+// Idempotency is used to honor the idempotency key header of authenticated requests. The first
+// request made with a key is processed, and its response stored for window. Later requests with
+// the same key receive the stored response, unless they differ from the first request, in which
+// case they are rejected. Responses with a 5xx status code, and requests whose handler panics, are
+// not stored, allowing them to be retried
+func Idempotency(db *gorm.DB, window time.Duration, l *zap.SugaredLogger) gin.HandlerFunc {
+	if window <= 0 {
+		window = DefaultIdempotencyWindow
+	}
+	l = l.Named("idempotency-middleware")
+	var (
+		pruneMux  sync.Mutex
+		lastPrune time.Time
+	)
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			abortWithMessage(c, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+		username, _ := jwt.ExtractClaims(c)["id"].(string)
+		if username == "" {
+			// keys are scoped to users, so we can't honor them for unauthenticated requests
+			c.Next()
+			return
+		}
+		fingerprint, err := fingerprintRequest(c.Request)
+		if err != nil {
+			abortWithMessage(c, http.StatusBadRequest, "failed to read request")
+			return
+		}
+		// periodically remove expired keys
+		pruneMux.Lock()
+		if time.Since(lastPrune) > time.Minute*10 {
+			lastPrune = time.Now()
+			if err := db.Unscoped().Where("created_at < ?", time.Now().Add(-window)).Delete(&IdempotencyKey{}).Error; err != nil {
+				l.Errorw("failed to remove expired idempotency keys", "error", err.Error())
+			}
+		}
+		pruneMux.Unlock()
+
+		// expired keys which haven't been pruned yet may be reused
+		if err := db.Unscoped().Where(
+			"user_name = ? AND key = ? AND created_at < ?", username, key, time.Now().Add(-window),
+		).Delete(&IdempotencyKey{}).Error; err != nil {
+			l.Errorw("failed to remove expired idempotency key", "error", err.Error(), "user", username)
+		}
+		record := IdempotencyKey{UserName: username, Key: key, Fingerprint: fingerprint}
+		if err := db.Create(&record).Error; err != nil {
+			// the key has already been used
+			var existing IdempotencyKey
+			if err := db.Where("user_name = ? AND key = ?", username, key).First(&existing).Error; err != nil {
+				l.Errorw("failed to find idempotency key", "error", err.Error(), "user", username)
+				abortWithMessage(c, http.StatusInternalServerError, "failed to process Idempotency-Key")
+				return
+			}
+			switch {
+			case existing.Fingerprint != fingerprint:
+				abortWithMessage(c, http.StatusUnprocessableEntity,
+					"Idempotency-Key has already been used for a different request")
+			case !existing.Completed:
+				abortWithMessage(c, http.StatusConflict,
+					"a request with this Idempotency-Key is still being processed")
+			default:
+				replay(c, existing)
+			}
+			return
+		}
+		// remove the key unless its response is stored, such as when the handler fails with
+		// a 5xx status code or panics, so that the request may be retried with the same key
+		var completed bool
+		defer func() {
+			if completed {
+				return
+			}
+			if err := db.Unscoped().Delete(&record).Error; err != nil {
+				l.Errorw("failed to remove idempotency key", "error", err.Error(), "user", username)
+			}
+		}()
+		// capture the response so that it may be replayed
+		writer := &idempotencyWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			return
+		}
+		headers := http.Header{}
+		for k, v := range c.Writer.Header() {
+			// the request id identifies this request, not the ones it is replayed to
+			if k != http.CanonicalHeaderKey("X-Request-Id") {
+				headers[k] = v
+			}
+		}
+		encodedHeaders, _ := json.Marshal(headers)
+		if err := db.Model(&record).Updates(map[string]interface{}{
+			"completed":   true,
+			"status_code": c.Writer.Status(),
+			"headers":     string(encodedHeaders),
+			"body":        writer.body.Bytes(),
+		}).Error; err != nil {
+			l.Errorw("failed to store idempotent response", "error", err.Error(), "user", username)
+			return
+		}
+		completed = true
+	}
+}
+
+// replay is used to respond with a stored response
+func replay(c *gin.Context, record IdempotencyKey) {
+	var headers http.Header
+	if err := json.Unmarshal([]byte(record.Headers), &headers); err == nil {
+		for k, v := range headers {
+			c.Writer.Header()[k] = v
+		}
+	}
+	c.Header(IdempotentReplayHeader, "true")
+	c.Status(record.StatusCode)
+	c.Writer.Write(record.Body)
+	c.Abort()
+}
+
+// fingerprintRequest is used to compute a hash of a request, covering its method, path
+// and parameters. Forms are hashed by value rather than their encoding, as multipart
+// boundaries differ each time a client sends a request
+func fingerprintRequest(r *http.Request) (string, error) {
+	if err := r.ParseMultipartForm(maxMultipartMemory); err != nil && err != http.ErrNotMultipart {
+		return "", err
+	}
+	hash := sha256.New()
+	write := func(values ...string) {
+		for _, v := range values {
+			// length prefix values so that they can't be shifted between fields
+			hash.Write([]byte{byte(len(v) >> 24), byte(len(v) >> 16), byte(len(v) >> 8), byte(len(v))})
+			hash.Write([]byte(v))
+		}
+	}
+	write(r.Method, r.URL.Path)
+	writeValues := func(values map[string][]string) {
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			write(name)
+			write(values[name]...)
+		}
+	}
+	// r.Form contains both query and body parameters
+	writeValues(r.Form)
+	if r.MultipartForm != nil {
+		writeValues(r.MultipartForm.Value)
+		names := make([]string, 0, len(r.MultipartForm.File))
+		for name := range r.MultipartForm.File {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			for _, fh := range r.MultipartForm.File[name] {
+				write(name, fh.Filename)
+				file, err := fh.Open()
+				if err != nil {
+					return "", err
+				}
+				_, err = io.Copy(hash, file)
+				file.Close()
+				if err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// abortWithMessage is used to abort a request with our standard error format
+func abortWithMessage(c *gin.Context, status int, message string) {
+	c.AbortWithStatusJSON(status, gin.H{
+		"code":     status,
+		"response": message,
+	})
+}
+
+// idempotencyWriter is used to capture the body of a response
+type idempotencyWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *idempotencyWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *idempotencyWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -1,12 +1,19 @@
 package middleware
 
 import (
+	"bytes"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	jwtgo "gopkg.in/dgrijalva/jwt-go.v3"
 
 	"github.com/RTradeLtd/Temporal/log"
 	"github.com/RTradeLtd/config/v2"
@@ -96,6 +103,129 @@ func TestSecMiddleware(t *testing.T) {
 	}
 }
 
+func TestIdempotencyMiddleware(t *testing.T) {
+	cfg, err := config.LoadConfig("../../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := loadDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateIdempotencyKeys(db.DB); err != nil {
+		t.Fatal(err)
+	}
+	logger, err := log.NewLogger("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	_, engine := gin.CreateTestContext(httptest.NewRecorder())
+	engine.Use(gin.Recovery())
+	engine.POST("/charge", func(c *gin.Context) {
+		// simulate an authenticated user
+		c.Set("JWT_PAYLOAD", jwtgo.MapClaims{"id": "testuser"})
+	}, Idempotency(db.DB, time.Minute, logger), func(c *gin.Context) {
+		calls++
+		if c.PostForm("panic") == "true" {
+			panic("handler failed")
+		}
+		if c.PostForm("fail") == "true" {
+			c.JSON(http.StatusInternalServerError, gin.H{"response": "failed"})
+			return
+		}
+		c.Header("X-Job-ID", "job")
+		c.JSON(http.StatusOK, gin.H{"response": calls})
+	})
+	var (
+		key      = uuid.New().String()
+		otherKey = uuid.New().String()
+		panicKey = uuid.New().String()
+	)
+	defer db.DB.Unscoped().Where("key IN (?)", []string{key, otherKey, panicKey}).Delete(&IdempotencyKey{})
+	tests := []struct {
+		name       string
+		key        string
+		form       url.Values
+		wantStatus int
+		wantCalls  int
+		wantReplay bool
+	}{
+		{"NoKey", "", url.Values{"amount": {"1"}}, 200, 1, false},
+		{"FirstRequest", key, url.Values{"amount": {"1"}}, 200, 2, false},
+		{"Replayed", key, url.Values{"amount": {"1"}}, 200, 2, true},
+		{"DifferentRequest", key, url.Values{"amount": {"2"}}, 422, 2, false},
+		{"ServerError", otherKey, url.Values{"fail": {"true"}}, 500, 3, false},
+		// server errors aren't stored, so the request may be retried
+		{"ServerErrorRetried", otherKey, url.Values{"fail": {"true"}}, 500, 4, false},
+		{"Panic", panicKey, url.Values{"panic": {"true"}}, 500, 5, false},
+		// keys aren't left in progress by handlers which panic
+		{"PanicRetried", panicKey, url.Values{"panic": {"true"}}, 500, 6, false},
+		{"TooLong", strings.Repeat("a", 256), url.Values{}, 400, 6, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/charge", strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.key != "" {
+				req.Header.Set(IdempotencyKeyHeader, tt.key)
+			}
+			engine.ServeHTTP(recorder, req)
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %v, want %v: %s", recorder.Code, tt.wantStatus, recorder.Body.String())
+			}
+			if calls != tt.wantCalls {
+				t.Fatalf("handler called %v times, want %v", calls, tt.wantCalls)
+			}
+			if replayed := recorder.Header().Get(IdempotentReplayHeader) == "true"; replayed != tt.wantReplay {
+				t.Fatalf("replayed = %v, want %v", replayed, tt.wantReplay)
+			}
+			if tt.wantReplay && recorder.Header().Get("X-Job-ID") != "job" {
+				t.Fatal("expected response headers to be replayed")
+			}
+		})
+	}
+}
+
+func TestFingerprintRequest(t *testing.T) {
+	newRequest := func(boundary, content string) *http.Request {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		writer.SetBoundary(boundary)
+		writer.WriteField("hold_time", "1")
+		part, _ := writer.CreateFormFile("file", "file.txt")
+		part.Write([]byte(content))
+		writer.Close()
+		req := httptest.NewRequest("POST", "/v2/ipfs/public/file/add", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return req
+	}
+	first, err := fingerprintRequest(newRequest("boundary1", "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		req       *http.Request
+		wantMatch bool
+	}{
+		{"DifferentBoundary", newRequest("boundary2", "hello"), true},
+		{"DifferentFile", newRequest("boundary1", "world"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fingerprintRequest(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == first) != tt.wantMatch {
+				t.Fatalf("fingerprints match = %v, want %v", got == first, tt.wantMatch)
+			}
+		})
+	}
+}
+
 func loadDatabase(cfg *config.TemporalConfig) (*database.Manager, error) {
 	return database.New(cfg, database.Options{
 		SSLModeDisable: true,
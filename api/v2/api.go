@@ -9,11 +9,21 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/streadway/amqp"
-
+	"github.com/RTradeLtd/Temporal/billing"
+	"github.com/RTradeLtd/Temporal/customer"
+	"github.com/RTradeLtd/Temporal/gateway"
+	"github.com/RTradeLtd/Temporal/gc"
+	"github.com/RTradeLtd/Temporal/jobs"
+	"github.com/RTradeLtd/Temporal/ledger"
 	"github.com/RTradeLtd/Temporal/log"
+	"github.com/RTradeLtd/Temporal/oracle"
+	"github.com/RTradeLtd/Temporal/outbox"
+	"github.com/RTradeLtd/Temporal/payments"
 	"github.com/RTradeLtd/Temporal/rtfscluster"
+	"github.com/RTradeLtd/Temporal/share"
+	"github.com/RTradeLtd/Temporal/tus"
 	"github.com/RTradeLtd/Temporal/utils"
+	"github.com/RTradeLtd/Temporal/webhooks"
 	pbLens "github.com/RTradeLtd/grpc/lensv2"
 	pbOrch "github.com/RTradeLtd/grpc/nexus"
 	pbSigner "github.com/RTradeLtd/grpc/pay"
@@ -53,6 +63,15 @@ type API struct {
 	rm          *models.RecordManager
 	nm          *models.HostedNetworkManager
 	usage       *models.UsageManager
+	jobs        *jobs.Manager
+	webhooks    *webhooks.Manager
+	renewals    *gc.Manager
+	payments    *payments.Manager
+	ledger      *ledger.Manager
+	billing     *billing.Manager
+	customer    *customer.Manager
+	intents     *payments.Processor
+	prices      oracle.PriceOracle
 	l           *zap.SugaredLogger
 	signer      pbSigner.SignerClient
 	orch        pbOrch.ServiceClient
@@ -60,9 +79,14 @@ type API struct {
 	dc          *dash.Client
 	queues      queues
 	clam        *utils.Shell
+	uploads     *tus.Store
+	gateway     *gateway.Signer
+	shares      *share.Manager
 	service     string
 
-	version string
+	version             string
+	idempotencyWindow   time.Duration
+	stripeWebhookSecret string
 }
 
 // Initialize is used ot initialize our API service. debug = true is useful
@@ -107,6 +131,7 @@ func Initialize(
 		return nil, err
 	}
 	api.version = version
+	api.idempotencyWindow = opts.IdempotencyWindow
 
 	// init routes
 	if err = api.setupRoutes(); err != nil {
@@ -205,8 +230,56 @@ func new(cfg *config.TemporalConfig, router *gin.Engine, l *zap.SugaredLogger, c
 		stripePublishableKey := os.Getenv("STRIPE_PUBLISHABLE_KEY")
 		cfg.Stripe.PublishableKey = stripePublishableKey
 	}
+	// our configuration has no field for the secret used to sign stripe webhooks
+	stripeWebhookSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	// prices may be read from a file rather than public apis, such as when testing. The
+	// number of providers which must agree on a price may be set with PRICE_ORACLE_MIN_PROVIDERS
+	var (
+		priceProviders []oracle.Provider
+		priceOpts      oracle.Options
+	)
+	if min := os.Getenv("PRICE_ORACLE_MIN_PROVIDERS"); min != "" {
+		if priceOpts.MinProviders, err = strconv.Atoi(min); err != nil {
+			return nil, fmt.Errorf("invalid PRICE_ORACLE_MIN_PROVIDERS: %s", err)
+		}
+	}
+	if path := os.Getenv("PRICE_ORACLE_FILE"); path != "" {
+		// the file is the only provider, and is trusted as it is managed by us
+		priceProviders = append(priceProviders, oracle.File{Path: path})
+		priceOpts.MinProviders = 1
+	} else {
+		hc := oracle.NewHTTPClient()
+		priceProviders = append(priceProviders, oracle.CoinGecko{Client: hc}, oracle.CoinCap{Client: hc})
+		if key := os.Getenv("CMC_API_KEY"); key != "" {
+			priceProviders = append(priceProviders, oracle.CoinMarketCap{Client: hc, APIKey: key})
+		}
+	}
+	// resumable uploads are staged in the temp directory unless configured otherwise
+	uploads, err := tus.NewStore(tus.Options{Dir: os.Getenv("TUS_UPLOAD_DIR")}, l)
+	if err != nil {
+		return nil, err
+	}
+	// our configuration has no field for the key share link passphrases are sealed with, so
+	// unless one is provided they are sealed with a key derived from our jwt key. Keys are
+	// derived under a label of their own, so the jwt key itself never seals passphrases
+	shareKey := os.Getenv("SHARE_ENCRYPTION_KEY")
+	if shareKey == "" {
+		shareKey = cfg.JWT.Key
+	}
+	// gateway tokens are signed with a dedicated key when one is provided, otherwise with a
+	// key derived from our jwt key, so that gateway tokens and json web tokens are never
+	// signed with the same key
+	gatewayKey := os.Getenv("GATEWAY_SIGNING_KEY")
+	if gatewayKey == "" {
+		gatewayKey = cfg.JWT.Key
+	}
+	prices, err := oracle.New(priceProviders, priceOpts, l)
+	if err != nil {
+		return nil, err
+	}
+	pays := payments.NewManager(dbm.DB)
 	// return
-	return &API{
+	api := &API{
 		ipfs:        ipfs,
 		ipfsCluster: ipfsCluster,
 		keys:        keys{kb1: kb1, kb2: kb2},
@@ -221,6 +294,15 @@ func new(cfg *config.TemporalConfig, router *gin.Engine, l *zap.SugaredLogger, c
 		ue:          models.NewEncryptedUploadManager(dbm.DB),
 		upm:         models.NewUploadManager(dbm.DB),
 		usage:       models.NewUsageManager(dbm.DB),
+		jobs:        jobs.NewManager(dbm.DB),
+		webhooks:    webhooks.NewManager(dbm.DB),
+		renewals:    gc.NewManager(dbm.DB),
+		ledger:      ledger.NewManager(dbm.DB),
+		billing:     billing.NewManager(dbm.DB),
+		customer:    customer.NewManager(models.NewUserManager(dbm.DB), ipfs),
+		payments:    pays,
+		intents:     payments.NewProcessor(pays, payments.NewStripe(cfg.Stripe.SecretKey)),
+		prices:      prices,
 		lens:        clients.Lens,
 		signer:      clients.Signer,
 		orch:        clients.Orch,
@@ -234,11 +316,19 @@ func new(cfg *config.TemporalConfig, router *gin.Engine, l *zap.SugaredLogger, c
 			dash:    qmDash,
 			eth:     qmEth,
 		},
-		zm:   models.NewZoneManager(dbm.DB),
-		rm:   models.NewRecordManager(dbm.DB),
-		nm:   models.NewHostedNetworkManager(dbm.DB),
-		clam: clam,
-	}, nil
+		zm:      models.NewZoneManager(dbm.DB),
+		rm:      models.NewRecordManager(dbm.DB),
+		nm:      models.NewHostedNetworkManager(dbm.DB),
+		clam:    clam,
+		uploads: uploads,
+		gateway: gateway.NewSigner(gatewayKey),
+		shares:  share.NewManager(dbm.DB, shareKey),
+
+		stripeWebhookSecret: stripeWebhookSecret,
+	}
+	// email receipts for stripe payments once they are confirmed
+	pays.Receipts = api.sendReceipt
+	return api, nil
 }
 
 // Close releases API resources
@@ -273,6 +363,10 @@ func (api *API) ListenAndServe(ctx context.Context, addr string, tlsConfig *TLSC
 		Addr:    addr,
 		Handler: api.r,
 	}
+	// publish messages recorded in the outbox by our handlers
+	go outbox.NewRelay(api.dbm.DB, api.publishOutboxMessage, outbox.RelayOptions{}, api.l).Run(ctx)
+	// remove resumable uploads abandoned by their clients
+	go api.uploads.Run(ctx)
 	errChan := make(chan error, 1)
 	go func() {
 		if tlsConfig != nil {
@@ -303,55 +397,12 @@ func (api *API) ListenAndServe(ctx context.Context, addr string, tlsConfig *TLSC
 		errChan <- server.ListenAndServe()
 		return
 	}()
-	for {
-		select {
-		case err := <-errChan:
-			return err
-		case <-ctx.Done():
-			return server.Close()
-		case msg := <-api.queues.cluster.ErrCh:
-			qmCluster, err := api.handleQueueError(msg, api.cfg.RabbitMQ.URL, queue.IpfsClusterPinQueue, true)
-			if err != nil {
-				return server.Close()
-			}
-			api.queues.cluster = qmCluster
-		case msg := <-api.queues.dash.ErrCh:
-			qmDash, err := api.handleQueueError(msg, api.cfg.RabbitMQ.URL, queue.DashPaymentConfirmationQueue, true)
-			if err != nil {
-				return server.Close()
-			}
-			api.queues.dash = qmDash
-		case msg := <-api.queues.email.ErrCh:
-			qmEmail, err := api.handleQueueError(msg, api.cfg.RabbitMQ.URL, queue.EmailSendQueue, true)
-			if err != nil {
-				return server.Close()
-			}
-			api.queues.email = qmEmail
-		case msg := <-api.queues.ipns.ErrCh:
-			qmIpns, err := api.handleQueueError(msg, api.cfg.RabbitMQ.URL, queue.IpnsEntryQueue, true)
-			if err != nil {
-				return server.Close()
-			}
-			api.queues.ipns = qmIpns
-		case msg := <-api.queues.key.ErrCh:
-			qmKey, err := api.handleQueueError(msg, api.cfg.RabbitMQ.URL, queue.IpfsKeyCreationQueue, true)
-			if err != nil {
-				return server.Close()
-			}
-			api.queues.key = qmKey
-		case msg := <-api.queues.eth.ErrCh:
-			qmEth, err := api.handleQueueError(msg, api.cfg.RabbitMQ.URL, queue.EthPaymentConfirmationQueue, true)
-			if err != nil {
-				return server.Close()
-			}
-			api.queues.eth = qmEth
-		case msg := <-api.queues.pin.ErrCh:
-			qmPin, err := api.handleQueueError(msg, api.cfg.RabbitMQ.URL, queue.IpfsPinQueue, true)
-			if err != nil {
-				return server.Close()
-			}
-			api.queues.pin = qmPin
-		}
+	// queue managers reconnect to the broker themselves, so we only wait for the server to stop
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return server.Close()
 	}
 }
 
@@ -396,6 +447,8 @@ func (api *API) setupRoutes() error {
 	// set up middleware
 	ginjwt := middleware.JwtConfigGenerate(api.cfg.JWT.Key, api.cfg.JWT.Realm, api.dbm.DB, api.l)
 	authware := []gin.HandlerFunc{ginjwt.MiddlewareFunc()}
+	// honors idempotency keys of billable requests, and must follow authware
+	idempotent := middleware.Idempotency(api.dbm.DB, api.idempotencyWindow, api.l)
 
 	// V2 API
 	v2 := api.r.Group("/v2")
@@ -427,6 +480,12 @@ func (api *API) setupRoutes() error {
 		statistics.GET("/stats", api.getStats)
 	}
 
+	// administration
+	admin := v2.Group("/admin").Use(authware...)
+	{
+		admin.POST("/plan", api.grantPlan)
+	}
+
 	// lens search engine
 	lens := v2.Group("/lens")
 	{
@@ -435,6 +494,9 @@ func (api *API) setupRoutes() error {
 		lens.POST("/search", api.submitSearchRequest)
 	}
 
+	// stripe authenticates webhooks using their signature, rather than a token
+	v2.POST("/payments/stripe/webhook", api.stripeWebhook)
+
 	// payments
 	payments := v2.Group("/payments", authware...)
 	{
@@ -449,9 +511,18 @@ func (api *API) setupRoutes() error {
 		}
 		stripe := payments.Group("/stripe")
 		{
-			stripe.POST("/charge", api.stripeCharge)
+			stripe.POST("/charge", idempotent, api.stripeCharge)
+			stripe.POST("/intent", idempotent, api.createStripeIntent)
+			stripe.POST("/intent/:id/confirm", api.confirmStripeIntent)
+			stripe.GET("/methods", api.getStripePaymentMethods)
+			stripe.DELETE("/methods/:id", api.removeStripePaymentMethod)
+			stripe.GET("/topup", api.getAutoTopUp)
+			stripe.POST("/topup", api.enableAutoTopUp)
+			stripe.DELETE("/topup", api.disableAutoTopUp)
 		}
+		payments.GET("", api.listPayments)
 		payments.GET("/status/:number", api.getPaymentStatus)
+		payments.GET("/invoice/:number", api.getPaymentInvoice)
 	}
 
 	// accounts
@@ -477,6 +548,14 @@ func (api *API) setupRoutes() error {
 		credits := account.Group("/credits", authware...)
 		{
 			credits.GET("/available", api.getCredits)
+			credits.GET("/history", api.getCreditHistory)
+		}
+		webhooks := account.Group("/webhooks", authware...)
+		{
+			webhooks.GET("", api.listWebhooks)
+			webhooks.POST("", api.createWebhook)
+			webhooks.DELETE("/:id", api.deleteWebhook)
+			webhooks.GET("/:id/deliveries", api.getWebhookDeliveries)
 		}
 		email := account.Group("/email")
 		{
@@ -496,6 +575,20 @@ func (api *API) setupRoutes() error {
 			// used to upgrade account to light tier
 			auth.POST("/upgrade", api.upgradeAccount)
 			auth.GET("/usage", api.usageData)
+			auth.GET("/usage/history", api.usageHistory)
+			auth.GET("/plans", api.listPlans)
+		}
+		plan := account.Group("/plan", authware...)
+		{
+			plan.GET("", api.getPlan)
+			plan.POST("", api.changePlan)
+			plan.DELETE("/scheduled", api.cancelPlanChange)
+			plan.GET("/history", api.getPlanHistory)
+		}
+		limits := account.Group("/limits", authware...)
+		{
+			limits.GET("", api.getSpendingLimits)
+			limits.POST("", api.setSpendingLimits)
 		}
 	}
 
@@ -508,14 +601,26 @@ func (api *API) setupRoutes() error {
 			// pinning routes
 			pin := public.Group("/pin")
 			{
-				pin.POST("/:hash", api.pinHashLocally)
+				pin.POST("/:hash", idempotent, api.pinHashLocally)
 				pin.POST("/:hash/extend", api.extendPin)
+				pin.GET("/:hash/renewal", api.getRenewal)
+				pin.POST("/:hash/renewal", api.enableRenewal)
+				pin.DELETE("/:hash/renewal", api.disableRenewal)
 			}
 			// file upload routes
 			file := public.Group("/file")
 			{
-				file.POST("/add", api.addFile)
+				file.POST("/add", idempotent, api.addFile)
 				file.POST("/add/directory", api.uploadDirectory)
+				// resumable upload routes, following the tus protocol
+				resumable := file.Group("/tus", tusResumable)
+				{
+					resumable.OPTIONS("", api.getUploadOptions)
+					resumable.POST("", api.createUpload)
+					resumable.HEAD("/:id", api.getUploadOffset)
+					resumable.PATCH("/:id", api.writeUpload)
+					resumable.DELETE("/:id", api.removeUpload)
+				}
 			}
 			// pubsub routes
 			pubsub := public.Group("/pubsub")
@@ -575,6 +680,7 @@ func (api *API) setupRoutes() error {
 		utils := ipfs.Group("/utils")
 		{
 			// generic download
+			utils.GET("/download/:hash", api.downloadContentHash)
 			utils.POST("/download/:hash", api.downloadContentHash)
 			laser := utils.Group("/laser")
 			{
@@ -583,13 +689,40 @@ func (api *API) setupRoutes() error {
 		}
 	}
 
+	// gateway routes
+	gateway := v2.Group("/gateway", authware...)
+	{
+		gateway.POST("/sign", api.signGatewayURL)
+	}
+
+	// share link routes
+	shares := v2.Group("/share", authware...)
+	{
+		shares.POST("", api.createShareLink)
+		shares.GET("", api.listShareLinks)
+		shares.DELETE("/:id", api.revokeShareLink)
+		shares.GET("/:id/access", api.getShareLinkAccesses)
+	}
+
+	// authless share link downloads
+	shared := v2.Group("/shared")
+	{
+		shared.GET("/:token", api.downloadSharedContent)
+		shared.POST("/:token", api.downloadSharedContent)
+	}
+
+	// http gateway serving content to browsers
+	gatewayware := api.gatewayAuth(ginjwt.MiddlewareFunc())
+	api.r.GET("/ipfs/*path", gatewayware, api.serveGateway)
+	api.r.GET("/ipns/*path", gatewayware, api.serveGateway)
+
 	// ipns
 	ipns := v2.Group("/ipns", authware...)
 	{
 		// public ipns routes
 		public := ipns.Group("/public")
 		{
-			public.POST("/publish/details", api.publishToIPNSDetails)
+			public.POST("/publish/details", idempotent, api.publishToIPNSDetails)
 			// used to handle pinning of IPNS records on public ipfs
 			// this involves first resolving the record, parsing it
 			// and extracting the hash to pin
@@ -599,6 +732,13 @@ func (api *API) setupRoutes() error {
 		ipns.GET("/records", api.getIPNSRecordsPublishedByUser)
 	}
 
+	// asynchronous job status
+	jobs := v2.Group("/jobs", authware...)
+	{
+		jobs.GET("", api.listJobs)
+		jobs.GET("/:id", api.getJob)
+	}
+
 	// database
 	database := v2.Group("/database", authware...)
 	{
@@ -622,22 +762,3 @@ func (api *API) setupRoutes() error {
 	api.l.Info("Routes initialized")
 	return nil
 }
-
-// HandleQueueError is used to handle queue connectivity issues requiring us to re-connect
-func (api *API) handleQueueError(amqpErr *amqp.Error, rabbitMQURL string, queueType queue.Queue, publish bool) (*queue.Manager, error) {
-	api.l.Errorw(
-		"a protocol connection error stopping rabbitmq was received",
-		"queue", queueType.String(),
-		"error", amqpErr.Error())
-	qManager, err := queue.New(queueType, rabbitMQURL, publish, dev, api.cfg, api.l)
-	if err != nil {
-		api.l.Errorw(
-			"failed to re-establish queue process, exiting",
-			"queue", queueType.String(),
-			"error", err.Error())
-		return nil, err
-	}
-	api.l.Warnw(
-		"successfully re-established queue connection", "queue", queueType.String())
-	return qManager, nil
-}
@@ -13,10 +13,20 @@ import (
 	"testing"
 	"time"
 
+	"github.com/RTradeLtd/Temporal/api/middleware"
+	"github.com/RTradeLtd/Temporal/billing"
+	"github.com/RTradeLtd/Temporal/gc"
+	"github.com/RTradeLtd/Temporal/jobs"
+	"github.com/RTradeLtd/Temporal/ledger"
 	log "github.com/RTradeLtd/Temporal/log"
 	"github.com/RTradeLtd/Temporal/mocks"
+	"github.com/RTradeLtd/Temporal/oracle"
+	"github.com/RTradeLtd/Temporal/outbox"
+	"github.com/RTradeLtd/Temporal/payments"
 	"github.com/RTradeLtd/Temporal/queue"
 	"github.com/RTradeLtd/Temporal/rtfscluster"
+	"github.com/RTradeLtd/Temporal/share"
+	"github.com/RTradeLtd/Temporal/webhooks"
 	"github.com/RTradeLtd/config/v2"
 	"github.com/RTradeLtd/database/v2"
 	"github.com/RTradeLtd/database/v2/models"
@@ -338,6 +348,14 @@ func Test_Utils(t *testing.T) {
 	if err := api.FileSizeCheck(int64(datasize.GB.Bytes() * 10)); err == nil {
 		t.Fatal("error expected")
 	}
+	// use fixed prices, rather than relying on public price apis
+	prices, err := oracle.New([]oracle.Provider{oracle.Static{
+		"ethereum": 180, "bitcoin": 8000, "litecoin": 60, "monero": 60, "dash": 80,
+	}}, oracle.Options{MinProviders: 1}, api.l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.prices = prices
 	type args struct {
 		paymentType string
 		blockchain  string
@@ -366,15 +384,15 @@ func Test_Utils(t *testing.T) {
 			if valid := api.validateBlockchain(tt.args.blockchain); !valid != tt.wantErr {
 				t.Errorf("validateBlockchain() error = %v, wantErr %v", valid, tt.wantErr)
 			}
-			if _, err := api.getUSDValue(tt.args.paymentType); (err != nil) != tt.wantErr {
+			if _, err := api.getUSDValue(context.Background(), tt.args.paymentType); (err != nil) != tt.wantErr {
 				t.Errorf("getUSDValue() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
-	if err := api.validateUserCredits(testUser, 1); err != nil {
+	if err := api.validateUserCredits(testUser, 1, ""); err != nil {
 		t.Fatal(err)
 	}
-	if err := api.validateUserCredits(testUser, tooManyCredits); err == nil {
+	if err := api.validateUserCredits(testUser, tooManyCredits, ""); err == nil {
 		t.Fatal("error expected")
 	}
 	if err := api.validateAdminRequest(testUser); err != nil {
@@ -388,7 +406,7 @@ func Test_Utils(t *testing.T) {
 		t.Fatal(err)
 	}
 	previousCreditAmount := user.Credits
-	api.refundUserCredits(testUser, "ipfs-pin", 10)
+	api.refundUserCredits(testUser, "ipfs-pin", 10, "")
 	user, err = api.um.FindByUserName(testUser)
 	if err != nil {
 		t.Fatal(err)
@@ -624,7 +642,7 @@ func Test_API_Initialize_ListenAndServe(t *testing.T) {
 	}
 }
 
-func TestAPI_HandleQueuError_Success(t *testing.T) {
+func TestAPI_QueueReconnect(t *testing.T) {
 	cfg, err := config.LoadConfig("../../testenv/config.json")
 	if err != nil {
 		t.Fatal(err)
@@ -646,110 +664,67 @@ func TestAPI_HandleQueuError_Success(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	go func() {
-		if err := api.ListenAndServe(context.Background(), "127.0.0.1:6799", &TLSConfig{"../../testenv/certs/api.cert", "../../testenv/certs/api.key"}); err != nil && err != http.ErrServerClosed {
-			t.Fatal(err)
-		}
-	}()
-	type args struct {
-		queueType queue.Queue
-	}
+	defer api.Close()
 	tests := []struct {
 		name string
-		args args
+		qm   *queue.Manager
 	}{
-		{queue.IpfsClusterPinQueue.String(), args{queue.IpfsClusterPinQueue}},
-		{queue.EmailSendQueue.String(), args{queue.EmailSendQueue}},
-		{queue.IpnsEntryQueue.String(), args{queue.IpnsEntryQueue}},
-		{queue.IpfsPinQueue.String(), args{queue.IpfsPinQueue}},
-		{queue.IpfsKeyCreationQueue.String(), args{queue.IpfsKeyCreationQueue}},
-		{queue.DashPaymentConfirmationQueue.String(), args{queue.DashPaymentConfirmationQueue}},
-		{queue.EthPaymentConfirmationQueue.String(), args{queue.EthPaymentConfirmationQueue}},
+		{queue.IpfsClusterPinQueue.String(), api.queues.cluster},
+		{queue.EmailSendQueue.String(), api.queues.email},
+		{queue.IpnsEntryQueue.String(), api.queues.ipns},
+		{queue.IpfsPinQueue.String(), api.queues.pin},
+		{queue.IpfsKeyCreationQueue.String(), api.queues.key},
+		{queue.DashPaymentConfirmationQueue.String(), api.queues.dash},
+		{queue.EthPaymentConfirmationQueue.String(), api.queues.eth},
 	}
 	// declare an error to use for testing
 	amqpErr := &amqp.Error{Code: 400, Reason: "test", Server: true, Recover: false}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// test ListenAndServe queue function handling
-			switch tt.args.queueType {
-			case queue.IpfsClusterPinQueue:
-				api.queues.cluster.ErrCh <- amqpErr
-			case queue.EmailSendQueue:
-				api.queues.email.ErrCh <- amqpErr
-			case queue.IpnsEntryQueue:
-				api.queues.ipns.ErrCh <- amqpErr
-			case queue.IpfsPinQueue:
-				api.queues.pin.ErrCh <- amqpErr
-			case queue.IpfsKeyCreationQueue:
-				api.queues.key.ErrCh <- amqpErr
-			case queue.DashPaymentConfirmationQueue:
-				api.queues.dash.ErrCh <- amqpErr
-			case queue.EthPaymentConfirmationQueue:
-				api.queues.eth.ErrCh <- amqpErr
-			}
-			// test handleQueueError function directly
-			if _, err := api.handleQueueError(amqpErr, api.cfg.RabbitMQ.URL, tt.args.queueType, true); err != nil {
-				t.Fatal(err)
-			}
+			// queue managers reconnect themselves when a connection error is received
+			tt.qm.ErrCh <- amqpErr
 		})
 	}
+	// publishes wait for the connection to be re-established
+	if err := api.queues.email.PublishMessage(queue.EmailSend{
+		Subject:     "reconnect test",
+		Content:     "reconnect test",
+		ContentType: "text/html",
+	}); err != nil {
+		t.Fatal(err)
+	}
 }
 
-func TestAPI_HandleQueuError_Failure(t *testing.T) {
-	cfg, err := config.LoadConfig("../../testenv/config.json")
+func loadDatabase(cfg *config.TemporalConfig) (*gorm.DB, error) {
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
 	if err != nil {
-		t.Fatal(err)
+		return nil, err
 	}
-	logger, err := log.NewLogger("stdout", true)
-	if err != nil {
-		t.Fatal(err)
+	if err := jobs.Migrate(dbm.DB); err != nil {
+		return nil, err
 	}
-	// setup fake mock clients
-	fakeLens := &mocks.FakeLensV2Client{}
-	fakeOrch := &mocks.FakeServiceClient{}
-	fakeSigner := &mocks.FakeSignerClient{}
-	clients := Clients{
-		Lens:   fakeLens,
-		Orch:   fakeOrch,
-		Signer: fakeSigner,
+	if err := webhooks.Migrate(dbm.DB); err != nil {
+		return nil, err
 	}
-	api, err := Initialize(context.Background(), cfg, "", Options{DevMode: true, DebugLogging: true}, clients, logger)
-	if err != nil {
-		t.Fatal(err)
+	if err := gc.Migrate(dbm.DB); err != nil {
+		return nil, err
 	}
-	type args struct {
-		queueType queue.Queue
+	if err := payments.Migrate(dbm.DB); err != nil {
+		return nil, err
 	}
-	tests := []struct {
-		name string
-		args args
-	}{
-		{queue.IpfsClusterPinQueue.String(), args{queue.IpfsClusterPinQueue}},
-		{queue.EmailSendQueue.String(), args{queue.EmailSendQueue}},
-		{queue.IpnsEntryQueue.String(), args{queue.IpnsEntryQueue}},
-		{queue.IpfsPinQueue.String(), args{queue.IpfsPinQueue}},
-		{queue.IpfsKeyCreationQueue.String(), args{queue.IpfsKeyCreationQueue}},
-		{queue.DashPaymentConfirmationQueue.String(), args{queue.DashPaymentConfirmationQueue}},
-		{queue.EthPaymentConfirmationQueue.String(), args{queue.EthPaymentConfirmationQueue}},
-	}
-	// setup a bad rabbitmq url for testing connectivity failures
-	api.cfg.RabbitMQ.URL = "notarealprotocol://notarealurl"
-	// declare an error to use for testing
-	amqpErr := &amqp.Error{Code: 400, Reason: "test", Server: true, Recover: false}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			//TODO: enable this kind of testing within ListenAndServe eventually
-			// test handleQueueError function directly
-			if _, err := api.handleQueueError(amqpErr, api.cfg.RabbitMQ.URL, tt.args.queueType, true); err == nil {
-				t.Fatal("error expected")
-			}
-		})
+	if err := outbox.Migrate(dbm.DB); err != nil {
+		return nil, err
 	}
-}
-
-func loadDatabase(cfg *config.TemporalConfig) (*gorm.DB, error) {
-	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
-	if err != nil {
+	if err := ledger.Migrate(dbm.DB); err != nil {
+		return nil, err
+	}
+	if err := billing.Migrate(dbm.DB); err != nil {
+		return nil, err
+	}
+	if err := share.Migrate(dbm.DB); err != nil {
+		return nil, err
+	}
+	if err := middleware.MigrateIdempotencyKeys(dbm.DB); err != nil {
 		return nil, err
 	}
 	return dbm.DB, nil
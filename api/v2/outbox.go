@@ -0,0 +1,146 @@
+package v2
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/RTradeLtd/Temporal/billing"
+	"github.com/RTradeLtd/Temporal/eh"
+	"github.com/RTradeLtd/Temporal/ledger"
+	"github.com/RTradeLtd/Temporal/outbox"
+	"github.com/RTradeLtd/Temporal/queue"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/gorm"
+	"github.com/gin-gonic/gin"
+)
+
+// txError associates an error encountered while applying account changes,
+// or adding content, with the message and status code returned to the user
+type txError struct {
+	err     error
+	message string
+	status  int
+}
+
+func (te *txError) Error() string { return te.err.Error() }
+
+// debitedKey is the transaction setting recording the user debited by bill, so that
+// their credits can be topped up once the transaction of enqueue commits
+const debitedKey = "temporal:debited_user"
+
+// enqueue is used to apply the account changes made by a request, and record the message
+// it produces, within a single database transaction. The outbox relay publishes the message
+// once the transaction commits, so users are never charged for a message which isn't
+// published, nor is a message published for a request that failed to be charged
+func (api *API) enqueue(q queue.Queue, msg interface{}, changes ...func(tx *gorm.DB) error) error {
+	tx := api.dbm.DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for _, change := range changes {
+		if err := change(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := outbox.NewManager(tx).Enqueue(q.String(), msg); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	// top up the credits of a debited user if they have fallen below their
+	// threshold, without delaying the request on the payment
+	if username, ok := tx.Get(debitedKey); ok {
+		go api.autoTopUp(username.(string))
+	}
+	return nil
+}
+
+// failEnqueue is used to fail a request whose call to enqueue returned an error
+func (api *API) failEnqueue(c *gin.Context, err error) {
+	if te, ok := err.(*txError); ok {
+		api.LogError(c, te.err, te.message)(te.status)
+		return
+	}
+	api.LogError(c, err, eh.QueuePublishError)(http.StatusInternalServerError)
+}
+
+// bill returns the account changes used to deduct the cost of a request from a
+// users credits, charging it against reference, and record the data usage it incurs.
+// The users credits and usage are locked until the transaction completes, preventing
+// concurrent requests from spending the same credits. Users who are debited have their
+// credits topped up once the transaction commits
+func bill(username string, cost float64, size uint64, reference string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		locked := tx.Set("gorm:query_option", "FOR UPDATE")
+		if cost > 0 {
+			if err := validateCredits(ledger.NewManager(tx), username, cost, reference); err != nil {
+				return chargeError(err)
+			}
+			tx.InstantSet(debitedKey, username)
+		}
+		if size > 0 {
+			if err := models.NewUsageManager(locked).UpdateDataUsage(username, size); err != nil {
+				return &txError{err, eh.DataUsageUpdateError, http.StatusBadRequest}
+			}
+		}
+		return nil
+	}
+}
+
+// chargeError returns the error users are shown when they can't be charged for a request.
+// Charges exceeding the spending caps, or the balance of the user are rejected with a 402,
+// while other failures, such as those of our database, are internal errors
+func chargeError(err error) *txError {
+	switch err {
+	case billing.ErrDailyCapExceeded:
+		return &txError{err, eh.DailySpendingCapError, http.StatusPaymentRequired}
+	case billing.ErrMonthlyCapExceeded:
+		return &txError{err, eh.MonthlySpendingCapError, http.StatusPaymentRequired}
+	case ledger.ErrInsufficientCredits:
+		return &txError{err, eh.InvalidBalanceError, http.StatusPaymentRequired}
+	default:
+		return &txError{err, eh.DatabaseUpdateError, http.StatusInternalServerError}
+	}
+}
+
+// checkCredits is used to fail early when a user can't afford a request which adds content
+// before being charged, so that content is never added for users who can't pay for it.
+// The balance is checked again when charging
+func (api *API) checkCredits(username string, cost float64) error {
+	credits, err := api.um.GetCreditsForUser(username)
+	if err != nil {
+		return &txError{err, eh.UserSearchError, http.StatusInternalServerError}
+	}
+	if credits < cost {
+		return &txError{errors.New(eh.InvalidBalanceError), eh.InvalidBalanceError, http.StatusPaymentRequired}
+	}
+	return nil
+}
+
+// publishOutboxMessage is used by the outbox relay to publish messages to our queues
+func (api *API) publishOutboxMessage(name string, body []byte, messageID string) error {
+	var qm *queue.Manager
+	switch queue.Queue(name) {
+	case queue.IpfsPinQueue:
+		qm = api.queues.pin
+	case queue.IpfsClusterPinQueue:
+		qm = api.queues.cluster
+	case queue.EmailSendQueue:
+		qm = api.queues.email
+	case queue.IpnsEntryQueue:
+		qm = api.queues.ipns
+	case queue.IpfsKeyCreationQueue:
+		qm = api.queues.key
+	case queue.DashPaymentConfirmationQueue:
+		qm = api.queues.dash
+	case queue.EthPaymentConfirmationQueue:
+		qm = api.queues.eth
+	default:
+		return fmt.Errorf("%s is not a queue we publish to", name)
+	}
+	return qm.PublishRaw(body, messageID)
+}
@@ -9,8 +9,10 @@ import (
 	"strings"
 
 	"github.com/RTradeLtd/Temporal/eh"
+	"github.com/RTradeLtd/Temporal/ledger"
 	"github.com/RTradeLtd/Temporal/queue"
 	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/gorm"
 	"github.com/gin-gonic/gin"
 )
 
@@ -216,11 +218,6 @@ func (api *API) createIPFSKey(c *gin.Context) {
 		api.LogError(c, err, err.Error())(http.StatusBadRequest)
 		return
 	}
-	// increment their key count
-	if err := api.usage.IncrementKeyCount(username, 1); err != nil {
-		api.LogError(c, err, "failed to increment key count")(http.StatusBadRequest)
-		return
-	}
 	// create key creation message
 	key := queue.IPFSKeyCreation{
 		UserName:    username,
@@ -228,10 +225,17 @@ func (api *API) createIPFSKey(c *gin.Context) {
 		Type:        forms["key_type"],
 		Size:        bitsInt,
 		NetworkName: "public",
+		JobID:       api.newJob(c, username, queue.IpfsKeyCreationQueue, keyName),
 	}
-	// send message for processing
-	if err = api.queues.key.PublishMessage(key); err != nil {
-		api.LogError(c, err, eh.QueuePublishError)(http.StatusBadRequest)
+	// increment their key count, and send message for processing
+	if err = api.enqueue(queue.IpfsKeyCreationQueue, key, func(tx *gorm.DB) error {
+		if err := models.NewUsageManager(tx).IncrementKeyCount(username, 1); err != nil {
+			return &txError{err, "failed to increment key count", http.StatusBadRequest}
+		}
+		return nil
+	}); err != nil {
+		api.failJob(key.JobID, err)
+		api.failEnqueue(c, err)
 		return
 	}
 	// log and return
@@ -280,6 +284,29 @@ func (api *API) getCredits(c *gin.Context) {
 	Respond(c, http.StatusOK, gin.H{"response": credits})
 }
 
+// getCreditHistory is used to retrieve the most recent changes to the credits of a user
+func (api *API) getCreditHistory(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 {
+			FailWithBadRequest(c, "limit must be a positive integer")
+			return
+		}
+	}
+	entries, err := api.ledger.FindByUserName(username, limit)
+	if err != nil {
+		api.LogError(c, err, eh.CreditHistoryError)(http.StatusInternalServerError)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": entries})
+}
+
 // ForgotEmail is used to retrieve an email if the user forgets it
 func (api *API) forgotEmail(c *gin.Context) {
 	username, err := GetAuthenticatedUserFromContext(c)
@@ -373,8 +400,8 @@ func (api *API) resetPassword(c *gin.Context) {
 	Respond(c, http.StatusOK, gin.H{"response": "password reset, please check your email for a new password"})
 }
 
-// UpgradeAccount is used to remove free tier restrictions and enable paid access
-// once upgraded, your account can't be reverted
+// UpgradeAccount is used to remove free tier restrictions and enable paid access,
+// granting free credits to users upgrading for the first time
 func (api *API) upgradeAccount(c *gin.Context) {
 	username, err := GetAuthenticatedUserFromContext(c)
 	if err != nil {
@@ -386,18 +413,27 @@ func (api *API) upgradeAccount(c *gin.Context) {
 		api.LogError(c, err, eh.UserSearchError)(http.StatusBadRequest)
 		return
 	}
-	// prevent people from repeatedly calling this granting perpetual credits
 	if usages.Tier != models.Free {
 		Fail(c, errors.New("user account is already upgrade"))
 		return
 	}
+	// prevent people from repeatedly downgrading, and calling this granting perpetual credits
+	changes, err := api.billing.FindTierChanges(username, 1)
+	if err != nil {
+		api.LogError(c, err, eh.TierUpgradeError)(http.StatusBadRequest)
+		return
+	}
+	if len(changes) > 0 {
+		Fail(c, errors.New("free credits have already been granted, please use /v2/account/plan to change your tier"))
+		return
+	}
 	// update tier
-	if err := api.usage.UpdateTier(username, models.Light); err != nil {
+	if _, err := api.billing.ChangeTier(username, models.Light); err != nil {
 		api.LogError(c, err, eh.TierUpgradeError)(http.StatusBadRequest)
 		return
 	}
 	// grant 10 cents in free credits
-	if _, err := api.um.AddCredits(username, 0.115); err != nil {
+	if _, err := api.ledger.Credit(username, 0.115, ledger.Grant, string(models.Light)); err != nil {
 		api.LogError(c, err, "an error occurred while granting free credits")(http.StatusBadRequest)
 		return
 	}
@@ -439,3 +475,27 @@ func (api *API) usageData(c *gin.Context) {
 	// return data
 	Respond(c, http.StatusOK, gin.H{"response": usages})
 }
+
+// usageHistory is used to retrieve the statements recording the usage of a user
+// during their most recent billing cycles
+func (api *API) usageHistory(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	limit := 12
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 {
+			FailWithBadRequest(c, "limit must be a positive integer")
+			return
+		}
+	}
+	statements, err := api.billing.FindByUserName(username, limit)
+	if err != nil {
+		api.LogError(c, err, eh.UsageHistoryError)(http.StatusInternalServerError)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": statements})
+}
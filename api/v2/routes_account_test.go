@@ -4,6 +4,8 @@ import (
 	"net/url"
 	"testing"
 
+	"github.com/RTradeLtd/Temporal/billing"
+	"github.com/RTradeLtd/Temporal/ledger"
 	"github.com/RTradeLtd/Temporal/mocks"
 	"github.com/RTradeLtd/config/v2"
 	"github.com/RTradeLtd/database/v2/models"
@@ -175,6 +177,149 @@ func Test_API_Routes_Account(t *testing.T) {
 		t.Fatal("bad api status code from /v2/account/credits/available")
 	}
 
+	// get credit history
+	// /v2/account/credits/history
+	api.refundUserCredits("testuser", "ipfs-pin", 1, "testjob")
+	var historyResp struct {
+		Code     int            `json:"code"`
+		Response []ledger.Entry `json:"response"`
+	}
+	if err := sendRequest(
+		api, "GET", "/v2/account/credits/history?limit=1", 200, nil, nil, &historyResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if len(historyResp.Response) != 1 {
+		t.Fatalf("expected 1 entry, got %v", len(historyResp.Response))
+	}
+	if entry := historyResp.Response[0]; entry.Reason != ledger.Refund || entry.Reference != "testjob" || entry.Amount != 1 {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+	if err := sendRequest(
+		api, "GET", "/v2/account/credits/history?limit=0", 400, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// get usage history
+	// /v2/account/usage/history
+	var usageHistoryResp struct {
+		Code     int                 `json:"code"`
+		Response []billing.Statement `json:"response"`
+	}
+	if err := sendRequest(
+		api, "GET", "/v2/account/usage/history", 200, nil, nil, &usageHistoryResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if usageHistoryResp.Code != 200 {
+		t.Fatal("bad api status code from /v2/account/usage/history")
+	}
+	if err := sendRequest(
+		api, "GET", "/v2/account/usage/history?limit=bad", 400, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// /v2/account/plans
+	var plansResp struct {
+		Code     int            `json:"code"`
+		Response []billing.Plan `json:"response"`
+	}
+	if err := sendRequest(
+		api, "GET", "/v2/account/plans", 200, nil, nil, &plansResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if len(plansResp.Response) != len(billing.Plans()) {
+		t.Fatal("bad plans returned from /v2/account/plans")
+	}
+
+	// /v2/account/plan
+	if err := sendRequest(
+		api, "GET", "/v2/account/plan", 200, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	urlValues = url.Values{}
+	urlValues.Add("tier", "gold")
+	if err := sendRequest(
+		api, "POST", "/v2/account/plan", 400, nil, urlValues, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	// partner accounts must be granted by an administrator
+	urlValues = url.Values{}
+	urlValues.Add("tier", "partner")
+	if err := sendRequest(
+		api, "POST", "/v2/account/plan", 403, nil, urlValues, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	// /v2/admin/plan
+	urlValues = url.Values{}
+	urlValues.Add("username", "testuser")
+	urlValues.Add("tier", "gold")
+	if err := sendRequest(
+		api, "POST", "/v2/admin/plan", 400, nil, urlValues, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	// /v2/account/plan/scheduled
+	if err := sendRequest(
+		api, "DELETE", "/v2/account/plan/scheduled", 404, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	// /v2/account/plan/history
+	if err := sendRequest(
+		api, "GET", "/v2/account/plan/history", 200, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// /v2/account/limits
+	urlValues = url.Values{}
+	urlValues.Add("daily_cap", "-1")
+	if err := sendRequest(
+		api, "POST", "/v2/account/limits", 400, nil, urlValues, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	urlValues = url.Values{}
+	urlValues.Add("daily_cap", "0.5")
+	if err := sendRequest(
+		api, "POST", "/v2/account/limits", 200, nil, urlValues, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	// charges exceeding the cap are rejected
+	if err := api.validateUserCredits("testuser", 1, ""); err != billing.ErrDailyCapExceeded {
+		t.Fatalf("validateUserCredits() err = %v, want %v", err, billing.ErrDailyCapExceeded)
+	}
+	var limitsResp struct {
+		Code     int `json:"code"`
+		Response struct {
+			DailyCap float64 `json:"daily_cap"`
+		} `json:"response"`
+	}
+	if err := sendRequest(
+		api, "GET", "/v2/account/limits", 200, nil, nil, &limitsResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if limitsResp.Response.DailyCap != 0.5 {
+		t.Fatal("bad daily cap returned from /v2/account/limits")
+	}
+	// remove the cap so other tests can spend freely
+	urlValues = url.Values{}
+	urlValues.Add("daily_cap", "0")
+	if err := sendRequest(
+		api, "POST", "/v2/account/limits", 200, nil, urlValues, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+
 	// test email activation
 	// /v2/account/email/verify/:user/:token
 	if _, err := api.um.NewUserAccount("verificationtestuser", "password123", "verificationtestuser@example.org"); err != nil {
@@ -7,7 +7,7 @@ import (
 	"github.com/RTradeLtd/gorm"
 
 	"github.com/RTradeLtd/Temporal/eh"
-	"github.com/RTradeLtd/Temporal/utils"
+	ipfsapi "github.com/RTradeLtd/go-ipfs-api"
 	"github.com/gin-gonic/gin"
 	gocid "github.com/ipfs/go-cid"
 )
@@ -33,16 +33,21 @@ func (api *API) calculatePinCost(c *gin.Context) {
 		Fail(c, err)
 		return
 	}
-	// calculate pin cost
-	totalCost, err := utils.CalculatePinCost(username, hash, holdTimeInt, api.ipfs, api.usage)
+	// get the full size of the content
+	stats, err := api.ipfs.Stat(hash)
+	if err != nil {
+		api.LogError(c, err, eh.IPFSObjectStatError)(http.StatusBadRequest)
+		return
+	}
+	// calculate pin cost, with and without deduplication
+	quote, err := api.quote(username, hash, int64(stats.CumulativeSize), holdTimeInt)
 	if err != nil {
 		api.LogError(c, err, eh.CostCalculationError)(http.StatusBadRequest)
-		Fail(c, err)
 		return
 	}
 	// log and return
 	api.l.With("user", username).Info("pin cost calculation requested")
-	Respond(c, http.StatusOK, gin.H{"response": totalCost})
+	Respond(c, http.StatusOK, gin.H{"response": quote})
 }
 
 // CalculateFileCost is used to calculate the cost of uploading a file to our system
@@ -76,14 +81,27 @@ func (api *API) calculateFileCost(c *gin.Context) {
 		return
 	}
 	api.l.With("user", username).Info("file cost calculation requested")
-	// calculate cost
-	cost, err := utils.CalculateFileCost(username, holdTimeInt, file.Size, api.usage)
+	openFile, err := file.Open()
+	if err != nil {
+		api.LogError(c, err, eh.FileOpenError)(http.StatusBadRequest)
+		return
+	}
+	defer openFile.Close()
+	// add the file without pinning it, so that the references it shares with
+	// previous uploads can be found, while it is still garbage collected
+	hash, err := api.ipfs.Add(openFile, ipfsapi.Pin(false))
+	if err != nil {
+		api.LogError(c, err, eh.IPFSAddError)(http.StatusBadRequest)
+		return
+	}
+	// calculate cost, with and without deduplication
+	quote, err := api.quote(username, hash, file.Size, holdTimeInt)
 	if err != nil {
 		api.LogError(c, err, eh.CostCalculationError)(http.StatusBadRequest)
 		return
 	}
 	// return
-	Respond(c, http.StatusOK, gin.H{"response": cost})
+	Respond(c, http.StatusOK, gin.H{"response": quote})
 }
 
 // GetEncryptedUploadsForUser is used to get all the encrypted uploads a user has
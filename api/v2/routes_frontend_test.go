@@ -38,15 +38,23 @@ func Test_API_Routes_Frontend(t *testing.T) {
 
 	// test pin cost calculate
 	// /v2/frontend/cost/calculate/:hash/:holTime
-	var floatAPIResp floatAPIResponse
+	var quoteAPIResp struct {
+		Code     int       `json:"code"`
+		Response costQuote `json:"response"`
+	}
 	if err := sendRequest(
-		api, "GET", "/v2/frontend/cost/calculate/"+hash+"/5", 200, nil, nil, &floatAPIResp,
+		api, "GET", "/v2/frontend/cost/calculate/"+hash+"/5", 200, nil, nil, &quoteAPIResp,
 	); err != nil {
 		t.Fatal(err)
 	}
-	if floatAPIResp.Code != 200 {
+	if quoteAPIResp.Code != 200 {
 		t.Fatal("bad response code from /v2/frontend/cost/calculate")
 	}
+	// deduplication never increases the size, or cost of content
+	if quoteAPIResp.Response.DeduplicatedSize > quoteAPIResp.Response.Size ||
+		quoteAPIResp.Response.DeduplicatedCost > quoteAPIResp.Response.Cost {
+		t.Fatalf("bad quote from /v2/frontend/cost/calculate %+v", quoteAPIResp.Response)
+	}
 
 	// test file upload cost calculation
 	// /v2/frontend/cost/calculate/file
@@ -76,17 +84,17 @@ func Test_API_Routes_Frontend(t *testing.T) {
 	if testRecorder.Code != 200 {
 		t.Fatal("bad http status code recovered from /v2/frontend/cost/calculate/file")
 	}
-	floatAPIResp = floatAPIResponse{}
+	quoteAPIResp.Response = costQuote{}
 	// unmarshal the response
 	bodyBytes, err := ioutil.ReadAll(testRecorder.Result().Body)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err = json.Unmarshal(bodyBytes, &floatAPIResp); err != nil {
+	if err = json.Unmarshal(bodyBytes, &quoteAPIResp); err != nil {
 		t.Fatal(err)
 	}
 	// validate the response code
-	if floatAPIResp.Code != 200 {
+	if quoteAPIResp.Code != 200 {
 		t.Fatal("bad api status code from /v2/frontend/cost/calculate/file")
 	}
 }
@@ -0,0 +1,239 @@
+package v2
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/eh"
+	"github.com/RTradeLtd/Temporal/gateway"
+	ipfsapi "github.com/RTradeLtd/go-ipfs-api"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// gatewayTokenKey is the context key of the signed token a gateway request was authenticated with
+	gatewayTokenKey = "gateway_token"
+	// gatewayCookie is the cookie a signed token is stored in, so that it
+	// authenticates requests for relative links beneath the path it grants access to
+	gatewayCookie = "gateway_token"
+	// gatewayExpiry is the default, and gatewayMaxExpiry the maximum number of hours a signed url is valid for
+	gatewayExpiry    = 24
+	gatewayMaxExpiry = 24 * 30
+	// gatewaySniffLength is the number of bytes used to detect the type of content without an extension
+	gatewaySniffLength = 512
+)
+
+// gatewayAuth is a middleware used to authenticate gateway requests with a signed token, provided as
+// the token query parameter, or by the cookie set when it was first used. Requests without a signed
+// token are authenticated with a jwt by authware
+func (api *API) gatewayAuth(authware gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		signed, fromQuery := c.GetQuery("token")
+		if !fromQuery {
+			signed, _ = c.Cookie(gatewayCookie)
+		}
+		if signed == "" {
+			authware(c)
+			return
+		}
+		token, err := api.gateway.Verify(signed, time.Now())
+		if err != nil {
+			Fail(c, err, http.StatusUnauthorized)
+			c.Abort()
+			return
+		}
+		p, err := gateway.ParsePath(c.Request.URL.Path)
+		if err != nil {
+			Fail(c, err)
+			c.Abort()
+			return
+		}
+		if !token.Allows(p) {
+			FailNotAuthorized(c, "token does not grant access to this path")
+			c.Abort()
+			return
+		}
+		if fromQuery {
+			c.SetCookie(
+				gatewayCookie, signed, int(time.Until(token.Expires).Seconds()),
+				strings.TrimSuffix(token.Path, "/")+"/", "", !dev, true,
+			)
+		}
+		c.Set(gatewayTokenKey, token)
+		c.Next()
+	}
+}
+
+// signGatewayURL is used to sign an expiring url granting access to a gateway path, and everything
+// beneath it, allowing content to be linked to from browsers. Access to private networks is
+// checked again each time the url is used
+func (api *API) signGatewayURL(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	forms, missingField := api.extractPostForms(c, "path")
+	if missingField != "" {
+		FailWithMissingField(c, missingField)
+		return
+	}
+	p, err := gateway.ParsePath(forms["path"])
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	networkName := c.PostForm("network_name")
+	if networkName == "" {
+		networkName = "public"
+	} else if networkName != "public" {
+		if err := CheckAccessForPrivateNetwork(username, networkName, api.dbm.DB); err != nil {
+			api.LogError(c, err, eh.PrivateNetworkAccessError)(http.StatusBadRequest)
+			return
+		}
+	}
+	hours := int64(gatewayExpiry)
+	if form := c.PostForm("expiry"); form != "" {
+		if hours, err = strconv.ParseInt(form, 10, 64); err != nil || hours < 1 || hours > gatewayMaxExpiry {
+			FailWithBadRequest(c, "expiry must be between 1 and "+strconv.Itoa(gatewayMaxExpiry)+" hours")
+			return
+		}
+	}
+	token := gateway.Token{
+		UserName: username,
+		Network:  networkName,
+		Path:     p.String(),
+		Expires:  time.Now().Add(time.Hour * time.Duration(hours)),
+	}
+	signed, err := api.gateway.Sign(token)
+	if err != nil {
+		api.LogError(c, err, eh.GatewayTokenError)(http.StatusInternalServerError)
+		return
+	}
+	api.l.Infow("gateway url signed", "user", username, "path", token.Path, "network", networkName)
+	Respond(c, http.StatusOK, gin.H{"response": gin.H{
+		"url":     token.Path + "?token=" + url.QueryEscape(signed),
+		"token":   signed,
+		"expires": token.Expires,
+	}})
+}
+
+// serveGateway is used to serve the content at /ipfs/<hash>/<path>, or /ipns/<name>/<path> to
+// browsers. Directories are served as their index.html if they have one, or as a listing of
+// their contents otherwise. Content is served from the public network, or the private network
+// named by the token the request was authenticated with, or the network_name query parameter
+func (api *API) serveGateway(c *gin.Context) {
+	p, err := gateway.ParsePath(c.Request.URL.Path)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	var username, networkName string
+	if value, exists := c.Get(gatewayTokenKey); exists {
+		token := value.(*gateway.Token)
+		username, networkName = token.UserName, token.Network
+	} else {
+		if username, err = GetAuthenticatedUserFromContext(c); err != nil {
+			api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+			return
+		}
+		networkName = c.Query("network_name")
+	}
+	// access is checked on every request, so signed urls stop working once access is revoked
+	if networkName != "" && networkName != "public" {
+		if err := CheckAccessForPrivateNetwork(username, networkName, api.dbm.DB); err != nil {
+			api.LogError(c, err, eh.PrivateNetworkAccessError)(http.StatusForbidden)
+			return
+		}
+	}
+	sh, err := api.networkShell(c, username, networkName)
+	if err != nil {
+		api.LogError(c, err, eh.IPFSConnectionError)(http.StatusInternalServerError)
+		return
+	}
+	// content is untrusted, so it is sandboxed from the api, and anything else served from its origin
+	c.Header("Content-Security-Policy", "sandbox allow-scripts allow-forms allow-popups allow-modals allow-downloads")
+	stat, err := statPath(c.Request.Context(), sh, p.String())
+	if err != nil {
+		api.LogError(c, err, eh.IPFSObjectStatError)(http.StatusNotFound)
+		return
+	}
+	if stat.Type != "directory" {
+		api.serveGatewayFile(c, sh, stat, path.Base(p.String()))
+		return
+	}
+	// relative links within a directory only resolve when its path ends with a slash
+	if !strings.HasSuffix(c.Request.URL.Path, "/") {
+		location := *c.Request.URL
+		location.Path += "/"
+		c.Redirect(http.StatusMovedPermanently, location.RequestURI())
+		return
+	}
+	if index, err := statPath(c.Request.Context(), sh, p.String()+"/index.html"); err == nil && index.Type != "directory" {
+		api.serveGatewayFile(c, sh, index, "index.html")
+		return
+	}
+	if notModified(c, stat.Hash) {
+		return
+	}
+	links, err := sh.List("/ipfs/" + stat.Hash)
+	if err != nil {
+		api.LogError(c, err, eh.GatewayListingError)(http.StatusBadRequest)
+		return
+	}
+	entries := make([]gateway.Entry, 0, len(links))
+	for _, link := range links {
+		entries = append(entries, gateway.Entry{
+			Name: link.Name,
+			Hash: link.Hash,
+			Size: link.Size,
+			Dir:  link.Type == ipfsapi.TDirectory,
+		})
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := gateway.WriteListing(c.Writer, p, entries); err != nil {
+		api.l.Errorw(eh.GatewayListingError, "error", err.Error(), "path", p.String())
+	}
+}
+
+// serveGatewayFile is used to serve the file described by stat, with the given name, through the gateway.
+// The type of the file is detected from the extension of its name, or from its content otherwise
+func (api *API) serveGatewayFile(c *gin.Context, sh *ipfsapi.Shell, stat *contentStat, name string) {
+	if notModified(c, stat.Hash) {
+		return
+	}
+	headers := make(map[string]string)
+	status, offset, length, ok := requestedRange(c, stat.Hash, stat.Size, headers)
+	if !ok {
+		return
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		head, err := catRange(c.Request.Context(), sh, stat.Hash, 0, gatewaySniffLength)
+		if err != nil {
+			api.LogError(c, err, eh.IPFSCatError)(http.StatusBadRequest)
+			return
+		}
+		sniffed, err := ioutil.ReadAll(head)
+		head.Close()
+		if err != nil {
+			api.LogError(c, err, eh.IPFSCatError)(http.StatusBadRequest)
+			return
+		}
+		contentType = http.DetectContentType(sniffed)
+	}
+	content, err := catRange(c.Request.Context(), sh, stat.Hash, offset, length)
+	if err != nil {
+		api.LogError(c, err, eh.IPFSCatError)(http.StatusBadRequest)
+		return
+	}
+	defer content.Close()
+	c.DataFromReader(status, length, contentType, content, headers)
+}
@@ -12,7 +12,8 @@ import (
 
 	"github.com/RTradeLtd/Temporal/eh"
 	"github.com/RTradeLtd/Temporal/queue"
-	"github.com/RTradeLtd/Temporal/utils"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/gorm"
 	gocid "github.com/ipfs/go-cid"
 )
 
@@ -65,10 +66,6 @@ func (api *API) publishToIPNSDetails(c *gin.Context) {
 		api.LogError(c, err, "too many ipns records published this month, please wait until next billing cycle")(http.StatusBadRequest)
 		return
 	}
-	if err := api.usage.IncrementIPNSUsage(username, 1); err != nil {
-		api.LogError(c, err, "failed to increment ipns usage")
-		return
-	}
 	// create ipns entry creation message
 	ie := queue.IPNSEntry{
 		CID:         forms["hash"],
@@ -78,10 +75,17 @@ func (api *API) publishToIPNSDetails(c *gin.Context) {
 		Key:         forms["key"],
 		UserName:    username,
 		NetworkName: "public",
+		JobID:       api.newJob(c, username, queue.IpnsEntryQueue, forms["key"]),
 	}
-	// send message for processing
-	if err = api.queues.ipns.PublishMessage(ie); err != nil {
-		api.LogError(c, err, eh.QueuePublishError)(http.StatusBadRequest)
+	// increment their ipns usage, and send message for processing
+	if err = api.enqueue(queue.IpnsEntryQueue, ie, func(tx *gorm.DB) error {
+		if err := models.NewUsageManager(tx).IncrementIPNSUsage(username, 1); err != nil {
+			return &txError{err, "failed to increment ipns usage", http.StatusBadRequest}
+		}
+		return nil
+	}); err != nil {
+		api.failJob(ie.JobID, err)
+		api.failEnqueue(c, err)
 		return
 	}
 	// log and return
@@ -173,35 +177,29 @@ func (api *API) pinIPNSHash(c *gin.Context) {
 		api.LogError(c, err, eh.CantUploadError)(http.StatusBadRequest)
 		return
 	}
-	// get the cost of this object
-	cost, err := utils.CalculatePinCost(username, hash, holdTimeInt, api.ipfs, api.usage)
+	// get the cost of this object, charging only for data the user hasn't stored before
+	quote, err := api.quote(username, hash, int64(stats.CumulativeSize), holdTimeInt)
 	if err != nil {
 		api.LogError(c, err, eh.CostCalculationError)(http.StatusBadRequest)
 		return
 	}
-	// ensure they have enough credits
-	if err := api.validateUserCredits(username, cost); err != nil {
-		api.LogError(c, err, eh.InvalidBalanceError)(http.StatusPaymentRequired)
-		return
-	}
-	if err := api.usage.UpdateDataUsage(username, uint64(stats.CumulativeSize)); err != nil {
-		api.LogError(c, err, eh.DataUsageUpdateError)(http.StatusBadRequest)
-		api.refundUserCredits(username, "pin", cost)
-		return
-	}
 	// create pin message
 	qp := queue.IPFSClusterPin{
 		CID:              hash,
 		NetworkName:      "public",
 		UserName:         username,
 		HoldTimeInMonths: holdTimeInt,
-		CreditCost:       cost,
-	}
-	// send message for processing
-	if err = api.queues.cluster.PublishMessage(qp); err != nil {
-		api.LogError(c, err, eh.QueuePublishError)(http.StatusBadRequest)
-		api.refundUserCredits(username, "pin", cost)
-		api.usage.ReduceDataUsage(username, uint64(stats.CumulativeSize))
+		Size:             int64(stats.CumulativeSize),
+		CreditCost:       quote.DeduplicatedCost,
+		JobID:            api.newJob(c, username, queue.IpfsClusterPinQueue, hash),
+	}
+	// deduct credits, update their data usage, and send message for processing
+	if err := api.enqueue(
+		queue.IpfsClusterPinQueue, qp,
+		bill(username, quote.DeduplicatedCost, uint64(stats.CumulativeSize), qp.JobID),
+	); err != nil {
+		api.failJob(qp.JobID, err)
+		api.failEnqueue(c, err)
 		return
 	}
 	// log and return
@@ -0,0 +1,88 @@
+package v2
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/RTradeLtd/Temporal/eh"
+	"github.com/RTradeLtd/Temporal/jobs"
+	"github.com/RTradeLtd/Temporal/queue"
+	"github.com/gin-gonic/gin"
+)
+
+// jobIDHeader is the response header containing the id of the job created by a request
+const jobIDHeader = "X-Job-ID"
+
+// newJob is used to create a job tracking an asynchronous operation, returning its id
+// to the caller through the job id header. Job tracking is best effort, so failures are
+// logged and an empty job id is returned rather than failing the request
+func (api *API) newJob(c *gin.Context, username string, q queue.Queue, reference string) string {
+	job, err := api.jobs.NewJob(username, q.String(), reference)
+	if err != nil {
+		api.l.Errorw("failed to create job", "error", err.Error(), "user", username)
+		return ""
+	}
+	c.Header(jobIDHeader, job.JobID)
+	return job.JobID
+}
+
+// failJob is used to mark a job as failed when its message could not be published
+func (api *API) failJob(jobID string, err error) {
+	if jobID == "" {
+		return
+	}
+	if err := api.jobs.UpdateState(jobID, jobs.Failed, err.Error()); err != nil {
+		api.l.Errorw("failed to update job state", "error", err.Error(), "job_id", jobID)
+	}
+}
+
+// getJob is used to retrieve the status of a job
+func (api *API) getJob(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	job, err := api.jobs.FindByJobID(c.Param("id"))
+	// don't reveal the existence of jobs belonging to other users
+	if err != nil || job.UserName != username {
+		if err == nil {
+			err = errors.New(eh.JobSearchError)
+		}
+		api.LogError(c, err, eh.JobSearchError)(http.StatusNotFound)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": job})
+}
+
+// listJobs is used to list the most recent jobs of the authenticated user,
+// optionally filtered by state
+func (api *API) listJobs(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 {
+			FailWithBadRequest(c, "limit must be a positive integer")
+			return
+		}
+	}
+	state := jobs.State(c.Query("state"))
+	switch state {
+	case "", jobs.Queued, jobs.Processing, jobs.Succeeded, jobs.Failed, jobs.Refunded:
+	default:
+		FailWithBadRequest(c, "state must be one of queued, processing, succeeded, failed, refunded")
+		return
+	}
+	found, err := api.jobs.FindByUserName(username, state, limit)
+	if err != nil {
+		api.LogError(c, err, eh.JobSearchError)(http.StatusInternalServerError)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": found})
+}
@@ -0,0 +1,75 @@
+package v2
+
+import (
+	"testing"
+
+	"github.com/RTradeLtd/Temporal/jobs"
+	"github.com/RTradeLtd/Temporal/mocks"
+	"github.com/RTradeLtd/Temporal/queue"
+	"github.com/RTradeLtd/config/v2"
+)
+
+func Test_API_Routes_Jobs(t *testing.T) {
+	// load configuration
+	cfg, err := config.LoadConfig("../../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := loadDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// setup fake mock clients
+	fakeLens := &mocks.FakeLensV2Client{}
+	fakeOrch := &mocks.FakeServiceClient{}
+	fakeSigner := &mocks.FakeSignerClient{}
+
+	api, _, err := setupAPI(fakeLens, fakeOrch, fakeSigner, cfg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := api.jobs.NewJob(testUser, queue.IpfsClusterPinQueue.String(), hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(job)
+	otherJob, err := api.jobs.NewJob("notthetestuser", queue.IpfsClusterPinQueue.String(), hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(otherJob)
+
+	// test get job
+	// /v2/jobs/:id
+	var interfaceAPIResp interfaceAPIResponse
+	if err := sendRequest(
+		api, "GET", "/v2/jobs/"+job.JobID, 200, nil, nil, &interfaceAPIResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+	// jobs of other users should not be found
+	if err := sendRequest(
+		api, "GET", "/v2/jobs/"+otherJob.JobID, 404, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// test list jobs
+	// /v2/jobs
+	if err := sendRequest(
+		api, "GET", "/v2/jobs?state="+string(jobs.Queued)+"&limit=10", 200, nil, nil, &interfaceAPIResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendRequest(
+		api, "GET", "/v2/jobs?state=notastate", 400, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendRequest(
+		api, "GET", "/v2/jobs?limit=-1", 400, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+}
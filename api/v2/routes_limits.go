@@ -0,0 +1,90 @@
+package v2
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/billing"
+	"github.com/RTradeLtd/Temporal/eh"
+	"github.com/RTradeLtd/gorm"
+	"github.com/gin-gonic/gin"
+)
+
+// getSpendingLimits is used to retrieve the spending limits of the authenticated
+// user, along with their spending during the current day, and billing cycle
+func (api *API) getSpendingLimits(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	limit, err := api.billing.FindSpendingLimit(username)
+	if err == gorm.ErrRecordNotFound {
+		// users without limits may spend freely
+		limit = &billing.SpendingLimit{UserName: username}
+	} else if err != nil {
+		api.LogError(c, err, eh.SpendingLimitSearchError)(http.StatusInternalServerError)
+		return
+	}
+	spending, err := api.billing.Spent(username, time.Now())
+	if err != nil {
+		api.LogError(c, err, eh.SpendingLimitSearchError)(http.StatusInternalServerError)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": gin.H{
+		"daily_cap":     limit.DailyCap,
+		"monthly_cap":   limit.MonthlyCap,
+		"daily_alert":   limit.DailyAlert,
+		"monthly_alert": limit.MonthlyAlert,
+		"spending":      spending,
+	}})
+}
+
+// setSpendingLimits is used to configure the spending caps, and alert thresholds of the
+// authenticated user. Limits which aren't provided are left unchanged, and a limit of 0
+// disables it
+func (api *API) setSpendingLimits(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	limit, err := api.billing.FindSpendingLimit(username)
+	if err == gorm.ErrRecordNotFound {
+		limit = &billing.SpendingLimit{UserName: username}
+	} else if err != nil {
+		api.LogError(c, err, eh.SpendingLimitSearchError)(http.StatusInternalServerError)
+		return
+	}
+	for name, value := range map[string]*float64{
+		"daily_cap":     &limit.DailyCap,
+		"monthly_cap":   &limit.MonthlyCap,
+		"daily_alert":   &limit.DailyAlert,
+		"monthly_alert": &limit.MonthlyAlert,
+	} {
+		form, exists := c.GetPostForm(name)
+		if !exists {
+			continue
+		}
+		if *value, err = strconv.ParseFloat(form, 64); err != nil {
+			FailWithBadRequest(c, name+" must be a number")
+			return
+		}
+	}
+	limit, err = api.billing.SetSpendingLimit(limit)
+	if err == billing.ErrInvalidLimit || err == billing.ErrAlertAboveCap {
+		Fail(c, err)
+		return
+	} else if err != nil {
+		api.LogError(c, err, eh.SpendingLimitUpdateError)(http.StatusInternalServerError)
+		return
+	}
+	api.l.Infow("spending limits updated", "user", username)
+	Respond(c, http.StatusOK, gin.H{"response": gin.H{
+		"daily_cap":     limit.DailyCap,
+		"monthly_cap":   limit.MonthlyCap,
+		"daily_alert":   limit.DailyAlert,
+		"monthly_alert": limit.MonthlyAlert,
+	}})
+}
@@ -1,15 +1,22 @@
 package v2
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/stripe/stripe-go/charge"
+	"github.com/stripe/stripe-go/webhook"
 
 	"github.com/RTradeLtd/Temporal/eh"
+	"github.com/RTradeLtd/Temporal/payments"
+	"github.com/RTradeLtd/database/v2/models"
 	"github.com/RTradeLtd/gorm"
 	"github.com/stripe/stripe-go"
 
@@ -20,6 +27,13 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	// maxStripeEventSize is the largest stripe event payload we accept
+	maxStripeEventSize = 65536
+	// minStripeCharge is the smallest amount in cents stripe allows us to charge
+	minStripeCharge = 50
+)
+
 // ConfirmETHPayment is used to confirm an ethereum based payment
 func (api *API) ConfirmETHPayment(c *gin.Context) {
 	username, err := GetAuthenticatedUserFromContext(c)
@@ -106,9 +120,9 @@ func (api *API) RequestSignedPaymentMessage(c *gin.Context) {
 		return
 	}
 	// get the current value of a single (ie, 1.0 eth) unit of currency of the given payment type
-	usdValueFloat, err := api.getUSDValue(paymentType)
+	usdValueFloat, err := api.getUSDValue(c, paymentType)
 	if err != nil {
-		api.LogError(c, err, eh.CmcCheckError)(http.StatusBadRequest)
+		api.LogError(c, err, eh.PriceCheckError)(http.StatusServiceUnavailable)
 		return
 	}
 	// get the number of the current payment we are processing
@@ -153,11 +167,12 @@ func (api *API) RequestSignedPaymentMessage(c *gin.Context) {
 		api.LogError(c, err, err.Error())(http.StatusBadRequest)
 		return
 	}
-	// format a unique payment number to take the place of deposit address and tx hash temporarily
+	// format a unique payment number to take the place of the tx hash temporarily. The sender
+	// address is recorded as the deposit address, as only it can make the signed payment
 	paymentNumberString := fmt.Sprintf("%s-%s", username, strconv.FormatInt(paymentNumber, 10))
 	if _, err = api.pm.NewPayment(
 		paymentNumber,
-		paymentNumberString,
+		forms["sender_address"],
 		paymentNumberString,
 		creditValueFloat,
 		chargeAmountFloat,
@@ -207,9 +222,9 @@ func (api *API) CreateDashPayment(c *gin.Context) {
 		FailWithMissingField(c, missingField)
 		return
 	}
-	usdValueFloat, err := api.getUSDValue("dash")
+	usdValueFloat, err := api.getUSDValue(c, "dash")
 	if err != nil {
-		Fail(c, err)
+		api.LogError(c, err, eh.PriceCheckError)(http.StatusServiceUnavailable)
 		return
 	}
 	creditValueFloat, err := strconv.ParseFloat(forms["credit_value"], 64)
@@ -309,11 +324,6 @@ func (api *API) stripeCharge(c *gin.Context) {
 		Fail(c, err)
 		return
 	}
-	valueInCentsFloat, err := strconv.ParseFloat(forms["value_in_cents"], 64)
-	if err != nil {
-		Fail(c, err)
-		return
-	}
 	// set the secret key after input validation
 	stripe.Key = api.cfg.Stripe.SecretKey
 	// set the source for the charge
@@ -336,6 +346,8 @@ func (api *API) stripeCharge(c *gin.Context) {
 		Params: stripe.Params{
 			Metadata: map[string]string{
 				"order_type": "temporal.credits",
+				// allows webhook events to be attributed to the user
+				"username": username,
 			},
 		},
 	})
@@ -343,16 +355,402 @@ func (api *API) stripeCharge(c *gin.Context) {
 		api.LogError(c, err, err.Error())(http.StatusBadRequest)
 		return
 	}
+	// credits are only granted for the amount stripe reports was paid
+	if !ch.Paid {
+		api.LogError(c, errors.New("charge was not paid"), "stripe charge was not paid", "charge", ch.ID)(http.StatusPaymentRequired)
+		return
+	}
 	api.l.Infow("payment complete", "payment.method", "stripe", "user", username, "charge", ch)
-	// add credits to use
-	if _, err := api.um.AddCredits(username, valueInCentsFloat/100); err != nil {
+	credits := float64(ch.Amount) / 100
+	// record the charge as a payment, so that refunds and disputes reported by our
+	// webhook can be reconciled with it, and add credits to use
+	if _, err := api.payments.RecordStripePayment(username, ch.ID, credits); err != nil {
 		api.LogError(c, err, "failed to grant credits")(http.StatusInternalServerError)
 		return
 	}
-	api.l.Infow("credits granted", "payment.method", "stripe", "credit.amount", valueInCentsFloat/100)
+	api.l.Infow("credits granted", "payment.method", "stripe", "credit.amount", credits)
 	Respond(c, http.StatusOK, gin.H{"response": "stripe credit purchase successful"})
 }
 
+// createStripeIntent is used to start a credit purchase using a stripe payment intent,
+// which supports cards requiring authentication such as 3-D Secure. The returned client
+// secret is used to confirm the payment client side, or a payment method may be provided
+// and the intent confirmed with confirmStripeIntent
+func (api *API) createStripeIntent(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	forms, missingField := api.extractPostForms(c, "value_in_cents")
+	if missingField != "" {
+		FailWithMissingField(c, missingField)
+		return
+	}
+	valueInCents, err := strconv.ParseInt(forms["value_in_cents"], 10, 64)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	if valueInCents < minStripeCharge {
+		FailWithBadRequest(c, fmt.Sprintf("value_in_cents must be at least %v", minStripeCharge))
+		return
+	}
+	save, err := strconv.ParseBool(c.DefaultPostForm("save_payment_method", "false"))
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	user, err := api.um.FindByUserName(username)
+	if err != nil {
+		api.LogError(c, err, eh.UserSearchError)(http.StatusBadRequest)
+		return
+	}
+	intent, err := api.intents.CreateIntent(username, user.EmailAddress, valueInCents, c.PostForm("payment_method"), save)
+	if err != nil {
+		api.LogError(c, err, err.Error())(http.StatusBadRequest)
+		return
+	}
+	api.l.Infow("payment intent created", "payment.method", "stripe", "user", username, "intent", intent.ID)
+	Respond(c, http.StatusOK, gin.H{"response": gin.H{
+		"id":            intent.ID,
+		"client_secret": intent.ClientSecret,
+		"status":        intent.Status,
+	}})
+}
+
+// confirmStripeIntent is used to confirm a payment intent, granting credits once the
+// payment succeeds. If the payment requires authentication, the next action the user
+// must take is returned, after which the intent should be confirmed again
+func (api *API) confirmStripeIntent(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	intent, err := api.intents.ConfirmIntent(username, c.Param("id"), c.PostForm("payment_method"))
+	switch err {
+	case nil:
+	case payments.ErrIntentNotFound:
+		Fail(c, err, http.StatusNotFound)
+		return
+	default:
+		api.LogError(c, err, err.Error())(http.StatusBadRequest)
+		return
+	}
+	if intent.Status == stripe.PaymentIntentStatusSucceeded {
+		api.l.Infow("credits granted",
+			"payment.method", "stripe",
+			"user", username,
+			"intent", intent.ID,
+			"credit.amount", float64(intent.AmountReceived)/100)
+	}
+	Respond(c, http.StatusOK, gin.H{"response": gin.H{
+		"id":            intent.ID,
+		"client_secret": intent.ClientSecret,
+		"status":        intent.Status,
+		"next_action":   intent.NextAction,
+	}})
+}
+
+// getStripePaymentMethods is used to list the cards a user has saved for future payments
+func (api *API) getStripePaymentMethods(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	methods, err := api.intents.PaymentMethods(username)
+	if err != nil {
+		api.LogError(c, err, eh.PaymentMethodSearchError)(http.StatusBadRequest)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": methods})
+}
+
+// removeStripePaymentMethod is used to remove a saved card, disabling
+// any automatic top ups which use it
+func (api *API) removeStripePaymentMethod(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	switch err := api.intents.RemovePaymentMethod(username, c.Param("id")); err {
+	case nil:
+	case payments.ErrPaymentMethodNotFound:
+		api.LogError(c, err, eh.PaymentMethodSearchError)(http.StatusNotFound)
+		return
+	default:
+		api.LogError(c, err, eh.PaymentMethodRemoveError)(http.StatusBadRequest)
+		return
+	}
+	api.l.Infow("payment method removed", "user", username, "payment_method", c.Param("id"))
+	Respond(c, http.StatusOK, gin.H{"response": "payment method removed"})
+}
+
+// getAutoTopUp is used to retrieve the automatic top up settings of a user,
+// including the reason the last top up failed if any
+func (api *API) getAutoTopUp(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	topUp, err := api.intents.FindAutoTopUp(username)
+	if err != nil {
+		api.LogError(c, err, eh.AutoTopUpSearchError)(http.StatusNotFound)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": topUp})
+}
+
+// enableAutoTopUp is used to purchase credits with a saved card whenever the balance
+// of a user falls below a threshold. Enabling automatic top ups again updates them
+func (api *API) enableAutoTopUp(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	forms, missingField := api.extractPostForms(c, "threshold", "value_in_cents", "payment_method")
+	if missingField != "" {
+		FailWithMissingField(c, missingField)
+		return
+	}
+	threshold, err := strconv.ParseFloat(forms["threshold"], 64)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	if threshold <= 0 {
+		FailWithBadRequest(c, "threshold must be greater than 0")
+		return
+	}
+	valueInCents, err := strconv.ParseInt(forms["value_in_cents"], 10, 64)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	if valueInCents < minStripeCharge {
+		FailWithBadRequest(c, fmt.Sprintf("value_in_cents must be at least %v", minStripeCharge))
+		return
+	}
+	topUp, err := api.intents.EnableAutoTopUp(username, threshold, valueInCents, forms["payment_method"])
+	switch err {
+	case nil:
+	case payments.ErrPaymentMethodNotFound:
+		api.LogError(c, err, eh.PaymentMethodSearchError)(http.StatusNotFound)
+		return
+	default:
+		api.LogError(c, err, eh.AutoTopUpEnableError)(http.StatusBadRequest)
+		return
+	}
+	api.l.Infow("automatic top up enabled", "user", username, "threshold", threshold, "value_in_cents", valueInCents)
+	Respond(c, http.StatusOK, gin.H{"response": topUp})
+}
+
+// disableAutoTopUp is used to stop purchasing credits automatically
+func (api *API) disableAutoTopUp(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	if _, err := api.intents.FindAutoTopUp(username); err != nil {
+		api.LogError(c, err, eh.AutoTopUpSearchError)(http.StatusNotFound)
+		return
+	}
+	if err := api.intents.DisableAutoTopUp(username); err != nil {
+		api.LogError(c, err, eh.AutoTopUpDisableError)(http.StatusInternalServerError)
+		return
+	}
+	api.l.Infow("automatic top up disabled", "user", username)
+	Respond(c, http.StatusOK, gin.H{"response": "automatic top up disabled"})
+}
+
+// autoTopUp is used to purchase credits for a user whose balance has fallen below their
+// automatic top up threshold. Failures are recorded against the top up for the user to review
+func (api *API) autoTopUp(username string) {
+	credits, err := api.intents.TopUp(username)
+	if err != nil {
+		api.l.Errorw("automatic top up failed", "user", username, "error", err.Error())
+		return
+	}
+	if credits > 0 {
+		api.l.Infow("credits granted", "payment.method", "stripe", "user", username, "credit.amount", credits, "top_up", true)
+	}
+}
+
+// stripeWebhook is used to process events sent by stripe, granting credits for payment
+// intents which succeed, and removing credits granted for charges which are refunded,
+// disputed, or fail. Stripe retries events until we respond
+// with a 2xx status, so events which have already been processed are acknowledged
+func (api *API) stripeWebhook(c *gin.Context) {
+	if api.stripeWebhookSecret == "" {
+		api.LogError(c, errors.New("STRIPE_WEBHOOK_SECRET is not set"), eh.StripeWebhookError)(http.StatusServiceUnavailable)
+		return
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxStripeEventSize))
+	if err != nil {
+		FailWithBadRequest(c, "failed to read event")
+		return
+	}
+	event, err := webhook.ConstructEvent(payload, c.GetHeader("Stripe-Signature"), api.stripeWebhookSecret)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	processed, err := api.payments.ProcessStripeEvent(event)
+	switch err {
+	case nil:
+		api.l.Infow("stripe event processed",
+			"event", event.ID,
+			"type", event.Type,
+			"charge", processed.ChargeID,
+			"user", processed.UserName,
+			"credits_removed", processed.Credits)
+		Respond(c, http.StatusOK, gin.H{"response": "event processed"})
+	case payments.ErrDuplicateEvent:
+		Respond(c, http.StatusOK, gin.H{"response": "event already processed"})
+	case payments.ErrUnhandledEvent:
+		Respond(c, http.StatusOK, gin.H{"response": "event ignored"})
+	default:
+		// respond with an error so that stripe retries the event
+		api.LogError(c, err, eh.StripeWebhookError, "event", event.ID)(http.StatusInternalServerError)
+	}
+}
+
+// listPayments is used to list the payments of the authenticated user, most recent first.
+// Payments may be filtered by blockchain, status, and the period they were created within
+func (api *API) listPayments(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	filter := payments.PaymentFilter{Page: 1, PerPage: 20}
+	if c.Query("page") != "" {
+		filter.Page, err = strconv.Atoi(c.Query("page"))
+		if err != nil || filter.Page <= 0 {
+			FailWithBadRequest(c, "page must be a positive integer")
+			return
+		}
+	}
+	if c.Query("per_page") != "" {
+		filter.PerPage, err = strconv.Atoi(c.Query("per_page"))
+		if err != nil || filter.PerPage <= 0 || filter.PerPage > 100 {
+			FailWithBadRequest(c, "per_page must be between 1 and 100")
+			return
+		}
+	}
+	filter.Blockchain = c.Query("blockchain")
+	if filter.Blockchain != "" && filter.Blockchain != "stripe" && !api.validateBlockchain(filter.Blockchain) {
+		FailWithBadRequest(c, "blockchain must be one of ethereum, bitcoin, litecoin, monero, dash, stripe")
+		return
+	}
+	switch status := c.Query("status"); status {
+	case "":
+	case "confirmed", "pending":
+		confirmed := status == "confirmed"
+		filter.Confirmed = &confirmed
+	default:
+		FailWithBadRequest(c, "status must be one of confirmed, pending")
+		return
+	}
+	for param, t := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if c.Query(param) == "" {
+			continue
+		}
+		if *t, err = parseDate(c.Query(param)); err != nil {
+			FailWithBadRequest(c, param+" must be a date such as 2019-01-31, or an RFC3339 timestamp")
+			return
+		}
+	}
+	page, err := api.payments.FindPayments(username, filter)
+	if err != nil {
+		api.LogError(c, err, eh.PaymentSearchError)(http.StatusInternalServerError)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": page})
+}
+
+// getPaymentInvoice is used to retrieve the invoice for a payment, rendered
+// as html, or as a pdf when the format query parameter is pdf
+func (api *API) getPaymentInvoice(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	number, err := strconv.ParseInt(c.Param("number"), 10, 64)
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	format := c.DefaultQuery("format", "html")
+	if format != "html" && format != "pdf" {
+		FailWithBadRequest(c, "format must be one of html, pdf")
+		return
+	}
+	payment, err := api.pm.FindPaymentByNumber(username, number)
+	if err != nil {
+		api.LogError(c, err, eh.PaymentSearchError)(http.StatusNotFound)
+		return
+	}
+	var (
+		invoice = payments.NewInvoice(payment)
+		buf     bytes.Buffer
+	)
+	contentType := "text/html; charset=utf-8"
+	if format == "pdf" {
+		contentType = "application/pdf"
+		err = invoice.PDF(&buf)
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", invoice.Number+".pdf"))
+	} else {
+		err = invoice.HTML(&buf)
+	}
+	if err != nil {
+		api.LogError(c, err, eh.InvoiceError)(http.StatusInternalServerError)
+		return
+	}
+	c.Data(http.StatusOK, contentType, buf.Bytes())
+}
+
+// sendReceipt is used to email a user a receipt for a confirmed payment
+func (api *API) sendReceipt(payment *models.Payments) {
+	user, err := api.um.FindByUserName(payment.UserName)
+	if err != nil {
+		api.l.Errorw("failed to find user to send receipt to", "error", err.Error(), "user", payment.UserName)
+		return
+	}
+	if !user.EmailEnabled {
+		return
+	}
+	subject, content, err := payments.Receipt(payment)
+	if err != nil {
+		api.l.Errorw("failed to generate receipt", "error", err.Error(), "user", payment.UserName)
+		return
+	}
+	if err := api.queues.email.PublishMessage(queue.EmailSend{
+		Subject:     subject,
+		Content:     content,
+		ContentType: "text/html",
+		UserNames:   []string{user.UserName},
+		Emails:      []string{user.EmailAddress},
+	}); err != nil {
+		api.l.Errorw(eh.QueuePublishError, "error", err.Error(), "user", payment.UserName)
+	}
+}
+
+// parseDate is used to parse either a date, or an RFC3339 timestamp
+func parseDate(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
 // GetPaymentStatus is used to retrieve whether or not a payment is confirmed
 func (api *API) getPaymentStatus(c *gin.Context) {
 	username, err := GetAuthenticatedUserFromContext(c)
@@ -374,18 +772,18 @@ func (api *API) getPaymentStatus(c *gin.Context) {
 }
 
 // GetUSDValue is used to retrieve the usd value of a given payment type
-func (api *API) getUSDValue(paymentType string) (float64, error) {
+func (api *API) getUSDValue(ctx context.Context, paymentType string) (float64, error) {
 	switch paymentType {
 	case "eth":
-		return utils.RetrieveUsdPrice("ethereum")
+		return api.prices.Price(ctx, "ethereum")
 	case "xmr":
-		return utils.RetrieveUsdPrice("monero")
+		return api.prices.Price(ctx, "monero")
 	case "dash":
-		return utils.RetrieveUsdPrice("dash")
+		return api.prices.Price(ctx, "dash")
 	case "btc":
-		return utils.RetrieveUsdPrice("bitcoin")
+		return api.prices.Price(ctx, "bitcoin")
 	case "ltc":
-		return utils.RetrieveUsdPrice("litecoin")
+		return api.prices.Price(ctx, "litecoin")
 	case "rtc":
 		return RtcCostUsd, nil
 	}
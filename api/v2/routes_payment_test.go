@@ -1,12 +1,20 @@
 package v2
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/RTradeLtd/Temporal/mocks"
+	"github.com/RTradeLtd/Temporal/payments"
 	"github.com/RTradeLtd/config/v2"
+	"github.com/stripe/stripe-go/webhook"
 )
 
 func Test_API_Routes_Payments(t *testing.T) {
@@ -74,3 +82,237 @@ func Test_API_Routes_Payments(t *testing.T) {
 	req.PostForm = urlValues
 	api.r.ServeHTTP(testRecorder, req)
 }
+
+func Test_API_Routes_StripeWebhook(t *testing.T) {
+	// load configuration
+	cfg, err := config.LoadConfig("../../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := loadDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// setup fake mock clients
+	fakeLens := &mocks.FakeLensV2Client{}
+	fakeOrch := &mocks.FakeServiceClient{}
+	fakeSigner := &mocks.FakeSignerClient{}
+
+	api, _, err := setupAPI(fakeLens, fakeOrch, fakeSigner, cfg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.stripeWebhookSecret = "whsec_test"
+	defer db.Unscoped().Where("event_id = ?", "evt_1FixtureFailed").Delete(&payments.StripeEvent{})
+
+	sign := func(secret string, payload []byte) string {
+		now := time.Now()
+		return fmt.Sprintf("t=%d,v1=%s", now.Unix(), hex.EncodeToString(webhook.ComputeSignature(now, payload, secret)))
+	}
+	tests := []struct {
+		name       string
+		fixture    string
+		secret     string
+		wantStatus int
+		wantResp   string
+	}{
+		{"BadSignature", "charge_failed.json", "whsec_other", 400, ""},
+		{"Processed", "charge_failed.json", "whsec_test", 200, "event processed"},
+		{"Duplicate", "charge_failed.json", "whsec_test", 200, "event already processed"},
+		{"Ignored", "customer_created.json", "whsec_test", 200, "event ignored"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := ioutil.ReadFile("../../testfiles/stripe/" + tt.fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testRecorder := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/v2/payments/stripe/webhook", bytes.NewReader(payload))
+			req.Header.Add("Stripe-Signature", sign(tt.secret, payload))
+			api.r.ServeHTTP(testRecorder, req)
+			if testRecorder.Code != tt.wantStatus {
+				t.Fatalf("received status %v expected %v", testRecorder.Code, tt.wantStatus)
+			}
+			if tt.wantResp == "" {
+				return
+			}
+			var apiResp apiResponse
+			if err := json.Unmarshal(testRecorder.Body.Bytes(), &apiResp); err != nil {
+				t.Fatal(err)
+			}
+			if apiResp.Response != tt.wantResp {
+				t.Fatalf("received response %q expected %q", apiResp.Response, tt.wantResp)
+			}
+		})
+	}
+}
+
+func Test_API_Routes_StripeIntents(t *testing.T) {
+	// load configuration
+	cfg, err := config.LoadConfig("../../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := loadDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// setup fake mock clients
+	fakeLens := &mocks.FakeLensV2Client{}
+	fakeOrch := &mocks.FakeServiceClient{}
+	fakeSigner := &mocks.FakeSignerClient{}
+
+	api, _, err := setupAPI(fakeLens, fakeOrch, fakeSigner, cfg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// /v2/payments/stripe/intent
+	if err := sendRequest(
+		api, "POST", "/v2/payments/stripe/intent", 400, nil, url.Values{}, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	urlValues := url.Values{}
+	urlValues.Add("value_in_cents", "49")
+	if err := sendRequest(
+		api, "POST", "/v2/payments/stripe/intent", 400, nil, urlValues, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// the test user has no saved payment methods
+	// /v2/payments/stripe/methods
+	var methodsResp struct {
+		Response []payments.PaymentMethod `json:"response"`
+	}
+	if err := sendRequest(
+		api, "GET", "/v2/payments/stripe/methods", 200, nil, nil, &methodsResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if len(methodsResp.Response) != 0 {
+		t.Fatalf("expected no payment methods, got %v", methodsResp.Response)
+	}
+	if err := sendRequest(
+		api, "DELETE", "/v2/payments/stripe/methods/pm_card", 404, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// /v2/payments/stripe/topup
+	if err := sendRequest(
+		api, "GET", "/v2/payments/stripe/topup", 404, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	urlValues = url.Values{}
+	urlValues.Add("threshold", "0")
+	urlValues.Add("value_in_cents", "1000")
+	urlValues.Add("payment_method", "pm_card")
+	if err := sendRequest(
+		api, "POST", "/v2/payments/stripe/topup", 400, nil, urlValues, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	urlValues.Set("threshold", "5")
+	if err := sendRequest(
+		api, "POST", "/v2/payments/stripe/topup", 404, nil, urlValues, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendRequest(
+		api, "DELETE", "/v2/payments/stripe/topup", 404, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_API_Routes_PaymentHistory(t *testing.T) {
+	// load configuration
+	cfg, err := config.LoadConfig("../../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := loadDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// setup fake mock clients
+	fakeLens := &mocks.FakeLensV2Client{}
+	fakeOrch := &mocks.FakeServiceClient{}
+	fakeSigner := &mocks.FakeSignerClient{}
+
+	api, _, err := setupAPI(fakeLens, fakeOrch, fakeSigner, cfg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	number, err := api.pm.GetLatestPaymentNumber("testuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := api.pm.NewPayment(number, "0xdeposit", "0xhistory", 10, 0.05, "ethereum", "eth", "testuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(payment)
+
+	// /v2/payments
+	var listResp struct {
+		Response payments.PaymentPage `json:"response"`
+	}
+	if err := sendRequest(
+		api, "GET", "/v2/payments?blockchain=ethereum&status=pending&per_page=100", 200, nil, nil, &listResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, p := range listResp.Response.Payments {
+		found = found || p.ID == payment.ID
+	}
+	if !found {
+		t.Fatal("expected pending payment to be listed")
+	}
+	for _, query := range []string{"status=unknown", "blockchain=unknown", "page=0", "per_page=101", "from=yesterday"} {
+		if err := sendRequest(
+			api, "GET", "/v2/payments?"+query, 400, nil, nil, nil,
+		); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	// /v2/payments/invoice/:number
+	tests := []struct {
+		name            string
+		format          string
+		wantStatus      int
+		wantContentType string
+	}{
+		{"HTML", "html", 200, "text/html; charset=utf-8"},
+		{"PDF", "pdf", 200, "application/pdf"},
+		{"InvalidFormat", "doc", 400, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testRecorder := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", fmt.Sprintf("/v2/payments/invoice/%d?format=%s", number, tt.format), nil)
+			req.Header.Add("Authorization", authHeader)
+			api.r.ServeHTTP(testRecorder, req)
+			if testRecorder.Code != tt.wantStatus {
+				t.Fatalf("received status %v expected %v", testRecorder.Code, tt.wantStatus)
+			}
+			if tt.wantContentType != "" && testRecorder.Header().Get("Content-Type") != tt.wantContentType {
+				t.Fatalf("received content type %q expected %q", testRecorder.Header().Get("Content-Type"), tt.wantContentType)
+			}
+		})
+	}
+	if err := sendRequest(
+		api, "GET", fmt.Sprintf("/v2/payments/invoice/%d", number+1), 404, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+}
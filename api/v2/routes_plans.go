@@ -0,0 +1,152 @@
+package v2
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/RTradeLtd/Temporal/billing"
+	"github.com/RTradeLtd/Temporal/eh"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/gorm"
+	"github.com/gin-gonic/gin"
+)
+
+// listPlans is used to list the pricing, and limits of each tier
+func (api *API) listPlans(c *gin.Context) {
+	Respond(c, http.StatusOK, gin.H{"response": billing.Plans()})
+}
+
+// getPlan is used to retrieve the plan of the tier the authenticated user belongs
+// to, along with any tier change scheduled for the end of the billing cycle
+func (api *API) getPlan(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	usage, err := api.usage.FindByUserName(username)
+	if err != nil {
+		api.LogError(c, err, eh.UserSearchError)(http.StatusBadRequest)
+		return
+	}
+	plan, err := billing.FindPlan(usage.Tier)
+	if err != nil {
+		api.LogError(c, err, eh.PlanSearchError)(http.StatusInternalServerError)
+		return
+	}
+	scheduled, err := api.billing.FindScheduledChange(username)
+	if err != nil && err != gorm.ErrRecordNotFound {
+		api.LogError(c, err, eh.PlanSearchError)(http.StatusInternalServerError)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": gin.H{
+		"plan":      plan,
+		"scheduled": scheduled,
+	}})
+}
+
+// changePlan is used to change the tier of the authenticated user. Upgrades take effect
+// immediately, while downgrades take effect at the end of the billing cycle. Users may
+// upgrade themselves to the light tier, and to the plus tier once they store enough data,
+// while other tiers are granted by an administrator with grantPlan
+func (api *API) changePlan(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	forms, missingField := api.extractPostForms(c, "tier")
+	if missingField != "" {
+		FailWithMissingField(c, missingField)
+		return
+	}
+	change, err := api.billing.ChangeTier(username, models.DataUsageTier(forms["tier"]))
+	if err == billing.ErrApprovalRequired {
+		Fail(c, err, http.StatusForbidden)
+		return
+	} else if _, exceeded := err.(*billing.UsageError); exceeded || err == billing.ErrUnknownTier ||
+		err == billing.ErrSameTier || err == billing.ErrPlusUsage {
+		Fail(c, err)
+		return
+	} else if err != nil {
+		api.LogError(c, err, eh.TierChangeError)(http.StatusInternalServerError)
+		return
+	}
+	api.l.Infow("tier change requested", "user", username, "from", change.From, "to", change.To,
+		"scheduled", change.AppliedAt == nil)
+	Respond(c, http.StatusOK, gin.H{"response": change})
+}
+
+// grantPlan is used by an administrator to change the tier of a user, including
+// upgrades to tiers which users aren't allowed to upgrade themselves to
+func (api *API) grantPlan(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	if err := api.validateAdminRequest(username); err != nil {
+		FailNotAuthorized(c, eh.UnAuthorizedAdminAccess)
+		return
+	}
+	forms, missingField := api.extractPostForms(c, "username", "tier")
+	if missingField != "" {
+		FailWithMissingField(c, missingField)
+		return
+	}
+	change, err := api.billing.GrantTier(forms["username"], models.DataUsageTier(forms["tier"]))
+	if err == gorm.ErrRecordNotFound {
+		Fail(c, err, http.StatusNotFound)
+		return
+	} else if _, exceeded := err.(*billing.UsageError); exceeded || err == billing.ErrUnknownTier || err == billing.ErrSameTier {
+		Fail(c, err)
+		return
+	} else if err != nil {
+		api.LogError(c, err, eh.TierChangeError)(http.StatusInternalServerError)
+		return
+	}
+	api.l.Infow("tier change granted", "admin", username, "user", forms["username"], "from", change.From, "to", change.To,
+		"scheduled", change.AppliedAt == nil)
+	Respond(c, http.StatusOK, gin.H{"response": change})
+}
+
+// cancelPlanChange is used to cancel the tier change scheduled by the authenticated user
+func (api *API) cancelPlanChange(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	if err := api.billing.CancelScheduledChange(username); err != nil {
+		if err == billing.ErrNoScheduledChange {
+			Fail(c, err, http.StatusNotFound)
+			return
+		}
+		api.LogError(c, err, eh.TierChangeError)(http.StatusInternalServerError)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": "scheduled tier change cancelled"})
+}
+
+// getPlanHistory is used to retrieve the most recent tier changes of the authenticated user
+func (api *API) getPlanHistory(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 {
+			FailWithBadRequest(c, "limit must be a positive integer")
+			return
+		}
+	}
+	changes, err := api.billing.FindTierChanges(username, limit)
+	if err != nil {
+		api.LogError(c, err, eh.PlanSearchError)(http.StatusInternalServerError)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": changes})
+}
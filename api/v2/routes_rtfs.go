@@ -2,12 +2,9 @@ package v2
 
 import (
 	"archive/zip"
-	"bytes"
 	"errors"
 	"fmt"
 	"html"
-	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -17,11 +14,10 @@ import (
 	"github.com/c2h5oh/datasize"
 
 	"github.com/RTradeLtd/Temporal/eh"
+	"github.com/RTradeLtd/Temporal/gc"
 	"github.com/RTradeLtd/Temporal/queue"
 	"github.com/RTradeLtd/Temporal/utils"
-	"github.com/RTradeLtd/crypto/v2"
 	"github.com/RTradeLtd/database/v2/models"
-	ipfsapi "github.com/RTradeLtd/go-ipfs-api"
 	"github.com/gin-gonic/gin"
 	gocid "github.com/ipfs/go-cid"
 )
@@ -77,23 +73,12 @@ func (api *API) pinHashLocally(c *gin.Context) {
 		)
 		return
 	}
-	// determine cost of upload
-	cost, err := utils.CalculatePinCost(username, hash, holdTimeInt, api.ipfs, api.usage)
+	// determine cost of upload, charging only for data the user hasn't stored before
+	quote, err := api.quote(username, hash, int64(stats.CumulativeSize), holdTimeInt)
 	if err != nil {
 		api.LogError(c, err, eh.CostCalculationError)(http.StatusBadRequest)
 		return
 	}
-	// validate, and deduct credits if they can upload
-	if err := api.validateUserCredits(username, cost); err != nil {
-		api.LogError(c, err, eh.InvalidBalanceError)(http.StatusPaymentRequired)
-		return
-	}
-	// update their data usage
-	if err := api.usage.UpdateDataUsage(username, uint64(stats.CumulativeSize)); err != nil {
-		api.LogError(c, err, eh.DataUsageUpdateError)(http.StatusBadRequest)
-		api.refundUserCredits(username, "pin", cost)
-		return
-	}
 	// construct pin message
 	qp := queue.IPFSClusterPin{
 		CID:              hash,
@@ -101,13 +86,16 @@ func (api *API) pinHashLocally(c *gin.Context) {
 		UserName:         username,
 		HoldTimeInMonths: holdTimeInt,
 		Size:             int64(stats.CumulativeSize),
-		CreditCost:       cost,
+		CreditCost:       quote.DeduplicatedCost,
+		JobID:            api.newJob(c, username, queue.IpfsClusterPinQueue, hash),
 	}
-	// sent pin message
-	if err = api.queues.cluster.PublishMessage(qp); err != nil {
-		api.LogError(c, err, eh.QueuePublishError)(http.StatusBadRequest)
-		api.refundUserCredits(username, "pin", cost)
-		api.usage.ReduceDataUsage(username, uint64(stats.CumulativeSize))
+	// deduct credits, update their data usage, and send the pin message
+	if err := api.enqueue(
+		queue.IpfsClusterPinQueue, qp,
+		bill(username, quote.DeduplicatedCost, uint64(stats.CumulativeSize), qp.JobID),
+	); err != nil {
+		api.failJob(qp.JobID, err)
+		api.failEnqueue(c, err)
 		return
 	}
 	// log success and return
@@ -145,33 +133,6 @@ func (api *API) addFile(c *gin.Context) {
 		Fail(c, err)
 		return
 	}
-	api.l.Debug("opening file")
-	openFile, err := fileHandler.Open()
-	if err != nil {
-		api.LogError(c, err, eh.FileOpenError)(http.StatusBadRequest)
-		return
-	}
-	// we need a small hack because reading from openFile once
-	// drains it's contents, by holding it in a temporary bytes object
-	// we can avoid any issues that may be caused
-	fileBytes, err := ioutil.ReadAll(openFile)
-	if err != nil {
-		Fail(c, err)
-		return
-	}
-	hash, err := api.ipfs.Add(bytes.NewReader(fileBytes), ipfsapi.OnlyHash(true))
-	if err != nil {
-		api.LogError(c, err, eh.IPFSAddError)(http.StatusBadRequest)
-		return
-	}
-	upload, err := api.upm.FindUploadByHashAndUserAndNetwork(username, hash, "public")
-	// by this conditional if statement passing, it means the user has
-	// upload content matching this hash before, and we don't want to charge them
-	// so we should gracefully abort further processing
-	if err == nil || upload != nil {
-		Respond(c, http.StatusBadRequest, gin.H{"response": alreadyUploadedMessage})
-		return
-	}
 	// format size of file into gigabytes
 	fileSizeInGB := uint64(fileHandler.Size) / datasize.GB.Bytes()
 	api.l.Debug("user", username, "file_size_in_gb", fileSizeInGB)
@@ -180,85 +141,27 @@ func (api *API) addFile(c *gin.Context) {
 		api.LogError(c, err, eh.CantUploadError)(http.StatusBadRequest)
 		return
 	}
-	// calculate code of upload
-	cost, err := utils.CalculateFileCost(username, holdTimeInMonthsInt, fileHandler.Size, api.usage)
-	if err != nil {
-		api.LogError(c, err, eh.CostCalculationError)(http.StatusBadRequest)
-		return
-	}
-	// validate they have enough credits to pay for the upload
-	if err = api.validateUserCredits(username, cost); err != nil {
-		api.LogError(c, err, eh.InvalidBalanceError)(http.StatusPaymentRequired)
-		return
-	}
-	// update their data usage
-	if err := api.usage.UpdateDataUsage(username, uint64(fileHandler.Size)); err != nil {
-		api.LogError(c, err, eh.DataUsageUpdateError)(http.StatusBadRequest)
-		api.refundUserCredits(username, "file", cost)
-		return
-	}
-	var reader io.Reader
-	// encrypt file is passphrase is given
-	if c.PostForm("passphrase") != "" {
-		userUsage, err := api.usage.FindByUserName(username)
-		if err != nil {
-			api.LogError(c, err, eh.UserSearchError)(http.StatusBadRequest)
-			return
-		}
-		// if the user is within the free tier, then we throttle on-demand encryption
-		// free accounts are limited to a file upload size of 275MB when performing
-		// on-demand encryption. Non free accounts do not have this limit
-		if userUsage.Tier == models.Free {
-			megabytesUint := datasize.MB.Bytes()
-			maxSize := megabytesUint * 275
-			if fileHandler.Size > int64(maxSize) {
-				Fail(c, errors.New("free accounts are limited to a max file size of 275MB when using on-demand encryption"))
-				api.refundUserCredits(username, "file", cost)
-				api.usage.ReduceDataUsage(username, uint64(fileHandler.Size))
-				return
-			}
-		}
-		// html decode strings
-		decodedPassPhrase := html.UnescapeString(c.PostForm("passphrase"))
-		encrypted, err := crypto.NewEncryptManager(decodedPassPhrase).Encrypt(bytes.NewReader(fileBytes))
-		if err != nil {
-			api.LogError(c, err, eh.EncryptionError)(http.StatusBadRequest)
-			api.refundUserCredits(username, "file", cost)
-			api.usage.ReduceDataUsage(username, uint64(fileHandler.Size))
+	passphrase := html.UnescapeString(c.PostForm("passphrase"))
+	if passphrase != "" {
+		if err := api.validateEncryptedSize(username, fileHandler.Size); err != nil {
+			Fail(c, err)
 			return
 		}
-		reader = bytes.NewReader(encrypted)
-		// generate an encryption manager and encrypt
-	} else {
-		reader = bytes.NewReader(fileBytes)
 	}
-	api.l.Debug("adding file...")
-	resp, err := api.ipfs.Add(reader)
+	api.l.Debug("opening file")
+	openFile, err := fileHandler.Open()
 	if err != nil {
-		api.LogError(c, err, eh.IPFSAddError)(http.StatusBadRequest)
-		api.refundUserCredits(username, "file", cost)
-		api.usage.ReduceDataUsage(username, uint64(fileHandler.Size))
+		api.LogError(c, err, eh.FileOpenError)(http.StatusBadRequest)
 		return
 	}
-	// if this was an encrypted upload we need to update the encrypted upload table
-	// ipfs cluster pin handles updating the regular uploads table
-	if c.PostForm("passphrase") != "" {
-		if _, err := api.ue.NewUpload(username, fileHandler.Filename, "public", resp); err != nil {
-			api.LogError(c, err, eh.DatabaseUpdateError)(http.StatusBadRequest)
-			// dont refund here as the data is already available on ipfs
-			return
-		}
-	}
-	api.l.Debug("file uploaded to ipfs")
-	qp := queue.IPFSClusterPin{
-		CID:              resp,
-		NetworkName:      "public",
-		UserName:         username,
-		HoldTimeInMonths: holdTimeInMonthsInt,
-	}
-	// send message to rabbitmq
-	if err = api.queues.cluster.PublishMessage(qp); err != nil {
-		api.LogError(c, err, eh.QueuePublishError)(http.StatusBadRequest)
+	defer openFile.Close()
+	api.l.Debug("adding file...")
+	resp, err := api.addPublicFile(c, username, fileHandler.Filename, openFile, fileHandler.Size, holdTimeInMonthsInt, passphrase)
+	if err == errAlreadyUploaded {
+		Respond(c, http.StatusBadRequest, gin.H{"response": alreadyUploadedMessage})
+		return
+	} else if err != nil {
+		api.failStream(c, err)
 		return
 	}
 	// log and return
@@ -364,28 +267,17 @@ func (api *API) uploadDirectory(c *gin.Context) {
 		api.LogError(c, err, eh.CantUploadError)(http.StatusBadRequest)
 		return
 	}
-	// upgrade their data usage
-	if err := api.usage.UpdateDataUsage(username, uint64(uncompressedSize)); err != nil {
-		// remove file if this fails
-		os.Remove(destPathZip)
-		api.LogError(c, err, eh.DataUsageUpdateError)(http.StatusBadRequest)
-		return
-	}
-	// calculate cost of file
+	// ensure they can afford the full cost of the directory before it is added, as
+	// the deduplicated cost they're charged can only be calculated after
 	cost, err := utils.CalculateFileCost(username, holdTimeInt, uncompressedSize, api.usage)
 	if err != nil {
-		// remove file if this fails
 		os.Remove(destPathZip)
-		api.usage.ReduceDataUsage(username, uint64(uncompressedSize))
-		api.LogError(c, err, eh.InvalidBalanceError)(http.StatusBadRequest)
+		api.LogError(c, err, eh.CostCalculationError)(http.StatusBadRequest)
 		return
 	}
-	// validate user credits
-	if err := api.validateUserCredits(username, cost); err != nil {
-		// remove file if this fails
+	if err := api.checkCredits(username, cost); err != nil {
 		os.Remove(destPathZip)
-		api.usage.ReduceDataUsage(username, uint64(uncompressedSize))
-		api.LogError(c, err, eh.InvalidBalanceError)(http.StatusPaymentRequired)
+		api.failEnqueue(c, err)
 		return
 	}
 	randString = randUtils.GenerateString(5, utils.LetterBytes)
@@ -395,7 +287,6 @@ func (api *API) uploadDirectory(c *gin.Context) {
 		// remove file if this fails
 		os.Remove(destPathZip)
 		os.RemoveAll(destPathUnzip)
-		api.usage.ReduceDataUsage(username, uint64(uncompressedSize))
 		api.l.Error(err)
 		Fail(c, err)
 		return
@@ -406,29 +297,46 @@ func (api *API) uploadDirectory(c *gin.Context) {
 		// remove file if this fails
 		os.Remove(destPathZip)
 		os.RemoveAll(destPathUnzip)
-		api.usage.ReduceDataUsage(username, uint64(uncompressedSize))
 		api.LogError(c, err, eh.IPFSAddError)(http.StatusBadRequest)
 		return
 	}
 	// cleanup unzipped file
 	if err := os.RemoveAll(destPathUnzip); err != nil {
 		os.Remove(destPathZip)
+		api.unpinUnused(hash)
 		api.LogError(c, err, "failed to cleanup file(s)")(http.StatusBadRequest)
 		return
 	}
 	// cleanup zip file
 	if err := os.Remove(destPathZip); err != nil {
+		api.unpinUnused(hash)
 		api.LogError(c, err, "failed to cleanup file(s)")(http.StatusBadRequest)
 		return
 	}
+	// calculate cost of the directory, charging only for data the user hasn't stored before
+	quote, err := api.quote(username, hash, uncompressedSize, holdTimeInt)
+	if err != nil {
+		api.unpinUnused(hash)
+		api.LogError(c, err, eh.CostCalculationError)(http.StatusBadRequest)
+		return
+	}
 	qp := queue.IPFSClusterPin{
 		CID:              hash,
 		NetworkName:      "public",
 		UserName:         username,
 		HoldTimeInMonths: holdTimeInt,
+		Size:             uncompressedSize,
+		CreditCost:       quote.DeduplicatedCost,
+		JobID:            api.newJob(c, username, queue.IpfsClusterPinQueue, hash),
 	}
-	if err := api.queues.cluster.PublishMessage(qp); err != nil {
-		api.LogError(c, err, eh.QueuePublishError)(http.StatusInternalServerError)
+	// deduct credits, update their data usage, and send the pin message
+	if err := api.enqueue(
+		queue.IpfsClusterPinQueue, qp,
+		bill(username, quote.DeduplicatedCost, uint64(uncompressedSize), qp.JobID),
+	); err != nil {
+		api.failJob(qp.JobID, err)
+		api.unpinUnused(hash)
+		api.failEnqueue(c, err)
 		return
 	}
 	api.l.Infow("directory upload processed", "user", username)
@@ -571,16 +479,102 @@ func (api *API) extendPin(c *gin.Context) {
 		return
 	}
 	// validate they have enough credits
-	if err := api.validateUserCredits(username, cost); err != nil {
-		api.LogError(c, err, eh.InvalidBalanceError)(http.StatusPaymentRequired)
+	if err := api.validateUserCredits(username, cost, hash); err != nil {
+		te := chargeError(err)
+		api.LogError(c, te.err, te.message)(te.status)
 		return
 	}
 	// extend garbage collection period
 	if err := api.upm.ExtendGarbageCollectionPeriod(username, hash, "public", int(holdTimeInt)); err != nil {
 		api.LogError(c, err, eh.PinExtendError)(http.StatusBadRequest)
-		api.refundUserCredits(username, "pin", cost)
+		api.refundUserCredits(username, "pin", cost, hash)
 		return
 	}
 	// return
 	Respond(c, http.StatusOK, gin.H{"response": "pin time successfully extended"})
 }
+
+// enableRenewal is used to automatically extend the hold time of a pin before it
+// expires, paid for using the credits of the user. Enabling renewal again updates
+// the hold time used for each renewal
+func (api *API) enableRenewal(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	hash := c.Param("hash")
+	if _, err := gocid.Decode(hash); err != nil {
+		Fail(c, err)
+		return
+	}
+	forms, missingField := api.extractPostForms(c, "hold_time")
+	if missingField != "" {
+		FailWithMissingField(c, missingField)
+		return
+	}
+	holdTimeInt, err := api.validateHoldTime(username, forms["hold_time"])
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	if holdTimeInt < 1 || holdTimeInt > gc.MaxRenewalMonths {
+		FailWithBadRequest(c, fmt.Sprintf("hold_time must be between 1 and %v months", gc.MaxRenewalMonths))
+		return
+	}
+	usage, err := api.usage.FindByUserName(username)
+	if err != nil {
+		api.LogError(c, err, eh.UserSearchError)(http.StatusBadRequest)
+		return
+	}
+	if usage.Tier == models.Free {
+		Fail(c, gc.ErrFreeTier)
+		return
+	}
+	if _, err := api.upm.FindUploadByHashAndUserAndNetwork(username, hash, "public"); err != nil {
+		api.LogError(c, err, eh.UploadSearchError)(http.StatusBadRequest)
+		return
+	}
+	renewal, err := api.renewals.EnableRenewal(username, hash, "public", holdTimeInt)
+	if err != nil {
+		api.LogError(c, err, eh.RenewalEnableError)(http.StatusBadRequest)
+		return
+	}
+	api.l.Infow("automatic renewal enabled", "user", username, "hash", hash, "hold_time", holdTimeInt)
+	Respond(c, http.StatusOK, gin.H{"response": renewal})
+}
+
+// getRenewal is used to retrieve the automatic renewal settings of a pin
+func (api *API) getRenewal(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	renewal, err := api.renewals.FindRenewal(username, c.Param("hash"), "public")
+	if err != nil {
+		api.LogError(c, err, eh.RenewalSearchError)(http.StatusNotFound)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": renewal})
+}
+
+// disableRenewal is used to stop automatically extending the hold time of a pin
+func (api *API) disableRenewal(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	hash := c.Param("hash")
+	if _, err := api.renewals.FindRenewal(username, hash, "public"); err != nil {
+		api.LogError(c, err, eh.RenewalSearchError)(http.StatusNotFound)
+		return
+	}
+	if err := api.renewals.DisableRenewal(username, hash, "public"); err != nil {
+		api.LogError(c, err, eh.RenewalDisableError)(http.StatusInternalServerError)
+		return
+	}
+	api.l.Infow("automatic renewal disabled", "user", username, "hash", hash)
+	Respond(c, http.StatusOK, gin.H{"response": "automatic renewal disabled"})
+}
@@ -3,15 +3,19 @@ package v2
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/RTradeLtd/Temporal/gc"
 	"github.com/RTradeLtd/Temporal/mocks"
+	"github.com/RTradeLtd/Temporal/share"
 	"github.com/RTradeLtd/config/v2"
 	"github.com/RTradeLtd/database/v2/models"
 )
@@ -255,6 +259,150 @@ func Test_API_Routes_IPFS_Public(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// test ranged download
+	// /v2/ipfs/utils/download
+	testRecorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/v2/ipfs/utils/download/"+hash, nil)
+	req.Header.Add("Authorization", authHeader)
+	req.Header.Add("Range", "bytes=0-9")
+	api.r.ServeHTTP(testRecorder, req)
+	if testRecorder.Code != 206 {
+		t.Fatalf("received status %v expected 206 from ranged download", testRecorder.Code)
+	}
+	if testRecorder.Body.Len() != 10 {
+		t.Fatalf("received %v bytes expected 10 from ranged download", testRecorder.Body.Len())
+	}
+
+	// test conditional download
+	// /v2/ipfs/utils/download
+	testRecorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/v2/ipfs/utils/download/"+hash, nil)
+	req.Header.Add("Authorization", authHeader)
+	req.Header.Add("If-None-Match", `"`+hash+`"`)
+	api.r.ServeHTTP(testRecorder, req)
+	if testRecorder.Code != 304 {
+		t.Fatalf("received status %v expected 304 from conditional download", testRecorder.Code)
+	}
+
+	// test gateway
+	// /ipfs/:hash
+	testRecorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/ipfs/"+hash, nil)
+	req.Header.Add("Authorization", authHeader)
+	api.r.ServeHTTP(testRecorder, req)
+	if testRecorder.Code != 200 {
+		t.Fatalf("received status %v expected 200 from gateway", testRecorder.Code)
+	}
+
+	// test signed gateway url
+	// /v2/gateway/sign
+	var signResp struct {
+		Code     int `json:"code"`
+		Response struct {
+			URL string `json:"url"`
+		} `json:"response"`
+	}
+	urlValues = url.Values{}
+	urlValues.Add("path", "/ipfs/"+hash)
+	urlValues.Add("expiry", "1")
+	if err := sendRequest(
+		api, "POST", "/v2/gateway/sign", 200, nil, urlValues, &signResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+	// signed urls don't require any other authentication
+	testRecorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", signResp.Response.URL, nil)
+	api.r.ServeHTTP(testRecorder, req)
+	if testRecorder.Code != 200 {
+		t.Fatalf("received status %v expected 200 from signed gateway url", testRecorder.Code)
+	}
+	// and only grant access to the signed path
+	testRecorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", strings.Replace(signResp.Response.URL, hash, "QmPY5iMFjNZKxRbUZZC85wXb9CFgNSyzAy1LxwL62D8VGr", 1), nil)
+	api.r.ServeHTTP(testRecorder, req)
+	if testRecorder.Code != 403 {
+		t.Fatalf("received status %v expected 403 from signed gateway url", testRecorder.Code)
+	}
+
+	// test share links
+	// /v2/share
+	var shareResp struct {
+		Code     int `json:"code"`
+		Response struct {
+			ID  uint   `json:"id"`
+			URL string `json:"url"`
+		} `json:"response"`
+	}
+	urlValues = url.Values{}
+	urlValues.Add("hash", hash)
+	urlValues.Add("max_downloads", "1")
+	urlValues.Add("password", "password123")
+	urlValues.Add("file_name", "dir/test.txt")
+	if err := sendRequest(
+		api, "POST", "/v2/share", 200, nil, urlValues, &shareResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Where("link_id = ?", shareResp.Response.ID).Delete(&share.Access{})
+	defer db.Unscoped().Delete(&share.Link{}, shareResp.Response.ID)
+	// content the user hasn't uploaded can't be shared
+	urlValues = url.Values{}
+	urlValues.Add("hash", "QmPY5iMFjNZKxRbUZZC85wXb9CFgNSyzAy1LxwL62D8VGr")
+	if err := sendRequest(
+		api, "POST", "/v2/share", 404, nil, urlValues, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	// share links don't require authentication, only the password of the link
+	testRecorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", shareResp.Response.URL, nil)
+	api.r.ServeHTTP(testRecorder, req)
+	if testRecorder.Code != 401 {
+		t.Fatalf("received status %v expected 401 from share link without password", testRecorder.Code)
+	}
+	testRecorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", shareResp.Response.URL+"?password=password123", nil)
+	api.r.ServeHTTP(testRecorder, req)
+	if testRecorder.Code != 200 {
+		t.Fatalf("received status %v expected 200 from share link", testRecorder.Code)
+	}
+	if !strings.Contains(testRecorder.Header().Get("Content-Disposition"), "test.txt") {
+		t.Fatal("expected share link to be downloaded as test.txt")
+	}
+	// the link is limited to a single download
+	testRecorder = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", shareResp.Response.URL+"?password=password123", nil)
+	api.r.ServeHTTP(testRecorder, req)
+	if testRecorder.Code != 410 {
+		t.Fatalf("received status %v expected 410 from used share link", testRecorder.Code)
+	}
+	// every attempt is recorded in the access log
+	// /v2/share/:id/access
+	var accessResp struct {
+		Code     int            `json:"code"`
+		Response []share.Access `json:"response"`
+	}
+	if err := sendRequest(
+		api, "GET", "/v2/share/"+fmt.Sprint(shareResp.Response.ID)+"/access", 200, nil, nil, &accessResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if len(accessResp.Response) != 3 {
+		t.Fatalf("expected 3 share link accesses, got %v", len(accessResp.Response))
+	}
+	// /v2/share/:id
+	if err := sendRequest(
+		api, "DELETE", "/v2/share/"+fmt.Sprint(shareResp.Response.ID), 200, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendRequest(
+		api, "DELETE", "/v2/share/notanid", 400, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+
 	// test public network beam
 	// /v2/ipfs/utils/laser/beam
 	urlValues = url.Values{}
@@ -277,4 +425,47 @@ func Test_API_Routes_IPFS_Public(t *testing.T) {
 	); err != nil {
 		t.Fatal(err)
 	}
+
+	// test automatic renewal
+	// /v2/ipfs/public/pin/:hash/renewal
+	if err := sendRequest(
+		api, "GET", "/v2/ipfs/public/pin/"+hash+"/renewal", 404, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	urlValues = url.Values{}
+	urlValues.Add("hold_time", "24")
+	if err := sendRequest(
+		api, "POST", "/v2/ipfs/public/pin/"+hash+"/renewal", 400, nil, urlValues, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	urlValues = url.Values{}
+	urlValues.Add("hold_time", "1")
+	if err := sendRequest(
+		api, "POST", "/v2/ipfs/public/pin/"+hash+"/renewal", 200, nil, urlValues, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	var renewalResp struct {
+		Response gc.Renewal `json:"response"`
+	}
+	if err := sendRequest(
+		api, "GET", "/v2/ipfs/public/pin/"+hash+"/renewal", 200, nil, nil, &renewalResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if renewalResp.Response.HoldTimeInMonths != 1 {
+		t.Fatalf("expected renewal hold time of 1 month, got %v", renewalResp.Response.HoldTimeInMonths)
+	}
+	if err := sendRequest(
+		api, "DELETE", "/v2/ipfs/public/pin/"+hash+"/renewal", 200, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendRequest(
+		api, "DELETE", "/v2/ipfs/public/pin/"+hash+"/renewal", 404, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
 }
@@ -1,19 +1,14 @@
 package v2
 
 import (
-	"bytes"
 	"errors"
 	"html"
-	"io"
-	"io/ioutil"
 	"net/http"
 	"time"
 
 	"github.com/RTradeLtd/Temporal/eh"
 	"github.com/RTradeLtd/Temporal/queue"
-	"github.com/RTradeLtd/crypto/v2"
 	"github.com/RTradeLtd/database/v2/models"
-	ipfsapi "github.com/RTradeLtd/go-ipfs-api"
 	"github.com/RTradeLtd/gorm"
 	"github.com/RTradeLtd/rtfs/v2"
 	gocid "github.com/ipfs/go-cid"
@@ -69,9 +64,11 @@ func (api *API) pinToHostedIPFSNetwork(c *gin.Context) {
 		HoldTimeInMonths: holdTimeInt,
 		CreditCost:       0,
 		JWT:              GetAuthToken(c),
+		JobID:            api.newJob(c, username, queue.IpfsPinQueue, hash),
 	}
 	// send message for processing
 	if err = api.queues.pin.PublishMessage(ip); err != nil {
+		api.failJob(ip.JobID, err)
 		api.LogError(c, err, eh.QueuePublishError)(http.StatusBadRequest)
 		return
 	}
@@ -121,64 +118,44 @@ func (api *API) addFileToHostedIPFSNetwork(c *gin.Context) {
 		Fail(c, err)
 		return
 	}
-	// open file into memory
-	file, err := fileHandler.Open()
+	// format a url to connect to for private network
+	apiURL := api.GetIPFSEndpoint(forms["network_name"])
+	// connect to private ifps network
+	ipfsManager, err := rtfs.NewManager(apiURL, GetAuthToken(c), time.Minute*60)
 	if err != nil {
-		api.LogError(c, err, eh.FileOpenError)(http.StatusBadRequest)
+		api.LogError(c, err, eh.IPFSConnectionError)(http.StatusBadRequest)
 		return
 	}
-	fileBytes, err := ioutil.ReadAll(file)
+	file, err := fileHandler.Open()
 	if err != nil {
-		Fail(c, err)
+		api.LogError(c, err, eh.FileOpenError)(http.StatusBadRequest)
 		return
 	}
-	hash, err := api.ipfs.Add(bytes.NewReader(fileBytes), ipfsapi.OnlyHash(true))
+	defer file.Close()
+	// hash, scan, optionally encrypt, and add the file in a single pass
+	passphrase := html.UnescapeString(c.PostForm("passphrase"))
+	resp, err := api.addStream(ipfsManager, file, passphrase)
 	if err != nil {
-		api.LogError(c, err, eh.IPFSAddError)(http.StatusInternalServerError)
+		api.failStream(c, err)
 		return
 	}
-	upload, err := api.upm.FindUploadByHashAndUserAndNetwork(username, hash, forms["network_name"])
-	if err == nil || upload != nil {
-		Respond(c, http.StatusBadRequest, gin.H{"response": alreadyUploadedMessage})
-		return
-	}
-	var reader io.Reader
-	// encrypt file if passphrase is given
-	if c.PostForm("passphrase") != "" {
-		// html decode strings
-		decodedPassPhrase := html.UnescapeString(c.PostForm("passphrase"))
-		encrypted, err := crypto.NewEncryptManager(decodedPassPhrase).Encrypt(file)
-		if err != nil {
-			api.LogError(c, err, eh.EncryptionError)(http.StatusBadRequest)
+	// encrypted uploads are never the same as previous uploads
+	if passphrase == "" {
+		upload, err := api.upm.FindUploadByHashAndUserAndNetwork(username, resp, forms["network_name"])
+		if err == nil || upload != nil {
+			Respond(c, http.StatusBadRequest, gin.H{"response": alreadyUploadedMessage})
 			return
 		}
-		reader = bytes.NewReader(encrypted)
-	} else {
-		reader = bytes.NewReader(fileBytes)
-	}
-	// format a url to connect to for private network
-	apiURL := api.GetIPFSEndpoint(forms["network_name"])
-	// connect to private ifps network
-	ipfsManager, err := rtfs.NewManager(apiURL, GetAuthToken(c), time.Minute*60)
-	if err != nil {
-		api.LogError(c, err, eh.IPFSConnectionError)(http.StatusBadRequest)
-		return
-	}
-	// add file to ipfs
-	resp, err := ipfsManager.Add(reader)
-	if err != nil {
-		api.LogError(c, err, eh.IPFSAddError)(http.StatusBadRequest)
-		return
 	}
 	// if this was an encrypted upload we need to update the encrypted upload table
 	// ipfs cluster pin handles updating the regular uploads table
-	if c.PostForm("passphrase") != "" {
+	if passphrase != "" {
 		if _, err := api.ue.NewUpload(username, fileHandler.Filename, "public", resp); err != nil {
 			api.LogError(c, err, eh.DatabaseUpdateError)(http.StatusBadRequest)
 			return
 		}
 	}
-	upload, err = api.upm.FindUploadByHashAndUserAndNetwork(
+	upload, err := api.upm.FindUploadByHashAndUserAndNetwork(
 		username,
 		resp,
 		forms["network_name"],
@@ -0,0 +1,272 @@
+package v2
+
+import (
+	"errors"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/eh"
+	"github.com/RTradeLtd/Temporal/share"
+	"github.com/RTradeLtd/Temporal/utils"
+	"github.com/RTradeLtd/gorm"
+	"github.com/gin-gonic/gin"
+	gocid "github.com/ipfs/go-cid"
+)
+
+const (
+	// shareExpiry is the default, and shareMaxExpiry the maximum number of hours a share link is valid for
+	shareExpiry    = 24 * 7
+	shareMaxExpiry = 24 * 90
+)
+
+// createShareLink is used to create an expiring link sharing content the authenticated user has
+// uploaded with people who don't have an account. Links may be limited to a number of downloads,
+// and protected by a password. When given a passphrase, encrypted content is decrypted as it is
+// downloaded through the link, with the passphrase sealed while it is stored
+func (api *API) createShareLink(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	forms, missingField := api.extractPostForms(c, "hash")
+	if missingField != "" {
+		FailWithMissingField(c, missingField)
+		return
+	}
+	if _, err := gocid.Decode(forms["hash"]); err != nil {
+		Fail(c, err)
+		return
+	}
+	networkName := c.PostForm("network_name")
+	if networkName == "" {
+		networkName = "public"
+	} else if networkName != "public" {
+		if err := CheckAccessForPrivateNetwork(username, networkName, api.dbm.DB); err != nil {
+			api.LogError(c, err, eh.PrivateNetworkAccessError)(http.StatusBadRequest)
+			return
+		}
+	}
+	// only content the user has uploaded may be shared
+	if _, err := api.upm.FindUploadByHashAndUserAndNetwork(username, forms["hash"], networkName); err != nil {
+		api.LogError(c, err, eh.UploadSearchError)(http.StatusNotFound)
+		return
+	}
+	hours := int64(shareExpiry)
+	if form := c.PostForm("expiry"); form != "" {
+		if hours, err = strconv.ParseInt(form, 10, 64); err != nil || hours < 1 || hours > shareMaxExpiry {
+			FailWithBadRequest(c, "expiry must be between 1 and "+strconv.Itoa(shareMaxExpiry)+" hours")
+			return
+		}
+	}
+	var maxDownloads int64
+	if form := c.PostForm("max_downloads"); form != "" {
+		if maxDownloads, err = strconv.ParseInt(form, 10, 64); err != nil || maxDownloads < 0 {
+			FailWithBadRequest(c, "max_downloads must be a positive integer")
+			return
+		}
+	}
+	// files are downloaded by name, without any directories
+	fileName := c.PostForm("file_name")
+	if fileName != "" {
+		fileName = path.Base(fileName)
+	}
+	link, token, err := api.shares.NewLink(username, share.Options{
+		Hash:         forms["hash"],
+		NetworkName:  networkName,
+		FileName:     fileName,
+		ExpiresAt:    time.Now().Add(time.Hour * time.Duration(hours)),
+		MaxDownloads: maxDownloads,
+		Password:     c.PostForm("password"),
+		Passphrase:   html.UnescapeString(c.PostForm("passphrase")),
+	})
+	if err != nil {
+		api.LogError(c, err, eh.ShareLinkCreationError)(http.StatusInternalServerError)
+		return
+	}
+	api.l.Infow("share link created", "user", username, "link", link.ID, "hash", link.Hash)
+	Respond(c, http.StatusOK, gin.H{"response": gin.H{
+		"id":         link.ID,
+		"url":        "/v2/shared/" + token,
+		"token":      token,
+		"expires_at": link.ExpiresAt,
+	}})
+}
+
+// listShareLinks is used to list the share links of the authenticated user
+func (api *API) listShareLinks(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	links, err := api.shares.FindLinksByUserName(username)
+	if err != nil {
+		api.LogError(c, err, eh.ShareLinkSearchError)(http.StatusInternalServerError)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": links})
+}
+
+// revokeShareLink is used to revoke a share link of the authenticated user, preventing any further downloads
+func (api *API) revokeShareLink(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		FailWithBadRequest(c, "id must be a positive integer")
+		return
+	}
+	if _, err := api.shares.FindLinkByUserNameAndID(username, uint(id)); err != nil {
+		api.LogError(c, err, eh.ShareLinkSearchError)(http.StatusNotFound)
+		return
+	}
+	if _, err := api.shares.Revoke(username, uint(id)); err != nil {
+		api.LogError(c, err, eh.ShareLinkRevokeError)(http.StatusInternalServerError)
+		return
+	}
+	api.l.Infow("share link revoked", "user", username, "link", id)
+	Respond(c, http.StatusOK, gin.H{"response": "share link revoked"})
+}
+
+// getShareLinkAccesses is used to retrieve the most recent attempts to download a share link of the authenticated user
+func (api *API) getShareLinkAccesses(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		FailWithBadRequest(c, "id must be a positive integer")
+		return
+	}
+	limit := 100
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 {
+			FailWithBadRequest(c, "limit must be a positive integer")
+			return
+		}
+	}
+	if _, err := api.shares.FindLinkByUserNameAndID(username, uint(id)); err != nil {
+		api.LogError(c, err, eh.ShareLinkSearchError)(http.StatusNotFound)
+		return
+	}
+	accesses, err := api.shares.FindAccessesByLink(username, uint(id), limit)
+	if err != nil {
+		api.LogError(c, err, eh.ShareLinkSearchError)(http.StatusInternalServerError)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": accesses})
+}
+
+// downloadSharedContent is used to download the content shared by a link, without authentication.
+// The password of protected links is provided as the password post form, or query parameter.
+// Every attempt to download a link is recorded in its access log, including those which are denied
+func (api *API) downloadSharedContent(c *gin.Context) {
+	link, err := api.shares.FindLinkByToken(c.Param("token"))
+	if err == gorm.ErrRecordNotFound {
+		Fail(c, errors.New("share link not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		api.LogError(c, err, eh.ShareLinkSearchError)(http.StatusInternalServerError)
+		return
+	}
+	access := &share.Access{
+		LinkID:    link.ID,
+		UserName:  link.UserName,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+	defer func() {
+		if err := api.shares.RecordAccess(access); err != nil {
+			api.l.Errorw("failed to record share link access", "error", err.Error(), "link", link.ID)
+		}
+	}()
+	// deny is used to fail the request, recording why access was denied
+	deny := func(err error, message string, status int) {
+		access.Reason = err.Error()
+		api.LogError(c, err, message, "link", link.ID)(status)
+	}
+	switch err := api.shares.Authorize(link, downloadParam(c, "password"), time.Now()); err {
+	case nil:
+	case share.ErrInvalidPassword:
+		deny(err, err.Error(), http.StatusUnauthorized)
+		return
+	default:
+		deny(err, err.Error(), http.StatusGone)
+		return
+	}
+	// access to private networks is checked on every download, so links stop working once it is revoked
+	if link.NetworkName != "public" {
+		if err := CheckAccessForPrivateNetwork(link.UserName, link.NetworkName, api.dbm.DB); err != nil {
+			deny(err, eh.PrivateNetworkAccessError, http.StatusForbidden)
+			return
+		}
+	}
+	sh, err := api.networkShell(c, link.UserName, link.NetworkName)
+	if err != nil {
+		deny(err, eh.IPFSConnectionError, http.StatusInternalServerError)
+		return
+	}
+	stat, err := statPath(c.Request.Context(), sh, "/ipfs/"+link.Hash)
+	if err != nil {
+		deny(err, eh.IPFSObjectStatError, http.StatusBadRequest)
+		return
+	}
+	if stat.Type == "directory" {
+		deny(errors.New("shared content is a directory"), "shared content is a directory", http.StatusBadRequest)
+		return
+	}
+	size := stat.Size
+	var passphrase string
+	if link.Encrypted() {
+		if passphrase, err = api.shares.Passphrase(link); err != nil {
+			deny(err, eh.ShareLinkSearchError, http.StatusInternalServerError)
+			return
+		}
+		if size < utils.EncryptionOverhead {
+			deny(errors.New("content is not encrypted"), "content is not encrypted", http.StatusBadRequest)
+			return
+		}
+		size -= utils.EncryptionOverhead
+	}
+	if err := api.shares.CountDownload(link); err == share.ErrDownloadLimit {
+		deny(err, err.Error(), http.StatusGone)
+		return
+	} else if err != nil {
+		deny(err, eh.ShareLinkSearchError, http.StatusInternalServerError)
+		return
+	}
+	var content io.ReadCloser
+	if passphrase == "" {
+		content, err = catRange(c.Request.Context(), sh, link.Hash, 0, size)
+	} else {
+		content, err = catDecrypted(c.Request.Context(), sh, link.Hash, passphrase, size, 0, size)
+	}
+	if err != nil {
+		deny(err, eh.IPFSCatError, http.StatusBadRequest)
+		return
+	}
+	defer content.Close()
+	access.Granted = true
+	contentType := "application/octet-stream"
+	headers := map[string]string{"Cache-Control": "no-store"}
+	if link.FileName != "" {
+		if ext := mime.TypeByExtension(path.Ext(link.FileName)); ext != "" {
+			contentType = ext
+		}
+		headers["Content-Disposition"] = mime.FormatMediaType("attachment", map[string]string{"filename": link.FileName})
+	}
+	api.l.Infow("shared content download served", "user", link.UserName, "link", link.ID)
+	c.DataFromReader(http.StatusOK, size, contentType, content, headers)
+}
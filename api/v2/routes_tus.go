@@ -0,0 +1,258 @@
+package v2
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/RTradeLtd/Temporal/eh"
+	"github.com/RTradeLtd/Temporal/tus"
+	"github.com/c2h5oh/datasize"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// tusVersion is the version of the tus protocol we support
+	tusVersion = "1.0.0"
+	// tusExtensions are the extensions of the tus protocol we support
+	tusExtensions = "creation,termination,expiration"
+	// tusContentType is the content type of chunks sent to an upload
+	tusContentType = "application/offset+octet-stream"
+)
+
+// tusResumable is a middleware used to ensure clients making resumable
+// uploads speak the same version of the tus protocol as us
+func tusResumable(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	// clients discover the versions we support through options requests
+	if c.Request.Method == http.MethodOptions {
+		return
+	}
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		FailWithMessage(c, "unsupported tus version", http.StatusPreconditionFailed)
+		c.Abort()
+	}
+}
+
+// getUploadOptions is used to describe the features of the tus protocol we support
+func (api *API) getUploadOptions(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(api.uploads.MaxSize(), 10))
+	c.Status(http.StatusNoContent)
+}
+
+// createUpload is used to create a resumable upload to the public network. The
+// Upload-Metadata header must contain the hold_time of the upload, and may contain
+// a filename, and a passphrase used to encrypt the upload once it is complete
+func (api *API) createUpload(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		FailWithBadRequest(c, "Upload-Length must be a positive integer")
+		return
+	}
+	metadata, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	if _, exists := metadata["hold_time"]; !exists {
+		FailWithMissingField(c, "hold_time")
+		return
+	}
+	if _, err := api.validateHoldTime(username, metadata["hold_time"]); err != nil {
+		Fail(c, err)
+		return
+	}
+	// validate the size of upload is within limits
+	if err := api.FileSizeCheck(size); err != nil {
+		Fail(c, err, http.StatusRequestEntityTooLarge)
+		return
+	}
+	// validate if they can upload an object of this size
+	if err := api.usage.CanUpload(username, uint64(size)/datasize.GB.Bytes()); err != nil {
+		api.LogError(c, err, eh.CantUploadError)(http.StatusBadRequest)
+		return
+	}
+	if metadata["passphrase"] != "" {
+		if err := api.validateEncryptedSize(username, size); err != nil {
+			Fail(c, err)
+			return
+		}
+	}
+	upload, err := api.uploads.Create(username, size, metadata)
+	if err == tus.ErrTooLarge {
+		Fail(c, err, http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		api.LogError(c, err, eh.UploadCreationError)(http.StatusInternalServerError)
+		return
+	}
+	api.l.Infow("resumable upload created", "user", username, "upload", upload.ID, "size", size)
+	c.Header("Location", path.Join(c.Request.URL.Path, upload.ID))
+	c.Header("Upload-Expires", api.uploads.Expires(upload).UTC().Format(http.TimeFormat))
+	Respond(c, http.StatusCreated, gin.H{"response": upload.ID})
+}
+
+// getUploadOffset is used to retrieve the offset a resumable upload should be resumed from
+func (api *API) getUploadOffset(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	upload, err := api.uploads.Get(username, c.Param("id"))
+	if err == tus.ErrNotFound {
+		Fail(c, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		api.LogError(c, err, eh.UploadSearchError)(http.StatusInternalServerError)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	c.Header("Upload-Expires", api.uploads.Expires(upload).UTC().Format(http.TimeFormat))
+	c.Status(http.StatusOK)
+}
+
+// writeUpload is used to append a chunk to a resumable upload. Once all of its content
+// has been received, the upload is added to the public network, and charged for the same
+// as a simple upload, responding with the hash of the upload. Should this fail, such as
+// from a lack of credits, the client may retry by sending an empty chunk at the final offset
+func (api *API) writeUpload(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	if c.ContentType() != tusContentType {
+		FailWithMessage(c, "Content-Type must be "+tusContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		FailWithBadRequest(c, "Upload-Offset must be a positive integer")
+		return
+	}
+	id := c.Param("id")
+	upload, err := api.uploads.Write(username, id, offset, c.Request.Body)
+	switch err {
+	case nil:
+	case tus.ErrNotFound:
+		Fail(c, err, http.StatusNotFound)
+		return
+	case tus.ErrOffsetMismatch:
+		Fail(c, err, http.StatusConflict)
+		return
+	case tus.ErrLocked:
+		Fail(c, err, http.StatusLocked)
+		return
+	case tus.ErrComplete:
+		// a previous attempt to process the upload failed, so retry it
+		if upload, err = api.uploads.Get(username, id); err != nil {
+			api.LogError(c, err, eh.UploadSearchError)(http.StatusInternalServerError)
+			return
+		}
+		if offset != upload.Size {
+			Fail(c, tus.ErrOffsetMismatch, http.StatusConflict)
+			return
+		}
+	default:
+		// the content received before the chunk failed is kept, so the client may resume
+		api.LogError(c, err, eh.UploadWriteError, "upload", id)(http.StatusInternalServerError)
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Expires", api.uploads.Expires(upload).UTC().Format(http.TimeFormat))
+	if !upload.Complete() {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	// hold times are validated again, as the tier of the user may have changed since creation
+	holdTime, err := api.validateHoldTime(username, upload.Metadata["hold_time"])
+	if err != nil {
+		Fail(c, err)
+		return
+	}
+	var hash string
+	err = api.uploads.Complete(username, id, func(upload *tus.Upload, content io.Reader) error {
+		hash, err = api.addPublicFile(
+			c, username, upload.Metadata["filename"], content,
+			upload.Size, holdTime, upload.Metadata["passphrase"],
+		)
+		// retrying an upload the user has stored before would never succeed, so remove it
+		if err == errAlreadyUploaded {
+			return nil
+		}
+		return err
+	})
+	switch {
+	case err == tus.ErrLocked:
+		Fail(c, err, http.StatusLocked)
+		return
+	case err == tus.ErrNotFound:
+		Fail(c, err, http.StatusNotFound)
+		return
+	case err != nil:
+		api.failStream(c, err)
+		return
+	case hash == "":
+		Respond(c, http.StatusBadRequest, gin.H{"response": alreadyUploadedMessage})
+		return
+	}
+	api.l.Infow("resumable ipfs file upload processed", "user", username, "upload", id)
+	Respond(c, http.StatusOK, gin.H{"response": hash})
+}
+
+// removeUpload is used to terminate a resumable upload, removing any content received
+func (api *API) removeUpload(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	if err := api.uploads.Remove(username, c.Param("id")); err == tus.ErrNotFound {
+		Fail(c, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		api.LogError(c, err, eh.UploadRemoveError)(http.StatusInternalServerError)
+		return
+	}
+	api.l.Infow("resumable upload terminated", "user", username, "upload", c.Param("id"))
+	c.Status(http.StatusNoContent)
+}
+
+// parseUploadMetadata is used to decode the Upload-Metadata header of a resumable upload,
+// a comma separated list of keys, each followed by a space and its base64 encoded value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, " ", 2)
+		// values are optional, in which case the key is recorded without one
+		if len(parts) == 1 {
+			metadata[parts[0]] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("metadata %s is not base64 encoded", parts[0])
+		}
+		metadata[parts[0]] = string(value)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,31 @@
+package v2
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseUploadMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"Empty", "", map[string]string{}, false},
+		{"Pairs", "hold_time MQ==, filename dGVzdC50eHQ=", map[string]string{"hold_time": "1", "filename": "test.txt"}, false},
+		{"KeyOnly", "hold_time MQ==,encrypted", map[string]string{"hold_time": "1", "encrypted": ""}, false},
+		{"NotBase64", "hold_time 1!", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseUploadMetadata(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseUploadMetadata() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseUploadMetadata() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
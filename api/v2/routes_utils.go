@@ -1,15 +1,17 @@
 package v2
 
 import (
-	"bytes"
 	"context"
 	"errors"
+	"html"
+	"io"
 	"net/http"
 	"time"
 
 	"github.com/RTradeLtd/Temporal/eh"
-	"github.com/RTradeLtd/crypto/v2"
+	"github.com/RTradeLtd/Temporal/utils"
 	mnemonics "github.com/RTradeLtd/entropy-mnemonics"
+	ipfsapi "github.com/RTradeLtd/go-ipfs-api"
 	pb "github.com/RTradeLtd/grpc/krab"
 	"github.com/RTradeLtd/rtfs/v2"
 	"github.com/RTradeLtd/rtfs/v2/beam"
@@ -75,16 +77,21 @@ func (api *API) beamContent(c *gin.Context) {
 	}
 	// perform optional encryption of content
 	if passphrase := c.PostForm("passphrase"); passphrase != "" {
-		// encrypt the file file
-		data, err := net1Conn.Cat(forms["content_hash"])
+		// stream the content from the source network, rather than holding it in memory
+		sh := ipfsapi.NewShell(source)
+		if forms["source_network"] != "public" {
+			sh = ipfsapi.NewDirectShell(source).WithAuthorization(GetAuthToken(c))
+		}
+		content, err := sh.Cat(forms["content_hash"])
 		if err != nil {
 			api.LogError(c, err, eh.IPFSCatError)(http.StatusBadRequest)
 			return
 		}
+		defer content.Close()
 		// re-add the encrypted content to the source network
-		newCid, err := net1Conn.Add(bytes.NewReader(data))
+		newCid, err := api.addStream(net1Conn, content, html.UnescapeString(passphrase))
 		if err != nil {
-			api.LogError(c, err, eh.IPFSAddError)(http.StatusBadRequest)
+			api.failStream(c, err)
 			return
 		}
 		// update the content hash to beam
@@ -170,7 +177,10 @@ func (api *API) exportKey(c *gin.Context) {
 	Respond(c, http.StatusOK, gin.H{"response": phrase})
 }
 
-// downloadContentHash is used to download content from  a private ipfs network
+// downloadContentHash is used to download content from the public, or a private ipfs network.
+// Content is streamed from ipfs as it is sent, rather than being held in memory, and requests
+// for a single byte range of the content are supported. As content is immutable, its hash is
+// used as the ETag. Content encrypted by Temporal is decrypted as it is streamed
 func (api *API) downloadContentHash(c *gin.Context) {
 	username, err := GetAuthenticatedUserFromContext(c)
 	if err != nil {
@@ -185,28 +195,23 @@ func (api *API) downloadContentHash(c *gin.Context) {
 		return
 	}
 	// get the network name, default to public if not specified
-	networkName := c.PostForm("network_name")
-	var manager rtfs.Manager
+	networkName := downloadParam(c, "network_name")
 	if networkName == "" {
 		networkName = "public"
-		manager = api.ipfs
 	} else if networkName != "public" {
 		// validate user access to network
 		if err := CheckAccessForPrivateNetwork(username, networkName, api.dbm.DB); err != nil {
 			api.LogError(c, err, eh.PrivateNetworkAccessError)(http.StatusBadRequest)
 			return
 		}
-		// retrieve api url
-		apiURL := api.GetIPFSEndpoint(networkName)
-		// initialize our connection to IPFS
-		manager, err = rtfs.NewManager(apiURL, GetAuthToken(c), time.Minute*60)
-		if err != nil {
-			api.LogError(c, err, eh.IPFSConnectionError)(http.StatusBadRequest)
-			return
-		}
+	}
+	sh, err := api.networkShell(c, username, networkName)
+	if err != nil {
+		api.LogError(c, err, eh.IPFSConnectionError)(http.StatusBadRequest)
+		return
 	}
 	// fetch the specified content type from the user
-	contentType := c.PostForm("content_type")
+	contentType := downloadParam(c, "content_type")
 	// if not specified, provide a default
 	if contentType == "" {
 		contentType = "application/octet-stream"
@@ -214,33 +219,9 @@ func (api *API) downloadContentHash(c *gin.Context) {
 
 	// get any extra headers the user might want
 	exHeaders := c.PostFormArray("extra_headers")
-
-	// read the contents of the file
-	contents, err := manager.Cat(contentHash)
-	if err != nil {
-		api.LogError(c, err, eh.IPFSCatError)(http.StatusBadRequest)
-		return
+	if len(exHeaders) == 0 {
+		exHeaders = c.QueryArray("extra_headers")
 	}
-	reader := bytes.NewReader(contents)
-	// get the size of hte file in bytes
-	stats, err := manager.Stat(contentHash)
-	if err != nil {
-		api.LogError(c, err, eh.IPFSObjectStatError)(http.StatusBadRequest)
-		return
-	}
-	size := stats.CumulativeSize
-	// decrypt Temporal-encrypted content if key is provided
-	decryptKey := c.PostForm("decrypt_key")
-	if decryptKey != "" {
-		decrypted, err := crypto.NewEncryptManager(decryptKey).Decrypt(reader)
-		if err != nil {
-			Fail(c, err)
-			return
-		}
-		size = len(decrypted)
-		reader = bytes.NewReader(decrypted)
-	}
-
 	// parse extra headers if there are any
 	extraHeaders := make(map[string]string)
 	// only process if there is actual data to process
@@ -261,6 +242,56 @@ func (api *API) downloadContentHash(c *gin.Context) {
 		}
 	}
 
-	api.l.Infow("private ipfs content download served", "user", username)
-	c.DataFromReader(200, int64(size), contentType, reader, extraHeaders)
+	// the client already has the content if it has a copy matching its hash
+	if notModified(c, contentHash) {
+		return
+	}
+	// get the size of the file in bytes
+	stat, err := statPath(c.Request.Context(), sh, "/ipfs/"+contentHash)
+	if err != nil {
+		api.LogError(c, err, eh.IPFSObjectStatError)(http.StatusBadRequest)
+		return
+	}
+	if stat.Type == "directory" {
+		FailWithBadRequest(c, "content hash is a directory")
+		return
+	}
+	size := stat.Size
+	// Temporal-encrypted content is larger than the content it decrypts to
+	decryptKey := downloadParam(c, "decrypt_key")
+	if decryptKey != "" {
+		if size < utils.EncryptionOverhead {
+			FailWithBadRequest(c, "content is not encrypted")
+			return
+		}
+		size -= utils.EncryptionOverhead
+	}
+	status, offset, length, ok := requestedRange(c, contentHash, size, extraHeaders)
+	if !ok {
+		return
+	}
+
+	var content io.ReadCloser
+	if decryptKey == "" {
+		content, err = catRange(c.Request.Context(), sh, contentHash, offset, length)
+	} else {
+		content, err = catDecrypted(c.Request.Context(), sh, contentHash, decryptKey, size, offset, length)
+	}
+	if err != nil {
+		api.LogError(c, err, eh.IPFSCatError)(http.StatusBadRequest)
+		return
+	}
+	defer content.Close()
+
+	api.l.Infow("ipfs content download served", "user", username, "network", networkName)
+	c.DataFromReader(status, length, contentType, content, extraHeaders)
+}
+
+// downloadParam returns the value of a download parameter, which is provided as
+// a post form, or as a query parameter when downloading with a get request
+func downloadParam(c *gin.Context, name string) string {
+	if value, exists := c.GetPostForm(name); exists {
+		return value
+	}
+	return c.Query(name)
 }
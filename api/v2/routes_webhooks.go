@@ -0,0 +1,123 @@
+package v2
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/RTradeLtd/Temporal/eh"
+	"github.com/RTradeLtd/Temporal/webhooks"
+	"github.com/gin-gonic/gin"
+)
+
+// createWebhook is used to register a webhook endpoint, returning the secret
+// used to sign its payloads. The secret is only ever returned by this call
+func (api *API) createWebhook(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	forms, missingField := api.extractPostForms(c, "url")
+	if missingField != "" {
+		FailWithMissingField(c, missingField)
+		return
+	}
+	if err := webhooks.ValidateURL(forms["url"], dev); err != nil {
+		FailWithBadRequest(c, err.Error())
+		return
+	}
+	// subscribe to all events if none are specified
+	events := webhooks.Events
+	if names := c.PostFormArray("events"); len(names) > 0 {
+		events = nil
+		for _, name := range names {
+			event := webhooks.Event(name)
+			if !event.Valid() {
+				FailWithBadRequest(c, name+" is not a valid event")
+				return
+			}
+			events = append(events, event)
+		}
+	}
+	endpoint, err := api.webhooks.NewEndpoint(username, forms["url"], events)
+	if err != nil {
+		api.LogError(c, err, eh.WebhookCreationError)(http.StatusBadRequest)
+		return
+	}
+	api.l.Infow("webhook registered", "user", username, "endpoint", endpoint.ID)
+	Respond(c, http.StatusOK, gin.H{"response": gin.H{
+		"webhook": endpoint,
+		"secret":  endpoint.Secret,
+	}})
+}
+
+// listWebhooks is used to list the webhook endpoints of the authenticated user
+func (api *API) listWebhooks(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	endpoints, err := api.webhooks.FindEndpointsByUserName(username)
+	if err != nil {
+		api.LogError(c, err, eh.WebhookSearchError)(http.StatusInternalServerError)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": endpoints})
+}
+
+// deleteWebhook is used to remove a webhook endpoint. Pending deliveries to it are discarded
+func (api *API) deleteWebhook(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		FailWithBadRequest(c, "id must be a positive integer")
+		return
+	}
+	if _, err := api.webhooks.FindEndpointByUserNameAndID(username, uint(id)); err != nil {
+		api.LogError(c, err, eh.WebhookSearchError)(http.StatusNotFound)
+		return
+	}
+	if err := api.webhooks.DeleteEndpoint(username, uint(id)); err != nil {
+		api.LogError(c, err, eh.WebhookDeleteError)(http.StatusInternalServerError)
+		return
+	}
+	api.l.Infow("webhook removed", "user", username, "endpoint", id)
+	Respond(c, http.StatusOK, gin.H{"response": "webhook removed"})
+}
+
+// getWebhookDeliveries is used to retrieve the most recent delivery attempts to a webhook endpoint
+func (api *API) getWebhookDeliveries(c *gin.Context) {
+	username, err := GetAuthenticatedUserFromContext(c)
+	if err != nil {
+		api.LogError(c, err, eh.NoAPITokenError)(http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		FailWithBadRequest(c, "id must be a positive integer")
+		return
+	}
+	limit := 100
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 {
+			FailWithBadRequest(c, "limit must be a positive integer")
+			return
+		}
+	}
+	if _, err := api.webhooks.FindEndpointByUserNameAndID(username, uint(id)); err != nil {
+		api.LogError(c, err, eh.WebhookSearchError)(http.StatusNotFound)
+		return
+	}
+	deliveries, err := api.webhooks.FindDeliveriesByEndpoint(username, uint(id), limit)
+	if err != nil {
+		api.LogError(c, err, eh.WebhookSearchError)(http.StatusInternalServerError)
+		return
+	}
+	Respond(c, http.StatusOK, gin.H{"response": deliveries})
+}
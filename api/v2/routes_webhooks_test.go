@@ -0,0 +1,119 @@
+package v2
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/RTradeLtd/Temporal/mocks"
+	"github.com/RTradeLtd/Temporal/webhooks"
+	"github.com/RTradeLtd/config/v2"
+)
+
+func Test_API_Routes_Webhooks(t *testing.T) {
+	// load configuration
+	cfg, err := config.LoadConfig("../../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := loadDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// setup fake mock clients
+	fakeLens := &mocks.FakeLensV2Client{}
+	fakeOrch := &mocks.FakeServiceClient{}
+	fakeSigner := &mocks.FakeSignerClient{}
+
+	api, _, err := setupAPI(fakeLens, fakeOrch, fakeSigner, cfg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// test webhook creation
+	// /v2/account/webhooks
+	var created struct {
+		Code     int `json:"code"`
+		Response struct {
+			Webhook webhooks.Endpoint `json:"webhook"`
+			Secret  string            `json:"secret"`
+		} `json:"response"`
+	}
+	urlValues := url.Values{}
+	urlValues.Add("url", "https://example.com/hook")
+	urlValues.Add("events", string(webhooks.PinSucceeded))
+	urlValues.Add("events", string(webhooks.PinFailed))
+	if err := sendRequest(
+		api, "POST", "/v2/account/webhooks", 200, nil, urlValues, &created,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if created.Response.Secret == "" {
+		t.Fatal("expected webhook secret to be returned")
+	}
+	id := fmt.Sprint(created.Response.Webhook.ID)
+	defer db.Unscoped().Delete(&webhooks.Endpoint{}, created.Response.Webhook.ID)
+	// bad url
+	urlValues = url.Values{}
+	urlValues.Add("url", "ftp://example.com/hook")
+	if err := sendRequest(
+		api, "POST", "/v2/account/webhooks", 400, nil, urlValues, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	// bad event
+	urlValues = url.Values{}
+	urlValues.Add("url", "https://example.com/hook")
+	urlValues.Add("events", "notanevent")
+	if err := sendRequest(
+		api, "POST", "/v2/account/webhooks", 400, nil, urlValues, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// test webhook listing
+	// /v2/account/webhooks
+	var interfaceAPIResp interfaceAPIResponse
+	if err := sendRequest(
+		api, "GET", "/v2/account/webhooks", 200, nil, nil, &interfaceAPIResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// test delivery log
+	// /v2/account/webhooks/:id/deliveries
+	if err := sendRequest(
+		api, "GET", "/v2/account/webhooks/"+id+"/deliveries", 200, nil, nil, &interfaceAPIResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendRequest(
+		api, "GET", "/v2/account/webhooks/"+id+"/deliveries?limit=0", 400, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendRequest(
+		api, "GET", "/v2/account/webhooks/999999999/deliveries", 404, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// test webhook removal
+	// /v2/account/webhooks/:id
+	if err := sendRequest(
+		api, "DELETE", "/v2/account/webhooks/"+id, 200, nil, nil, &interfaceAPIResp,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendRequest(
+		api, "DELETE", "/v2/account/webhooks/"+id, 404, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendRequest(
+		api, "DELETE", "/v2/account/webhooks/notanid", 400, nil, nil, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+}
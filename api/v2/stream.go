@@ -0,0 +1,311 @@
+package v2
+
+import (
+	"context"
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/RTradeLtd/Temporal/eh"
+	"github.com/RTradeLtd/Temporal/queue"
+	"github.com/RTradeLtd/Temporal/utils"
+	"github.com/RTradeLtd/database/v2/models"
+	ipfsapi "github.com/RTradeLtd/go-ipfs-api"
+	"github.com/RTradeLtd/gorm"
+	"github.com/RTradeLtd/rtfs/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// addStream is used to add r to ipfs through im in a single pass, without holding it in memory.
+// As r is read it is scanned for viruses, and encrypted with passphrase when one is given. The
+// scanner and ipfs read from the same pipe, so the slower of the two limits how quickly r is
+// read. Content is only pinned once it passes the scan, so infected content is garbage collected
+func (api *API) addStream(im rtfs.Manager, r io.Reader, passphrase string) (string, error) {
+	pr, pw := io.Pipe()
+	scanned := make(chan error, 1)
+	go func() {
+		err := api.clam.Scan(pr)
+		// drain anything left unread by the scanner, so the upload is never blocked on it
+		io.Copy(ioutil.Discard, pr)
+		scanned <- err
+	}()
+	var (
+		reader = io.TeeReader(r, pw)
+		err    error
+	)
+	if passphrase != "" {
+		if reader, err = utils.NewEncryptReader(reader, passphrase); err != nil {
+			pw.CloseWithError(err)
+			<-scanned
+			return "", &txError{err, eh.EncryptionError, http.StatusBadRequest}
+		}
+	}
+	hash, err := im.Add(reader, ipfsapi.Pin(false))
+	// closing with a nil error signals the scanner has reached the end of the content
+	pw.CloseWithError(err)
+	if scanErr := <-scanned; scanErr == utils.ErrVirusFound {
+		return "", &txError{scanErr, eh.VirusFoundError, http.StatusBadRequest}
+	} else if scanErr != nil && err == nil {
+		return "", &txError{scanErr, eh.VirusScanError, http.StatusInternalServerError}
+	}
+	if err != nil {
+		return "", &txError{err, eh.IPFSAddError, http.StatusBadRequest}
+	}
+	if err := im.Pin(hash); err != nil {
+		return "", &txError{err, eh.IPFSPinError, http.StatusBadRequest}
+	}
+	return hash, nil
+}
+
+// errAlreadyUploaded is returned when a user adds unencrypted content they've uploaded before
+var errAlreadyUploaded = errors.New(alreadyUploadedMessage)
+
+// addPublicFile is used to add the file read from r to the public network in a single pass,
+// charge the user for storing it, and send it to the cluster to be pinned. It is shared
+// by simple, and resumable uploads. Users must be able to afford the full cost of the file
+// before it is added, as the deduplicated cost they're charged can only be calculated after
+func (api *API) addPublicFile(c *gin.Context, username, filename string, r io.Reader, size, holdTime int64, passphrase string) (_ string, err error) {
+	cost, err := utils.CalculateFileCost(username, holdTime, size, api.usage)
+	if err != nil {
+		return "", &txError{err, eh.CostCalculationError, http.StatusBadRequest}
+	}
+	if err := api.checkCredits(username, cost); err != nil {
+		return "", err
+	}
+	// hash, scan, optionally encrypt, and add the file in a single pass
+	hash, err := api.addStream(api.ipfs, r, passphrase)
+	if err != nil {
+		return "", err
+	}
+	// content which the user isn't charged for is removed from our node
+	defer func() {
+		if err != nil {
+			api.unpinUnused(hash)
+		}
+	}()
+	// encrypted uploads are never the same as previous uploads, while by this conditional
+	// if statement passing, it means the user has upload content matching this hash before,
+	// and we don't want to charge them so we should gracefully abort further processing
+	if passphrase == "" {
+		upload, err := api.upm.FindUploadByHashAndUserAndNetwork(username, hash, "public")
+		if err == nil || upload != nil {
+			return "", errAlreadyUploaded
+		}
+	}
+	api.l.Debug("file uploaded to ipfs")
+	// calculate cost of upload now the file has been added, charging only
+	// for data the user hasn't stored before
+	quote, err := api.quote(username, hash, size, holdTime)
+	if err != nil {
+		return "", &txError{err, eh.CostCalculationError, http.StatusBadRequest}
+	}
+	qp := queue.IPFSClusterPin{
+		CID:              hash,
+		NetworkName:      "public",
+		UserName:         username,
+		HoldTimeInMonths: holdTime,
+		Size:             size,
+		CreditCost:       quote.DeduplicatedCost,
+		JobID:            api.newJob(c, username, queue.IpfsClusterPinQueue, hash),
+	}
+	changes := []func(tx *gorm.DB) error{bill(username, quote.DeduplicatedCost, uint64(size), qp.JobID)}
+	// if this was an encrypted upload we need to update the encrypted upload table
+	// ipfs cluster pin handles updating the regular uploads table
+	if passphrase != "" {
+		changes = append(changes, func(tx *gorm.DB) error {
+			if _, err := models.NewEncryptedUploadManager(tx).NewUpload(username, filename, "public", hash); err != nil {
+				return &txError{err, eh.DatabaseUpdateError, http.StatusBadRequest}
+			}
+			return nil
+		})
+	}
+	// deduct credits, update their data usage, and send the pin message
+	if err := api.enqueue(queue.IpfsClusterPinQueue, qp, changes...); err != nil {
+		api.failJob(qp.JobID, err)
+		if _, ok := err.(*txError); !ok {
+			err = &txError{err, eh.QueuePublishError, http.StatusInternalServerError}
+		}
+		return "", err
+	}
+	return hash, nil
+}
+
+// unpinUnused is used to remove content added by a request which failed from our node, unless
+// it is stored by an upload. Failures are logged, as the content is only left pinned on our node
+func (api *API) unpinUnused(hash string) {
+	uploads, err := api.upm.FindUploadsByHash(hash)
+	if err != nil {
+		api.l.Errorw("failed to check for uploads of content", "hash", hash, "error", err.Error())
+		return
+	}
+	if len(uploads) > 0 {
+		return
+	}
+	resp, err := api.ipfs.CustomRequest(context.Background(), api.ipfs.NodeAddress(), "pin/rm", nil, hash)
+	if err == nil {
+		defer resp.Close()
+		err = resp.Error
+	}
+	if err != nil {
+		api.l.Errorw("failed to unpin content", "hash", hash, "error", err.Error())
+	}
+}
+
+// failStream is used to fail a request whose call to addStream, or addPublicFile returned an error
+func (api *API) failStream(c *gin.Context, err error) {
+	if te, ok := err.(*txError); ok {
+		api.LogError(c, te.err, te.message)(te.status)
+		return
+	}
+	api.LogError(c, err, eh.IPFSAddError)(http.StatusBadRequest)
+}
+
+// errRangeNotSatisfiable is returned when a requested range doesn't overlap the content
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// parseRange is used to parse the Range header of a request for content of size bytes, returning
+// the offset, and length of the requested range. Only single byte ranges are supported, so the
+// whole content is returned, with ok false, for other ranges as permitted by RFC 7233
+func parseRange(header string, size int64) (offset, length int64, ok bool, err error) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, size, false, nil
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, size, false, nil
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	// a suffix range requests the final bytes of the content
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, size, false, nil
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, suffix, true, nil
+	}
+	offset, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, size, false, nil
+	}
+	if offset >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < offset {
+			return 0, size, false, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return offset, end - offset + 1, true, nil
+}
+
+// contentStat describes the content at an ipfs path
+type contentStat struct {
+	Hash string
+	// Size is the size of the file in bytes, as opposed to the size of the objects making up the file
+	Size int64
+	Type string
+}
+
+// statPath is used to describe the content at an ipfs path, such as /ipfs/<hash>, or /ipns/<name>/<path>
+func statPath(ctx context.Context, sh *ipfsapi.Shell, p string) (*contentStat, error) {
+	var stat contentStat
+	if err := sh.Request("files/stat", p).Exec(ctx, &stat); err != nil {
+		return nil, err
+	}
+	return &stat, nil
+}
+
+// notModified is used to set the ETag of a response serving the content at hash, which is
+// immutable, responding with no content if the client already has a copy of the content
+func notModified(c *gin.Context, hash string) bool {
+	etag := `"` + hash + `"`
+	c.Header("ETag", etag)
+	if match := c.GetHeader("If-None-Match"); match == "*" || strings.Contains(match, etag) {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// requestedRange is used to determine the range of the content at hash, which is size bytes, to serve
+// in response to c. The Content-Range of partial responses is added to headers, while requests for
+// unsatisfiable ranges are failed, returning false. Ranges are only served if the content matches
+// the copy the client has part of
+func requestedRange(c *gin.Context, hash string, size int64, headers map[string]string) (status int, offset, length int64, ok bool) {
+	c.Header("Accept-Ranges", "bytes")
+	header := c.GetHeader("Range")
+	if ifRange := c.GetHeader("If-Range"); header == "" || (ifRange != "" && ifRange != `"`+hash+`"`) {
+		return http.StatusOK, 0, size, true
+	}
+	offset, length, partial, err := parseRange(header, size)
+	if err != nil {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%d", size))
+		Fail(c, err, http.StatusRequestedRangeNotSatisfiable)
+		return 0, 0, 0, false
+	}
+	if !partial {
+		return http.StatusOK, 0, size, true
+	}
+	headers["Content-Range"] = fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size)
+	return http.StatusPartialContent, offset, length, true
+}
+
+// catRange is used to stream length bytes of the file at hash, starting from offset. The
+// returned reader must be closed, which ends the request without reading any remaining content
+func catRange(ctx context.Context, sh *ipfsapi.Shell, hash string, offset, length int64) (io.ReadCloser, error) {
+	resp, err := sh.Request("cat", hash).Option("offset", offset).Option("length", length).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the response has already been closed when ipfs returns an error
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp.Output, nil
+}
+
+// catDecrypted is used to stream length bytes of the Temporal-encrypted file at hash, starting
+// from offset, decrypting it with passphrase. size is the size of the file once decrypted
+func catDecrypted(ctx context.Context, sh *ipfsapi.Shell, hash, passphrase string, size, offset, length int64) (io.ReadCloser, error) {
+	// the salt used to derive the key is stored after the encrypted content
+	saltReader, err := catRange(ctx, sh, hash, size+utils.EncryptionOverhead-utils.EncryptSaltLen, utils.EncryptSaltLen)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := ioutil.ReadAll(saltReader)
+	saltReader.Close()
+	if err != nil {
+		return nil, err
+	}
+	// read the encrypted block preceding the range, followed by the blocks of the range
+	start := utils.EncryptedOffset(offset)
+	content, err := catRange(ctx, sh, hash, start, offset-start+aes.BlockSize+length)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := utils.NewDecryptReader(content, passphrase, salt, offset)
+	if err != nil {
+		content.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(decrypted, length), content}, nil
+}
@@ -0,0 +1,38 @@
+package v2
+
+import "testing"
+
+func Test_parseRange(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		wantOffset  int64
+		wantLength  int64
+		wantPartial bool
+		wantErr     bool
+	}{
+		{"Bounded", "bytes=0-9", 0, 10, true, false},
+		{"Open", "bytes=90-", 90, 10, true, false},
+		{"Suffix", "bytes=-5", 95, 5, true, false},
+		{"SuffixBeyondStart", "bytes=-500", 0, 100, true, false},
+		{"EndBeyondSize", "bytes=50-500", 50, 50, true, false},
+		{"StartBeyondSize", "bytes=100-", 0, 0, false, true},
+		{"EmptySuffix", "bytes=-0", 0, 0, false, true},
+		// unsupported, or invalid ranges are ignored, returning the whole content
+		{"MultipleRanges", "bytes=0-1,5-6", 0, 100, false, false},
+		{"OtherUnit", "items=0-1", 0, 100, false, false},
+		{"EndBeforeStart", "bytes=9-0", 0, 100, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offset, length, partial, err := parseRange(tt.header, 100)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRange() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if offset != tt.wantOffset || length != tt.wantLength || partial != tt.wantPartial {
+				t.Fatalf("parseRange() = %v, %v, %v, want %v, %v, %v",
+					offset, length, partial, tt.wantOffset, tt.wantLength, tt.wantPartial)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package v2
 
 import (
+	"time"
+
 	"github.com/RTradeLtd/Temporal/queue"
 	"github.com/RTradeLtd/kaas/v2"
 	xss "github.com/dvwright/xss-mw"
@@ -22,6 +24,9 @@ var (
 type Options struct {
 	DebugLogging bool
 	DevMode      bool
+	// IdempotencyWindow is how long responses to requests made with an
+	// idempotency key are stored, defaulting to 24 hours
+	IdempotencyWindow time.Duration
 }
 
 // Clients is used to configure service clients we use
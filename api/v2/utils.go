@@ -11,8 +11,14 @@ import (
 	"strings"
 	"time"
 
+	"github.com/RTradeLtd/Temporal/billing"
 	"github.com/RTradeLtd/Temporal/eh"
+	"github.com/RTradeLtd/Temporal/ledger"
+	"github.com/RTradeLtd/Temporal/outbox"
+	"github.com/RTradeLtd/Temporal/queue"
+	"github.com/RTradeLtd/Temporal/utils"
 	"github.com/RTradeLtd/database/v2/models"
+	ipfsapi "github.com/RTradeLtd/go-ipfs-api"
 	"github.com/RTradeLtd/gorm"
 	"github.com/c2h5oh/datasize"
 	"github.com/gin-gonic/gin"
@@ -52,6 +58,24 @@ func (api *API) GetIPFSEndpoint(networkName string) string {
 	return api.cfg.Nexus.Host + ":" + api.cfg.Nexus.Delegator.Port + "/network/" + networkName
 }
 
+// networkShell is used to connect to the public network, or a private network on behalf of a
+// user, whose access to the network must already be checked. Private networks are authenticated
+// with the jwt of the request, or a short lived jwt issued for the user when the request was
+// authenticated by other means
+func (api *API) networkShell(c *gin.Context, username, networkName string) (*ipfsapi.Shell, error) {
+	if networkName == "" || networkName == "public" {
+		return ipfsapi.NewShell(api.cfg.IPFS.APIConnection.Host + ":" + api.cfg.IPFS.APIConnection.Port), nil
+	}
+	authToken := GetAuthToken(c)
+	if authToken == "" {
+		var err error
+		if authToken, err = api.generateUserJWTToken(username, time.Minute*5); err != nil {
+			return nil, err
+		}
+	}
+	return ipfsapi.NewDirectShell(api.GetIPFSEndpoint(networkName)).WithAuthorization(authToken), nil
+}
+
 // FileSizeCheck is used to check and validate the size of the uploaded file
 func (api *API) FileSizeCheck(size int64) error {
 	sizeInt, err := strconv.ParseInt(
@@ -89,6 +113,18 @@ func (api *API) generateEmailJWTToken(username, verificationString string) (stri
 	return verificationJWT.SignedString([]byte(api.cfg.API.JWT.Key))
 }
 
+// generateUserJWTToken is used to generate a short lived jwt authenticating a user, as issued on
+// login. This allows us to authenticate with private networks on behalf of users who authenticated
+// with us by other means, such as a signed gateway url
+func (api *API) generateUserJWTToken(username string, expiry time.Duration) (string, error) {
+	now := time.Now()
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"id":       username,
+		"exp":      now.Add(expiry).Unix(),
+		"orig_iat": now.Unix(),
+	}).SignedString([]byte(api.cfg.JWT.Key))
+}
+
 func (api *API) verifyEmailJWTToken(jwtString, username string) error {
 	// parse the jwt for a token
 	token, err := jwt.Parse(jwtString, func(token *jwt.Token) (interface{}, error) {
@@ -152,27 +188,97 @@ func (api *API) verifyEmailJWTToken(jwtString, username string) error {
 	return nil
 }
 
-// validateUserCredits is used to validate whether or not a user has enough credits to pay for an action
-// and if they do, it is deducted from their account
-func (api *API) validateUserCredits(username string, cost float64) error {
-	availableCredits, err := api.um.GetCreditsForUser(username)
+// validateUserCredits is used to validate whether or not a user has enough credits to pay for an action,
+// and is within their spending caps. If they are, it is deducted from their account, recording the charge
+// against reference
+func (api *API) validateUserCredits(username string, cost float64, reference string) error {
+	tx := api.dbm.DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := validateCredits(ledger.NewManager(tx), username, cost, reference); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	// top up the credits of the user if they have fallen below their threshold,
+	// without delaying the request on the payment
+	go api.autoTopUp(username)
+	return nil
+}
+
+// validateCredits is used to validate, and deduct the credits of a user using lm, allowing
+// credits to be deducted within a transaction. Charges exceeding the spending caps of the user
+// are rejected, while those crossing an alert threshold email the user through our outbox
+func validateCredits(lm *ledger.Manager, username string, cost float64, reference string) error {
+	if cost <= 0 {
+		return nil
+	}
+	alerts, err := billing.NewManager(lm.DB).Charge(username, cost, ledger.Charge, reference, time.Now())
 	if err != nil {
 		return err
 	}
-	if availableCredits < cost {
-		return errors.New(eh.InvalidBalanceError)
+	if len(alerts) == 0 {
+		return nil
 	}
-	if _, err := api.um.RemoveCredits(username, cost); err != nil {
+	user, err := models.NewUserManager(lm.DB).FindByUserName(username)
+	if err != nil {
 		return err
 	}
+	if !user.EmailEnabled {
+		return nil
+	}
+	for _, alert := range alerts {
+		subject, content := alert.Email(username)
+		if _, err := outbox.NewManager(lm.DB).Enqueue(queue.EmailSendQueue.String(), queue.EmailSend{
+			Subject:     subject,
+			Content:     content,
+			ContentType: "text/html",
+			UserNames:   []string{user.UserName},
+			Emails:      []string{user.EmailAddress},
+		}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// costQuote is the cost of storing content, both in full and deduplicated
+// against the content a user has previously uploaded
+type costQuote struct {
+	Size             int64   `json:"size"`
+	DeduplicatedSize int64   `json:"deduplicated_size"`
+	Cost             float64 `json:"cost"`
+	DeduplicatedCost float64 `json:"deduplicated_cost"`
+}
+
+// quote is used to calculate the cost of storing hash for holdTime months, where size is
+// the full size of hash. Should deduplication fail, the deduplicated size is the full size
+// so that users are never undercharged
+func (api *API) quote(username, hash string, size, holdTime int64) (*costQuote, error) {
+	q := &costQuote{Size: size, DeduplicatedSize: size}
+	dedupSize, err := api.customer.GetDeduplicatedStorageSpaceInBytes(username, hash)
+	if err != nil {
+		api.l.Warnw("failed to calculate deduplicated size", "user", username, "hash", hash, "error", err.Error())
+	} else if int64(dedupSize) < size {
+		q.DeduplicatedSize = int64(dedupSize)
+	}
+	if q.Cost, err = utils.CalculateFileCost(username, holdTime, q.Size, api.usage); err != nil {
+		return nil, err
+	}
+	if q.DeduplicatedCost, err = utils.CalculateFileCost(username, holdTime, q.DeduplicatedSize, api.usage); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
 // refundUserCredits is used to trigger a credit refund for a user, in the event of an API level processing failure.
 // Note that we do not do any error handling here, instead we will log the information so that we may manually
 // remediate the situation
-func (api *API) refundUserCredits(username, callType string, cost float64) {
-	if _, err := api.um.AddCredits(username, cost); err != nil {
+func (api *API) refundUserCredits(username, callType string, cost float64, reference string) {
+	if _, err := api.ledger.Credit(username, cost, ledger.Refund, reference); err != nil {
 		api.l.With("user", username, "call_type", callType, "error", err.Error()).Error(eh.CreditRefundError)
 	}
 }
@@ -238,6 +344,20 @@ func (api *API) validateHoldTime(username, holdTime string) (int64, error) {
 	return holdTimeInt, nil
 }
 
+// validateEncryptedSize is used to validate a user may encrypt an upload of size bytes.
+// free accounts are limited to a file upload size of 275MB when performing
+// on-demand encryption. Non free accounts do not have this limit
+func (api *API) validateEncryptedSize(username string, size int64) error {
+	usageTier, err := api.usage.FindByUserName(username)
+	if err != nil {
+		return err
+	}
+	if usageTier.Tier == models.Free && size > int64(datasize.MB.Bytes()*275) {
+		return errors.New("free accounts are limited to a max file size of 275MB when using on-demand encryption")
+	}
+	return nil
+}
+
 func (api *API) ensureTwoYearMax(upload *models.Upload, holdTime int64) error {
 	// get current time
 	now := time.Now()
@@ -0,0 +1,67 @@
+package billing
+
+import (
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/gorm"
+)
+
+// Statement records the usage of a user during a single billing cycle
+type Statement struct {
+	gorm.Model
+	UserName    string    `gorm:"type:varchar(255);unique_index:idx_statement_user_period"`
+	PeriodStart time.Time `gorm:"index"`
+	PeriodEnd   time.Time `gorm:"unique_index:idx_statement_user_period"`
+	// Tier is the tier of the user when the cycle was closed
+	Tier                  models.DataUsageTier `gorm:"type:varchar(255)"`
+	DataUsedBytes         uint64               `gorm:"type:numeric;default:0"`
+	DataLimitBytes        uint64               `gorm:"type:numeric;default:0"`
+	IPNSRecordsPublished  int64
+	IPNSRecordsAllowed    int64
+	PubSubMessagesSent    int64
+	PubSubMessagesAllowed int64
+	KeysCreated           int64
+	KeysAllowed           int64
+	// Charged is the credits spent on requests and renewals during the cycle
+	Charged float64
+	// Refunded is the credits returned for requests which could not be processed
+	Refunded float64
+	// Purchased is the credits bought during the cycle, less any reversed payments
+	Purchased float64
+}
+
+// Manager is used to manipulate billing statements, tier changes, and spending limits in our database
+type Manager struct {
+	DB *gorm.DB
+}
+
+// NewManager is used to instantiate our billing manager
+func NewManager(db *gorm.DB) *Manager {
+	return &Manager{DB: db}
+}
+
+// Migrate is used to create or update the statement, tier change, and spending limit tables
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Statement{}, &TierChange{}, &SpendingLimit{}).Error
+}
+
+// FindByUserName is used to find the most recent statements of a user. A limit of 0 returns all statements
+func (m *Manager) FindByUserName(username string, limit int) ([]Statement, error) {
+	var statements []Statement
+	query := m.DB.Where("user_name = ?", username)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Order("period_end desc").Find(&statements).Error; err != nil {
+		return nil, err
+	}
+	return statements, nil
+}
+
+// CycleStart returns the start of the billing cycle containing t. Cycles
+// run for a calendar month, starting at midnight UTC on the first day
+func CycleStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
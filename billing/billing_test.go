@@ -0,0 +1,176 @@
+package billing
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/ledger"
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2"
+	"github.com/RTradeLtd/database/v2/models"
+	"go.uber.org/zap"
+)
+
+const (
+	testCfgPath = "../testenv/config.json"
+	testUser    = "billingtestuser"
+)
+
+func TestCycleStart(t *testing.T) {
+	tests := []struct {
+		name string
+		t    time.Time
+		want time.Time
+	}{
+		{"MidMonth", time.Date(2019, 3, 15, 12, 30, 0, 0, time.UTC), time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"StartOfMonth", time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)},
+		// cycles are in UTC, so this is still the last day of february
+		{"OtherTimeZone", time.Date(2019, 3, 1, 1, 0, 0, 0, time.FixedZone("CET", 3600*2)), time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CycleStart(tt.t); !got.Equal(tt.want) {
+				t.Fatalf("CycleStart() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatement_Email(t *testing.T) {
+	statement := &Statement{
+		UserName:              testUser,
+		PeriodStart:           time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC),
+		PeriodEnd:             time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC),
+		Tier:                  models.Light,
+		DataUsedBytes:         1024,
+		DataLimitBytes:        2048,
+		IPNSRecordsPublished:  7,
+		IPNSRecordsAllowed:    5,
+		PubSubMessagesAllowed: 100,
+		KeysAllowed:           5,
+		Charged:               1.5,
+	}
+	subject, content, err := statement.Email()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != StatementSubject {
+		t.Fatalf("subject = %s, want %s", subject, StatementSubject)
+	}
+	for _, want := range []string{
+		testUser,
+		"February 1, 2019 - March 1, 2019",
+		// ipns records published exceed those allowed
+		"<td>IPNS records published</td><td>7</td><td>5</td><td>2</td>",
+		"Charged: 1.5000",
+	} {
+		if !strings.Contains(content, want) {
+			t.Fatalf("statement does not contain %q", want)
+		}
+	}
+}
+
+func TestCycler(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	user, err := models.NewUserManager(dbm.DB).NewUserAccount(testUser, "password123", testUser+"@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.DB.Unscoped().Delete(user)
+	defer dbm.DB.Unscoped().Where("user_name = ?", testUser).Delete(&models.Usage{})
+	defer dbm.DB.Unscoped().Where("user_name = ?", testUser).Delete(&Statement{})
+	if err := dbm.DB.Model(user).Update("email_enabled", true).Error; err != nil {
+		t.Fatal(err)
+	}
+	var (
+		now      = time.Now()
+		signedUp = CycleStart(now).AddDate(0, -1, 0)
+	)
+	if err := dbm.DB.Model(&models.Usage{}).Where("user_name = ?", testUser).UpdateColumns(map[string]interface{}{
+		"created_at":              signedUp,
+		"current_data_used_bytes": 1024,
+		"ip_ns_records_published": 2,
+		"pub_sub_messages_sent":   3,
+		"keys_created":            4,
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	var notified []string
+	notify := func(username, email, subject, content string) error {
+		notified = append(notified, username)
+		return nil
+	}
+	tests := []struct {
+		name         string
+		dryRun       bool
+		wantClosed   bool
+		wantNotified int
+	}{
+		{"DryRun", true, false, 0},
+		{"Closed", false, true, 1},
+		// the cycle was already closed, so it isn't closed again
+		{"AlreadyClosed", false, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCycler(dbm.DB, notify, Options{DryRun: tt.dryRun}, zap.NewNop().Sugar())
+			c.now = func() time.Time { return now }
+			if _, err := c.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			statements, err := NewManager(dbm.DB).FindByUserName(testUser, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if closed := len(statements) == 1; closed != tt.wantClosed {
+				t.Fatalf("closed = %v, want %v", closed, tt.wantClosed)
+			}
+			var userNotified int
+			for _, username := range notified {
+				if username == testUser {
+					userNotified++
+				}
+			}
+			if userNotified != tt.wantNotified {
+				t.Fatalf("notified %v times, want %v", userNotified, tt.wantNotified)
+			}
+			if !tt.wantClosed {
+				return
+			}
+			statement := statements[0]
+			if !statement.PeriodStart.Equal(signedUp) || !statement.PeriodEnd.Equal(CycleStart(now)) {
+				t.Fatalf("unexpected period %v - %v", statement.PeriodStart, statement.PeriodEnd)
+			}
+			if statement.DataUsedBytes != 1024 || statement.IPNSRecordsPublished != 2 ||
+				statement.PubSubMessagesSent != 3 || statement.KeysCreated != 4 {
+				t.Fatalf("unexpected statement %+v", statement)
+			}
+			usage, err := models.NewUsageManager(dbm.DB).FindByUserName(testUser)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage.IPNSRecordsPublished != 0 || usage.PubSubMessagesSent != 0 || usage.KeysCreated != 0 {
+				t.Fatalf("usage was not reset %+v", usage)
+			}
+			// stored data remains stored once the cycle closes
+			if usage.CurrentDataUsedBytes != 1024 {
+				t.Fatalf("expected data used to be kept, got %v", usage.CurrentDataUsedBytes)
+			}
+		})
+	}
+}
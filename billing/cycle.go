@@ -0,0 +1,281 @@
+package billing
+
+import (
+	"context"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/ledger"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/gorm"
+	"go.uber.org/zap"
+)
+
+// NotifyFunc is used to email a user
+type NotifyFunc func(username, email, subject, content string) error
+
+// Options is used to configure the cycler
+type Options struct {
+	// BatchSize is the maximum number of users loaded from the database at once
+	BatchSize int
+	// Interval is how often we check for cycles to close when running continuously
+	Interval time.Duration
+	// DryRun reports the cycles which would be closed, without making any changes
+	DryRun bool
+}
+
+// DefaultOptions returns the default cycler options
+func DefaultOptions() Options {
+	return Options{
+		BatchSize: 100,
+		Interval:  time.Hour,
+	}
+}
+
+// withDefaults returns opts with zero values replaced by their defaults
+func (opts Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaults.BatchSize
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaults.Interval
+	}
+	return opts
+}
+
+// Result summarizes a run of the cycler
+type Result struct {
+	// Closed is the number of users whose cycle was closed
+	Closed int
+	// Notified is the number of users emailed their statement
+	Notified int
+	// Failed is the number of users whose cycle couldn't be closed,
+	// which are attempted again on the next run
+	Failed int
+}
+
+// Cycler closes the billing cycles of our users once they end, recording their usage
+// in a statement, resetting their usage counters, applying scheduled tier changes and
+// emailing them the statement. Only a single cycler should run at a time
+type Cycler struct {
+	db     *gorm.DB
+	notify NotifyFunc
+	opts   Options
+	l      *zap.SugaredLogger
+	// now is used to retrieve the current time, allowing it to be replaced in tests
+	now func() time.Time
+}
+
+// NewCycler is used to instantiate our cycler. Zero value options are replaced with their defaults
+func NewCycler(db *gorm.DB, notify NotifyFunc, opts Options, logger *zap.SugaredLogger) *Cycler {
+	return &Cycler{
+		db:     db,
+		notify: notify,
+		opts:   opts.withDefaults(),
+		l:      logger.Named("billing"),
+		now:    time.Now,
+	}
+}
+
+// Run is used to close billing cycles every interval until ctx is cancelled
+func (c *Cycler) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := c.Close(ctx); err != nil {
+			c.l.Errorw("closing billing cycles failed", "error", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close is used to close the previous billing cycle of every user who hasn't
+// had it closed yet. Users who signed up during the current cycle are skipped
+func (c *Cycler) Close(ctx context.Context) (Result, error) {
+	var (
+		result Result
+		lastID uint
+		end    = CycleStart(c.now())
+	)
+	for {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		var usages []models.Usage
+		if err := c.db.Where(
+			"id > ? AND created_at < ? AND NOT EXISTS (SELECT 1 FROM statements WHERE statements.user_name = usages.user_name AND statements.period_end = ?)",
+			lastID, end, end,
+		).Order("id").Limit(c.opts.BatchSize).Find(&usages).Error; err != nil {
+			return result, err
+		}
+		for _, usage := range usages {
+			lastID = usage.ID
+			statement, err := c.close(usage, end)
+			if err != nil {
+				result.Failed++
+				c.l.Errorw("failed to close billing cycle", "error", err.Error(), "user", usage.UserName)
+				continue
+			}
+			result.Closed++
+			if c.opts.DryRun {
+				continue
+			}
+			notified, err := c.send(statement)
+			if err != nil {
+				c.l.Errorw("failed to send statement", "error", err.Error(), "user", usage.UserName)
+			}
+			if notified {
+				result.Notified++
+			}
+		}
+		if len(usages) < c.opts.BatchSize {
+			break
+		}
+	}
+	c.l.Infow(
+		"billing cycles closed",
+		"dry_run", c.opts.DryRun,
+		"period_end", end,
+		"closed", result.Closed,
+		"notified", result.Notified,
+		"failed", result.Failed)
+	return result, nil
+}
+
+// close is used to record the statement of a user for the cycle ending at end, and reset
+// their per-cycle usage counters. Usage is locked while the cycle is closed, so usage recorded
+// concurrently is never lost, however usage recorded after the cycle ends, but before
+// it is closed, is attributed to the closed cycle
+func (c *Cycler) close(usage models.Usage, end time.Time) (*Statement, error) {
+	tx := c.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	statement, err := c.closeTx(tx, usage.ID, end)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if c.opts.DryRun {
+		tx.Rollback()
+		c.l.Infow(
+			"would close billing cycle",
+			"user", statement.UserName,
+			"period_start", statement.PeriodStart,
+			"data_used_bytes", statement.DataUsedBytes,
+			"charged", statement.Charged)
+		return statement, nil
+	}
+	return statement, tx.Commit().Error
+}
+
+// closeTx is used to close the cycle of a user using tx
+func (c *Cycler) closeTx(tx *gorm.DB, usageID uint, end time.Time) (*Statement, error) {
+	var usage models.Usage
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("id = ?", usageID).First(&usage).Error; err != nil {
+		return nil, err
+	}
+	// cycles begin where the previous cycle of the user ended, or when they signed up
+	start := usage.CreatedAt
+	var previous Statement
+	if err := tx.Where("user_name = ?", usage.UserName).
+		Order("period_end desc").First(&previous).Error; err == nil {
+		start = previous.PeriodEnd
+	} else if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	statement := &Statement{
+		UserName:              usage.UserName,
+		PeriodStart:           start,
+		PeriodEnd:             end,
+		Tier:                  usage.Tier,
+		DataUsedBytes:         usage.CurrentDataUsedBytes,
+		DataLimitBytes:        usage.MonthlyDataLimitBytes,
+		IPNSRecordsPublished:  usage.IPNSRecordsPublished,
+		IPNSRecordsAllowed:    usage.IPNSRecordsAllowed,
+		PubSubMessagesSent:    usage.PubSubMessagesSent,
+		PubSubMessagesAllowed: usage.PubSubMessagesAllowed,
+		KeysCreated:           usage.KeysCreated,
+		KeysAllowed:           usage.KeysAllowed,
+	}
+	if err := credits(tx, statement); err != nil {
+		return nil, err
+	}
+	if err := tx.Create(statement).Error; err != nil {
+		return nil, err
+	}
+	// data used is the data a user currently stores, rather than data uploaded during
+	// the cycle, so it is recorded in the statement but only reduced by removing uploads
+	reset := map[string]interface{}{
+		"ip_ns_records_published": 0,
+		"pub_sub_messages_sent":   0,
+		"keys_created":            0,
+	}
+	if err := tx.Model(&usage).UpdateColumns(reset).Error; err != nil {
+		return nil, err
+	}
+	// downgrades scheduled during the cycle take effect once it is closed
+	if err := applyScheduledChange(tx, &usage, end, c.now()); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+// credits is used to total the ledger entries of a user recorded during the
+// period of statement, by the reason their credits changed
+func credits(tx *gorm.DB, statement *Statement) error {
+	rows, err := tx.Model(&ledger.Entry{}).Select("reason, COALESCE(SUM(amount), 0)").Where(
+		"user_name = ? AND created_at >= ? AND created_at < ?",
+		statement.UserName, statement.PeriodStart, statement.PeriodEnd,
+	).Group("reason").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			reason ledger.Reason
+			amount float64
+		)
+		if err := rows.Scan(&reason, &amount); err != nil {
+			return err
+		}
+		switch reason {
+		case ledger.Charge, ledger.Renewal:
+			statement.Charged -= amount
+		case ledger.Refund:
+			statement.Refunded += amount
+		case ledger.Payment, ledger.Reversal:
+			statement.Purchased += amount
+		}
+	}
+	return rows.Err()
+}
+
+// send is used to email a statement to its user, returning whether it was sent.
+// Users without a verified email address are not sent statements
+func (c *Cycler) send(statement *Statement) (bool, error) {
+	if c.notify == nil {
+		return false, nil
+	}
+	user, err := models.NewUserManager(c.db).FindByUserName(statement.UserName)
+	if err != nil {
+		return false, err
+	}
+	if !user.EmailEnabled {
+		return false, nil
+	}
+	subject, content, err := statement.Email()
+	if err != nil {
+		return false, err
+	}
+	if err := c.notify(user.UserName, user.EmailAddress, subject, content); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,4 @@
+// Package billing closes the monthly billing cycles of our users, recording
+// their usage in a statement before resetting their per-cycle usage counters, manages
+// the tiers users belong to, and enforces the spending limits users configure
+package billing
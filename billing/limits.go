@@ -0,0 +1,196 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/ledger"
+	"github.com/RTradeLtd/gorm"
+)
+
+var (
+	// ErrDailyCapExceeded is returned when a charge would exceed the daily spending cap of a user
+	ErrDailyCapExceeded = errors.New("charge would exceed the daily spending cap")
+	// ErrMonthlyCapExceeded is returned when a charge would exceed the monthly spending cap of a user
+	ErrMonthlyCapExceeded = errors.New("charge would exceed the monthly spending cap")
+	// ErrInvalidLimit is returned when setting a negative limit
+	ErrInvalidLimit = errors.New("limits must not be negative")
+	// ErrAlertAboveCap is returned when setting an alert threshold which can never be crossed
+	ErrAlertAboveCap = errors.New("alert thresholds must not exceed the spending cap of the same period")
+)
+
+// SpendingLimit configures the credits a user may spend each day, and each billing
+// cycle, along with the spending at which they're alerted. Zero values are disabled
+type SpendingLimit struct {
+	gorm.Model
+	UserName     string `gorm:"type:varchar(255);unique_index"`
+	DailyCap     float64
+	MonthlyCap   float64
+	DailyAlert   float64
+	MonthlyAlert float64
+	// DailyAlertedAt, and MonthlyAlertedAt are when the user was last alerted,
+	// ensuring they're alerted at most once per period
+	DailyAlertedAt   *time.Time
+	MonthlyAlertedAt *time.Time
+}
+
+// Spending is the credits spent by a user during the current day, and billing cycle
+type Spending struct {
+	Daily   float64 `json:"daily"`
+	Monthly float64 `json:"monthly"`
+}
+
+// Alert is raised the first time the spending of a user crosses an alert threshold during a period
+type Alert struct {
+	// Period is either daily, or monthly
+	Period    string
+	Threshold float64
+	Spent     float64
+}
+
+// Email returns the subject, and content of the email used to notify a user of alert
+func (a Alert) Email(username string) (string, string) {
+	subject := fmt.Sprintf("TEMPORAL %s Spending Alert", a.Period)
+	content := fmt.Sprintf(
+		"%s, your %s spending has reached %.4f credits, crossing your alert threshold of %.4f credits",
+		username, a.Period, a.Spent, a.Threshold,
+	)
+	return subject, content
+}
+
+// DayStart returns midnight UTC of the day containing t, which is when daily spending resets
+func DayStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// FindSpendingLimit is used to find the spending limit of a user
+func (m *Manager) FindSpendingLimit(username string) (*SpendingLimit, error) {
+	var limit SpendingLimit
+	if err := m.DB.Where("user_name = ?", username).First(&limit).Error; err != nil {
+		return nil, err
+	}
+	return &limit, nil
+}
+
+// SetSpendingLimit is used to set the spending limit of a user, replacing any existing limit
+func (m *Manager) SetSpendingLimit(limit *SpendingLimit) (*SpendingLimit, error) {
+	for _, value := range []float64{limit.DailyCap, limit.MonthlyCap, limit.DailyAlert, limit.MonthlyAlert} {
+		if value < 0 {
+			return nil, ErrInvalidLimit
+		}
+	}
+	if (limit.DailyCap > 0 && limit.DailyAlert > limit.DailyCap) ||
+		(limit.MonthlyCap > 0 && limit.MonthlyAlert > limit.MonthlyCap) {
+		return nil, ErrAlertAboveCap
+	}
+	var existing SpendingLimit
+	if err := m.DB.Where("user_name = ?", limit.UserName).First(&existing).Error; err == gorm.ErrRecordNotFound {
+		if err := m.DB.Create(limit).Error; err != nil {
+			return nil, err
+		}
+		return limit, nil
+	} else if err != nil {
+		return nil, err
+	}
+	existing.DailyCap = limit.DailyCap
+	existing.MonthlyCap = limit.MonthlyCap
+	existing.DailyAlert = limit.DailyAlert
+	existing.MonthlyAlert = limit.MonthlyAlert
+	if err := m.DB.Save(&existing).Error; err != nil {
+		return nil, err
+	}
+	return &existing, nil
+}
+
+// Spent is used to total the credits spent by a user during the day, and billing
+// cycle containing now. Spending is what was charged, less what was refunded
+func (m *Manager) Spent(username string, now time.Time) (Spending, error) {
+	var spending Spending
+	for _, period := range []struct {
+		start time.Time
+		spent *float64
+	}{
+		{DayStart(now), &spending.Daily},
+		{CycleStart(now), &spending.Monthly},
+	} {
+		var sum struct{ Total float64 }
+		if err := m.DB.Model(&ledger.Entry{}).Select("COALESCE(SUM(amount), 0) AS total").Where(
+			"user_name = ? AND reason IN (?) AND created_at >= ?",
+			username, []ledger.Reason{ledger.Charge, ledger.Renewal, ledger.Refund}, period.start,
+		).Scan(&sum).Error; err != nil {
+			return Spending{}, err
+		}
+		// charges are debits, so spending is the inverse of their sum
+		*period.spent = -sum.Total
+	}
+	return spending, nil
+}
+
+// CheckSpending is used to validate that charging a user cost keeps them within their
+// spending caps, returning the alerts raised by the charge. Alerts are only returned
+// once per period, so m should be within the transaction that charges the user
+func (m *Manager) CheckSpending(username string, cost float64, now time.Time) ([]Alert, error) {
+	var limit SpendingLimit
+	// locking the limit serializes the charges of users who have one, so concurrent
+	// charges can't each fit within a cap which they exceed together
+	if err := m.DB.Set("gorm:query_option", "FOR UPDATE").
+		Where("user_name = ?", username).First(&limit).Error; err == gorm.ErrRecordNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	spending, err := m.Spent(username, now)
+	if err != nil {
+		return nil, err
+	}
+	daily, monthly := spending.Daily+cost, spending.Monthly+cost
+	if limit.DailyCap > 0 && daily > limit.DailyCap {
+		return nil, ErrDailyCapExceeded
+	}
+	if limit.MonthlyCap > 0 && monthly > limit.MonthlyCap {
+		return nil, ErrMonthlyCapExceeded
+	}
+	var (
+		alerts  []Alert
+		updates = make(map[string]interface{})
+	)
+	if crossed(limit.DailyAlert, daily, limit.DailyAlertedAt, DayStart(now)) {
+		alerts = append(alerts, Alert{"daily", limit.DailyAlert, daily})
+		updates["daily_alerted_at"] = now
+	}
+	if crossed(limit.MonthlyAlert, monthly, limit.MonthlyAlertedAt, CycleStart(now)) {
+		alerts = append(alerts, Alert{"monthly", limit.MonthlyAlert, monthly})
+		updates["monthly_alerted_at"] = now
+	}
+	if len(updates) > 0 {
+		if err := m.DB.Model(&limit).UpdateColumns(updates).Error; err != nil {
+			return nil, err
+		}
+	}
+	return alerts, nil
+}
+
+// Charge is used to deduct cost from the credits of a user for reason, recording the charge
+// against reference, provided it keeps them within their spending caps. The alerts raised by
+// the charge are returned, so that the user may be notified once the charge is committed. As
+// with CheckSpending, m should be within the transaction that charges the user
+func (m *Manager) Charge(username string, cost float64, reason ledger.Reason, reference string, now time.Time) ([]Alert, error) {
+	alerts, err := m.CheckSpending(username, cost, now)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ledger.NewManager(m.DB).Debit(username, cost, reason, reference); err != nil {
+		return nil, err
+	}
+	return alerts, nil
+}
+
+// crossed returns whether spent has reached threshold without an alert being raised since start
+func crossed(threshold, spent float64, alertedAt *time.Time, start time.Time) bool {
+	if threshold <= 0 || spent < threshold {
+		return false
+	}
+	return alertedAt == nil || alertedAt.Before(start)
+}
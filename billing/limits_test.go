@@ -0,0 +1,130 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/ledger"
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2"
+	"github.com/RTradeLtd/database/v2/models"
+)
+
+func TestCrossed(t *testing.T) {
+	var (
+		start     = time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+		before    = start.Add(-time.Hour)
+		afterward = start.Add(time.Hour)
+	)
+	tests := []struct {
+		name      string
+		threshold float64
+		spent     float64
+		alertedAt *time.Time
+		want      bool
+	}{
+		{"Disabled", 0, 10, nil, false},
+		{"Below", 5, 4, nil, false},
+		{"Reached", 5, 5, nil, true},
+		{"AlertedLastPeriod", 5, 6, &before, true},
+		{"AlertedThisPeriod", 5, 6, &afterward, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := crossed(tt.threshold, tt.spent, tt.alertedAt, start); got != tt.want {
+				t.Fatalf("crossed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManager_CheckSpending(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	const username = "limitstestuser"
+	user, err := models.NewUserManager(dbm.DB).NewUserAccount(username, "password123", username+"@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.DB.Unscoped().Delete(user)
+	defer dbm.DB.Unscoped().Where("user_name = ?", username).Delete(&models.Usage{})
+	defer dbm.DB.Unscoped().Where("user_name = ?", username).Delete(&SpendingLimit{})
+	defer dbm.DB.Unscoped().Where("user_name = ?", username).Delete(&ledger.Entry{})
+	var (
+		bm = NewManager(dbm.DB)
+		lm = ledger.NewManager(dbm.DB)
+	)
+	if _, err := lm.Credit(username, 100, ledger.Grant, ""); err != nil {
+		t.Fatal(err)
+	}
+	// users without limits are never capped
+	if alerts, err := bm.CheckSpending(username, 50, time.Now()); err != nil || len(alerts) != 0 {
+		t.Fatalf("CheckSpending() = %v, %v without limits", alerts, err)
+	}
+	if _, err := bm.SetSpendingLimit(&SpendingLimit{UserName: username, DailyCap: 5, DailyAlert: 10}); err != ErrAlertAboveCap {
+		t.Fatalf("SetSpendingLimit() err = %v, want %v", err, ErrAlertAboveCap)
+	}
+	if _, err := bm.SetSpendingLimit(&SpendingLimit{UserName: username, DailyCap: -1}); err != ErrInvalidLimit {
+		t.Fatalf("SetSpendingLimit() err = %v, want %v", err, ErrInvalidLimit)
+	}
+	if _, err := bm.SetSpendingLimit(&SpendingLimit{
+		UserName: username, DailyCap: 10, DailyAlert: 5, MonthlyCap: 20,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		cost       float64
+		wantErr    error
+		wantAlerts int
+	}{
+		{"BelowAlert", 4, nil, 0},
+		{"CrossesAlert", 2, nil, 1},
+		// alerts are raised once per period
+		{"AlreadyAlerted", 1, nil, 0},
+		{"ExceedsDailyCap", 4, ErrDailyCapExceeded, 0},
+		{"WithinDailyCap", 3, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alerts, err := bm.CheckSpending(username, tt.cost, time.Now())
+			if err != tt.wantErr {
+				t.Fatalf("CheckSpending() err = %v, want %v", err, tt.wantErr)
+			}
+			if len(alerts) != tt.wantAlerts {
+				t.Fatalf("raised %v alerts, want %v", len(alerts), tt.wantAlerts)
+			}
+			if err == nil {
+				if _, err := lm.Debit(username, tt.cost, ledger.Charge, tt.name); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+	spending, err := bm.Spent(username, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spending.Daily != 10 || spending.Monthly != 10 {
+		t.Fatalf("spent %+v, want 10 credits", spending)
+	}
+	// refunds are deducted from spending
+	if _, err := lm.Credit(username, 3, ledger.Refund, "refund"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bm.CheckSpending(username, 3, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,270 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/gorm"
+	"github.com/c2h5oh/datasize"
+)
+
+var (
+	// ErrUnknownTier is returned when changing to a tier which doesn't exist
+	ErrUnknownTier = errors.New("tier must be one of free, light, plus, partner")
+	// ErrSameTier is returned when changing to the tier a user already belongs to
+	ErrSameTier = errors.New("account already belongs to this tier")
+	// ErrNoScheduledChange is returned when cancelling a scheduled change which doesn't exist
+	ErrNoScheduledChange = errors.New("no tier change is scheduled")
+	// ErrApprovalRequired is returned when users upgrade themselves to a tier
+	// which must be granted by an administrator
+	ErrApprovalRequired = errors.New("upgrading to this tier requires approval by an administrator")
+	// ErrPlusUsage is returned when users upgrade themselves to the plus tier
+	// without storing the data required to belong to it
+	ErrPlusUsage = fmt.Errorf("upgrading to the plus tier requires at least %s of data stored",
+		datasize.ByteSize(models.PlusTierMinimumUpload).HR())
+)
+
+// UsageError is returned when downgrading to a tier whose limits
+// are lower than the usage of a user during the current cycle
+type UsageError struct {
+	Limit   string
+	Used    uint64
+	Allowed uint64
+}
+
+func (e *UsageError) Error() string {
+	return fmt.Sprintf("current %s usage of %v exceeds the %v allowed by the new tier", e.Limit, e.Used, e.Allowed)
+}
+
+// Plan describes the pricing, and limits of a tier
+type Plan struct {
+	Tier models.DataUsageTier `json:"tier"`
+	// PricePerGB is the cost in credits of storing a gigabyte for a month
+	PricePerGB            float64 `json:"price_per_gb"`
+	MonthlyDataLimitBytes uint64  `json:"monthly_data_limit_bytes"`
+	KeysAllowed           int64   `json:"keys_allowed"`
+	PubSubMessagesAllowed int64   `json:"pub_sub_messages_allowed"`
+	IPNSRecordsAllowed    int64   `json:"ipns_records_allowed"`
+}
+
+// Plans returns the plan of each tier, ordered from the lowest tier to the highest
+func Plans() []Plan {
+	return []Plan{
+		// free accounts are never charged for data
+		{models.Free, 0, models.FreeUploadLimit, models.FreeKeyLimit, models.FreePubSubLimit, models.FreeIPNSLimit},
+		{models.Light, models.Light.PricePerGB(), models.NonFreeUploadLimit, models.LightKeyLimit, models.LightPubSubLimit, models.LightIPNSLimit},
+		{models.Plus, models.Plus.PricePerGB(), models.NonFreeUploadLimit, models.PlusKeyLimit, models.PlusPubSubLimit, models.PlusIPNSRecordLimit},
+		{models.Partner, models.Partner.PricePerGB(), models.NonFreeUploadLimit, models.PartnerKeyLimit, models.PartnerPubSubLimit, models.PartnerIPNSLimit},
+	}
+}
+
+// FindPlan is used to find the plan of tier
+func FindPlan(tier models.DataUsageTier) (Plan, error) {
+	_, plan, ok := rank(tier)
+	if !ok {
+		return Plan{}, ErrUnknownTier
+	}
+	return plan, nil
+}
+
+// rank returns the position of tier within our plans, and whether the tier exists
+func rank(tier models.DataUsageTier) (int, Plan, bool) {
+	for i, plan := range Plans() {
+		if plan.Tier == tier {
+			return i, plan, true
+		}
+	}
+	return 0, Plan{}, false
+}
+
+// fits returns an error if usage exceeds the limits of plan
+func (plan Plan) fits(usage *models.Usage) error {
+	if usage.CurrentDataUsedBytes > plan.MonthlyDataLimitBytes {
+		return &UsageError{"data", usage.CurrentDataUsedBytes, plan.MonthlyDataLimitBytes}
+	}
+	for _, limit := range []struct {
+		name          string
+		used, allowed int64
+	}{
+		{"key", usage.KeysCreated, plan.KeysAllowed},
+		{"pubsub", usage.PubSubMessagesSent, plan.PubSubMessagesAllowed},
+		{"ipns", usage.IPNSRecordsPublished, plan.IPNSRecordsAllowed},
+	} {
+		if limit.used > limit.allowed {
+			return &UsageError{limit.name, uint64(limit.used), uint64(limit.allowed)}
+		}
+	}
+	return nil
+}
+
+// upgradable returns an error if users may not upgrade themselves to plan. Users may upgrade
+// to the light tier, and to the plus tier once they store as much data as it requires, in
+// line with the usage at which accounts are moved between the light and plus tiers
+func (plan Plan) upgradable(usage *models.Usage) error {
+	switch plan.Tier {
+	case models.Free, models.Light:
+		return nil
+	case models.Plus:
+		if usage.CurrentDataUsedBytes < models.PlusTierMinimumUpload {
+			return ErrPlusUsage
+		}
+		return nil
+	default:
+		return ErrApprovalRequired
+	}
+}
+
+// TierChange records a change to the tier of a user. Cancelled changes are deleted
+type TierChange struct {
+	gorm.Model
+	UserName string               `gorm:"type:varchar(255);index"`
+	From     models.DataUsageTier `gorm:"type:varchar(255)"`
+	To       models.DataUsageTier `gorm:"type:varchar(255)"`
+	// EffectiveAt is when the change takes effect. Upgrades take effect immediately,
+	// while downgrades take effect at the end of the cycle they're scheduled in
+	EffectiveAt time.Time
+	// AppliedAt is when the change was applied, and is nil while the change is scheduled
+	AppliedAt *time.Time
+}
+
+// ChangeTier is used by a user to move themselves to tier. Upgrades are applied immediately,
+// provided the user may upgrade themselves to the tier, while downgrades are scheduled for
+// the end of the current cycle, provided the usage of the user during the cycle fits within
+// the limits of the new tier. Any previously scheduled change is cancelled
+func (m *Manager) ChangeTier(username string, tier models.DataUsageTier) (*TierChange, error) {
+	return m.change(username, tier, false)
+}
+
+// GrantTier is used by an administrator to move a user to tier. Unlike ChangeTier, upgrades
+// to any tier are allowed, such as to the partner tier which users can't upgrade to themselves
+func (m *Manager) GrantTier(username string, tier models.DataUsageTier) (*TierChange, error) {
+	return m.change(username, tier, true)
+}
+
+// change is used to move a user to tier, allowing any upgrade if approved
+func (m *Manager) change(username string, tier models.DataUsageTier, approved bool) (*TierChange, error) {
+	to, plan, ok := rank(tier)
+	if !ok {
+		return nil, ErrUnknownTier
+	}
+	tx := m.DB.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	change, err := changeTier(tx, username, to, plan, approved, time.Now())
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return change, tx.Commit().Error
+}
+
+// changeTier is used to change the tier of a user using tx
+func changeTier(tx *gorm.DB, username string, to int, plan Plan, approved bool, now time.Time) (*TierChange, error) {
+	var usage models.Usage
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("user_name = ?", username).First(&usage).Error; err != nil {
+		return nil, err
+	}
+	from, _, ok := rank(usage.Tier)
+	if ok && from == to {
+		return nil, ErrSameTier
+	}
+	downgrade := ok && to < from
+	if !downgrade && !approved {
+		if err := plan.upgradable(&usage); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Where("user_name = ? AND applied_at IS NULL", username).Delete(&TierChange{}).Error; err != nil {
+		return nil, err
+	}
+	change := &TierChange{
+		UserName:    username,
+		From:        usage.Tier,
+		To:          plan.Tier,
+		EffectiveAt: now,
+		AppliedAt:   &now,
+	}
+	if downgrade {
+		if err := plan.fits(&usage); err != nil {
+			return nil, err
+		}
+		change.EffectiveAt = CycleStart(now).AddDate(0, 1, 0)
+		change.AppliedAt = nil
+	} else if err := applyPlan(tx, &usage, plan); err != nil {
+		return nil, err
+	}
+	if err := tx.Create(change).Error; err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// CancelScheduledChange is used to cancel the scheduled tier change of a user
+func (m *Manager) CancelScheduledChange(username string) error {
+	result := m.DB.Where("user_name = ? AND applied_at IS NULL", username).Delete(&TierChange{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoScheduledChange
+	}
+	return nil
+}
+
+// FindScheduledChange is used to find the scheduled tier change of a user
+func (m *Manager) FindScheduledChange(username string) (*TierChange, error) {
+	var change TierChange
+	if err := m.DB.Where("user_name = ? AND applied_at IS NULL", username).
+		First(&change).Error; err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// FindTierChanges is used to find the most recent tier changes of a user,
+// including those which are scheduled. A limit of 0 returns all changes
+func (m *Manager) FindTierChanges(username string, limit int) ([]TierChange, error) {
+	var changes []TierChange
+	query := m.DB.Where("user_name = ?", username)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Order("id desc").Find(&changes).Error; err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// applyScheduledChange is used to apply the tier change of a user scheduled to take effect by end
+func applyScheduledChange(tx *gorm.DB, usage *models.Usage, end, now time.Time) error {
+	var change TierChange
+	if err := tx.Where("user_name = ? AND applied_at IS NULL AND effective_at <= ?", usage.UserName, end).
+		First(&change).Error; err == gorm.ErrRecordNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, plan, ok := rank(change.To)
+	if !ok {
+		return ErrUnknownTier
+	}
+	if err := applyPlan(tx, usage, plan); err != nil {
+		return err
+	}
+	return tx.Model(&change).Update("applied_at", now).Error
+}
+
+// applyPlan is used to move usage to the tier of plan, updating its limits
+func applyPlan(tx *gorm.DB, usage *models.Usage, plan Plan) error {
+	return tx.Model(usage).UpdateColumns(map[string]interface{}{
+		"tier":                     plan.Tier,
+		"monthly_data_limit_bytes": plan.MonthlyDataLimitBytes,
+		"keys_allowed":             plan.KeysAllowed,
+		"pub_sub_messages_allowed": plan.PubSubMessagesAllowed,
+		"ip_ns_records_allowed":    plan.IPNSRecordsAllowed,
+	}).Error
+}
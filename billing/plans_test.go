@@ -0,0 +1,170 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2"
+	"github.com/RTradeLtd/database/v2/models"
+)
+
+func TestPlan_Fits(t *testing.T) {
+	free, err := FindPlan(models.Free)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		usage     models.Usage
+		wantLimit string
+	}{
+		{"Fits", models.Usage{CurrentDataUsedBytes: 1024, KeysCreated: models.FreeKeyLimit}, ""},
+		{"Data", models.Usage{CurrentDataUsedBytes: models.FreeUploadLimit + 1}, "data"},
+		{"Keys", models.Usage{KeysCreated: models.FreeKeyLimit + 1}, "key"},
+		{"PubSub", models.Usage{PubSubMessagesSent: models.FreePubSubLimit + 1}, "pubsub"},
+		{"IPNS", models.Usage{IPNSRecordsPublished: models.FreeIPNSLimit + 1}, "ipns"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := free.fits(&tt.usage)
+			if tt.wantLimit == "" {
+				if err != nil {
+					t.Fatalf("fits() err = %v", err)
+				}
+				return
+			}
+			usageErr, ok := err.(*UsageError)
+			if !ok || usageErr.Limit != tt.wantLimit {
+				t.Fatalf("fits() err = %v, want %s limit exceeded", err, tt.wantLimit)
+			}
+		})
+	}
+	if _, err := FindPlan("gold"); err != ErrUnknownTier {
+		t.Fatalf("FindPlan() err = %v, want %v", err, ErrUnknownTier)
+	}
+}
+
+func TestPlan_Upgradable(t *testing.T) {
+	tests := []struct {
+		name    string
+		tier    models.DataUsageTier
+		usage   models.Usage
+		wantErr error
+	}{
+		{"Light", models.Light, models.Usage{}, nil},
+		{"PlusUsage", models.Plus, models.Usage{CurrentDataUsedBytes: models.PlusTierMinimumUpload}, nil},
+		{"PlusNoUsage", models.Plus, models.Usage{CurrentDataUsedBytes: models.PlusTierMinimumUpload - 1}, ErrPlusUsage},
+		{"Partner", models.Partner, models.Usage{CurrentDataUsedBytes: models.PlusTierMinimumUpload}, ErrApprovalRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := FindPlan(tt.tier)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := plan.upgradable(&tt.usage); err != tt.wantErr {
+				t.Fatalf("upgradable() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestManager_ChangeTier(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	const username = "plantestuser"
+	user, err := models.NewUserManager(dbm.DB).NewUserAccount(username, "password123", username+"@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.DB.Unscoped().Delete(user)
+	defer dbm.DB.Unscoped().Where("user_name = ?", username).Delete(&models.Usage{})
+	defer dbm.DB.Unscoped().Where("user_name = ?", username).Delete(&TierChange{})
+	var (
+		bm  = NewManager(dbm.DB)
+		um  = models.NewUsageManager(dbm.DB)
+		now = time.Now()
+	)
+	if err := dbm.DB.Model(&models.Usage{}).Where("user_name = ?", username).
+		Update("keys_created", models.LightKeyLimit+1).Error; err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		tier          models.DataUsageTier
+		grant         bool
+		wantErr       bool
+		wantScheduled bool
+		wantTier      models.DataUsageTier
+	}{
+		{"Unknown", "gold", false, true, false, models.Free},
+		{"Same", models.Free, false, true, false, models.Free},
+		// too little data is stored to belong to the plus tier
+		{"PlusUsage", models.Plus, false, true, false, models.Free},
+		{"Upgrade", models.Light, false, false, false, models.Light},
+		{"PartnerApproval", models.Partner, false, true, false, models.Light},
+		{"Granted", models.Partner, true, false, false, models.Partner},
+		// more keys were created than light tier allows
+		{"UsageExceeded", models.Light, false, true, false, models.Partner},
+		{"ScheduledDowngrade", models.Plus, false, false, true, models.Partner},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changeTier := bm.ChangeTier
+			if tt.grant {
+				changeTier = bm.GrantTier
+			}
+			change, err := changeTier(username, tt.tier)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ChangeTier() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (change.AppliedAt == nil) != tt.wantScheduled {
+				t.Fatalf("scheduled = %v, want %v", change.AppliedAt == nil, tt.wantScheduled)
+			}
+			if tt.wantScheduled && !change.EffectiveAt.Equal(CycleStart(now).AddDate(0, 1, 0)) {
+				t.Fatalf("effective at %v, want the start of the next cycle", change.EffectiveAt)
+			}
+			usage, err := um.FindByUserName(username)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage.Tier != tt.wantTier {
+				t.Fatalf("tier = %s, want %s", usage.Tier, tt.wantTier)
+			}
+		})
+	}
+	// the scheduled downgrade is applied once the cycle ends
+	usage, err := um.FindByUserName(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyScheduledChange(dbm.DB, usage, CycleStart(now).AddDate(0, 1, 0), now); err != nil {
+		t.Fatal(err)
+	}
+	if usage, err = um.FindByUserName(username); err != nil {
+		t.Fatal(err)
+	}
+	if usage.Tier != models.Plus || usage.KeysAllowed != models.PlusKeyLimit {
+		t.Fatalf("scheduled change not applied, tier = %s", usage.Tier)
+	}
+	if err := bm.CancelScheduledChange(username); err != ErrNoScheduledChange {
+		t.Fatalf("CancelScheduledChange() err = %v, want %v", err, ErrNoScheduledChange)
+	}
+	changes, err := bm.FindTierChanges(username, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("found %v tier changes, want 3", len(changes))
+	}
+}
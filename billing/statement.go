@@ -0,0 +1,87 @@
+package billing
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// StatementSubject is the subject of the email sent when a billing cycle is closed
+const StatementSubject = "TEMPORAL Monthly Usage Statement"
+
+// statementLine is the usage of a single limit within a statement
+type statementLine struct {
+	Name    string
+	Used    string
+	Allowed string
+	// Overage is the amount used beyond the limit, which happens when
+	// the limits of a user are lowered during a cycle
+	Overage string
+}
+
+// lines returns the usage of each limit recorded by the statement
+func (s *Statement) lines() []statementLine {
+	data := statementLine{
+		Name:    "Data stored",
+		Used:    datasize.ByteSize(s.DataUsedBytes).HR(),
+		Allowed: datasize.ByteSize(s.DataLimitBytes).HR(),
+	}
+	if s.DataUsedBytes > s.DataLimitBytes {
+		data.Overage = datasize.ByteSize(s.DataUsedBytes - s.DataLimitBytes).HR()
+	}
+	return []statementLine{
+		data,
+		countLine("IPNS records published", s.IPNSRecordsPublished, s.IPNSRecordsAllowed),
+		countLine("PubSub messages sent", s.PubSubMessagesSent, s.PubSubMessagesAllowed),
+		countLine("Keys created", s.KeysCreated, s.KeysAllowed),
+	}
+}
+
+// countLine returns the statement line of a limit on the number of times something is done
+func countLine(name string, used, allowed int64) statementLine {
+	line := statementLine{
+		Name:    name,
+		Used:    fmt.Sprint(used),
+		Allowed: fmt.Sprint(allowed),
+	}
+	if used > allowed {
+		line.Overage = fmt.Sprint(used - allowed)
+	}
+	return line
+}
+
+var statementTemplate = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"credits": func(v float64) string { return fmt.Sprintf("%.4f", v) },
+	"date":    func(t time.Time) string { return t.UTC().Format("January 2, 2006") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Usage Statement</title></head>
+<body style="font-family: Helvetica, Arial, sans-serif; color: #222;">
+<h2>RTrade Technologies - Temporal</h2>
+<h3>Usage statement for {{.Statement.UserName}}</h3>
+<p>Period: {{date .Statement.PeriodStart}} - {{date .Statement.PeriodEnd}}<br>Tier: {{.Statement.Tier}}</p>
+<table style="border-collapse: collapse; width: 100%;">
+<tr style="text-align: left; border-bottom: 1px solid #ccc;"><th>Usage</th><th>Used</th><th>Allowed</th><th>Overage</th></tr>
+{{range .Lines}}<tr><td>{{.Name}}</td><td>{{.Used}}</td><td>{{.Allowed}}</td><td>{{if .Overage}}{{.Overage}}{{else}}-{{end}}</td></tr>
+{{end}}</table>
+<h4>Credits</h4>
+<p>Charged: {{credits .Statement.Charged}}<br>Refunded: {{credits .Statement.Refunded}}<br>Purchased: {{credits .Statement.Purchased}}</p>
+<p>Your IPNS, PubSub and key usage has been reset for the new billing cycle. Data stored remains counted until your uploads are removed.</p>
+</body>
+</html>
+`))
+
+// Email is used to generate the subject, and html content of the email sent with a statement
+func (s *Statement) Email() (string, string, error) {
+	var buf bytes.Buffer
+	if err := statementTemplate.Execute(&buf, struct {
+		Statement *Statement
+		Lines     []statementLine
+	}{s, s.lines()}); err != nil {
+		return "", "", err
+	}
+	return StatementSubject, buf.String(), nil
+}
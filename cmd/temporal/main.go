@@ -4,21 +4,33 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"sync"
 	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 
 	clients "github.com/RTradeLtd/Temporal/grpc-clients"
 	"github.com/RTradeLtd/gorm"
 
+	"github.com/RTradeLtd/Temporal/api/middleware"
 	v2 "github.com/RTradeLtd/Temporal/api/v2"
 	v3 "github.com/RTradeLtd/Temporal/api/v3"
+	"github.com/RTradeLtd/Temporal/billing"
+	"github.com/RTradeLtd/Temporal/gc"
+	"github.com/RTradeLtd/Temporal/jobs"
+	"github.com/RTradeLtd/Temporal/ledger"
 	"github.com/RTradeLtd/Temporal/log"
+	"github.com/RTradeLtd/Temporal/outbox"
+	"github.com/RTradeLtd/Temporal/payments"
 	"github.com/RTradeLtd/Temporal/queue"
+	"github.com/RTradeLtd/Temporal/rtfscluster"
+	"github.com/RTradeLtd/Temporal/share"
+	"github.com/RTradeLtd/Temporal/webhooks"
 	"github.com/RTradeLtd/cmd/v2"
 	"github.com/RTradeLtd/config/v2"
 	"github.com/RTradeLtd/database/v2"
@@ -27,6 +39,7 @@ import (
 	pbOrch "github.com/RTradeLtd/grpc/nexus"
 	pbSigner "github.com/RTradeLtd/grpc/pay"
 	"github.com/RTradeLtd/kaas/v2"
+	"github.com/RTradeLtd/rtfs/v2"
 )
 
 // Version denotes the tag of this build
@@ -56,8 +69,35 @@ var (
 	grpcNoSSL  *bool
 	apiPort    *string
 
+	// api flags
+	apiIdempotencyWindow *time.Duration
+	apiEmbeddedConsumers *bool
+
+	// queue flags
+	queueWorkers      *int
+	queuePrefetch     *int
+	queueTimeout      *time.Duration
+	queueDrainTimeout *time.Duration
+	queueMetrics      *string
+	queuePublish      *time.Duration
+
+	// dlq flags
+	dlqLimit *int
+
 	// bucket flags
 	bucketLocation *string
+
+	// gc flags
+	gcDryRun        *bool
+	gcBatchSize     *int
+	gcWarnDays      *int
+	gcInterval      *time.Duration
+	gcGracePeriod   *time.Duration
+	gcRenewalWindow *time.Duration
+
+	// billing flags
+	billingDryRun   *bool
+	billingInterval *time.Duration
 )
 
 func baseFlagSet() *flag.FlagSet {
@@ -84,6 +124,48 @@ func baseFlagSet() *flag.FlagSet {
 	// api configuration
 	apiPort = f.String("api.port", "6767",
 		"set port to expose API on")
+	apiIdempotencyWindow = f.Duration("api.idempotency_window", 24*time.Hour,
+		"how long responses to requests made with an Idempotency-Key are stored")
+	apiEmbeddedConsumers = f.Bool("api.embedded_consumers", false,
+		"consume messages from all queues within the api process, always enabled when using the in-memory broker")
+
+	// queue configuration, zero values use the defaults of the queue being consumed
+	queueWorkers = f.Int("queue.workers", 0,
+		"number of messages a queue consumer processes concurrently")
+	queuePrefetch = f.Int("queue.prefetch", 0,
+		"number of unacknowledged messages delivered to a queue consumer")
+	queueTimeout = f.Duration("queue.timeout", 0,
+		"maximum time spent processing a single queue message")
+	queueDrainTimeout = f.Duration("queue.drain_timeout", 0,
+		"maximum time to wait for in-flight queue messages when shutting down")
+	queueMetrics = f.String("queue.metrics", "",
+		"address to expose queue consumer metrics on, disabled if empty")
+	queuePublish = f.Duration("queue.publish_timeout", queue.PublishTimeout,
+		"maximum time to wait for the broker to confirm a published message")
+
+	// dlq configuration
+	dlqLimit = f.Int("dlq.limit", 100,
+		"maximum number of dead-lettered messages to list or replay")
+
+	// gc configuration
+	gcDryRun = f.Bool("gc.dry_run", false,
+		"report uploads which would be garbage collected, and users which would be warned, without making changes")
+	gcBatchSize = f.Int("gc.batch_size", gc.DefaultOptions().BatchSize,
+		"maximum number of uploads loaded from the database at once during garbage collection")
+	gcWarnDays = f.Int("gc.warn_days", 7,
+		"number of days before an upload expires that its owner is warned by email")
+	gcInterval = f.Duration("gc.interval", 0,
+		"how often to garbage collect, if 0 garbage collection runs once and exits")
+	gcGracePeriod = f.Duration("gc.grace_period", gc.DefaultOptions().GracePeriod,
+		"how long after an upload expires before it is garbage collected")
+	gcRenewalWindow = f.Duration("gc.renewal_window", gc.DefaultOptions().RenewalWindow,
+		"how long before an upload expires that it is automatically renewed, if enabled by its owner")
+
+	// billing configuration
+	billingDryRun = f.Bool("billing.dry_run", false,
+		"report billing cycles which would be closed, without making changes")
+	billingInterval = f.Duration("billing.interval", 0,
+		"how often to check for billing cycles to close, if 0 cycles are closed once and the command exits")
 
 	return f
 }
@@ -105,6 +187,125 @@ func newDB(cfg config.TemporalConfig, noSSL bool) (*gorm.DB, error) {
 	return dbm.DB, nil
 }
 
+// runLocalMigrations is used to migrate the models defined within
+// Temporal, as opposed to those belonging to our database package
+func runLocalMigrations(db *gorm.DB) error {
+	if err := jobs.Migrate(db); err != nil {
+		return err
+	}
+	if err := outbox.Migrate(db); err != nil {
+		return err
+	}
+	if err := queue.MigrateProcessedMessages(db); err != nil {
+		return err
+	}
+	if err := webhooks.Migrate(db); err != nil {
+		return err
+	}
+	if err := gc.Migrate(db); err != nil {
+		return err
+	}
+	if err := payments.Migrate(db); err != nil {
+		return err
+	}
+	if err := ledger.Migrate(db); err != nil {
+		return err
+	}
+	if err := billing.Migrate(db); err != nil {
+		return err
+	}
+	if err := share.Migrate(db); err != nil {
+		return err
+	}
+	return middleware.MigrateIdempotencyKeys(db)
+}
+
+// runQueue is used to consume messages from the given queue until interrupted,
+// reconnecting whenever a protocol connection error is encountered
+func runQueue(cfg config.TemporalConfig, q queue.Queue, logFile string) {
+	logger, err := log.NewLogger(logPath(cfg.LogDir, logFile), *devMode)
+	if err != nil {
+		fmt.Println("failed to start logger ", err)
+		os.Exit(1)
+	}
+	db, err := newDB(cfg, *dbNoSSL)
+	if err != nil {
+		fmt.Println("failed to start db", err)
+		os.Exit(1)
+	}
+	if *queueMetrics != "" {
+		// expvar registers the number of in-flight messages under /debug/vars
+		go func() {
+			if err := http.ListenAndServe(*queueMetrics, nil); err != nil {
+				logger.Errorw("failed to serve queue metrics", "error", err.Error())
+			}
+		}()
+	}
+	quitChannel := make(chan os.Signal)
+	signal.Notify(quitChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+	waitGroup := &sync.WaitGroup{}
+	go func() {
+		fmt.Println(closeMessage)
+		<-quitChannel
+		cancel()
+	}()
+	if err := consumeQueue(ctx, &cfg, q, db, logger, waitGroup); err != nil {
+		fmt.Println("failed to consume messages", err)
+		os.Exit(1)
+	}
+	waitGroup.Wait()
+}
+
+// consumeQueue is used to consume messages from the given queue until ctx is cancelled,
+// reconnecting whenever a protocol connection error is encountered. The wait group is
+// released once in-flight messages have been processed
+func consumeQueue(ctx context.Context, cfg *config.TemporalConfig, q queue.Queue, db *gorm.DB, logger *zap.SugaredLogger, wg *sync.WaitGroup) error {
+	for {
+		qm, err := queue.New(q, cfg.RabbitMQ.URL, false, *devMode, cfg, logger)
+		if err != nil {
+			return err
+		}
+		qm.SetWorkerOptions(queue.WorkerOptions{
+			Workers:        *queueWorkers,
+			Prefetch:       *queuePrefetch,
+			MessageTimeout: *queueTimeout,
+			DrainTimeout:   *queueDrainTimeout,
+		})
+		wg.Add(1)
+		err = qm.ConsumeMessages(ctx, wg, db, cfg)
+		// this will only be true if we had a graceful exit to the queue process, aka CTRL+C
+		if err == nil {
+			return nil
+		}
+		if err.Error() != queue.ErrReconnect {
+			// we failed before consuming, so the wait group hasn't been released
+			qm.Close()
+			wg.Done()
+			return err
+		}
+	}
+}
+
+// newDLQManager is used to connect to the given queue in order to manage its dead letter queue
+func newDLQManager(cfg config.TemporalConfig, name string) *queue.Manager {
+	q, err := queue.ParseQueue(name)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	logger, err := log.NewLogger(logPath(cfg.LogDir, "dlq.log"), *devMode)
+	if err != nil {
+		fmt.Println("failed to start logger ", err)
+		os.Exit(1)
+	}
+	qm, err := queue.New(q, cfg.RabbitMQ.URL, false, *devMode, &cfg, logger)
+	if err != nil {
+		fmt.Println("failed to start queue", err)
+		os.Exit(1)
+	}
+	return qm
+}
+
 func initClients(l *zap.SugaredLogger, cfg *config.TemporalConfig) (closers []func()) {
 	closers = make([]func(), 0)
 	if lens == nil {
@@ -165,7 +366,11 @@ var commands = map[string]cmd.Cmd{
 				ctx,
 				&cfg,
 				args["version"],
-				v2.Options{DebugLogging: *debug, DevMode: *devMode},
+				v2.Options{
+					DebugLogging:      *debug,
+					DevMode:           *devMode,
+					IdempotencyWindow: *apiIdempotencyWindow,
+				},
 				clients,
 				logger,
 			)
@@ -173,6 +378,27 @@ var commands = map[string]cmd.Cmd{
 				logger.Fatal(err)
 			}
 
+			// messages published to the in-memory broker can only be consumed within this
+			// process, so queue consumers are embedded into the api service
+			consumers := &sync.WaitGroup{}
+			if *apiEmbeddedConsumers || queue.IsMemoryURL(cfg.RabbitMQ.URL) {
+				db, err := newDB(cfg, *dbNoSSL)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				for _, q := range queue.Queues() {
+					consumers.Add(1)
+					go func(q queue.Queue) {
+						defer consumers.Done()
+						// consumeQueue only returns once in-flight messages have been processed
+						if err := consumeQueue(ctx, &cfg, q, db, logger, &sync.WaitGroup{}); err != nil {
+							logger.Errorw("failed to start embedded queue consumer",
+								"queue", q.String(), "error", err.Error())
+						}
+					}(q)
+				}
+			}
+
 			// set up clean interrupt
 			quitChannel := make(chan os.Signal)
 			signal.Notify(quitChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
@@ -199,6 +425,9 @@ var commands = map[string]cmd.Cmd{
 				fmt.Printf("API service execution failed: %s\n", err.Error())
 				fmt.Println("Refer to the logs for more details")
 			}
+			// stop embedded consumers, waiting for them to finish processing in-flight messages
+			cancel()
+			consumers.Wait()
 		},
 	},
 	"queue": {
@@ -215,226 +444,307 @@ var commands = map[string]cmd.Cmd{
 						Blurb:       "IPNS entry creation queue",
 						Description: "Listens to requests to create IPNS records",
 						Action: func(cfg config.TemporalConfig, args map[string]string) {
-							logger, err := log.NewLogger(logPath(cfg.LogDir, "ipns_consumer.log"), *devMode)
-							if err != nil {
-								fmt.Println("failed to start logger ", err)
-								os.Exit(1)
-							}
-							db, err := newDB(cfg, *dbNoSSL)
-							if err != nil {
-								fmt.Println("failed to start db", err)
-								os.Exit(1)
-							}
-							quitChannel := make(chan os.Signal)
-							signal.Notify(quitChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-							waitGroup := &sync.WaitGroup{}
-							go func() {
-								fmt.Println(closeMessage)
-								<-quitChannel
-								cancel()
-							}()
-							for {
-								qm, err := queue.New(queue.IpnsEntryQueue, cfg.RabbitMQ.URL, false, *devMode, &cfg, logger)
-								if err != nil {
-									fmt.Println("failed to start queue", err)
-									os.Exit(1)
-								}
-								waitGroup.Add(1)
-								err = qm.ConsumeMessages(ctx, waitGroup, db, &cfg)
-								if err != nil && err.Error() != queue.ErrReconnect {
-									fmt.Println("failed to consume messages", err)
-									os.Exit(1)
-								} else if err != nil && err.Error() == queue.ErrReconnect {
-									continue
-								}
-								// this will only be true if we had a graceful exit to the queue process, aka CTRL+C
-								if err == nil {
-									break
-								}
-							}
-							waitGroup.Wait()
+							runQueue(cfg, queue.IpnsEntryQueue, "ipns_consumer.log")
 						},
 					},
 					"pin": {
 						Blurb:       "Pin addition queue",
 						Description: "Listens to pin requests",
 						Action: func(cfg config.TemporalConfig, args map[string]string) {
-							logger, err := log.NewLogger(logPath(cfg.LogDir, "pin_consumer.log"), *devMode)
-							if err != nil {
-								fmt.Println("failed to start logger ", err)
-								os.Exit(1)
-							}
-
-							db, err := newDB(cfg, *dbNoSSL)
-							if err != nil {
-								fmt.Println("failed to start db", err)
-								os.Exit(1)
-							}
-							quitChannel := make(chan os.Signal)
-							signal.Notify(quitChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-							waitGroup := &sync.WaitGroup{}
-							go func() {
-								fmt.Println(closeMessage)
-								<-quitChannel
-								cancel()
-							}()
-							for {
-								qm, err := queue.New(queue.IpfsPinQueue, cfg.RabbitMQ.URL, false, *devMode, &cfg, logger)
-								if err != nil {
-									fmt.Println("failed to start queue", err)
-									os.Exit(1)
-								}
-								waitGroup.Add(1)
-								err = qm.ConsumeMessages(ctx, waitGroup, db, &cfg)
-								if err != nil && err.Error() != queue.ErrReconnect {
-									fmt.Println("failed to consume messages", err)
-									os.Exit(1)
-								} else if err != nil && err.Error() == queue.ErrReconnect {
-									continue
-								}
-								// this will only be true if we had a graceful exit to the queue process, aka CTRL+C
-								if err == nil {
-									break
-								}
-							}
-							waitGroup.Wait()
+							runQueue(cfg, queue.IpfsPinQueue, "pin_consumer.log")
 						},
 					},
 					"key-creation": {
 						Blurb:       "Key creation queue",
 						Description: fmt.Sprintf("Listen to key creation requests.\nMessages to this queue are broadcasted to all nodes"),
 						Action: func(cfg config.TemporalConfig, args map[string]string) {
-							logger, err := log.NewLogger(logPath(cfg.LogDir, "key_consumer.log"), *devMode)
-							if err != nil {
-								fmt.Println("failed to start logger ", err)
-								os.Exit(1)
-							}
-
-							db, err := newDB(cfg, *dbNoSSL)
-							if err != nil {
-								fmt.Println("failed to start db", err)
-								os.Exit(1)
-							}
-							quitChannel := make(chan os.Signal)
-							signal.Notify(quitChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-							waitGroup := &sync.WaitGroup{}
-							go func() {
-								fmt.Println(closeMessage)
-								<-quitChannel
-								cancel()
-							}()
-							for {
-								qm, err := queue.New(queue.IpfsKeyCreationQueue, cfg.RabbitMQ.URL, false, *devMode, &cfg, logger)
-								if err != nil {
-									fmt.Println("failed to start queue", err)
-									os.Exit(1)
-								}
-								waitGroup.Add(1)
-								err = qm.ConsumeMessages(ctx, waitGroup, db, &cfg)
-								if err != nil && err.Error() != queue.ErrReconnect {
-									fmt.Println("failed to consume messages", err)
-									os.Exit(1)
-								} else if err != nil && err.Error() == queue.ErrReconnect {
-									continue
-								}
-								// this will only be true if we had a graceful exit to the queue process, aka CTRL+C
-								if err == nil {
-									break
-								}
-							}
-							waitGroup.Wait()
+							runQueue(cfg, queue.IpfsKeyCreationQueue, "key_consumer.log")
 						},
 					},
 					"cluster": {
 						Blurb:       "Cluster pin queue",
 						Description: "Listens to requests to pin content to the cluster",
 						Action: func(cfg config.TemporalConfig, args map[string]string) {
-							logger, err := log.NewLogger(logPath(cfg.LogDir, "cluster_pin_consumer.log"), *devMode)
+							runQueue(cfg, queue.IpfsClusterPinQueue, "cluster_pin_consumer.log")
+						},
+					},
+				},
+			},
+			"email-send": {
+				Blurb:       "Email send queue",
+				Description: "Listens to requests to send emails",
+				Action: func(cfg config.TemporalConfig, args map[string]string) {
+					runQueue(cfg, queue.EmailSendQueue, "email_consumer.log")
+				},
+			},
+			"webhook": {
+				Blurb:       "Webhook delivery queue",
+				Description: "Listens to requests to deliver events to user registered webhook endpoints",
+				Action: func(cfg config.TemporalConfig, args map[string]string) {
+					runQueue(cfg, queue.WebhookDeliveryQueue, "webhook_consumer.log")
+				},
+			},
+			"payment": {
+				Blurb:         "Payment queue sub commands",
+				Description:   "Used to launch the various queues that process cryptocurrency payments",
+				ChildRequired: true,
+				Children: map[string]cmd.Cmd{
+					"dash": {
+						Blurb:       "Dash payment confirmation queue",
+						Description: "Listens to requests to confirm dash payments, crediting accounts once confirmed",
+						Action: func(cfg config.TemporalConfig, args map[string]string) {
+							runQueue(cfg, queue.DashPaymentConfirmationQueue, "dash_payment_consumer.log")
+						},
+					},
+					"eth": {
+						Blurb:       "Ethereum payment confirmation queue",
+						Description: "Listens to requests to confirm eth and rtc payments, crediting accounts once confirmed",
+						Action: func(cfg config.TemporalConfig, args map[string]string) {
+							runQueue(cfg, queue.EthPaymentConfirmationQueue, "eth_payment_consumer.log")
+						},
+					},
+				},
+			},
+			"dlq": {
+				Blurb:         "manage dead-lettered messages",
+				Description:   "Inspect, replay, and purge messages which failed processing after exhausting their retries",
+				ChildRequired: true,
+				Children: map[string]cmd.Cmd{
+					"list": {
+						Blurb:       "list dead-lettered messages",
+						Description: "List messages in the dead letter queue of the given queue, without removing them",
+						Args:        []string{"queue"},
+						Action: func(cfg config.TemporalConfig, args map[string]string) {
+							qm := newDLQManager(cfg, args["queue"])
+							defer qm.Close()
+							letters, err := qm.ListDeadLetters(*dlqLimit)
 							if err != nil {
-								fmt.Println("failed to start logger ", err)
+								fmt.Println("failed to list dead letters", err)
 								os.Exit(1)
 							}
-
-							db, err := newDB(cfg, *dbNoSSL)
+							for _, letter := range letters {
+								fmt.Printf("failed_at: %s, attempts: %v, refunded: %v, error: %s\n%s\n\n",
+									letter.FailedAt.Format(time.RFC3339), letter.Attempts, letter.Refunded, letter.Error, letter.Body)
+							}
+							fmt.Printf("%v dead-lettered messages listed\n", len(letters))
+						},
+					},
+					"replay": {
+						Blurb:       "replay dead-lettered messages",
+						Description: "Move messages in the dead letter queue of the given queue back onto the queue for processing. Refunded messages are not replayed",
+						Args:        []string{"queue"},
+						Action: func(cfg config.TemporalConfig, args map[string]string) {
+							qm := newDLQManager(cfg, args["queue"])
+							defer qm.Close()
+							replayed, err := qm.ReplayDeadLetters(*dlqLimit)
 							if err != nil {
-								fmt.Println("failed to start db", err)
+								fmt.Println("failed to replay dead letters", err)
 								os.Exit(1)
 							}
-							quitChannel := make(chan os.Signal)
-							signal.Notify(quitChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-							waitGroup := &sync.WaitGroup{}
-							go func() {
-								fmt.Println(closeMessage)
-								<-quitChannel
-								cancel()
-							}()
-							for {
-								qm, err := queue.New(queue.IpfsClusterPinQueue, cfg.RabbitMQ.URL, false, *devMode, &cfg, logger)
-								if err != nil {
-									fmt.Println("failed to start queue", err)
-									os.Exit(1)
-								}
-								waitGroup.Add(1)
-								err = qm.ConsumeMessages(ctx, waitGroup, db, &cfg)
-								if err != nil && err.Error() != queue.ErrReconnect {
-									fmt.Println("failed to consume messages", err)
-									os.Exit(1)
-								} else if err != nil && err.Error() == queue.ErrReconnect {
-									continue
-								}
-								// this will only be true if we had a graceful exit to the queue process, aka CTRL+C
-								if err == nil {
-									break
-								}
+							fmt.Printf("%v dead-lettered messages replayed\n", replayed)
+						},
+					},
+					"purge": {
+						Blurb:       "purge dead-lettered messages",
+						Description: "Permanently remove all messages in the dead letter queue of the given queue",
+						Args:        []string{"queue"},
+						Action: func(cfg config.TemporalConfig, args map[string]string) {
+							qm := newDLQManager(cfg, args["queue"])
+							defer qm.Close()
+							purged, err := qm.PurgeDeadLetters()
+							if err != nil {
+								fmt.Println("failed to purge dead letters", err)
+								os.Exit(1)
 							}
-							waitGroup.Wait()
+							fmt.Printf("%v dead-lettered messages purged\n", purged)
 						},
 					},
 				},
 			},
-			"email-send": {
-				Blurb:       "Email send queue",
-				Description: "Listens to requests to send emails",
+		},
+	},
+	"gc": {
+		Blurb:       "garbage collect expired uploads",
+		Description: "Renews uploads with automatic renewal enabled, removes uploads whose hold time and grace period have expired, unpinning their content and reducing the data usage of their owners, and warns users by email before their uploads expire. Runs once unless --gc.interval is set",
+		Action: func(cfg config.TemporalConfig, args map[string]string) {
+			logger, err := log.NewLogger(logPath(cfg.LogDir, "gc.log"), *devMode)
+			if err != nil {
+				fmt.Println("failed to start logger ", err)
+				os.Exit(1)
+			}
+			db, err := newDB(cfg, *dbNoSSL)
+			if err != nil {
+				fmt.Println("failed to start db", err)
+				os.Exit(1)
+			}
+			ipfs, err := rtfs.NewManager(
+				cfg.IPFS.APIConnection.Host+":"+cfg.IPFS.APIConnection.Port,
+				"", time.Minute*10,
+			)
+			if err != nil {
+				fmt.Println("failed to connect to ipfs", err)
+				os.Exit(1)
+			}
+			cluster, err := rtfscluster.Initialize(
+				ctx,
+				cfg.IPFSCluster.APIConnection.Host,
+				cfg.IPFSCluster.APIConnection.Port,
+			)
+			if err != nil {
+				fmt.Println("failed to connect to cluster", err)
+				os.Exit(1)
+			}
+			qm, err := queue.New(queue.EmailSendQueue, cfg.RabbitMQ.URL, true, *devMode, &cfg, logger)
+			if err != nil {
+				fmt.Println("failed to start queue", err)
+				os.Exit(1)
+			}
+			defer qm.Close()
+			notify := func(username, email, subject, content string) error {
+				return qm.PublishMessage(queue.EmailSend{
+					Subject:     subject,
+					Content:     content,
+					ContentType: "text/html",
+					UserNames:   []string{username},
+					Emails:      []string{email},
+				})
+			}
+			intents := payments.NewProcessor(payments.NewManager(db), payments.NewStripe(cfg.Stripe.SecretKey))
+			topUp := func(username string) error {
+				credits, err := intents.TopUp(username)
+				if err != nil {
+					return err
+				}
+				if credits > 0 {
+					logger.Infow("credits granted", "payment.method", "stripe", "user", username, "credit.amount", credits, "top_up", true)
+				}
+				return nil
+			}
+			opts := gc.Options{
+				BatchSize:     *gcBatchSize,
+				WarningPeriod: time.Duration(*gcWarnDays) * time.Hour * 24,
+				GracePeriod:   *gcGracePeriod,
+				RenewalWindow: *gcRenewalWindow,
+				Interval:      *gcInterval,
+				DryRun:        *gcDryRun,
+			}
+			// when running once, uploads are renewed before being collected. When running
+			// continuously the grace period gives the renewer time to renew expired uploads
+			renewer := gc.NewRenewer(db, ipfs, notify, topUp, opts, logger)
+			collector := gc.NewCollector(db, ipfs, cluster, notify, opts, logger)
+			if *gcInterval <= 0 {
+				renewed, err := renewer.Renew(ctx)
+				if err != nil {
+					fmt.Println("renewal failed", err)
+					os.Exit(1)
+				}
+				fmt.Printf("renewed: %v, credits spent: %v, low balance: %v, failed: %v\n",
+					renewed.Renewed, renewed.Credits, renewed.LowBalance, renewed.Failed)
+				result, err := collector.Collect(ctx)
+				if err != nil {
+					fmt.Println("garbage collection failed", err)
+					os.Exit(1)
+				}
+				fmt.Printf("collected: %v, unpinned: %v, failed: %v, freed bytes: %v, users warned: %v\n",
+					result.Collected, result.Unpinned, result.Failed, result.FreedBytes, result.Warned)
+				return
+			}
+			quitChannel := make(chan os.Signal, 1)
+			signal.Notify(quitChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+			go func() {
+				fmt.Println("press CTRL+C to stop garbage collection")
+				<-quitChannel
+				cancel()
+			}()
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				renewer.Run(ctx)
+			}()
+			collector.Run(ctx)
+			wg.Wait()
+		},
+	},
+	"billing": {
+		Blurb:       "close monthly billing cycles",
+		Description: "Closes the billing cycle of each user once the month ends, recording their usage in a statement, resetting their ipns, pubsub and key usage counters and emailing them the statement. Runs once unless --billing.interval is set",
+		Action: func(cfg config.TemporalConfig, args map[string]string) {
+			logger, err := log.NewLogger(logPath(cfg.LogDir, "billing.log"), *devMode)
+			if err != nil {
+				fmt.Println("failed to start logger ", err)
+				os.Exit(1)
+			}
+			db, err := newDB(cfg, *dbNoSSL)
+			if err != nil {
+				fmt.Println("failed to start db", err)
+				os.Exit(1)
+			}
+			qm, err := queue.New(queue.EmailSendQueue, cfg.RabbitMQ.URL, true, *devMode, &cfg, logger)
+			if err != nil {
+				fmt.Println("failed to start queue", err)
+				os.Exit(1)
+			}
+			defer qm.Close()
+			notify := func(username, email, subject, content string) error {
+				return qm.PublishMessage(queue.EmailSend{
+					Subject:     subject,
+					Content:     content,
+					ContentType: "text/html",
+					UserNames:   []string{username},
+					Emails:      []string{email},
+				})
+			}
+			cycler := billing.NewCycler(db, notify, billing.Options{
+				Interval: *billingInterval,
+				DryRun:   *billingDryRun,
+			}, logger)
+			if *billingInterval <= 0 {
+				result, err := cycler.Close(ctx)
+				if err != nil {
+					fmt.Println("closing billing cycles failed", err)
+					os.Exit(1)
+				}
+				fmt.Printf("closed: %v, notified: %v, failed: %v\n", result.Closed, result.Notified, result.Failed)
+				return
+			}
+			quitChannel := make(chan os.Signal, 1)
+			signal.Notify(quitChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+			go func() {
+				fmt.Println("press CTRL+C to stop closing billing cycles")
+				<-quitChannel
+				cancel()
+			}()
+			cycler.Run(ctx)
+		},
+	},
+	"ledger": {
+		Blurb:         "inspect the credit ledger",
+		Description:   "Inspect the ledger recording every change made to the credits of our users",
+		ChildRequired: true,
+		Children: map[string]cmd.Cmd{
+			"verify": {
+				Blurb:       "verify user balances against the ledger",
+				Description: "Re-derives the balance of each user from their ledger entries, reporting users whose balance has drifted from their entries. Exits with a non-zero status if any drift is found",
 				Action: func(cfg config.TemporalConfig, args map[string]string) {
-					logger, err := log.NewLogger(logPath(cfg.LogDir, "email_consumer.log"), *devMode)
+					db, err := newDB(cfg, *dbNoSSL)
 					if err != nil {
-						fmt.Println("failed to start logger ", err)
+						fmt.Println("failed to start db", err)
 						os.Exit(1)
 					}
-
-					db, err := newDB(cfg, *dbNoSSL)
+					report, err := ledger.NewManager(db).Verify()
 					if err != nil {
-						fmt.Println("failed to start db", err)
+						fmt.Println("failed to verify ledger", err)
 						os.Exit(1)
 					}
-					quitChannel := make(chan os.Signal)
-					signal.Notify(quitChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-					waitGroup := &sync.WaitGroup{}
-					go func() {
-						fmt.Println(closeMessage)
-						<-quitChannel
-						cancel()
-					}()
-					for {
-						qm, err := queue.New(queue.EmailSendQueue, cfg.RabbitMQ.URL, false, *devMode, &cfg, logger)
-						if err != nil {
-							fmt.Println("failed to start queue", err)
-							os.Exit(1)
-						}
-						waitGroup.Add(1)
-						err = qm.ConsumeMessages(ctx, waitGroup, db, &cfg)
-						if err != nil && err.Error() != queue.ErrReconnect {
-							fmt.Println("failed to consume messages", err)
-							os.Exit(1)
-						} else if err != nil && err.Error() == queue.ErrReconnect {
-							continue
-						}
-						// this will only be true if we had a graceful exit to the queue process, aka CTRL+C
-						if err == nil {
-							break
-						}
+					for _, drift := range report.Drift {
+						fmt.Printf("user: %s, balance: %v, derived: %v, difference: %v, entries: %v, first mismatched entry: %v\n",
+							drift.UserName, drift.Balance, drift.Derived, drift.Balance-drift.Derived, drift.Entries, drift.FirstMismatch)
+					}
+					fmt.Printf("%v users verified, %v drifted\n", report.Users, len(report.Drift))
+					if len(report.Drift) > 0 {
+						os.Exit(1)
 					}
-					waitGroup.Wait()
 				},
 			},
 		},
@@ -484,7 +794,7 @@ var commands = map[string]cmd.Cmd{
 				os.Exit(1)
 			}
 			// add credits
-			if _, err := models.NewUserManager(d.DB).AddCredits(args["user"], 99999999); err != nil {
+			if _, err := ledger.NewManager(d.DB).Credit(args["user"], 99999999, ledger.Grant, ""); err != nil {
 				fmt.Println("failed to grant credits to user account", err)
 				os.Exit(1)
 			}
@@ -569,13 +879,18 @@ var commands = map[string]cmd.Cmd{
 		Blurb:       "run database migrations",
 		Description: "Runs our initial database migrations, creating missing tables, etc. Not affected by --db.migrate",
 		Action: func(cfg config.TemporalConfig, args map[string]string) {
-			if _, err := database.New(&cfg, database.Options{
+			dbm, err := database.New(&cfg, database.Options{
 				SSLModeDisable: *dbNoSSL,
 				RunMigrations:  true,
-			}); err != nil {
+			})
+			if err != nil {
 				fmt.Println("failed to perform secure migration", err)
 				os.Exit(1)
 			}
+			if err := runLocalMigrations(dbm.DB); err != nil {
+				fmt.Println("failed to perform migration", err)
+				os.Exit(1)
+			}
 		},
 	},
 }
@@ -609,6 +924,9 @@ func main() {
 		os.Exit(1)
 	}
 
+	// applies to every queue we publish to
+	queue.PublishTimeout = *queuePublish
+
 	// load arguments
 	flags := map[string]string{
 		"certFilePath":  tCfg.API.Connection.Certificates.CertPath,
@@ -117,6 +117,60 @@ func TestQueuesEmailSend(t *testing.T) {
 	}
 }
 
+func TestQueuesWebhook(t *testing.T) {
+	cfg, err := config.LoadConfig("../../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type args struct {
+		logDir string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{"NoLogDir", args{""}},
+		{"LogDir", args{"./tmp"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.LogDir = tt.args.logDir
+			ctx, cancel = context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			commands["queue"].Children["webhook"].Action(*cfg, nil)
+		})
+	}
+}
+
+func TestQueuesPayment(t *testing.T) {
+	cfg, err := config.LoadConfig("../../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type args struct {
+		childCmd string
+		logDir   string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{"Dash-NoLogDir", args{"dash", ""}},
+		{"Dash-LogDir", args{"dash", "./tmp/"}},
+		{"ETH-NoLogDir", args{"eth", ""}},
+		{"ETH-LogDir", args{"eth", "./tmp/"}},
+	}
+	queueCmds := commands["queue"]
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.LogDir = tt.args.logDir
+			ctx, cancel = context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			queueCmds.Children["payment"].Children[tt.args.childCmd].Action(*cfg, nil)
+		})
+	}
+}
+
 func TestMigrations(t *testing.T) {
 	cfg, err := config.LoadConfig("../../testenv/config.json")
 	if err != nil {
@@ -130,4 +130,72 @@ const (
 	PinExtendError = "failed to extend pin duration, this likely means you haven't actually uploaded this content before"
 	// MaxHoldTimeError is an error message when the current hold time value would breach set pin time limits
 	MaxHoldTimeError = "a hold time of this long would result in a longer maximum pin time of 2 years, please reduce your hold time and try again"
+	// JobSearchError is an error message used when a job can't be found
+	JobSearchError = "failed to find job"
+	// WebhookSearchError is an error message used when a webhook endpoint can't be found
+	WebhookSearchError = "failed to find webhook"
+	// WebhookCreationError is an error message used when a webhook endpoint can't be registered
+	WebhookCreationError = "failed to register webhook"
+	// WebhookDeleteError is an error message used when a webhook endpoint can't be removed
+	WebhookDeleteError = "failed to remove webhook"
+	// RenewalSearchError is an error message used when the automatic renewal of an upload can't be found
+	RenewalSearchError = "failed to find automatic renewal"
+	// RenewalEnableError is an error message used when automatic renewal can't be enabled
+	RenewalEnableError = "failed to enable automatic renewal"
+	// RenewalDisableError is an error message used when automatic renewal can't be disabled
+	RenewalDisableError = "failed to disable automatic renewal"
+	// StripeWebhookError is an error message used when a stripe webhook event can't be processed
+	StripeWebhookError = "failed to process stripe event"
+	// PaymentMethodSearchError is an error message used when a saved payment method can't be found
+	PaymentMethodSearchError = "failed to find payment method"
+	// PaymentMethodRemoveError is an error message used when a saved payment method can't be removed
+	PaymentMethodRemoveError = "failed to remove payment method"
+	// AutoTopUpSearchError is an error message used when automatic top ups can't be found
+	AutoTopUpSearchError = "failed to find automatic top up"
+	// AutoTopUpEnableError is an error message used when automatic top ups can't be enabled
+	AutoTopUpEnableError = "failed to enable automatic top up"
+	// AutoTopUpDisableError is an error message used when automatic top ups can't be disabled
+	AutoTopUpDisableError = "failed to disable automatic top up"
+	// PriceCheckError is an error message used when the usd price of a payment type can't be retrieved
+	PriceCheckError = "failed to retrieve usd price, please try again later"
+	// InvoiceError is an error message used when the invoice for a payment can't be generated
+	InvoiceError = "failed to generate invoice"
+	// CreditHistoryError is an error message used when the credit history of a user can't be retrieved
+	CreditHistoryError = "failed to retrieve credit history"
+	// UsageHistoryError is an error message used when the usage history of a user can't be retrieved
+	UsageHistoryError = "failed to retrieve usage history"
+	// PlanSearchError is an error message used when the plan, or tier changes of a user can't be found
+	PlanSearchError = "failed to find plan"
+	// TierChangeError is an error message used when the tier of a user can't be changed
+	TierChangeError = "failed to change tier"
+	// DailySpendingCapError is an error message used when a charge would exceed the daily spending cap of a user
+	DailySpendingCapError = "daily spending cap reached"
+	// MonthlySpendingCapError is an error message used when a charge would exceed the monthly spending cap of a user
+	MonthlySpendingCapError = "monthly spending cap reached"
+	// SpendingLimitSearchError is an error message used when the spending limits of a user can't be found
+	SpendingLimitSearchError = "failed to find spending limits"
+	// SpendingLimitUpdateError is an error message used when the spending limits of a user can't be updated
+	SpendingLimitUpdateError = "failed to update spending limits"
+	// IPFSPinError is an error message used when content added to ipfs can't be pinned
+	IPFSPinError = "failed to pin content"
+	// VirusFoundError is an error message used when uploaded content is infected
+	VirusFoundError = "virus found in uploaded content"
+	// VirusScanError is an error message used when uploaded content can't be scanned for viruses
+	VirusScanError = "failed to scan uploaded content for viruses"
+	// UploadCreationError is an error message used when a resumable upload can't be created
+	UploadCreationError = "failed to create upload"
+	// UploadWriteError is an error message used when a chunk can't be written to a resumable upload
+	UploadWriteError = "failed to write upload chunk"
+	// UploadRemoveError is an error message used when a resumable upload can't be removed
+	UploadRemoveError = "failed to remove upload"
+	// GatewayTokenError is an error message used when a gateway token can't be signed
+	GatewayTokenError = "failed to sign gateway token"
+	// GatewayListingError is an error message used when a directory listing can't be served through the gateway
+	GatewayListingError = "failed to list directory"
+	// ShareLinkCreationError is an error message used when a share link can't be created
+	ShareLinkCreationError = "failed to create share link"
+	// ShareLinkSearchError is an error message used when share links, or their access logs can't be found
+	ShareLinkSearchError = "failed to find share link"
+	// ShareLinkRevokeError is an error message used when a share link can't be revoked
+	ShareLinkRevokeError = "failed to revoke share link"
 )
@@ -0,0 +1,4 @@
+// Package gateway provides the building blocks of Temporal's http gateway, which serves
+// ipfs content to browsers. This covers the parsing of gateway paths, signed tokens granting
+// access to content through expiring urls, and the rendering of directory listings
+package gateway
@@ -0,0 +1,56 @@
+package gateway
+
+import (
+	"html/template"
+	"io"
+	"net/url"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// Entry is an entry of a directory listing
+type Entry struct {
+	Name string
+	Hash string
+	Size uint64
+	Dir  bool
+}
+
+var listingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{
+	// links are relative to the directory, and prefixed so names are never mistaken for a scheme
+	"link": func(e Entry) string {
+		if e.Dir {
+			return "./" + url.PathEscape(e.Name) + "/"
+		}
+		return "./" + url.PathEscape(e.Name)
+	},
+	"size": func(size uint64) string { return datasize.ByteSize(size).HumanReadable() },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of {{.Path}}</title>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Hash</th></tr>
+{{- if .Parent}}
+<tr><td><a href="../">..</a></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr><td><a href="{{link .}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td>{{if not .Dir}}{{size .Size}}{{end}}</td><td>{{.Hash}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// WriteListing is used to write an html listing of entries, the contents of the directory at p, to w
+func WriteListing(w io.Writer, p *Path, entries []Entry) error {
+	return listingTemplate.Execute(w, struct {
+		Path    string
+		Parent  bool
+		Entries []Entry
+	}{p.String(), p.Rest != "", entries})
+}
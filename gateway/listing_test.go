@@ -0,0 +1,26 @@
+package gateway
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteListing(t *testing.T) {
+	p, err := ParsePath("/ipns/example.org/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteListing(&buf, p, []Entry{
+		{Name: "images", Dir: true},
+		{Name: "a:b <c>.txt", Size: 2048},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`href="../"`, `href="./images/"`, `href="./a:b%20%3Cc%3E.txt"`, "a:b &lt;c&gt;.txt", "2.0 KB"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("listing does not contain %s:\n%s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package gateway
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	gocid "github.com/ipfs/go-cid"
+)
+
+// ErrInvalidPath is returned when parsing a path which isn't beneath /ipfs/<hash>, or /ipns/<name>
+var ErrInvalidPath = errors.New("path must begin with /ipfs/<hash>, or /ipns/<name>")
+
+// Path is a parsed gateway path, such as /ipfs/<hash>/docs/index.html
+type Path struct {
+	// Namespace is either ipfs, or ipns
+	Namespace string
+	// Root is the hash, or name the path begins with
+	Root string
+	// Rest is the remainder of the path beneath the root, if any, beginning with a /
+	Rest string
+}
+
+// ParsePath is used to parse, and clean a gateway path. Paths are cleaned before
+// being parsed, so a path can never escape its root through .. elements
+func ParsePath(p string) (*Path, error) {
+	parts := strings.SplitN(strings.TrimPrefix(path.Clean("/"+p), "/"), "/", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return nil, ErrInvalidPath
+	}
+	switch parts[0] {
+	case "ipfs":
+		if _, err := gocid.Decode(parts[1]); err != nil {
+			return nil, ErrInvalidPath
+		}
+	case "ipns":
+	default:
+		return nil, ErrInvalidPath
+	}
+	parsed := &Path{Namespace: parts[0], Root: parts[1]}
+	if len(parts) == 3 {
+		parsed.Rest = "/" + parts[2]
+	}
+	return parsed, nil
+}
+
+// String returns the cleaned path
+func (p *Path) String() string {
+	return "/" + p.Namespace + "/" + p.Root + p.Rest
+}
@@ -0,0 +1,33 @@
+package gateway
+
+import "testing"
+
+func TestParsePath(t *testing.T) {
+	const hash = "QmPY5iMFjNZKxRbUZZC85wXb9CFgNSyzAy1LxwL62D8VGr"
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"Root", "/ipfs/" + hash, "/ipfs/" + hash, false},
+		{"Nested", "/ipfs/" + hash + "/docs/index.html", "/ipfs/" + hash + "/docs/index.html", false},
+		{"TrailingSlash", "/ipfs/" + hash + "/docs/", "/ipfs/" + hash + "/docs", false},
+		{"Name", "/ipns/example.org/docs", "/ipns/example.org/docs", false},
+		{"DotSegments", "/ipfs/" + hash + "/../../ipns/example.org", "/ipns/example.org", false},
+		{"InvalidHash", "/ipfs/notarealhash", "", true},
+		{"MissingRoot", "/ipfs/", "", true},
+		{"OtherNamespace", "/v2/ipfs/" + hash, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePath() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Fatalf("ParsePath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigner(t *testing.T) {
+	var (
+		signer = NewSigner("secret")
+		now    = time.Now()
+		token  = Token{UserName: "testuser", Network: "public", Path: "/ipns/example.org/docs", Expires: now.Add(time.Hour)}
+	)
+	signed, err := signer.Sign(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		signer  *Signer
+		signed  string
+		now     time.Time
+		wantErr error
+	}{
+		{"Valid", signer, signed, now, nil},
+		{"Expired", signer, signed, now.Add(time.Hour), ErrTokenExpired},
+		{"OtherSecret", NewSigner("other"), signed, now, ErrInvalidToken},
+		{"Tampered", signer, "e30" + signed[strings.Index(signed, "."):], now, ErrInvalidToken},
+		{"Malformed", signer, "notatoken", now, ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.signer.Verify(tt.signed, tt.now)
+			if err != tt.wantErr {
+				t.Fatalf("Verify() err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got.Path != token.Path {
+				t.Fatalf("Verify() path = %v, want %v", got.Path, token.Path)
+			}
+		})
+	}
+}
+
+func TestToken_Allows(t *testing.T) {
+	token := &Token{Path: "/ipns/example.org/docs"}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/ipns/example.org/docs", true},
+		{"/ipns/example.org/docs/index.html", true},
+		{"/ipns/example.org/docsets", false},
+		{"/ipns/example.org", false},
+		{"/ipns/example.org/docs/../private", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			p, err := ParsePath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := token.Allows(p); got != tt.want {
+				t.Fatalf("Allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,4 @@
+// Package gc garbage collects uploads whose hold time has expired, removing their pins
+// from ipfs and our cluster, warning users before their uploads expire, and renewing
+// uploads which users have opted to renew automatically using their credits
+package gc
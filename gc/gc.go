@@ -0,0 +1,345 @@
+package gc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/gorm"
+	"github.com/RTradeLtd/rtfs/v2"
+	gocid "github.com/ipfs/go-cid"
+	"go.uber.org/zap"
+)
+
+// network is the only network we garbage collect. Private networks are
+// hosted for their users, who are responsible for their storage
+const network = "public"
+
+// Cluster is used to remove pins from our ipfs cluster
+type Cluster interface {
+	Unpin(ctx context.Context, cid gocid.Cid) error
+}
+
+// NotifyFunc is used to email a user
+type NotifyFunc func(username, email, subject, content string) error
+
+// TopUpFunc is used to top up the credits of a user who has been charged,
+// if they have fallen below their automatic top up threshold
+type TopUpFunc func(username string) error
+
+// Options is used to configure the collector
+type Options struct {
+	// BatchSize is the maximum number of uploads loaded from the database at once
+	BatchSize int
+	// WarningPeriod is how long before an upload expires that its owner is warned
+	WarningPeriod time.Duration
+	// GracePeriod is how long after an upload expires that it becomes eligible for
+	// collection, giving users with renewals enabled time to top up their credits
+	GracePeriod time.Duration
+	// RenewalWindow is how long before an upload expires that we attempt to renew it
+	RenewalWindow time.Duration
+	// Interval is how often we collect when running continuously
+	Interval time.Duration
+	// DryRun reports what would be collected and warned, without making any changes
+	DryRun bool
+}
+
+// DefaultOptions returns the default collector options
+func DefaultOptions() Options {
+	return Options{
+		BatchSize:     100,
+		WarningPeriod: time.Hour * 24 * 7,
+		GracePeriod:   time.Hour * 24 * 3,
+		RenewalWindow: time.Hour * 24,
+		Interval:      time.Hour,
+	}
+}
+
+// Result summarizes a garbage collection run
+type Result struct {
+	// Collected is the number of expired uploads removed
+	Collected int
+	// Unpinned is the number of hashes removed from ipfs and our cluster. Hashes
+	// are only unpinned once no other upload of them is being held
+	Unpinned int
+	// Failed is the number of expired uploads we were unable to collect,
+	// which are attempted again on the next run
+	Failed int
+	// FreedBytes is the amount of data usage removed from users
+	FreedBytes uint64
+	// Warned is the number of users warned that their uploads are about to expire
+	Warned int
+}
+
+// Collector garbage collects expired uploads. Only a single collector should run at a time
+type Collector struct {
+	db      *gorm.DB
+	ipfs    rtfs.Manager
+	cluster Cluster
+	notify  NotifyFunc
+	opts    Options
+	l       *zap.SugaredLogger
+}
+
+// withDefaults returns opts with zero values replaced by their defaults. The
+// grace period is left as is, as a grace period of zero disables it
+func (opts Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaults.BatchSize
+	}
+	if opts.WarningPeriod <= 0 {
+		opts.WarningPeriod = defaults.WarningPeriod
+	}
+	if opts.RenewalWindow <= 0 {
+		opts.RenewalWindow = defaults.RenewalWindow
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaults.Interval
+	}
+	return opts
+}
+
+// NewCollector is used to instantiate our garbage collector. Zero value
+// options, other than the grace period, are replaced with their defaults
+func NewCollector(db *gorm.DB, ipfs rtfs.Manager, cluster Cluster, notify NotifyFunc, opts Options, logger *zap.SugaredLogger) *Collector {
+	return &Collector{
+		db:      db,
+		ipfs:    ipfs,
+		cluster: cluster,
+		notify:  notify,
+		opts:    opts.withDefaults(),
+		l:       logger.Named("gc"),
+	}
+}
+
+// Run is used to collect expired uploads, and warn users, every interval until ctx is cancelled
+func (c *Collector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := c.Collect(ctx); err != nil {
+			c.l.Errorw("garbage collection failed", "error", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Collect is used to warn users of uploads which are about to expire, and then
+// remove uploads which expired before the start of the grace period
+func (c *Collector) Collect(ctx context.Context) (Result, error) {
+	var (
+		result Result
+		now    = time.Now()
+		cutoff = now.Add(-c.opts.GracePeriod)
+	)
+	warned, err := c.warn(now)
+	result.Warned = warned
+	if err != nil {
+		return result, err
+	}
+	var lastID uint
+	for {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		var uploads []models.Upload
+		if err := c.db.Where(
+			"id > ? AND network_name = ? AND garbage_collect_date < ?",
+			lastID, network, cutoff,
+		).Order("id").Limit(c.opts.BatchSize).Find(&uploads).Error; err != nil {
+			return result, err
+		}
+		for _, upload := range uploads {
+			lastID = upload.ID
+			size, unpinned, err := c.collect(ctx, upload, cutoff)
+			if err != nil {
+				result.Failed++
+				c.l.Errorw(
+					"failed to collect upload",
+					"error", err.Error(),
+					"user", upload.UserName,
+					"hash", upload.Hash)
+				continue
+			}
+			result.Collected++
+			result.FreedBytes += size
+			if unpinned {
+				result.Unpinned++
+			}
+		}
+		if len(uploads) < c.opts.BatchSize {
+			break
+		}
+	}
+	c.l.Infow(
+		"garbage collection finished",
+		"dry_run", c.opts.DryRun,
+		"collected", result.Collected,
+		"unpinned", result.Unpinned,
+		"failed", result.Failed,
+		"freed_bytes", result.FreedBytes,
+		"warned", result.Warned)
+	return result, nil
+}
+
+// collect is used to remove a single expired upload, unpinning its content if no
+// other upload of it is being held, and reducing the data usage of its owner. Uploads
+// which expired after cutoff are still within their grace period, and so are held
+func (c *Collector) collect(ctx context.Context, upload models.Upload, cutoff time.Time) (uint64, bool, error) {
+	stats, err := c.ipfs.Stat(upload.Hash)
+	if err != nil {
+		return 0, false, err
+	}
+	size := uint64(stats.CumulativeSize)
+	var held int
+	if err := c.db.Model(&models.Upload{}).Where(
+		"hash = ? AND network_name = ? AND garbage_collect_date >= ?",
+		upload.Hash, network, cutoff,
+	).Count(&held).Error; err != nil {
+		return 0, false, err
+	}
+	unpin := held == 0
+	if c.opts.DryRun {
+		c.l.Infow(
+			"would collect upload",
+			"user", upload.UserName,
+			"hash", upload.Hash,
+			"size", size,
+			"unpin", unpin)
+		return size, unpin, nil
+	}
+	if unpin {
+		if err := c.unpin(ctx, upload.Hash); err != nil {
+			return 0, false, err
+		}
+	}
+	tx := c.db.Begin()
+	if err := tx.Delete(&upload).Error; err != nil {
+		tx.Rollback()
+		return 0, false, err
+	}
+	if err := models.NewUsageManager(tx).ReduceDataUsage(upload.UserName, size); err != nil {
+		tx.Rollback()
+		return 0, false, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, false, err
+	}
+	c.l.Infow(
+		"collected upload",
+		"user", upload.UserName,
+		"hash", upload.Hash,
+		"size", size,
+		"unpinned", unpin)
+	return size, unpin, nil
+}
+
+// unpin is used to remove a hash from our cluster, and our ipfs node. Content
+// which has already been unpinned is not considered an error
+func (c *Collector) unpin(ctx context.Context, hash string) error {
+	cid, err := gocid.Decode(hash)
+	if err != nil {
+		return err
+	}
+	if c.cluster != nil {
+		if err := c.cluster.Unpin(ctx, cid); err != nil && !notPinned(err) {
+			return err
+		}
+	}
+	resp, err := c.ipfs.CustomRequest(ctx, c.ipfs.NodeAddress(), "pin/rm", nil, hash)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	if resp.Error != nil && !notPinned(resp.Error) {
+		return resp.Error
+	}
+	return nil
+}
+
+// notPinned returns whether or not err indicates the content wasn't pinned
+func notPinned(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "not pinned") || strings.Contains(msg, "not found")
+}
+
+// warn is used to email users whose uploads expire within the warning period, and
+// haven't yet been warned of their current garbage collection date. Uploads which
+// are renewed automatically are excluded. It returns the number of users who were warned
+func (c *Collector) warn(now time.Time) (int, error) {
+	var (
+		lastID   uint
+		expiring = make(map[string][]models.Upload)
+	)
+	for {
+		var uploads []models.Upload
+		if err := c.db.Where(
+			"id > ? AND network_name = ? AND garbage_collect_date >= ? AND garbage_collect_date < ?",
+			lastID, network, now, now.Add(c.opts.WarningPeriod),
+		).Where(
+			"NOT EXISTS (SELECT 1 FROM expiry_warnings w WHERE w.upload_id = uploads.id AND w.garbage_collect_date = uploads.garbage_collect_date AND w.deleted_at IS NULL)",
+		).Where(
+			"NOT EXISTS (SELECT 1 FROM renewals r WHERE r.user_name = uploads.user_name AND r.hash = uploads.hash AND r.network_name = uploads.network_name AND r.deleted_at IS NULL)",
+		).Order("id").Limit(c.opts.BatchSize).Find(&uploads).Error; err != nil {
+			return 0, err
+		}
+		for _, upload := range uploads {
+			lastID = upload.ID
+			expiring[upload.UserName] = append(expiring[upload.UserName], upload)
+		}
+		if len(uploads) < c.opts.BatchSize {
+			break
+		}
+	}
+	var (
+		warned int
+		um     = models.NewUserManager(c.db)
+	)
+	for username, uploads := range expiring {
+		if c.opts.DryRun {
+			c.l.Infow("would warn user of expiring uploads", "user", username, "uploads", len(uploads))
+			warned++
+			continue
+		}
+		user, err := um.FindByUserName(username)
+		if err != nil {
+			c.l.Errorw("failed to find user", "error", err.Error(), "user", username)
+			continue
+		}
+		// users without a verified email address are not warned, but we record
+		// the warning so that they aren't considered again on each run
+		if user.EmailEnabled && c.notify != nil {
+			subject, content := warningEmail(uploads, c.opts.GracePeriod)
+			if err := c.notify(username, user.EmailAddress, subject, content); err != nil {
+				c.l.Errorw("failed to warn user of expiring uploads", "error", err.Error(), "user", username)
+				continue
+			}
+			warned++
+		}
+		if err := NewManager(c.db).RecordWarnings(uploads); err != nil {
+			return warned, err
+		}
+	}
+	return warned, nil
+}
+
+// warningEmail returns the subject and content of the email warning a user of their expiring uploads
+func warningEmail(uploads []models.Upload, grace time.Duration) (string, string) {
+	var content strings.Builder
+	content.WriteString("The following uploads will be removed once their hold time expires. ")
+	content.WriteString("To keep them, extend their hold time, or enable automatic renewal, before they expire.<br><br>")
+	for _, upload := range uploads {
+		fmt.Fprintf(&content, "%s expires %s, and will be removed after %s<br>",
+			upload.Hash,
+			upload.GarbageCollectDate.UTC().Format(time.RFC1123),
+			upload.GarbageCollectDate.Add(grace).UTC().Format(time.RFC1123))
+	}
+	return "TEMPORAL Uploads Expiring Soon", content.String()
+}
@@ -0,0 +1,236 @@
+package gc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/billing"
+	"github.com/RTradeLtd/Temporal/gc"
+	"github.com/RTradeLtd/Temporal/ledger"
+	"github.com/RTradeLtd/Temporal/mocks"
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2"
+	"github.com/RTradeLtd/database/v2/models"
+	shell "github.com/RTradeLtd/go-ipfs-api"
+	gocid "github.com/ipfs/go-cid"
+	"go.uber.org/zap"
+)
+
+const (
+	testCfgPath = "../testenv/config.json"
+	expiredHash = "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"
+	heldHash    = "QmbWqxBEKC3P8tqsKc98xmWNzrzDtRLMiMPL8wBuTGsMnR"
+	renewHash   = "QmNTgmrL2YBbgDYVdh2XNiC5Nn4wJ7bCPnPt8ZV9MGqS8J"
+	lowHash     = "QmTFauExutTsy4XP6JbMFcw2Wa9645HJt2bTqL6qYDCKfe"
+)
+
+type fakeCluster struct {
+	unpinned []string
+}
+
+func (f *fakeCluster) Unpin(ctx context.Context, cid gocid.Cid) error {
+	f.unpinned = append(f.unpinned, cid.String())
+	return nil
+}
+
+func TestCollector(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		now     = time.Now()
+		uploads = []*models.Upload{
+			// expired, and not held by anyone else
+			{Hash: expiredHash, Type: "file", NetworkName: "public", UserName: "testuser", GarbageCollectDate: now.Add(-time.Hour)},
+			// expired, but still held by another upload
+			{Hash: heldHash, Type: "pin", NetworkName: "public", UserName: "testuser", GarbageCollectDate: now.Add(-time.Hour)},
+			// expiring within the warning period
+			{Hash: heldHash, Type: "pin", NetworkName: "public", UserName: "testuser", GarbageCollectDate: now.Add(time.Hour)},
+			// expired, but on a private network
+			{Hash: expiredHash, Type: "file", NetworkName: "privnet", UserName: "testuser", GarbageCollectDate: now.Add(-time.Hour)},
+		}
+	)
+	for _, upload := range uploads {
+		if err := dbm.DB.Create(upload).Error; err != nil {
+			t.Fatal(err)
+		}
+		defer dbm.DB.Unscoped().Delete(upload)
+	}
+	defer dbm.DB.Unscoped().Where("upload_id = ?", uploads[2].ID).Delete(&gc.ExpiryWarning{})
+	ipfs := &mocks.FakeManager{}
+	ipfs.StatReturns(&shell.ObjectStats{CumulativeSize: 100}, nil)
+	ipfs.CustomRequestReturns(&shell.Response{}, nil)
+	cluster := &fakeCluster{}
+	notify := func(username, email, subject, content string) error { return nil }
+	tests := []struct {
+		name          string
+		dryRun        bool
+		wantCollected int
+		wantUnpinned  int
+		wantFreed     uint64
+		wantWarnings  int
+	}{
+		{"DryRun", true, 2, 1, 200, 0},
+		{"Collect", false, 2, 1, 200, 1},
+		{"AlreadyCollected", false, 0, 0, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := gc.NewCollector(dbm.DB, ipfs, cluster, notify, gc.Options{
+				BatchSize: 1,
+				DryRun:    tt.dryRun,
+			}, zap.NewNop().Sugar())
+			result, err := collector.Collect(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Collected != tt.wantCollected || result.Unpinned != tt.wantUnpinned || result.FreedBytes != tt.wantFreed {
+				t.Fatalf("unexpected result %+v", result)
+			}
+			warnings, err := gc.NewManager(dbm.DB).FindByUserName("testuser")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var warned int
+			for _, w := range warnings {
+				if w.UploadID == uploads[2].ID {
+					warned++
+				}
+			}
+			if warned != tt.wantWarnings {
+				t.Fatalf("found %v warnings, want %v", warned, tt.wantWarnings)
+			}
+		})
+	}
+	// only content no longer held by any upload is unpinned
+	if len(cluster.unpinned) != 1 || cluster.unpinned[0] != expiredHash {
+		t.Fatalf("unexpected cluster unpins %v", cluster.unpinned)
+	}
+	if ipfs.CustomRequestCallCount() != 1 {
+		t.Fatalf("expected 1 ipfs unpin, got %v", ipfs.CustomRequestCallCount())
+	}
+	var remaining int
+	if err := dbm.DB.Model(&models.Upload{}).Where("id IN (?)", []uint{uploads[2].ID, uploads[3].ID}).Count(&remaining).Error; err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 2 {
+		t.Fatalf("expected held and private uploads to remain, found %v", remaining)
+	}
+}
+
+func TestRenewer(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	// renewals are subject to spending caps
+	if err := billing.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		now     = time.Now()
+		gm      = gc.NewManager(dbm.DB)
+		um      = models.NewUserManager(dbm.DB)
+		uploads = []*models.Upload{
+			// expiring within the renewal window
+			{Hash: renewHash, Type: "pin", NetworkName: "public", UserName: "testuser", GarbageCollectDate: now.Add(time.Hour)},
+			// expired, within the grace period, and too large to pay for
+			{Hash: lowHash, Type: "pin", NetworkName: "public", UserName: "testuser", GarbageCollectDate: now.Add(-time.Hour)},
+		}
+	)
+	for _, upload := range uploads {
+		if err := dbm.DB.Create(upload).Error; err != nil {
+			t.Fatal(err)
+		}
+		defer dbm.DB.Unscoped().Delete(upload)
+		if _, err := gm.EnableRenewal(upload.UserName, upload.Hash, upload.NetworkName, 1); err != nil {
+			t.Fatal(err)
+		}
+		defer gm.DisableRenewal(upload.UserName, upload.Hash, upload.NetworkName)
+	}
+	if _, err := um.AddCredits("testuser", 10); err != nil {
+		t.Fatal(err)
+	}
+	ipfs := &mocks.FakeManager{}
+	ipfs.StatCalls(func(hash string) (*shell.ObjectStats, error) {
+		if hash == lowHash {
+			return &shell.ObjectStats{CumulativeSize: 1 << 60}, nil
+		}
+		return &shell.ObjectStats{CumulativeSize: 1 << 20}, nil
+	})
+	var toppedUp int
+	renewer := gc.NewRenewer(dbm.DB, ipfs, func(username, email, subject, content string) error {
+		return nil
+	}, func(username string) error {
+		toppedUp++
+		return nil
+	}, gc.Options{GracePeriod: time.Hour * 24}, zap.NewNop().Sugar())
+	tests := []struct {
+		name           string
+		wantRenewed    int
+		wantLowBalance int
+		wantToppedUp   int
+	}{
+		{"Renew", 1, 1, 1},
+		// the renewed upload is no longer within the renewal window
+		{"AlreadyRenewed", 0, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, err := um.GetCreditsForUser("testuser")
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := renewer.Renew(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Renewed != tt.wantRenewed || result.LowBalance != tt.wantLowBalance || result.Failed != 0 {
+				t.Fatalf("unexpected result %+v", result)
+			}
+			after, err := um.GetCreditsForUser("testuser")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spent := before - after; spent < result.Credits-0.0001 || spent > result.Credits+0.0001 {
+				t.Fatalf("expected %v credits to be spent, got %v", result.Credits, spent)
+			}
+			if toppedUp != tt.wantToppedUp {
+				t.Fatalf("expected %v top ups, got %v", tt.wantToppedUp, toppedUp)
+			}
+		})
+	}
+	renewed, err := models.NewUploadManager(dbm.DB).FindUploadByHashAndUserAndNetwork("testuser", renewHash, "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uploads[0].GarbageCollectDate.AddDate(0, 1, 0); renewed.GarbageCollectDate.Sub(want) > time.Second || want.Sub(renewed.GarbageCollectDate) > time.Second {
+		t.Fatalf("expected garbage collect date %v, got %v", want, renewed.GarbageCollectDate)
+	}
+	renewal, err := gm.FindRenewal("testuser", lowHash, "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewal.NotifiedDate == nil || renewal.LastError == "" {
+		t.Fatalf("expected low balance to be recorded, got %+v", renewal)
+	}
+}
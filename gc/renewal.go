@@ -0,0 +1,339 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/billing"
+	"github.com/RTradeLtd/Temporal/ledger"
+	"github.com/RTradeLtd/Temporal/utils"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/gorm"
+	"github.com/RTradeLtd/rtfs/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxHoldTime is the furthest into the future an upload may be held
+	maxHoldTime = time.Hour * 17520
+	// MaxRenewalMonths is the longest hold time a renewal may extend an upload by. As
+	// uploads are renewed before they expire, renewing by two years would always
+	// breach the maximum hold time
+	MaxRenewalMonths = 23
+)
+
+var (
+	// ErrFreeTier is returned when free accounts attempt to renew uploads
+	ErrFreeTier = errors.New("free accounts are not allowed to extend pin times")
+	// ErrMaxHoldTime is returned when renewing an upload would hold it for longer than two years
+	ErrMaxHoldTime = errors.New("renewing would result in a pin time longer than 2 years")
+	// errLowBalance is returned when a user doesn't have enough credits to renew an upload
+	errLowBalance = errors.New("insufficient credits to renew upload")
+)
+
+// Renewal is an upload which is renewed automatically before it expires,
+// paid for using the prepaid credits of its owner
+type Renewal struct {
+	gorm.Model
+	UserName    string `gorm:"type:varchar(255);unique_index:idx_renewal_user_hash_network"`
+	Hash        string `gorm:"type:varchar(255);unique_index:idx_renewal_user_hash_network"`
+	NetworkName string `gorm:"type:varchar(255);unique_index:idx_renewal_user_hash_network"`
+	// HoldTimeInMonths is how long the hold time is extended by with each renewal
+	HoldTimeInMonths int64
+	LastRenewedAt    *time.Time
+	// NotifiedDate is the garbage collection date the user was last told
+	// they don't have enough credits to renew for
+	NotifiedDate *time.Time `json:"-"`
+	// LastError is the reason the last renewal attempt failed
+	LastError string `gorm:"type:text"`
+}
+
+// EnableRenewal is used to renew an upload by the given number of months whenever
+// it is about to expire. If renewal is already enabled, the hold time is updated
+func (m *Manager) EnableRenewal(username, hash, network string, holdTimeInMonths int64) (*Renewal, error) {
+	renewal := &Renewal{}
+	if err := m.DB.Where(Renewal{
+		UserName:    username,
+		Hash:        hash,
+		NetworkName: network,
+	}).Assign(Renewal{HoldTimeInMonths: holdTimeInMonths}).FirstOrCreate(renewal).Error; err != nil {
+		return nil, err
+	}
+	return renewal, nil
+}
+
+// DisableRenewal is used to stop renewing an upload. The renewal is removed
+// permanently, so that renewal may be enabled again later
+func (m *Manager) DisableRenewal(username, hash, network string) error {
+	return m.DB.Unscoped().Where(
+		"user_name = ? AND hash = ? AND network_name = ?",
+		username, hash, network,
+	).Delete(&Renewal{}).Error
+}
+
+// FindRenewal is used to find the renewal of an upload
+func (m *Manager) FindRenewal(username, hash, network string) (*Renewal, error) {
+	renewal := &Renewal{}
+	if err := m.DB.Where(
+		"user_name = ? AND hash = ? AND network_name = ?",
+		username, hash, network,
+	).First(renewal).Error; err != nil {
+		return nil, err
+	}
+	return renewal, nil
+}
+
+// RenewResult summarizes a renewal run
+type RenewResult struct {
+	// Renewed is the number of uploads whose hold time was extended
+	Renewed int
+	// Credits is the amount of credits spent on renewals
+	Credits float64
+	// LowBalance is the number of uploads which couldn't be renewed as their owner lacked
+	// credits, or renewing them would exceed the spending caps of their owner
+	LowBalance int
+	// Failed is the number of uploads which couldn't be renewed for any other reason
+	Failed int
+}
+
+// Renewer extends the hold time of uploads with renewal enabled before they expire.
+// Only a single renewer should run at a time
+type Renewer struct {
+	db     *gorm.DB
+	ipfs   rtfs.Manager
+	notify NotifyFunc
+	topUp  TopUpFunc
+	opts   Options
+	l      *zap.SugaredLogger
+}
+
+// NewRenewer is used to instantiate our renewer. Zero value options, other than the
+// grace period, are replaced with their defaults. topUp may be nil, in which case the
+// credits of users are not topped up after their renewals are charged
+func NewRenewer(db *gorm.DB, ipfs rtfs.Manager, notify NotifyFunc, topUp TopUpFunc, opts Options, logger *zap.SugaredLogger) *Renewer {
+	return &Renewer{
+		db:     db,
+		ipfs:   ipfs,
+		notify: notify,
+		topUp:  topUp,
+		opts:   opts.withDefaults(),
+		l:      logger.Named("renewer"),
+	}
+}
+
+// Run is used to renew uploads every interval until ctx is cancelled
+func (r *Renewer) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.Renew(ctx); err != nil {
+			r.l.Errorw("renewal failed", "error", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Renew is used to renew uploads which expire within the renewal window, including
+// those which have expired but are still within their grace period
+func (r *Renewer) Renew(ctx context.Context) (RenewResult, error) {
+	var (
+		result RenewResult
+		lastID uint
+		now    = time.Now()
+	)
+	for {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		var renewals []Renewal
+		if err := r.db.Select("renewals.*").Joins(
+			"JOIN uploads ON uploads.user_name = renewals.user_name AND uploads.hash = renewals.hash AND uploads.network_name = renewals.network_name AND uploads.deleted_at IS NULL",
+		).Where(
+			"renewals.id > ? AND uploads.garbage_collect_date < ? AND uploads.garbage_collect_date >= ?",
+			lastID, now.Add(r.opts.RenewalWindow), now.Add(-r.opts.GracePeriod),
+		).Order("renewals.id").Limit(r.opts.BatchSize).Find(&renewals).Error; err != nil {
+			return result, err
+		}
+		for _, renewal := range renewals {
+			lastID = renewal.ID
+			cost, err := r.renew(renewal, now)
+			switch err {
+			case nil:
+				result.Renewed++
+				result.Credits += cost
+			case errLowBalance, billing.ErrDailyCapExceeded, billing.ErrMonthlyCapExceeded:
+				result.LowBalance++
+			default:
+				result.Failed++
+				r.l.Errorw(
+					"failed to renew upload",
+					"error", err.Error(),
+					"user", renewal.UserName,
+					"hash", renewal.Hash)
+				r.db.Model(&renewal).Update("last_error", err.Error())
+			}
+		}
+		if len(renewals) < r.opts.BatchSize {
+			break
+		}
+	}
+	r.l.Infow(
+		"renewal finished",
+		"dry_run", r.opts.DryRun,
+		"renewed", result.Renewed,
+		"credits", result.Credits,
+		"low_balance", result.LowBalance,
+		"failed", result.Failed)
+	return result, nil
+}
+
+// renew is used to charge the owner of an upload for its renewal, and extend its hold time
+func (r *Renewer) renew(renewal Renewal, now time.Time) (float64, error) {
+	upload, err := models.NewUploadManager(r.db).FindUploadByHashAndUserAndNetwork(
+		renewal.UserName, renewal.Hash, renewal.NetworkName)
+	if err != nil {
+		return 0, err
+	}
+	usage, err := models.NewUsageManager(r.db).FindByUserName(renewal.UserName)
+	if err != nil {
+		return 0, err
+	}
+	if usage.Tier == models.Free {
+		return 0, ErrFreeTier
+	}
+	if upload.GarbageCollectDate.AddDate(0, int(renewal.HoldTimeInMonths), 0).Sub(now) > maxHoldTime {
+		return 0, ErrMaxHoldTime
+	}
+	cost, err := utils.CalculatePinCost(
+		renewal.UserName, renewal.Hash, renewal.HoldTimeInMonths, r.ipfs, models.NewUsageManager(r.db))
+	if err != nil {
+		return 0, err
+	}
+	user, err := models.NewUserManager(r.db).FindByUserName(renewal.UserName)
+	if err != nil {
+		return 0, err
+	}
+	if user.Credits < cost {
+		if err := r.notifyUnpaid(renewal, user, upload, cost, errLowBalance); err != nil {
+			r.l.Errorw("failed to notify user of low balance", "error", err.Error(), "user", user.UserName)
+		}
+		return 0, errLowBalance
+	}
+	if r.opts.DryRun {
+		r.l.Infow(
+			"would renew upload",
+			"user", renewal.UserName,
+			"hash", renewal.Hash,
+			"months", renewal.HoldTimeInMonths,
+			"cost", cost)
+		return cost, nil
+	}
+	// credits are removed within the same transaction as the hold time is extended, so
+	// that a failure to do either leaves the user unchanged. Renewals are charged like
+	// any other request, so they are subject to the spending caps of the user
+	tx := r.db.Begin()
+	var alerts []billing.Alert
+	if cost > 0 {
+		if alerts, err = billing.NewManager(tx).Charge(renewal.UserName, cost, ledger.Renewal, renewal.Hash, now); err != nil {
+			tx.Rollback()
+			if err == billing.ErrDailyCapExceeded || err == billing.ErrMonthlyCapExceeded {
+				if notifyErr := r.notifyUnpaid(renewal, user, upload, cost, err); notifyErr != nil {
+					r.l.Errorw("failed to notify user of spending cap", "error", notifyErr.Error(), "user", user.UserName)
+				}
+			}
+			return 0, err
+		}
+	}
+	if err := models.NewUploadManager(tx).ExtendGarbageCollectionPeriod(
+		renewal.UserName, renewal.Hash, renewal.NetworkName, int(renewal.HoldTimeInMonths),
+	); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Model(&renewal).Updates(map[string]interface{}{
+		"last_renewed_at": now,
+		"notified_date":   nil,
+		"last_error":      "",
+	}).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+	r.l.Infow(
+		"renewed upload",
+		"user", renewal.UserName,
+		"hash", renewal.Hash,
+		"months", renewal.HoldTimeInMonths,
+		"cost", cost)
+	r.notifyAlerts(user, alerts)
+	if cost > 0 && r.topUp != nil {
+		if err := r.topUp(renewal.UserName); err != nil {
+			r.l.Errorw("automatic top up failed", "error", err.Error(), "user", renewal.UserName)
+		}
+	}
+	return cost, nil
+}
+
+// notifyUnpaid is used to email a user who can't pay to renew an upload, as they either don't
+// have enough credits, or renewing would exceed their spending caps. Users are only notified
+// once for each garbage collection date of an upload
+func (r *Renewer) notifyUnpaid(renewal Renewal, user *models.User, upload *models.Upload, cost float64, reason error) error {
+	if renewal.NotifiedDate != nil && renewal.NotifiedDate.Equal(upload.GarbageCollectDate) {
+		return nil
+	}
+	if r.opts.DryRun {
+		r.l.Infow("would notify user of failed renewal", "user", user.UserName, "hash", renewal.Hash, "reason", reason.Error())
+		return nil
+	}
+	if user.EmailEnabled && r.notify != nil {
+		var (
+			subject  = "TEMPORAL Automatic Renewal Failed"
+			deadline = upload.GarbageCollectDate.Add(r.opts.GracePeriod).UTC().Format(time.RFC1123)
+			content  string
+		)
+		switch reason {
+		case billing.ErrDailyCapExceeded, billing.ErrMonthlyCapExceeded:
+			period := "daily"
+			if reason == billing.ErrMonthlyCapExceeded {
+				period = "monthly"
+			}
+			content = fmt.Sprintf(
+				"We were unable to renew %s as renewing it for %v months costs %v credits, which would exceed your %s spending cap.<br><br>"+
+					"Please raise your spending cap before %s, otherwise your upload will be removed.",
+				renewal.Hash, renewal.HoldTimeInMonths, cost, period, deadline)
+		default:
+			content = fmt.Sprintf(
+				"We were unable to renew %s as renewing it for %v months costs %v credits, and you have %v credits remaining.<br><br>"+
+					"Please top up your credits before %s, otherwise your upload will be removed.",
+				renewal.Hash, renewal.HoldTimeInMonths, cost, user.Credits, deadline)
+		}
+		if err := r.notify(user.UserName, user.EmailAddress, subject, content); err != nil {
+			return err
+		}
+	}
+	return r.db.Model(&renewal).Updates(map[string]interface{}{
+		"notified_date": upload.GarbageCollectDate,
+		"last_error":    reason.Error(),
+	}).Error
+}
+
+// notifyAlerts is used to email a user of the spending alerts raised by charging them for a renewal
+func (r *Renewer) notifyAlerts(user *models.User, alerts []billing.Alert) {
+	if !user.EmailEnabled || r.notify == nil {
+		return
+	}
+	for _, alert := range alerts {
+		subject, content := alert.Email(user.UserName)
+		if err := r.notify(user.UserName, user.EmailAddress, subject, content); err != nil {
+			r.l.Errorw("failed to notify user of spending alert", "error", err.Error(), "user", user.UserName)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package gc
+
+import (
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/gorm"
+)
+
+// ExpiryWarning records that a user was warned an upload is about to expire. Warnings are
+// tied to the garbage collection date, so extending the hold time of an upload results
+// in the user being warned again before the new date
+type ExpiryWarning struct {
+	gorm.Model
+	UploadID           uint      `gorm:"unique_index:idx_expiry_warning_upload_date"`
+	UserName           string    `gorm:"type:varchar(255);index"`
+	GarbageCollectDate time.Time `gorm:"unique_index:idx_expiry_warning_upload_date"`
+}
+
+// Manager is used to manipulate expiry warnings, and renewals in our database
+type Manager struct {
+	DB *gorm.DB
+}
+
+// NewManager is used to instantiate our garbage collection manager
+func NewManager(db *gorm.DB) *Manager {
+	return &Manager{DB: db}
+}
+
+// Migrate is used to create or update the expiry warning, and renewal tables
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&ExpiryWarning{}, &Renewal{}).Error
+}
+
+// RecordWarnings is used to record that the owner of each upload has been warned of its expiry
+func (m *Manager) RecordWarnings(uploads []models.Upload) error {
+	tx := m.DB.Begin()
+	for _, upload := range uploads {
+		if err := tx.Create(&ExpiryWarning{
+			UploadID:           upload.ID,
+			UserName:           upload.UserName,
+			GarbageCollectDate: upload.GarbageCollectDate,
+		}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// FindByUserName is used to find the expiry warnings sent to a user
+func (m *Manager) FindByUserName(username string) ([]ExpiryWarning, error) {
+	var warnings []ExpiryWarning
+	if err := m.DB.Where("user_name = ?", username).Order("id").Find(&warnings).Error; err != nil {
+		return nil, err
+	}
+	return warnings, nil
+}
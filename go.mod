@@ -38,6 +38,7 @@ require (
 	github.com/ipfs/go-path v0.0.3
 	github.com/ipfs/ipfs-cluster v0.10.1
 	github.com/json-iterator/go v1.1.6 // indirect
+	github.com/lib/pq v1.1.0
 	github.com/libp2p/go-libp2p v0.0.13 // indirect
 	github.com/libp2p/go-libp2p-connmgr v0.0.3 // indirect
 	github.com/libp2p/go-libp2p-crypto v0.0.1
@@ -54,6 +55,7 @@ require (
 	github.com/streadway/amqp v0.0.0-20190404075320-75d898a42a94
 	github.com/stripe/stripe-go v60.0.1+incompatible
 	go.uber.org/zap v1.9.1
+	golang.org/x/crypto v0.0.0-20190418165655-df01cb2cc480
 	golang.org/x/net v0.0.0-20190420063019-afa5a82059c6
 	google.golang.org/genproto v0.0.0-20190418145605-e7d98fc518a7
 	google.golang.org/grpc v1.20.1
@@ -0,0 +1,2 @@
+// Package jobs provides status tracking of asynchronous operations processed by our queues
+package jobs
@@ -0,0 +1,100 @@
+package jobs
+
+import (
+	"github.com/RTradeLtd/gorm"
+	"github.com/google/uuid"
+)
+
+// State is the processing state of a job
+type State string
+
+const (
+	// Queued indicates the job is waiting to be processed
+	Queued State = "queued"
+	// Processing indicates the job is being processed
+	Processing State = "processing"
+	// Succeeded indicates the job was processed successfully
+	Succeeded State = "succeeded"
+	// Failed indicates the job could not be processed
+	Failed State = "failed"
+	// Refunded indicates the job could not be processed, and its cost was refunded
+	Refunded State = "refunded"
+)
+
+// Job is an asynchronous operation requested by a user
+type Job struct {
+	gorm.Model
+	JobID    string `gorm:"type:varchar(255);unique"`
+	UserName string `gorm:"type:varchar(255)"`
+	// Type is the name of the queue processing the job
+	Type string `gorm:"type:varchar(255)"`
+	// Reference identifies what the job operates on, such as a content hash or key name
+	Reference string `gorm:"type:varchar(255)"`
+	State     State  `gorm:"type:varchar(255)"`
+	// Reason contains the error which caused the job to fail, or be retried
+	Reason string `gorm:"type:text"`
+}
+
+// Manager is used to manipulate jobs in our database
+type Manager struct {
+	DB *gorm.DB
+}
+
+// NewManager is used to instantiate our job manager
+func NewManager(db *gorm.DB) *Manager {
+	return &Manager{DB: db}
+}
+
+// Migrate is used to create or update the jobs table
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Job{}).Error
+}
+
+// NewJob is used to create a queued job with a newly generated job id
+func (m *Manager) NewJob(username, jobType, reference string) (*Job, error) {
+	job := &Job{
+		JobID:     uuid.New().String(),
+		UserName:  username,
+		Type:      jobType,
+		Reference: reference,
+		State:     Queued,
+	}
+	if err := m.DB.Create(job).Error; err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// FindByJobID is used to find a job by its id
+func (m *Manager) FindByJobID(jobID string) (*Job, error) {
+	var job Job
+	if err := m.DB.Where("job_id = ?", jobID).First(&job).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// FindByUserName is used to find the most recent jobs of a user, optionally
+// filtered by state. A limit of 0 returns all jobs
+func (m *Manager) FindByUserName(username string, state State, limit int) ([]Job, error) {
+	var jobs []Job
+	query := m.DB.Where("user_name = ?", username)
+	if state != "" {
+		query = query.Where("state = ?", state)
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Order("created_at desc").Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// UpdateState is used to transition a job to the given state. Refunded is a terminal
+// state, so refunded jobs are not transitioned
+func (m *Manager) UpdateState(jobID string, state State, reason string) error {
+	return m.DB.Model(&Job{}).
+		Where("job_id = ? AND state <> ?", jobID, Refunded).
+		Updates(map[string]interface{}{"state": state, "reason": reason}).Error
+}
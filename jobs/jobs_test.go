@@ -0,0 +1,63 @@
+package jobs_test
+
+import (
+	"testing"
+
+	"github.com/RTradeLtd/Temporal/jobs"
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2"
+)
+
+const testCfgPath = "../testenv/config.json"
+
+func TestJobs(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jobs.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	jm := jobs.NewManager(dbm.DB)
+	job, err := jm.NewJob("testuser", "ipfs-pin-queue", "QmS4ustL54uo8FzR9455qaxZwuMiUhyvMcX9Ba8nUH4uVv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.DB.Unscoped().Delete(job)
+	tests := []struct {
+		name      string
+		state     jobs.State
+		reason    string
+		wantState jobs.State
+	}{
+		{"Processing", jobs.Processing, "", jobs.Processing},
+		{"Refunded", jobs.Refunded, "failed to pin", jobs.Refunded},
+		// refunded is terminal, so the job should not transition
+		{"FailedAfterRefund", jobs.Failed, "failed to pin", jobs.Refunded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := jm.UpdateState(job.JobID, tt.state, tt.reason); err != nil {
+				t.Fatal(err)
+			}
+			found, err := jm.FindByJobID(job.JobID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found.State != tt.wantState {
+				t.Fatalf("state = %s, want %s", found.State, tt.wantState)
+			}
+		})
+	}
+	found, err := jm.FindByUserName("testuser", jobs.Refunded, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) == 0 {
+		t.Fatal("expected to find refunded job")
+	}
+}
@@ -0,0 +1,2 @@
+// Package ledger provides an append-only record of every change made to the credits of our users
+package ledger
@@ -0,0 +1,167 @@
+package ledger
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/gorm"
+)
+
+var (
+	// ErrInsufficientCredits is returned when a debit would result in a negative balance
+	ErrInsufficientCredits = errors.New("unable to remove credits, would result in negative balance")
+	// ErrInvalidAmount is returned when the amount of a change isn't positive
+	ErrInvalidAmount = errors.New("amount must be greater than 0")
+)
+
+// Reason is why the credits of a user changed
+type Reason string
+
+const (
+	// Opening records the credits a user held before their first entry
+	Opening Reason = "opening"
+	// Charge records credits spent on a request, referencing its job
+	Charge Reason = "charge"
+	// Refund records credits returned after a request could not be processed
+	Refund Reason = "refund"
+	// Renewal records credits spent automatically renewing a pin, referencing its hash
+	Renewal Reason = "renewal"
+	// Payment records credits purchased, referencing the transaction hash, or charge id of the payment
+	Payment Reason = "payment"
+	// Reversal records credits removed after their payment was refunded, disputed or failed
+	Reversal Reason = "reversal"
+	// Grant records credits given to a user without payment
+	Grant Reason = "grant"
+)
+
+// Entry is a single change to the credits of a user. Entries are never
+// updated or removed, so the entries of a user sum to their balance
+type Entry struct {
+	gorm.Model
+	UserName string `gorm:"type:varchar(255);index"`
+	// Amount is positive for credits, and negative for debits
+	Amount float64
+	Reason Reason `gorm:"type:varchar(255)"`
+	// Reference identifies what the change was for, such as a job id, content hash or payment
+	Reference string `gorm:"type:varchar(255)"`
+	// BalanceAfter is the credits of the user once the change was applied
+	BalanceAfter float64
+}
+
+// TableName is used to store entries in the ledger_entries table
+func (Entry) TableName() string {
+	return "ledger_entries"
+}
+
+// Manager is used to change the credits of users, recording each change in our ledger
+type Manager struct {
+	DB *gorm.DB
+}
+
+// NewManager is used to instantiate our ledger manager. When db is a transaction,
+// changes are applied within it, otherwise each change uses its own transaction
+func NewManager(db *gorm.DB) *Manager {
+	return &Manager{DB: db}
+}
+
+// Migrate is used to create or update the ledger entries table
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Entry{}).Error
+}
+
+// Credit is used to add credits to a user
+func (m *Manager) Credit(username string, amount float64, reason Reason, reference string) (*Entry, error) {
+	if !(amount > 0) {
+		return nil, ErrInvalidAmount
+	}
+	return m.apply(username, amount, reason, reference, false)
+}
+
+// Debit is used to remove credits from a user, failing if they can't afford it
+func (m *Manager) Debit(username string, amount float64, reason Reason, reference string) (*Entry, error) {
+	if !(amount > 0) {
+		return nil, ErrInvalidAmount
+	}
+	return m.apply(username, -amount, reason, reference, true)
+}
+
+// Reverse is used to remove credits granted by a payment which was refunded, disputed
+// or failed. As the credits may have already been spent, this may result in a negative balance
+func (m *Manager) Reverse(username string, amount float64, reference string) (*Entry, error) {
+	if !(amount > 0) {
+		return nil, ErrInvalidAmount
+	}
+	return m.apply(username, -amount, Reversal, reference, false)
+}
+
+// FindByUserName is used to find the most recent entries of a user. A limit of 0 returns all entries
+func (m *Manager) FindByUserName(username string, limit int) ([]Entry, error) {
+	var entries []Entry
+	query := m.DB.Where("user_name = ?", username)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Order("id desc").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// apply is used to change the balance of a user by amount, recording the change. The
+// balance and entry are always written together, and the user is locked until the
+// transaction completes, so concurrent changes can't be lost
+func (m *Manager) apply(username string, amount float64, reason Reason, reference string, checkBalance bool) (*Entry, error) {
+	if _, ok := m.DB.CommonDB().(*sql.Tx); !ok {
+		tx := m.DB.Begin()
+		if tx.Error != nil {
+			return nil, tx.Error
+		}
+		entry, err := NewManager(tx).apply(username, amount, reason, reference, checkBalance)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		return entry, tx.Commit().Error
+	}
+	var user models.User
+	if err := m.DB.Set("gorm:query_option", "FOR UPDATE").
+		Where("user_name = ?", username).First(&user).Error; err != nil {
+		return nil, err
+	}
+	balance := user.Credits + amount
+	if checkBalance && balance < 0 {
+		return nil, ErrInsufficientCredits
+	}
+	// credits held before the ledger was introduced are recorded
+	// as an opening entry, so that entries sum to the balance
+	var count int
+	if err := m.DB.Model(&Entry{}).Where("user_name = ?", username).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 && user.Credits != 0 {
+		if err := m.DB.Create(&Entry{
+			UserName:     username,
+			Amount:       user.Credits,
+			Reason:       Opening,
+			BalanceAfter: user.Credits,
+		}).Error; err != nil {
+			return nil, err
+		}
+	}
+	if err := m.DB.Model(&models.User{}).Where("user_name = ?", username).
+		Update("credits", balance).Error; err != nil {
+		return nil, err
+	}
+	entry := &Entry{
+		UserName:     username,
+		Amount:       amount,
+		Reason:       reason,
+		Reference:    reference,
+		BalanceAfter: balance,
+	}
+	if err := m.DB.Create(entry).Error; err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
@@ -0,0 +1,109 @@
+package ledger_test
+
+import (
+	"testing"
+
+	"github.com/RTradeLtd/Temporal/ledger"
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2"
+	"github.com/RTradeLtd/database/v2/models"
+)
+
+const (
+	testCfgPath = "../testenv/config.json"
+	testUser    = "ledgertestuser"
+)
+
+func TestLedger(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	um := models.NewUserManager(dbm.DB)
+	user, err := um.NewUserAccount(testUser, "password123", testUser+"@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.DB.Unscoped().Delete(user)
+	defer dbm.DB.Unscoped().Where("user_name = ?", testUser).Delete(&ledger.Entry{})
+	// credits held before the ledger should be recorded by an opening entry
+	if err := dbm.DB.Model(user).Update("credits", 10).Error; err != nil {
+		t.Fatal(err)
+	}
+	lm := ledger.NewManager(dbm.DB)
+	tests := []struct {
+		name        string
+		change      func() (*ledger.Entry, error)
+		wantErr     error
+		wantBalance float64
+	}{
+		{"Charge", func() (*ledger.Entry, error) { return lm.Debit(testUser, 4, ledger.Charge, "job") }, nil, 6},
+		{"InsufficientCredits", func() (*ledger.Entry, error) { return lm.Debit(testUser, 100, ledger.Charge, "job") }, ledger.ErrInsufficientCredits, 6},
+		{"Refund", func() (*ledger.Entry, error) { return lm.Credit(testUser, 2, ledger.Refund, "job") }, nil, 8},
+		{"InvalidAmount", func() (*ledger.Entry, error) { return lm.Credit(testUser, 0, ledger.Grant, "") }, ledger.ErrInvalidAmount, 8},
+		// reversals may result in a negative balance
+		{"Reversal", func() (*ledger.Entry, error) { return lm.Reverse(testUser, 20, "ch_test") }, nil, -12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := tt.change()
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && entry.BalanceAfter != tt.wantBalance {
+				t.Fatalf("balance after = %v, want %v", entry.BalanceAfter, tt.wantBalance)
+			}
+			credits, err := um.GetCreditsForUser(testUser)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if credits != tt.wantBalance {
+				t.Fatalf("credits = %v, want %v", credits, tt.wantBalance)
+			}
+		})
+	}
+	entries, err := lm.FindByUserName(testUser, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantReasons := []ledger.Reason{ledger.Reversal, ledger.Refund, ledger.Charge, ledger.Opening}
+	if len(entries) != len(wantReasons) {
+		t.Fatalf("found %v entries, want %v", len(entries), len(wantReasons))
+	}
+	for i, reason := range wantReasons {
+		if entries[i].Reason != reason {
+			t.Fatalf("entry %v reason = %s, want %s", i, entries[i].Reason, reason)
+		}
+	}
+	// verify should only report drift once the balance is changed outside of the ledger
+	for _, wantDrift := range []bool{false, true} {
+		if wantDrift {
+			if err := dbm.DB.Model(user).Update("credits", 100).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+		report, err := lm.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var drifted bool
+		for _, drift := range report.Drift {
+			if drift.UserName == testUser {
+				drifted = true
+				if drift.Derived != -12 || drift.Balance != 100 {
+					t.Fatalf("unexpected drift %+v", drift)
+				}
+			}
+		}
+		if drifted != wantDrift {
+			t.Fatalf("drifted = %v, want %v", drifted, wantDrift)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package ledger
+
+import (
+	"math"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/gorm"
+)
+
+// tolerance is the largest difference between balances which isn't considered drift,
+// allowing for the rounding of floating point credits
+const tolerance = 1e-6
+
+// Drift is a user whose balance doesn't match the balance derived from their entries
+type Drift struct {
+	UserName string `json:"user_name"`
+	// Balance is the credits currently held by the user
+	Balance float64 `json:"balance"`
+	// Derived is the sum of the amounts of the entries of the user
+	Derived float64 `json:"derived"`
+	// Entries is the number of entries recorded for the user
+	Entries int `json:"entries"`
+	// FirstMismatch is the id of the first entry whose balance after doesn't
+	// follow from the entries before it, or 0 if every entry does
+	FirstMismatch uint `json:"first_mismatch"`
+}
+
+// Report is the result of verifying our ledger
+type Report struct {
+	// Users is the number of users with entries in our ledger
+	Users int `json:"users"`
+	// Drift contains the users whose balance doesn't match their entries
+	Drift []Drift `json:"drift"`
+}
+
+// Verify is used to re-derive the balance of each user from their entries, reporting any user
+// whose current balance, or recorded balances, don't match. Users without entries are not
+// checked, as their balance predates the ledger and is recorded by their first entry. Removed
+// users are treated as having no credits
+func (m *Manager) Verify() (*Report, error) {
+	rows, err := m.DB.Model(&Entry{}).Order("user_name asc, id asc").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var (
+		derived []*Drift
+		current *Drift
+	)
+	for rows.Next() {
+		var entry Entry
+		if err := m.DB.ScanRows(rows, &entry); err != nil {
+			return nil, err
+		}
+		if current == nil || current.UserName != entry.UserName {
+			current = &Drift{UserName: entry.UserName}
+			derived = append(derived, current)
+		}
+		current.Derived += entry.Amount
+		current.Entries++
+		if current.FirstMismatch == 0 && math.Abs(current.Derived-entry.BalanceAfter) > tolerance {
+			current.FirstMismatch = entry.ID
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	report := &Report{Users: len(derived), Drift: []Drift{}}
+	for _, user := range derived {
+		var found models.User
+		if err := m.DB.Select("credits").Where("user_name = ?", user.UserName).
+			First(&found).Error; err != nil && err != gorm.ErrRecordNotFound {
+			return nil, err
+		}
+		user.Balance = found.Credits
+		if user.FirstMismatch != 0 || math.Abs(user.Balance-user.Derived) > tolerance {
+			report.Drift = append(report.Drift, *user)
+		}
+	}
+	return report, nil
+}
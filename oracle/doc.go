@@ -0,0 +1,3 @@
+// Package oracle provides the USD price of the coins we accept as payment, aggregated
+// from multiple price providers so that no single provider is relied upon
+package oracle
@@ -0,0 +1,226 @@
+package oracle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrNoPrice is returned when too few providers return a price,
+// and no sufficiently recent price is cached
+var ErrNoPrice = errors.New("unable to retrieve a recent price")
+
+// ErrTooFewProviders is returned when an oracle is given fewer providers than
+// the number which must return a price, so that it could never return a price
+var ErrTooFewProviders = errors.New("fewer price providers than the minimum number of providers")
+
+// PriceOracle retrieves the USD price of a coin, such as ethereum or bitcoin
+type PriceOracle interface {
+	Price(ctx context.Context, coin string) (float64, error)
+}
+
+// Options configures our oracle
+type Options struct {
+	// TTL is how long prices are cached before being retrieved again
+	TTL time.Duration
+	// MaxStaleness is the oldest cached price returned when providers are unavailable
+	MaxStaleness time.Duration
+	// Timeout is how long providers are given to return a price
+	Timeout time.Duration
+	// MinProviders is the number of providers which must return a price. At least two are
+	// required by default, so that a single provider can't set the price we charge
+	MinProviders int
+	// FailureThreshold is the number of consecutive failures after which a provider is skipped
+	FailureThreshold int
+	// Cooldown is how long a failing provider is skipped for, before being tried again
+	Cooldown time.Duration
+}
+
+// DefaultOptions returns the options used for any left unset
+func DefaultOptions() Options {
+	return Options{
+		TTL:              time.Minute,
+		MaxStaleness:     time.Minute * 15,
+		Timeout:          time.Second * 10,
+		MinProviders:     2,
+		FailureThreshold: 3,
+		Cooldown:         time.Minute * 5,
+	}
+}
+
+func (o Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if o.TTL <= 0 {
+		o.TTL = defaults.TTL
+	}
+	if o.MaxStaleness < o.TTL {
+		o.MaxStaleness = o.TTL
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaults.Timeout
+	}
+	if o.MinProviders <= 0 {
+		o.MinProviders = defaults.MinProviders
+	}
+	if o.FailureThreshold <= 0 {
+		o.FailureThreshold = defaults.FailureThreshold
+	}
+	if o.Cooldown <= 0 {
+		o.Cooldown = defaults.Cooldown
+	}
+	return o
+}
+
+// quote is a cached price
+type quote struct {
+	price float64
+	at    time.Time
+}
+
+// breaker tracks the failures of a provider, skipping it once it fails repeatedly
+type breaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// Oracle is a PriceOracle returning the median of the prices returned by its providers.
+// Prices are cached, and providers which fail repeatedly are skipped for a cooldown
+// period, so that a provider being unavailable doesn't delay every request
+type Oracle struct {
+	providers []Provider
+	opts      Options
+	l         *zap.SugaredLogger
+	// now is used to retrieve the current time, allowing it to be replaced in tests
+	now func() time.Time
+
+	mux      sync.Mutex
+	cache    map[string]quote
+	breakers map[string]*breaker
+}
+
+// New is used to instantiate our oracle. Zero value options are replaced with their defaults.
+// An error is returned if there are fewer providers than the minimum number of providers
+func New(providers []Provider, opts Options, logger *zap.SugaredLogger) (*Oracle, error) {
+	opts = opts.withDefaults()
+	if len(providers) < opts.MinProviders {
+		return nil, ErrTooFewProviders
+	}
+	return &Oracle{
+		providers: providers,
+		opts:      opts,
+		l:         logger.Named("oracle"),
+		now:       time.Now,
+		cache:     make(map[string]quote),
+		breakers:  make(map[string]*breaker),
+	}, nil
+}
+
+// Price returns the USD price of coin. Cached prices are returned until they expire, after
+// which the median of the prices returned by available providers is used. If fewer than
+// the minimum number of providers return a price, the cached price is returned until it
+// becomes stale, after which ErrNoPrice is returned
+func (o *Oracle) Price(ctx context.Context, coin string) (float64, error) {
+	o.mux.Lock()
+	cached, ok := o.cache[coin]
+	o.mux.Unlock()
+	if ok && o.now().Sub(cached.at) < o.opts.TTL {
+		return cached.price, nil
+	}
+	prices := o.fetch(ctx, coin)
+	if len(prices) >= o.opts.MinProviders {
+		price := median(prices)
+		o.mux.Lock()
+		o.cache[coin] = quote{price: price, at: o.now()}
+		o.mux.Unlock()
+		return price, nil
+	}
+	o.l.Warnw("too few providers returned a price", "coin", coin, "providers", len(prices), "min_providers", o.opts.MinProviders)
+	if ok && o.now().Sub(cached.at) < o.opts.MaxStaleness {
+		o.l.Warnw("using cached price", "coin", coin, "age", o.now().Sub(cached.at).String(), "providers", len(prices))
+		return cached.price, nil
+	}
+	return 0, ErrNoPrice
+}
+
+// fetch is used to concurrently retrieve the price of coin from each available provider
+func (o *Oracle) fetch(ctx context.Context, coin string) []float64 {
+	ctx, cancel := context.WithTimeout(ctx, o.opts.Timeout)
+	defer cancel()
+	var (
+		wg      sync.WaitGroup
+		results = make([]float64, len(o.providers))
+	)
+	for i, provider := range o.providers {
+		if !o.allow(provider) {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, provider Provider) {
+			defer wg.Done()
+			price, err := provider.Price(ctx, coin)
+			if err == nil && (price <= 0 || math.IsNaN(price) || math.IsInf(price, 0)) {
+				err = fmt.Errorf("invalid price %v", price)
+			}
+			o.record(provider, err)
+			if err != nil {
+				o.l.Warnw("failed to retrieve price", "provider", provider.Name(), "coin", coin, "error", err.Error())
+				return
+			}
+			results[i] = price
+		}(i, provider)
+	}
+	wg.Wait()
+	var prices []float64
+	for _, price := range results {
+		if price > 0 {
+			prices = append(prices, price)
+		}
+	}
+	return prices
+}
+
+// allow returns whether a provider may be used. Once the cooldown of a failing provider
+// has passed, it is tried again, and skipped for another cooldown if it still fails
+func (o *Oracle) allow(provider Provider) bool {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	b, ok := o.breakers[provider.Name()]
+	return !ok || !o.now().Before(b.openUntil)
+}
+
+// record is used to update the breaker of a provider with the result of a request
+func (o *Oracle) record(provider Provider, err error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	b, ok := o.breakers[provider.Name()]
+	if !ok {
+		b = &breaker{}
+		o.breakers[provider.Name()] = b
+	}
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= o.opts.FailureThreshold {
+		b.openUntil = o.now().Add(o.opts.Cooldown)
+		o.l.Errorw("skipping failing provider", "provider", provider.Name(), "failures", b.failures, "until", b.openUntil)
+	}
+}
+
+// median returns the median of prices, which must not be empty
+func median(prices []float64) float64 {
+	sorted := append([]float64(nil), prices...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
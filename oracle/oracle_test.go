@@ -0,0 +1,159 @@
+package oracle
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakeProvider returns price, or fails if err is set
+type fakeProvider struct {
+	name  string
+	price float64
+	err   error
+	calls int
+}
+
+func (f *fakeProvider) Name() string { return f.name }
+
+func (f *fakeProvider) Price(ctx context.Context, coin string) (float64, error) {
+	f.calls++
+	return f.price, f.err
+}
+
+func TestOracle_Median(t *testing.T) {
+	tests := []struct {
+		name         string
+		prices       []float64
+		minProviders int
+		wantPrice    float64
+		wantErr      error
+	}{
+		{"Single", []float64{100}, 1, 100, nil},
+		{"Odd", []float64{100, 300, 110}, 0, 110, nil},
+		{"Even", []float64{100, 120, 110, 1000}, 0, 115, nil},
+		// invalid prices are ignored
+		{"Invalid", []float64{0, -1, 100, 110}, 0, 105, nil},
+		{"NoPrices", []float64{0}, 1, 0, ErrNoPrice},
+		// two providers must return a price by default
+		{"TooFewPrices", []float64{0, 100}, 0, 0, ErrNoPrice},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var providers []Provider
+			for i, price := range tt.prices {
+				providers = append(providers, &fakeProvider{name: string(rune('a' + i)), price: price})
+			}
+			o, err := New(providers, Options{MinProviders: tt.minProviders}, zap.NewNop().Sugar())
+			if err != nil {
+				t.Fatal(err)
+			}
+			price, err := o.Price(context.Background(), "ethereum")
+			if err != tt.wantErr {
+				t.Fatalf("Price() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if price != tt.wantPrice {
+				t.Fatalf("Price() = %v, want %v", price, tt.wantPrice)
+			}
+		})
+	}
+}
+
+func TestOracle_TooFewProviders(t *testing.T) {
+	if _, err := New([]Provider{&fakeProvider{name: "fake", price: 100}}, Options{}, zap.NewNop().Sugar()); err != ErrTooFewProviders {
+		t.Fatalf("New() err = %v, wantErr %v", err, ErrTooFewProviders)
+	}
+}
+
+func TestOracle_Cache(t *testing.T) {
+	var (
+		now      = time.Now()
+		provider = &fakeProvider{name: "fake", price: 100}
+	)
+	o, err := New([]Provider{provider}, Options{
+		TTL:              time.Minute,
+		MaxStaleness:     time.Minute * 5,
+		MinProviders:     1,
+		FailureThreshold: 2,
+		Cooldown:         time.Minute * 5,
+	}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.now = func() time.Time { return now }
+	tests := []struct {
+		name      string
+		elapsed   time.Duration
+		err       error
+		wantPrice float64
+		wantErr   error
+		wantCalls int
+	}{
+		{"Fetched", 0, nil, 100, nil, 1},
+		{"Cached", time.Second * 30, nil, 100, nil, 1},
+		// the cached price expired, but is returned while it isn't stale
+		{"ProviderFailing", time.Minute * 2, errors.New("unavailable"), 100, nil, 2},
+		// the provider failed twice in a row, and is skipped during the cooldown
+		{"BreakerTripped", time.Minute * 3, errors.New("unavailable"), 100, nil, 3},
+		{"BreakerOpen", time.Minute * 4, nil, 100, nil, 3},
+		{"Stale", time.Minute * 6, nil, 0, ErrNoPrice, 3},
+		// the cooldown has passed, so the provider is tried again
+		{"BreakerClosed", time.Minute * 9, nil, 100, nil, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider.err = tt.err
+			o.now = func() time.Time { return now.Add(tt.elapsed) }
+			price, err := o.Price(context.Background(), "ethereum")
+			if err != tt.wantErr {
+				t.Fatalf("Price() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if price != tt.wantPrice {
+				t.Fatalf("Price() = %v, want %v", price, tt.wantPrice)
+			}
+			if provider.calls != tt.wantCalls {
+				t.Fatalf("provider called %v times, want %v", provider.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestFile_Price(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oracle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "prices.json")
+	if err := ioutil.WriteFile(path, []byte(`{"ethereum": 180.5}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		path      string
+		coin      string
+		wantPrice float64
+		wantErr   bool
+	}{
+		{"Ethereum", path, "ethereum", 180.5, false},
+		{"Unknown", path, "bitcoin", 0, true},
+		{"MissingFile", filepath.Join(dir, "missing.json"), "ethereum", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			price, err := File{Path: tt.path}.Price(context.Background(), tt.coin)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Price() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if price != tt.wantPrice {
+				t.Fatalf("Price() = %v, want %v", price, tt.wantPrice)
+			}
+		})
+	}
+}
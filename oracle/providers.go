@@ -0,0 +1,178 @@
+package oracle
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	coinGeckoURL     = "https://api.coingecko.com/api/v3/simple/price"
+	coinCapURL       = "https://api.coincap.io/v2/assets"
+	coinMarketCapURL = "https://pro-api.coinmarketcap.com/v1/cryptocurrency/quotes/latest"
+	// maxResponseSize is the largest response we read from a provider
+	maxResponseSize = 1 << 20
+)
+
+// Provider retrieves the USD price of a coin from a single source. Coins are identified
+// by their name, such as ethereum or bitcoin
+type Provider interface {
+	Name() string
+	Price(ctx context.Context, coin string) (float64, error)
+}
+
+// Static is a provider returning fixed prices, useful for testing
+type Static map[string]float64
+
+// Name returns the name of the provider
+func (s Static) Name() string { return "static" }
+
+// Price returns the fixed price of coin
+func (s Static) Price(ctx context.Context, coin string) (float64, error) {
+	price, ok := s[coin]
+	if !ok {
+		return 0, fmt.Errorf("no price for %s", coin)
+	}
+	return price, nil
+}
+
+// File is a provider returning prices from a json file mapping coins to their USD price,
+// such as {"ethereum": 180.5}. The file is read on every request, so prices may be
+// updated without restarting
+type File struct {
+	Path string
+}
+
+// Name returns the name of the provider
+func (f File) Name() string { return "file" }
+
+// Price returns the price of coin from the file
+func (f File) Price(ctx context.Context, coin string) (float64, error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return 0, err
+	}
+	var prices Static
+	if err := json.Unmarshal(data, &prices); err != nil {
+		return 0, err
+	}
+	return prices.Price(ctx, coin)
+}
+
+// CoinGecko is a provider using the coingecko api
+type CoinGecko struct {
+	Client *http.Client
+}
+
+// Name returns the name of the provider
+func (p CoinGecko) Name() string { return "coingecko" }
+
+// Price retrieves the price of coin from coingecko
+func (p CoinGecko) Price(ctx context.Context, coin string) (float64, error) {
+	params := url.Values{"ids": {coin}, "vs_currencies": {"usd"}}
+	var decode map[string]struct {
+		USD float64 `json:"usd"`
+	}
+	if err := getJSON(ctx, p.Client, coinGeckoURL+"?"+params.Encode(), nil, &decode); err != nil {
+		return 0, err
+	}
+	price, ok := decode[coin]
+	if !ok {
+		return 0, fmt.Errorf("no price for %s", coin)
+	}
+	return price.USD, nil
+}
+
+// CoinCap is a provider using the coincap api
+type CoinCap struct {
+	Client *http.Client
+}
+
+// Name returns the name of the provider
+func (p CoinCap) Name() string { return "coincap" }
+
+// Price retrieves the price of coin from coincap
+func (p CoinCap) Price(ctx context.Context, coin string) (float64, error) {
+	var decode struct {
+		Data *struct {
+			PriceUsd string `json:"priceUsd"`
+		} `json:"data"`
+	}
+	if err := getJSON(ctx, p.Client, coinCapURL+"/"+url.PathEscape(coin), nil, &decode); err != nil {
+		return 0, err
+	}
+	if decode.Data == nil {
+		return 0, fmt.Errorf("no price for %s", coin)
+	}
+	return strconv.ParseFloat(decode.Data.PriceUsd, 64)
+}
+
+// CoinMarketCap is a provider using the coinmarketcap pro api, which requires an api key
+type CoinMarketCap struct {
+	Client *http.Client
+	APIKey string
+}
+
+// Name returns the name of the provider
+func (p CoinMarketCap) Name() string { return "coinmarketcap" }
+
+// Price retrieves the price of coin from coinmarketcap
+func (p CoinMarketCap) Price(ctx context.Context, coin string) (float64, error) {
+	params := url.Values{"slug": {coin}, "convert": {"USD"}}
+	var decode struct {
+		Data map[string]struct {
+			Slug  string `json:"slug"`
+			Quote map[string]struct {
+				Price float64 `json:"price"`
+			} `json:"quote"`
+		} `json:"data"`
+	}
+	if err := getJSON(
+		ctx, p.Client, coinMarketCapURL+"?"+params.Encode(),
+		http.Header{"X-CMC_PRO_API_KEY": {p.APIKey}}, &decode,
+	); err != nil {
+		return 0, err
+	}
+	// quotes are keyed by the id coinmarketcap assigns the coin
+	for _, quote := range decode.Data {
+		if usd, ok := quote.Quote["USD"]; ok && quote.Slug == coin {
+			return usd.Price, nil
+		}
+	}
+	return 0, fmt.Errorf("no price for %s", coin)
+}
+
+// NewHTTPClient returns a client suitable for use by providers
+func NewHTTPClient() *http.Client {
+	return &http.Client{Timeout: time.Second * 10}
+}
+
+// getJSON is used to decode the json response to a get request into out
+func getJSON(ctx context.Context, client *http.Client, url string, header http.Header, out interface{}) error {
+	if client == nil {
+		client = NewHTTPClient()
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(out)
+}
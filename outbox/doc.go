@@ -0,0 +1,4 @@
+// Package outbox implements a transactional outbox. Queue messages are recorded
+// in the same database transaction as the account changes which produce them, and
+// are published to rabbitmq by a relay once that transaction has committed
+package outbox
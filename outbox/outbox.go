@@ -0,0 +1,122 @@
+package outbox
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/RTradeLtd/gorm"
+)
+
+// Message is a queue message waiting to be, or which has been, published
+type Message struct {
+	gorm.Model
+	// Queue is the name of the queue the message is published to
+	Queue string `gorm:"type:varchar(255)"`
+	// Body is the json encoded message
+	Body        string `gorm:"type:text"`
+	Published   bool   `gorm:"index"`
+	PublishedAt *time.Time
+	// Attempts is the number of failed attempts to publish the message
+	Attempts int
+	// Failed is whether the message exhausted its attempts, and will no longer be published
+	Failed bool `gorm:"index"`
+	// LastError is the error which caused the last publish attempt to fail
+	LastError string `gorm:"type:text"`
+}
+
+// Manager is used to manipulate outbox messages in our database. To record messages
+// alongside other changes, the manager should be created using a transaction
+type Manager struct {
+	DB *gorm.DB
+}
+
+// NewManager is used to instantiate our outbox manager
+func NewManager(db *gorm.DB) *Manager {
+	return &Manager{DB: db}
+}
+
+// Migrate is used to create or update the outbox table
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Message{}).Error
+}
+
+// Enqueue is used to record a message to be published to the given queue
+func (m *Manager) Enqueue(queue string, body interface{}) (*Message, error) {
+	marshaled, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{
+		Queue: queue,
+		Body:  string(marshaled),
+	}
+	if err := m.DB.Create(msg).Error; err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// FindPending is used to find up to limit messages which haven't been published, or
+// failed, oldest first. A limit of 0 returns all pending messages
+func (m *Manager) FindPending(limit int) ([]Message, error) {
+	var msgs []Message
+	query := m.DB.Where("published = ? AND failed = ?", false, false).Order("id")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Find(&msgs).Error; err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// NextPending is used to find the oldest pending message with an id greater than after
+func (m *Manager) NextPending(after uint) (*Message, error) {
+	var msg Message
+	if err := m.DB.Where("published = ? AND failed = ? AND id > ?", false, false, after).
+		Order("id").First(&msg).Error; err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// FindFailed is used to find up to limit messages which exhausted their attempts to be
+// published, oldest first. A limit of 0 returns all failed messages
+func (m *Manager) FindFailed(limit int) ([]Message, error) {
+	var msgs []Message
+	query := m.DB.Where("failed = ?", true).Order("id")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Find(&msgs).Error; err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// MarkPublished is used to record that a message has been published
+func (m *Manager) MarkPublished(id uint) error {
+	return m.DB.Model(&Message{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"published":    true,
+		"published_at": time.Now(),
+	}).Error
+}
+
+// MarkFailed is used to record a failed attempt to publish a message. Once the message
+// has failed maxAttempts times, it is marked failed, and no longer published
+func (m *Manager) MarkFailed(id uint, reason error, maxAttempts int) error {
+	return m.DB.Model(&Message{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"attempts":   gorm.Expr("attempts + 1"),
+		"failed":     gorm.Expr("attempts + 1 >= ?", maxAttempts),
+		"last_error": reason.Error(),
+	}).Error
+}
+
+// DeletePublished is used to remove messages published before the given time,
+// returning the number of messages removed
+func (m *Manager) DeletePublished(before time.Time) (int64, error) {
+	db := m.DB.Unscoped().
+		Where("published = ? AND published_at < ?", true, before).
+		Delete(&Message{})
+	return db.RowsAffected, db.Error
+}
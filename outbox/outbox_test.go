@@ -0,0 +1,147 @@
+package outbox_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/RTradeLtd/Temporal/outbox"
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2"
+	"go.uber.org/zap"
+)
+
+const testCfgPath = "../testenv/config.json"
+
+func TestRelay(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	// messages enqueued within a rolled back transaction should never be published
+	tx := dbm.DB.Begin()
+	if _, err := outbox.NewManager(tx).Enqueue("rolled-back-queue", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	var (
+		om        = outbox.NewManager(dbm.DB)
+		published = make(map[string]int)
+		fail      = true
+	)
+	if _, err := om.Enqueue("good-queue", map[string]string{"hello": "world"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := om.Enqueue("bad-queue", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	relay := outbox.NewRelay(dbm.DB, func(queue string, body []byte, messageID string) error {
+		if queue == "bad-queue" && fail {
+			return errors.New("publish failed")
+		}
+		if messageID == "" {
+			t.Error("expected a message id")
+		}
+		published[queue]++
+		return nil
+	}, outbox.RelayOptions{}, zap.NewNop().Sugar())
+	tests := []struct {
+		name        string
+		fail        bool
+		wantPending int
+	}{
+		{"PublishFails", true, 1},
+		{"PublishRetried", false, 0},
+		{"NothingPending", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fail = tt.fail
+			// other tests may enqueue messages, so relay until nothing is left
+			for {
+				count, err := relay.RelayBatch()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count < outbox.DefaultRelayOptions().BatchSize {
+					break
+				}
+			}
+			pending, err := om.FindPending(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var found int
+			for _, msg := range pending {
+				if msg.Queue == "good-queue" || msg.Queue == "bad-queue" {
+					found++
+				}
+			}
+			if found != tt.wantPending {
+				t.Fatalf("found %v pending messages, want %v", found, tt.wantPending)
+			}
+		})
+	}
+	if published["good-queue"] != 1 || published["bad-queue"] != 1 {
+		t.Fatalf("expected each message to be published once, got %v", published)
+	}
+	if published["rolled-back-queue"] != 0 {
+		t.Fatal("rolled back message was published")
+	}
+}
+
+func TestRelay_MaxAttempts(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	om := outbox.NewManager(dbm.DB)
+	msg, err := om.Enqueue("failing-queue", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.DB.Unscoped().Delete(msg)
+	var attempts int
+	relay := outbox.NewRelay(dbm.DB, func(queue string, body []byte, messageID string) error {
+		if queue == "failing-queue" {
+			attempts++
+			return errors.New("publish failed")
+		}
+		return nil
+	}, outbox.RelayOptions{MaxAttempts: 2}, zap.NewNop().Sugar())
+	// a message is attempted once per batch, until it exhausts its attempts
+	for i := 0; i < 3; i++ {
+		if _, err := relay.RelayBatch(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 publish attempts, got %v", attempts)
+	}
+	failed, err := om.FindFailed(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, failedMsg := range failed {
+		if failedMsg.ID == msg.ID {
+			found = failedMsg.Attempts == 2 && failedMsg.LastError == "publish failed"
+		}
+	}
+	if !found {
+		t.Fatal("expected message to be marked failed")
+	}
+}
@@ -0,0 +1,172 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/RTradeLtd/gorm"
+	"go.uber.org/zap"
+)
+
+// PublishFunc is used to publish an encoded message to a queue. The message id
+// allows consumers to detect messages which were published more than once
+type PublishFunc func(queue string, body []byte, messageID string) error
+
+// RelayOptions is used to configure the relay
+type RelayOptions struct {
+	// Interval is how often we check for pending messages
+	Interval time.Duration
+	// BatchSize is the maximum number of messages published per check
+	BatchSize int
+	// Retention is how long published messages are kept before being removed
+	Retention time.Duration
+	// MaxAttempts is the number of times publishing a message is attempted before it is marked failed
+	MaxAttempts int
+}
+
+// DefaultRelayOptions returns the default relay options
+func DefaultRelayOptions() RelayOptions {
+	return RelayOptions{
+		Interval:    time.Second,
+		BatchSize:   100,
+		Retention:   time.Hour * 24 * 7,
+		MaxAttempts: 10,
+	}
+}
+
+// Relay publishes messages recorded in the outbox. Messages are published at least
+// once, as the relay may stop after publishing a message but before recording that it was,
+// so each is published with a message id consumers use to discard duplicates. Multiple
+// relays may run at once, as pending messages are locked while being published
+type Relay struct {
+	db      *gorm.DB
+	publish PublishFunc
+	opts    RelayOptions
+	l       *zap.SugaredLogger
+}
+
+// NewRelay is used to instantiate our outbox relay. Zero value options
+// are replaced with their defaults
+func NewRelay(db *gorm.DB, publish PublishFunc, opts RelayOptions, logger *zap.SugaredLogger) *Relay {
+	defaults := DefaultRelayOptions()
+	if opts.Interval <= 0 {
+		opts.Interval = defaults.Interval
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaults.BatchSize
+	}
+	if opts.Retention <= 0 {
+		opts.Retention = defaults.Retention
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaults.MaxAttempts
+	}
+	return &Relay{db: db, publish: publish, opts: opts, l: logger.Named("outbox")}
+}
+
+// Run is used to publish pending messages until ctx is cancelled
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+	var lastPrune time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// keep publishing while there are full batches waiting
+		for ctx.Err() == nil {
+			published, err := r.RelayBatch()
+			if err != nil {
+				r.l.Errorw("failed to relay outbox messages", "error", err.Error())
+				break
+			}
+			if published < r.opts.BatchSize {
+				break
+			}
+		}
+		if time.Since(lastPrune) > time.Hour {
+			lastPrune = time.Now()
+			if removed, err := NewManager(r.db).DeletePublished(time.Now().Add(-r.opts.Retention)); err != nil {
+				r.l.Errorw("failed to remove published outbox messages", "error", err.Error())
+			} else if removed > 0 {
+				r.l.Infow("removed published outbox messages", "count", removed)
+			}
+		}
+	}
+}
+
+// RelayBatch is used to publish a single batch of pending messages, returning the
+// number of messages which were published. Each message is published within its own
+// transaction, so only the message being published is locked. Messages which fail to
+// publish are left pending, and retried in a later batch until they exhaust their attempts
+func (r *Relay) RelayBatch() (int, error) {
+	var (
+		published int
+		after     uint
+	)
+	for i := 0; i < r.opts.BatchSize; i++ {
+		msg, ok, err := r.relay(after)
+		if err != nil {
+			return published, err
+		}
+		if msg == nil {
+			break
+		}
+		// messages which failed to publish are skipped until the next batch
+		after = msg.ID
+		if ok {
+			published++
+		}
+	}
+	return published, nil
+}
+
+// relay is used to publish the oldest pending message with an id greater than after,
+// returning the message, and whether it was published. No message is returned when
+// there are none pending
+func (r *Relay) relay(after uint) (*Message, bool, error) {
+	tx := r.db.Begin()
+	if tx.Error != nil {
+		return nil, false, tx.Error
+	}
+	// skip messages locked by other relays, rather than waiting for them
+	msg, err := NewManager(tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED")).NextPending(after)
+	if err == gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return nil, false, nil
+	} else if err != nil {
+		tx.Rollback()
+		return nil, false, err
+	}
+	m := NewManager(tx)
+	if err := r.publish(msg.Queue, []byte(msg.Body), fmt.Sprintf("outbox-%d", msg.ID)); err != nil {
+		if msg.Attempts+1 >= r.opts.MaxAttempts {
+			r.l.Errorw(
+				"outbox message exhausted its attempts, and will no longer be published",
+				"error", err.Error(),
+				"id", msg.ID,
+				"queue", msg.Queue,
+				"attempts", msg.Attempts+1)
+		} else {
+			r.l.Warnw(
+				"failed to publish outbox message",
+				"error", err.Error(),
+				"id", msg.ID,
+				"queue", msg.Queue,
+				"attempts", msg.Attempts+1)
+		}
+		if err := m.MarkFailed(msg.ID, err, r.opts.MaxAttempts); err != nil {
+			tx.Rollback()
+			return nil, false, err
+		}
+		return msg, false, tx.Commit().Error
+	}
+	if err := m.MarkPublished(msg.ID); err != nil {
+		tx.Rollback()
+		return nil, false, err
+	}
+	return msg, true, tx.Commit().Error
+}
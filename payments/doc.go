@@ -0,0 +1,4 @@
+// Package payments takes card payments using stripe payment intents, and reconciles the
+// payments we've received with events reported by our payment processors, such as refunds
+// and disputes, adjusting the credits of users accordingly
+package payments
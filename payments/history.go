@@ -0,0 +1,70 @@
+package payments
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+)
+
+// PaymentFilter restricts the payments returned when listing the payments of a user
+type PaymentFilter struct {
+	// Blockchain restricts payments to those made using the blockchain, or stripe
+	Blockchain string
+	// Confirmed restricts payments to those which are, or aren't confirmed
+	Confirmed *bool
+	// From and To restrict payments to those created within the period, if set
+	From time.Time
+	To   time.Time
+	// Page is the page of payments to return, starting at 1
+	Page    int
+	PerPage int
+}
+
+// PaymentPage is a page of the payments of a user, most recent first
+type PaymentPage struct {
+	Payments []models.Payments `json:"payments"`
+	Page     int               `json:"page"`
+	PerPage  int               `json:"per_page"`
+	// Total is the number of payments matching the filter across all pages
+	Total int `json:"total"`
+}
+
+// FindPayments is used to list the payments of a user matching filter
+func (m *Manager) FindPayments(username string, filter PaymentFilter) (*PaymentPage, error) {
+	if filter.Page < 1 {
+		filter.Page = 1
+	}
+	if filter.PerPage < 1 {
+		filter.PerPage = 20
+	}
+	query := m.DB.Model(&models.Payments{}).Where("user_name = ?", username)
+	if filter.Blockchain != "" {
+		query = query.Where("blockchain = ?", filter.Blockchain)
+	}
+	if filter.Confirmed != nil {
+		// confirmed is stored as text, rather than a boolean
+		query = query.Where("confirmed = ?", strconv.FormatBool(*filter.Confirmed))
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("created_at < ?", filter.To)
+	}
+	page := &PaymentPage{
+		Payments: []models.Payments{},
+		Page:     filter.Page,
+		PerPage:  filter.PerPage,
+	}
+	if err := query.Count(&page.Total).Error; err != nil {
+		return nil, err
+	}
+	if err := query.Order("created_at desc, id desc").
+		Offset((filter.Page - 1) * filter.PerPage).
+		Limit(filter.PerPage).
+		Find(&page.Payments).Error; err != nil {
+		return nil, err
+	}
+	return page, nil
+}
@@ -0,0 +1,73 @@
+package payments_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/payments"
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2"
+	"github.com/RTradeLtd/database/v2/models"
+)
+
+func TestFindPayments(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		pm    = models.NewPaymentManager(dbm.DB)
+		start = time.Now().Add(-time.Second)
+	)
+	for i, blockchain := range []string{"ethereum", "dash", "stripe"} {
+		number, err := pm.GetLatestPaymentNumber("testuser")
+		if err != nil {
+			t.Fatal(err)
+		}
+		txHash := fmt.Sprintf("history-%d-%d", start.UnixNano(), i)
+		payment, err := pm.NewPayment(number, "", txHash, 10, 10, blockchain, blockchain, "testuser")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dbm.DB.Unscoped().Delete(payment)
+		// only the stripe payment is confirmed
+		if blockchain == "stripe" {
+			if _, err := pm.ConfirmPayment(txHash); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	confirmed, pending := true, false
+	tests := []struct {
+		name      string
+		filter    payments.PaymentFilter
+		wantCount int
+		wantTotal int
+	}{
+		{"All", payments.PaymentFilter{}, 3, 3},
+		{"Paginated", payments.PaymentFilter{Page: 2, PerPage: 2}, 1, 3},
+		{"Blockchain", payments.PaymentFilter{Blockchain: "dash"}, 1, 1},
+		{"Confirmed", payments.PaymentFilter{Confirmed: &confirmed}, 1, 1},
+		{"Pending", payments.PaymentFilter{Confirmed: &pending}, 2, 2},
+		{"Before", payments.PaymentFilter{From: start.Add(-time.Hour), To: start}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.filter.From.IsZero() {
+				tt.filter.From = start
+			}
+			page, err := payments.NewManager(dbm.DB).FindPayments("testuser", tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Payments) != tt.wantCount || page.Total != tt.wantTotal {
+				t.Fatalf("found %v of %v payments, want %v of %v", len(page.Payments), page.Total, tt.wantCount, tt.wantTotal)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package payments
+
+import (
+	"errors"
+
+	"github.com/RTradeLtd/gorm"
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/customer"
+	"github.com/stripe/stripe-go/paymentintent"
+	"github.com/stripe/stripe-go/paymentmethod"
+)
+
+var (
+	// ErrIntentNotFound is returned when a payment intent doesn't exist, or belongs to another user
+	ErrIntentNotFound = errors.New("payment intent not found")
+	// ErrPaymentMethodNotFound is returned when a payment method isn't saved for the user
+	ErrPaymentMethodNotFound = errors.New("payment method not found")
+)
+
+// Stripe is the subset of the stripe api used to take payments with payment
+// intents, allowing it to be replaced in tests
+type Stripe interface {
+	NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error)
+	NewPaymentIntent(params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error)
+	GetPaymentIntent(id string) (*stripe.PaymentIntent, error)
+	ConfirmPaymentIntent(id string, params *stripe.PaymentIntentConfirmParams) (*stripe.PaymentIntent, error)
+	GetPaymentMethod(id string) (*stripe.PaymentMethod, error)
+	ListPaymentMethods(customerID string) ([]*stripe.PaymentMethod, error)
+	DetachPaymentMethod(id string) error
+}
+
+// stripeClient implements Stripe using the stripe api
+type stripeClient struct {
+	customers      customer.Client
+	paymentIntents paymentintent.Client
+	paymentMethods paymentmethod.Client
+}
+
+// NewStripe is used to instantiate a Stripe client authenticated with the given secret key
+func NewStripe(key string) Stripe {
+	backend := stripe.GetBackend(stripe.APIBackend)
+	return &stripeClient{
+		customers:      customer.Client{B: backend, Key: key},
+		paymentIntents: paymentintent.Client{B: backend, Key: key},
+		paymentMethods: paymentmethod.Client{B: backend, Key: key},
+	}
+}
+
+func (s *stripeClient) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return s.customers.New(params)
+}
+
+func (s *stripeClient) NewPaymentIntent(params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	return s.paymentIntents.New(params)
+}
+
+func (s *stripeClient) GetPaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	return s.paymentIntents.Get(id, nil)
+}
+
+func (s *stripeClient) ConfirmPaymentIntent(id string, params *stripe.PaymentIntentConfirmParams) (*stripe.PaymentIntent, error) {
+	return s.paymentIntents.Confirm(id, params)
+}
+
+func (s *stripeClient) GetPaymentMethod(id string) (*stripe.PaymentMethod, error) {
+	return s.paymentMethods.Get(id, nil)
+}
+
+func (s *stripeClient) ListPaymentMethods(customerID string) ([]*stripe.PaymentMethod, error) {
+	iter := s.paymentMethods.List(&stripe.PaymentMethodListParams{
+		Customer: stripe.String(customerID),
+		Type:     stripe.String(string(stripe.PaymentMethodTypeCard)),
+	})
+	var methods []*stripe.PaymentMethod
+	for iter.Next() {
+		methods = append(methods, iter.PaymentMethod())
+	}
+	return methods, iter.Err()
+}
+
+func (s *stripeClient) DetachPaymentMethod(id string) error {
+	_, err := s.paymentMethods.Detach(id, nil)
+	return err
+}
+
+// StripeCustomer is the stripe customer the payment methods of a user are saved to
+type StripeCustomer struct {
+	gorm.Model
+	UserName   string `gorm:"type:varchar(255);unique_index"`
+	CustomerID string `gorm:"type:varchar(255);unique_index"`
+}
+
+// PaymentMethod is a card saved for future payments
+type PaymentMethod struct {
+	ID       string `json:"id"`
+	Brand    string `json:"brand"`
+	Last4    string `json:"last4"`
+	ExpMonth uint64 `json:"exp_month"`
+	ExpYear  uint64 `json:"exp_year"`
+}
+
+// Processor is used to take card payments using stripe payment intents, which unlike
+// charges support payments requiring strong customer authentication, such as 3-D Secure
+type Processor struct {
+	db       *gorm.DB
+	payments *Manager
+	stripe   Stripe
+}
+
+// NewProcessor is used to instantiate our payment intent processor, which
+// records payments, and sends receipts using m
+func NewProcessor(m *Manager, sc Stripe) *Processor {
+	return &Processor{db: m.DB, payments: m, stripe: sc}
+}
+
+// CreateIntent is used to create a payment intent to purchase credits worth valueInCents.
+// If a payment method is given the intent is confirmed using the payment method, otherwise
+// it is confirmed by the user with the returned client secret. Payment methods are saved
+// to the customer of the user for future payments if save is true
+func (p *Processor) CreateIntent(username, email string, valueInCents int64, paymentMethod string, save bool) (*stripe.PaymentIntent, error) {
+	customerID, err := p.customerID(username, email)
+	if err != nil {
+		return nil, err
+	}
+	params := &stripe.PaymentIntentParams{
+		Amount:             stripe.Int64(valueInCents),
+		Currency:           stripe.String(string(stripe.CurrencyUSD)),
+		Customer:           stripe.String(customerID),
+		Description:        stripe.String("temporal credit purchase"),
+		PaymentMethodTypes: []*string{stripe.String(string(stripe.PaymentMethodTypeCard))},
+		// StatementDescriptor is what appears in their credit card billing report
+		StatementDescriptor: stripe.String("credit purchase"),
+		ReceiptEmail:        stripe.String(email),
+		SavePaymentMethod:   stripe.Bool(save),
+		Params: stripe.Params{
+			Metadata: map[string]string{
+				"order_type": creditsOrderType,
+				// allows the intent, and webhook events to be attributed to the user
+				"username": username,
+			},
+		},
+	}
+	if paymentMethod != "" {
+		params.PaymentMethod = stripe.String(paymentMethod)
+	}
+	return p.stripe.NewPaymentIntent(params)
+}
+
+// ConfirmIntent is used to confirm a payment intent, granting the credits purchased with it
+// once it succeeds. Intents which require authentication are returned with a status of
+// requires_action, and should be confirmed again after the user has authenticated the
+// payment. Intents which have already succeeded only grant credits once
+func (p *Processor) ConfirmIntent(username, id, paymentMethod string) (*stripe.PaymentIntent, error) {
+	intent, err := p.stripe.GetPaymentIntent(id)
+	if err != nil {
+		return nil, err
+	}
+	if intent.Metadata["username"] != username || intent.Metadata["order_type"] != creditsOrderType {
+		return nil, ErrIntentNotFound
+	}
+	if intent.Status == stripe.PaymentIntentStatusRequiresConfirmation ||
+		(intent.Status == stripe.PaymentIntentStatusRequiresPaymentMethod && paymentMethod != "") {
+		params := &stripe.PaymentIntentConfirmParams{}
+		if paymentMethod != "" {
+			params.PaymentMethod = stripe.String(paymentMethod)
+		}
+		if intent, err = p.stripe.ConfirmPaymentIntent(id, params); err != nil {
+			return nil, err
+		}
+	}
+	if intent.Status == stripe.PaymentIntentStatusSucceeded {
+		if err := p.credit(intent); err != nil {
+			return nil, err
+		}
+	}
+	return intent, nil
+}
+
+// credit is used to grant the credits purchased with a successful payment intent
+func (p *Processor) credit(intent *stripe.PaymentIntent) error {
+	_, err := p.payments.RecordStripePayment(
+		intent.Metadata["username"], intentChargeID(intent), float64(intent.AmountReceived)/100)
+	if err == ErrDuplicatePayment {
+		return nil
+	}
+	return err
+}
+
+// PaymentMethods is used to list the cards a user has saved for future payments
+func (p *Processor) PaymentMethods(username string) ([]PaymentMethod, error) {
+	cust, err := p.findCustomer(username)
+	if err == gorm.ErrRecordNotFound {
+		return []PaymentMethod{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	saved, err := p.stripe.ListPaymentMethods(cust.CustomerID)
+	if err != nil {
+		return nil, err
+	}
+	methods := make([]PaymentMethod, 0, len(saved))
+	for _, method := range saved {
+		methods = append(methods, toPaymentMethod(method))
+	}
+	return methods, nil
+}
+
+// RemovePaymentMethod is used to remove a saved card. Automatic top ups using
+// the card are disabled
+func (p *Processor) RemovePaymentMethod(username, id string) error {
+	if _, err := p.ownedPaymentMethod(username, id); err != nil {
+		return err
+	}
+	if err := p.stripe.DetachPaymentMethod(id); err != nil {
+		return err
+	}
+	return p.db.Unscoped().Where(
+		"user_name = ? AND payment_method_id = ?", username, id,
+	).Delete(&AutoTopUp{}).Error
+}
+
+// ownedPaymentMethod is used to retrieve a payment method saved to the customer of a user
+func (p *Processor) ownedPaymentMethod(username, id string) (*stripe.PaymentMethod, error) {
+	cust, err := p.findCustomer(username)
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrPaymentMethodNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	method, err := p.stripe.GetPaymentMethod(id)
+	if err != nil {
+		return nil, err
+	}
+	if method.Customer == nil || method.Customer.ID != cust.CustomerID {
+		return nil, ErrPaymentMethodNotFound
+	}
+	return method, nil
+}
+
+// findCustomer is used to find the stripe customer of a user
+func (p *Processor) findCustomer(username string) (*StripeCustomer, error) {
+	cust := &StripeCustomer{}
+	if err := p.db.Where("user_name = ?", username).First(cust).Error; err != nil {
+		return nil, err
+	}
+	return cust, nil
+}
+
+// customerID is used to retrieve the id of the stripe customer of a user,
+// creating the customer if the user doesn't have one yet
+func (p *Processor) customerID(username, email string) (string, error) {
+	cust, err := p.findCustomer(username)
+	if err == nil {
+		return cust.CustomerID, nil
+	} else if err != gorm.ErrRecordNotFound {
+		return "", err
+	}
+	created, err := p.stripe.NewCustomer(&stripe.CustomerParams{
+		Email: stripe.String(email),
+		Params: stripe.Params{
+			Metadata: map[string]string{"username": username},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := p.db.Create(&StripeCustomer{UserName: username, CustomerID: created.ID}).Error; err != nil {
+		// another request may have created a customer for the user first
+		if cust, findErr := p.findCustomer(username); findErr == nil {
+			return cust.CustomerID, nil
+		}
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// intentChargeID returns the id of the charge which completed a payment intent, which
+// refund and dispute events refer to. The intent id is used if it has no charges
+func intentChargeID(intent *stripe.PaymentIntent) string {
+	if intent.Charges != nil {
+		for _, ch := range intent.Charges.Data {
+			if ch.Paid {
+				return ch.ID
+			}
+		}
+	}
+	return intent.ID
+}
+
+func toPaymentMethod(method *stripe.PaymentMethod) PaymentMethod {
+	pm := PaymentMethod{ID: method.ID}
+	if method.Card != nil {
+		pm.Brand = string(method.Card.Brand)
+		pm.Last4 = method.Card.Last4
+		pm.ExpMonth = method.Card.ExpMonth
+		pm.ExpYear = method.Card.ExpYear
+	}
+	return pm
+}
@@ -0,0 +1,198 @@
+package payments_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/RTradeLtd/Temporal/ledger"
+	"github.com/RTradeLtd/Temporal/payments"
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/stripe/stripe-go"
+)
+
+// fakeStripe succeeds every payment intent confirmed with a payment
+// method, other than those using the requiresAction method
+type fakeStripe struct {
+	intents        map[string]*stripe.PaymentIntent
+	customers      int
+	requiresAction string
+}
+
+func (f *fakeStripe) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	f.customers++
+	return &stripe.Customer{ID: "cus_fake"}, nil
+}
+
+func (f *fakeStripe) NewPaymentIntent(params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	intent := &stripe.PaymentIntent{
+		ID:       fmt.Sprintf("pi_fake%d", len(f.intents)),
+		Amount:   *params.Amount,
+		Metadata: params.Metadata,
+		Status:   stripe.PaymentIntentStatusRequiresPaymentMethod,
+	}
+	f.intents[intent.ID] = intent
+	if params.PaymentMethod == nil {
+		return intent, nil
+	}
+	intent.Status = stripe.PaymentIntentStatusRequiresConfirmation
+	if params.Confirm != nil && *params.Confirm {
+		return f.ConfirmPaymentIntent(intent.ID, &stripe.PaymentIntentConfirmParams{PaymentMethod: params.PaymentMethod})
+	}
+	return intent, nil
+}
+
+func (f *fakeStripe) GetPaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	intent, ok := f.intents[id]
+	if !ok {
+		return nil, &stripe.Error{Code: stripe.ErrorCodeResourceMissing}
+	}
+	return intent, nil
+}
+
+func (f *fakeStripe) ConfirmPaymentIntent(id string, params *stripe.PaymentIntentConfirmParams) (*stripe.PaymentIntent, error) {
+	intent := f.intents[id]
+	if params.PaymentMethod != nil && *params.PaymentMethod == f.requiresAction {
+		intent.Status = stripe.PaymentIntentStatusRequiresAction
+		return intent, nil
+	}
+	intent.Status = stripe.PaymentIntentStatusSucceeded
+	intent.AmountReceived = intent.Amount
+	intent.Charges = &stripe.ChargeList{Data: []*stripe.Charge{{ID: "ch_" + id, Paid: true}}}
+	return intent, nil
+}
+
+func (f *fakeStripe) GetPaymentMethod(id string) (*stripe.PaymentMethod, error) {
+	return &stripe.PaymentMethod{ID: id, Customer: &stripe.Customer{ID: "cus_fake"}}, nil
+}
+
+func (f *fakeStripe) ListPaymentMethods(customerID string) ([]*stripe.PaymentMethod, error) {
+	return []*stripe.PaymentMethod{{ID: "pm_card", Card: &stripe.PaymentMethodCard{Last4: "4242"}}}, nil
+}
+
+func (f *fakeStripe) DetachPaymentMethod(id string) error {
+	return nil
+}
+
+func TestProcessor(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := payments.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		um = models.NewUserManager(dbm.DB)
+		sc = &fakeStripe{intents: map[string]*stripe.PaymentIntent{}, requiresAction: "pm_3ds"}
+		p  = payments.NewProcessor(payments.NewManager(dbm.DB), sc)
+	)
+	defer dbm.DB.Unscoped().Where("user_name = ?", "testuser").Delete(&payments.StripeCustomer{})
+	defer p.DisableAutoTopUp("testuser")
+	defer func() {
+		for id := range sc.intents {
+			dbm.DB.Unscoped().Where("tx_hash = ?", "ch_"+id).Delete(&models.Payments{})
+		}
+	}()
+	balance := func() float64 {
+		t.Helper()
+		credits, err := um.GetCreditsForUser("testuser")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return credits
+	}
+
+	t.Run("Intents", func(t *testing.T) {
+		tests := []struct {
+			name          string
+			paymentMethod string
+			wantStatus    stripe.PaymentIntentStatus
+			wantCredits   float64
+		}{
+			{"Succeeded", "pm_card", stripe.PaymentIntentStatusSucceeded, 10},
+			{"RequiresAction", "pm_3ds", stripe.PaymentIntentStatusRequiresAction, 0},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				intent, err := p.CreateIntent("testuser", "test@example.com", 1000, "", true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := p.ConfirmIntent("testuser2", intent.ID, tt.paymentMethod); err != payments.ErrIntentNotFound {
+					t.Fatalf("expected intents of other users to be hidden, got %v", err)
+				}
+				before := balance()
+				// confirming an intent twice only grants credits once
+				for i := 0; i < 2; i++ {
+					if intent, err = p.ConfirmIntent("testuser", intent.ID, tt.paymentMethod); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if intent.Status != tt.wantStatus {
+					t.Fatalf("intent status %v, want %v", intent.Status, tt.wantStatus)
+				}
+				if granted := balance() - before; granted != tt.wantCredits {
+					t.Fatalf("granted %v credits, want %v", granted, tt.wantCredits)
+				}
+				defer um.RemoveCredits("testuser", tt.wantCredits)
+			})
+		}
+		if sc.customers != 1 {
+			t.Fatalf("expected a single customer to be created, got %v", sc.customers)
+		}
+	})
+
+	t.Run("TopUp", func(t *testing.T) {
+		credits := balance()
+		if _, err := p.EnableAutoTopUp("testuser", credits, 500, "pm_card"); err != nil {
+			t.Fatal(err)
+		}
+		// the balance isn't below the threshold
+		if granted, err := p.TopUp("testuser"); err != nil || granted != 0 {
+			t.Fatalf("TopUp() = %v, %v, want no top up", granted, err)
+		}
+		if _, err := p.EnableAutoTopUp("testuser", credits+10, 500, "pm_card"); err != nil {
+			t.Fatal(err)
+		}
+		granted, err := p.TopUp("testuser")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer um.RemoveCredits("testuser", granted)
+		if granted != 5 || balance()-credits != 5 {
+			t.Fatalf("expected 5 credits to be purchased, got %v", granted)
+		}
+		// the balance is still below the threshold, but a top up was just attempted
+		if granted, err := p.TopUp("testuser"); err != nil || granted != 0 {
+			t.Fatalf("TopUp() = %v, %v, want no top up", granted, err)
+		}
+	})
+
+	t.Run("RemovePaymentMethod", func(t *testing.T) {
+		methods, err := p.PaymentMethods("testuser")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(methods) != 1 || methods[0].Last4 != "4242" {
+			t.Fatalf("unexpected payment methods %+v", methods)
+		}
+		if err := p.RemovePaymentMethod("testuser", "pm_card"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.FindAutoTopUp("testuser"); err == nil {
+			t.Fatal("expected automatic top up using the payment method to be disabled")
+		}
+		if err := p.RemovePaymentMethod("testuser2", "pm_card"); err != payments.ErrPaymentMethodNotFound {
+			t.Fatalf("expected payment methods of other users to be hidden, got %v", err)
+		}
+	})
+}
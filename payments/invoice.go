@@ -0,0 +1,134 @@
+package payments
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+)
+
+// ReceiptSubject is the subject of the email sent when a payment is confirmed
+const ReceiptSubject = "TEMPORAL Payment Receipt"
+
+// LineItem is a single item billed on an invoice
+type LineItem struct {
+	Description string  `json:"description"`
+	Quantity    float64 `json:"quantity"`
+	UnitPrice   float64 `json:"unit_price"`
+	Amount      float64 `json:"amount"`
+}
+
+// Invoice is an itemized record of a payment
+type Invoice struct {
+	Number   string    `json:"number"`
+	UserName string    `json:"user_name"`
+	Date     time.Time `json:"date"`
+	// Status is paid once the payment is confirmed, and pending until then
+	Status string     `json:"status"`
+	Items  []LineItem `json:"items"`
+	// Total is the value of the invoice in USD
+	Total float64 `json:"total"`
+	// ChargeAmount is the amount charged in the currency the payment was made with
+	ChargeAmount   float64 `json:"charge_amount"`
+	Currency       string  `json:"currency"`
+	Blockchain     string  `json:"blockchain"`
+	TxHash         string  `json:"tx_hash"`
+	DepositAddress string  `json:"deposit_address"`
+}
+
+// NewInvoice is used to generate the invoice for a payment
+func NewInvoice(payment *models.Payments) *Invoice {
+	status := "pending"
+	if payment.Confirmed {
+		status = "paid"
+	}
+	return &Invoice{
+		Number:   fmt.Sprintf("TEMPORAL-%s-%d", payment.UserName, payment.Number),
+		UserName: payment.UserName,
+		Date:     payment.CreatedAt,
+		Status:   status,
+		Items: []LineItem{{
+			// a credit is worth a single USD
+			Description: "Temporal credits",
+			Quantity:    payment.USDValue,
+			UnitPrice:   1,
+			Amount:      payment.USDValue,
+		}},
+		Total:          payment.USDValue,
+		ChargeAmount:   payment.ChargeAmount,
+		Currency:       strings.ToUpper(payment.Type),
+		Blockchain:     payment.Blockchain,
+		TxHash:         payment.TxHash,
+		DepositAddress: payment.DepositAddress,
+	}
+}
+
+var invoiceTemplate = template.Must(template.New("invoice").Funcs(template.FuncMap{
+	"usd":  func(v float64) string { return fmt.Sprintf("$%.2f", v) },
+	"date": func(t time.Time) string { return t.UTC().Format("January 2, 2006") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Invoice {{.Number}}</title></head>
+<body style="font-family: Helvetica, Arial, sans-serif; color: #222;">
+<h2>RTrade Technologies - Temporal</h2>
+<h3>Invoice {{.Number}}</h3>
+<p>Billed to: {{.UserName}}<br>Date: {{date .Date}}<br>Status: {{.Status}}</p>
+<table style="border-collapse: collapse; width: 100%;">
+<tr style="text-align: left; border-bottom: 1px solid #ccc;"><th>Description</th><th>Quantity</th><th>Unit Price</th><th>Amount</th></tr>
+{{range .Items}}<tr><td>{{.Description}}</td><td>{{printf "%.2f" .Quantity}}</td><td>{{usd .UnitPrice}}</td><td>{{usd .Amount}}</td></tr>
+{{end}}<tr style="border-top: 1px solid #ccc;"><td colspan="3"><b>Total</b></td><td><b>{{usd .Total}}</b></td></tr>
+</table>
+<h4>Payment Details</h4>
+<p>Paid with: {{.Currency}} ({{.Blockchain}})<br>Amount charged: {{printf "%.8g" .ChargeAmount}} {{.Currency}}<br>Transaction: {{.TxHash}}<br>Deposit address: {{.DepositAddress}}</p>
+</body>
+</html>
+`))
+
+// HTML is used to render the invoice as an html document
+func (inv *Invoice) HTML(w io.Writer) error {
+	return invoiceTemplate.Execute(w, inv)
+}
+
+// PDF is used to render the invoice as a single page pdf document
+func (inv *Invoice) PDF(w io.Writer) error {
+	lines := []pdfLine{
+		{"RTrade Technologies - Temporal", 18, true},
+		{"Invoice " + inv.Number, 14, true},
+		{"", 10, false},
+		{"Billed to: " + inv.UserName, 10, false},
+		{"Date: " + inv.Date.UTC().Format("January 2, 2006"), 10, false},
+		{"Status: " + inv.Status, 10, false},
+		{"", 10, false},
+		{fmt.Sprintf("%-30s %12s %12s %12s", "Description", "Quantity", "Unit Price", "Amount"), 10, true},
+	}
+	for _, item := range inv.Items {
+		lines = append(lines, pdfLine{fmt.Sprintf(
+			"%-30s %12.2f %12s %12s",
+			item.Description, item.Quantity, fmt.Sprintf("$%.2f", item.UnitPrice), fmt.Sprintf("$%.2f", item.Amount),
+		), 10, false})
+	}
+	lines = append(lines,
+		pdfLine{fmt.Sprintf("%-56s %12s", "Total", fmt.Sprintf("$%.2f", inv.Total)), 10, true},
+		pdfLine{"", 10, false},
+		pdfLine{"Payment Details", 12, true},
+		pdfLine{fmt.Sprintf("Paid with: %s (%s)", inv.Currency, inv.Blockchain), 10, false},
+		pdfLine{fmt.Sprintf("Amount charged: %.8g %s", inv.ChargeAmount, inv.Currency), 10, false},
+		pdfLine{"Transaction: " + inv.TxHash, 10, false},
+		pdfLine{"Deposit address: " + inv.DepositAddress, 10, false},
+	)
+	return writePDF(w, lines)
+}
+
+// Receipt is used to generate the subject, and html content of the
+// email sent to a user once their payment is confirmed
+func Receipt(payment *models.Payments) (string, string, error) {
+	var buf bytes.Buffer
+	if err := NewInvoice(payment).HTML(&buf); err != nil {
+		return "", "", err
+	}
+	return ReceiptSubject, buf.String(), nil
+}
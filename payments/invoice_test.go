@@ -0,0 +1,54 @@
+package payments_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/RTradeLtd/Temporal/payments"
+	"github.com/RTradeLtd/database/v2/models"
+)
+
+func TestInvoice(t *testing.T) {
+	payment := &models.Payments{
+		Number:         3,
+		DepositAddress: "0xdeposit",
+		TxHash:         "0xtxhash",
+		USDValue:       25,
+		ChargeAmount:   0.125,
+		Blockchain:     "ethereum",
+		Type:           "eth",
+		UserName:       "testuser",
+		Confirmed:      true,
+	}
+	tests := []struct {
+		name   string
+		render func(inv *payments.Invoice, buf *bytes.Buffer) error
+		want   []string
+	}{
+		{"HTML", func(inv *payments.Invoice, buf *bytes.Buffer) error { return inv.HTML(buf) },
+			[]string{"TEMPORAL-testuser-3", "Temporal credits", "$25.00", "0xtxhash", "0xdeposit", "paid"}},
+		{"PDF", func(inv *payments.Invoice, buf *bytes.Buffer) error { return inv.PDF(buf) },
+			[]string{"%PDF-1.4", "(Invoice TEMPORAL-testuser-3)", "$25.00", "0xtxhash", "0xdeposit", "%%EOF"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.render(payments.NewInvoice(payment), &buf); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Fatalf("invoice does not contain %q:\n%s", want, buf.String())
+				}
+			}
+		})
+	}
+	subject, content, err := payments.Receipt(payment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != payments.ReceiptSubject || !strings.Contains(content, "TEMPORAL-testuser-3") {
+		t.Fatalf("unexpected receipt %q %q", subject, content)
+	}
+}
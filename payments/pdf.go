@@ -0,0 +1,87 @@
+package payments
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// pdfWidth and pdfHeight are the dimensions of an A4 page in points
+	pdfWidth  = 595
+	pdfHeight = 842
+	// pdfMargin is the distance from the edge of the page text is written at
+	pdfMargin = 50
+)
+
+// pdfLine is a line of text written to a pdf
+type pdfLine struct {
+	text string
+	size float64
+	bold bool
+}
+
+// writePDF is used to write a single page pdf containing lines of text. Text is written
+// using the built in courier fonts, so that columns may be aligned with spaces, and
+// characters the fonts don't support are replaced. Lines beyond the page are dropped
+func writePDF(w io.Writer, lines []pdfLine) error {
+	var content bytes.Buffer
+	y := float64(pdfHeight - pdfMargin)
+	for _, line := range lines {
+		y -= line.size * 1.5
+		if y < pdfMargin {
+			break
+		}
+		font := "F1"
+		if line.bold {
+			font = "F2"
+		}
+		fmt.Fprintf(&content, "BT /%s %.1f Tf %d %.1f Td (%s) Tj ET\n", font, line.size, pdfMargin, y, pdfEscape(line.text))
+	}
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf(
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Contents 4 0 R /Resources << /Font << /F1 5 0 R /F2 6 0 R >> >> >>",
+			pdfWidth, pdfHeight),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier-Bold /Encoding /WinAnsiEncoding >>",
+	}
+	var (
+		doc     bytes.Buffer
+		offsets = make([]int, len(objects))
+	)
+	doc.WriteString("%PDF-1.4\n")
+	for i, object := range objects {
+		offsets[i] = doc.Len()
+		fmt.Fprintf(&doc, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := doc.Len()
+	fmt.Fprintf(&doc, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&doc, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&doc, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	_, err := doc.WriteTo(w)
+	return err
+}
+
+// pdfEscape is used to escape text written within a pdf string, replacing
+// characters outside of printable ascii
+func pdfEscape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			b.WriteRune('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,317 @@
+package payments
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+
+	"github.com/RTradeLtd/Temporal/ledger"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/gorm"
+	"github.com/stripe/stripe-go"
+)
+
+// Stripe event types we act upon
+const (
+	// ChargeRefunded is sent whenever a charge is refunded, including partial refunds
+	ChargeRefunded = "charge.refunded"
+	// ChargeDisputeCreated is sent when a customer disputes a charge with their bank
+	ChargeDisputeCreated = "charge.dispute.created"
+	// ChargeFailed is sent when a charge fails, including asynchronous payment failures
+	ChargeFailed = "charge.failed"
+	// PaymentIntentSucceeded is sent when a payment intent succeeds, including those
+	// confirmed by the customer after authenticating the payment with their bank
+	PaymentIntentSucceeded = "payment_intent.succeeded"
+)
+
+// creditsOrderType identifies charges, and payment intents made to purchase credits
+const creditsOrderType = "temporal.credits"
+
+var (
+	// ErrDuplicateEvent is returned when an event has already been processed
+	ErrDuplicateEvent = errors.New("stripe event has already been processed")
+	// ErrUnhandledEvent is returned for event types we don't act upon
+	ErrUnhandledEvent = errors.New("stripe event type is not handled")
+	// ErrDuplicatePayment is returned when credits have already been granted for a charge
+	ErrDuplicatePayment = errors.New("payment has already been recorded")
+)
+
+// StripeEvent is an event received from stripe, and the credits removed from
+// the account of the user who made the payment as a result of it, if any
+type StripeEvent struct {
+	gorm.Model
+	// EventID is the id stripe assigned the event, used to ensure events are only processed once
+	EventID  string `gorm:"type:varchar(255);unique_index"`
+	Type     string `gorm:"type:varchar(255)"`
+	ChargeID string `gorm:"type:varchar(255);index"`
+	// PaymentID is the id of the payment the charge was recorded as, if any
+	PaymentID uint
+	UserName  string `gorm:"type:varchar(255);index"`
+	// Credits is the amount of credits removed from the user
+	Credits float64
+}
+
+// Manager is used to reconcile payment processor events with our payments
+type Manager struct {
+	DB *gorm.DB
+	// Receipts is called with each stripe payment once it is confirmed, if set
+	Receipts func(payment *models.Payments)
+}
+
+// NewManager is used to instantiate our payments manager
+func NewManager(db *gorm.DB) *Manager {
+	return &Manager{DB: db}
+}
+
+// Migrate is used to create or update the stripe event, customer, and automatic top up tables
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&StripeEvent{}, &StripeCustomer{}, &AutoTopUp{}).Error
+}
+
+// FindStripeEventsByCharge is used to find the events processed for a charge
+func (m *Manager) FindStripeEventsByCharge(chargeID string) ([]StripeEvent, error) {
+	var events []StripeEvent
+	if err := m.DB.Where("charge_id = ?", chargeID).Order("id").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// RecordStripePayment is used to record a successful stripe charge as a payment, and grant
+// the credits purchased with it within a single transaction. ErrDuplicatePayment is
+// returned if the charge has already been recorded, so that charges reported by both
+// the user and our webhook only grant credits once
+func (m *Manager) RecordStripePayment(username, chargeID string, credits float64) (*models.Payments, error) {
+	tx := m.DB.Begin()
+	payment, err := recordPayment(tx, username, chargeID, credits)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	m.sendReceipt(payment)
+	return payment, nil
+}
+
+// sendReceipt is used to send a receipt for a confirmed payment, if receipts are enabled
+func (m *Manager) sendReceipt(payment *models.Payments) {
+	if m.Receipts != nil && payment != nil {
+		m.Receipts(payment)
+	}
+}
+
+// recordPayment is used to record a confirmed charge as a payment, and grant credits using tx
+func recordPayment(tx *gorm.DB, username, chargeID string, credits float64) (*models.Payments, error) {
+	pm := models.NewPaymentManager(tx)
+	if _, err := pm.FindPaymentByTxHash(chargeID); err == nil {
+		return nil, ErrDuplicatePayment
+	} else if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	number, err := pm.GetLatestPaymentNumber(username)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pm.NewPayment(number, chargeID, chargeID, credits, credits, "stripe", "stripe", username); err != nil {
+		return nil, err
+	}
+	payment, err := pm.ConfirmPayment(chargeID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ledger.NewManager(tx).Credit(username, credits, ledger.Payment, chargeID); err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
+
+// ProcessStripeEvent is used to apply an event to the payment, and account it concerns.
+// Successful payment intents grant the credits purchased with them, unless the payment
+// has already been recorded. Refunds remove the credits granted for the newly refunded amount, disputes remove the
+// credits granted for the disputed amount, and failures remove any credits granted for
+// the charge, marking its payment unconfirmed.
+//
+// Credits are removed even if this results in a negative balance, as they may have
+// already been spent, and the amount removed for a charge never exceeds the amount granted
+// for it. The event is recorded within the same transaction, so that retried deliveries
+// of an event return ErrDuplicateEvent rather than removing credits again
+func (m *Manager) ProcessStripeEvent(event stripe.Event) (*StripeEvent, error) {
+	if event.Data == nil {
+		return nil, errors.New("stripe event contains no data")
+	}
+	var (
+		chargeID string
+		// amount is the amount in cents the event concerns
+		amount int64
+		// fallback is used to find the user if we have no record of the payment
+		fallback *stripe.Charge
+	)
+	switch event.Type {
+	case ChargeRefunded, ChargeFailed:
+		var ch stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &ch); err != nil {
+			return nil, err
+		}
+		chargeID, fallback = ch.ID, &ch
+		if event.Type == ChargeRefunded {
+			amount = ch.AmountRefunded
+		} else {
+			amount = ch.Amount
+		}
+	case ChargeDisputeCreated:
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+			return nil, err
+		}
+		if dispute.Charge == nil {
+			return nil, errors.New("stripe dispute contains no charge")
+		}
+		chargeID, amount = dispute.Charge.ID, dispute.Amount
+	case PaymentIntentSucceeded:
+		var intent stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &intent); err != nil {
+			return nil, err
+		}
+		if intent.Metadata["order_type"] != creditsOrderType {
+			return nil, ErrUnhandledEvent
+		}
+		tx := m.DB.Begin()
+		processed, payment, err := m.processIntent(tx, event, &intent)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return nil, err
+		}
+		m.sendReceipt(payment)
+		return processed, nil
+	default:
+		return nil, ErrUnhandledEvent
+	}
+	tx := m.DB.Begin()
+	processed, err := m.process(tx, event, chargeID, amount, fallback)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return processed, nil
+}
+
+// checkDuplicate is used to return ErrDuplicateEvent if an event has already been processed
+func checkDuplicate(tx *gorm.DB, eventID string) error {
+	var count int
+	if err := tx.Model(&StripeEvent{}).Where("event_id = ?", eventID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrDuplicateEvent
+	}
+	return nil
+}
+
+// processIntent is used to record a payment intent event, and grant the credits
+// purchased with the intent using tx. The payment is returned if it was recorded
+func (m *Manager) processIntent(tx *gorm.DB, event stripe.Event, intent *stripe.PaymentIntent) (*StripeEvent, *models.Payments, error) {
+	if err := checkDuplicate(tx, event.ID); err != nil {
+		return nil, nil, err
+	}
+	processed := &StripeEvent{
+		EventID:  event.ID,
+		Type:     event.Type,
+		ChargeID: intentChargeID(intent),
+		UserName: intent.Metadata["username"],
+	}
+	var payment *models.Payments
+	if processed.UserName != "" {
+		var err error
+		payment, err = recordPayment(tx, processed.UserName, processed.ChargeID, float64(intent.AmountReceived)/100)
+		switch err {
+		case nil:
+			processed.PaymentID = payment.ID
+		case ErrDuplicatePayment:
+			// credits were granted when the user confirmed the payment
+		default:
+			return nil, nil, err
+		}
+	}
+	if err := tx.Create(processed).Error; err != nil {
+		return nil, nil, err
+	}
+	return processed, payment, nil
+}
+
+// process is used to record an event, and remove the credits it results in using tx
+func (m *Manager) process(tx *gorm.DB, event stripe.Event, chargeID string, amount int64, fallback *stripe.Charge) (*StripeEvent, error) {
+	if err := checkDuplicate(tx, event.ID); err != nil {
+		return nil, err
+	}
+	processed := &StripeEvent{
+		EventID:  event.ID,
+		Type:     event.Type,
+		ChargeID: chargeID,
+	}
+	// the credits granted for a charge, which is the most we ever remove for it
+	var granted float64
+	payment, err := models.NewPaymentManager(tx).FindPaymentByTxHash(chargeID)
+	switch {
+	case err == nil:
+		processed.PaymentID = payment.ID
+		processed.UserName = payment.UserName
+		if payment.Confirmed {
+			granted = payment.USDValue
+		}
+	case err == gorm.ErrRecordNotFound && fallback != nil:
+		// charges made before payments were recorded identify the user in their metadata
+		processed.UserName = fallback.Metadata["username"]
+		if fallback.Paid && event.Type != ChargeFailed {
+			granted = float64(fallback.Amount) / 100
+		}
+	case err != gorm.ErrRecordNotFound:
+		return nil, err
+	}
+	var removed float64
+	if chargeID != "" {
+		if err := tx.Model(&StripeEvent{}).Where("charge_id = ?", chargeID).
+			Select("COALESCE(SUM(credits), 0)").Row().Scan(&removed); err != nil {
+			return nil, err
+		}
+	}
+	switch event.Type {
+	case ChargeRefunded:
+		// amounts refunded are cumulative, so only the newly refunded amount is removed
+		var refunded float64
+		if err := tx.Model(&StripeEvent{}).Where("charge_id = ? AND type = ?", chargeID, ChargeRefunded).
+			Select("COALESCE(SUM(credits), 0)").Row().Scan(&refunded); err != nil {
+			return nil, err
+		}
+		processed.Credits = float64(amount)/100 - refunded
+	case ChargeDisputeCreated:
+		processed.Credits = float64(amount) / 100
+	case ChargeFailed:
+		processed.Credits = granted
+		if payment != nil && payment.Confirmed {
+			if err := tx.Model(payment).Update("confirmed", false).Error; err != nil {
+				return nil, err
+			}
+		}
+	}
+	processed.Credits = math.Max(0, math.Min(processed.Credits, granted-removed))
+	if processed.UserName == "" {
+		processed.Credits = 0
+	}
+	if err := tx.Create(processed).Error; err != nil {
+		return nil, err
+	}
+	if processed.Credits > 0 {
+		if _, err := ledger.NewManager(tx).Reverse(processed.UserName, processed.Credits, chargeID); err != nil {
+			return nil, err
+		}
+	}
+	return processed, nil
+}
@@ -0,0 +1,110 @@
+package payments_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/RTradeLtd/Temporal/ledger"
+	"github.com/RTradeLtd/Temporal/payments"
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/stripe/stripe-go"
+)
+
+const (
+	testCfgPath  = "../testenv/config.json"
+	fixturesPath = "../testfiles/stripe/"
+)
+
+func loadEvent(t *testing.T, name string) stripe.Event {
+	t.Helper()
+	data, err := ioutil.ReadFile(fixturesPath + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event stripe.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestProcessStripeEvent(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := payments.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		pm = models.NewPaymentManager(dbm.DB)
+		um = models.NewUserManager(dbm.DB)
+	)
+	number, err := pm.GetLatestPaymentNumber("testuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := pm.NewPayment(number, "", "ch_1FixtureCharge", 10, 10, "stripe", "stripe", "testuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.DB.Unscoped().Delete(payment)
+	if _, err := pm.ConfirmPayment(payment.TxHash); err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.DB.Unscoped().Where(
+		"charge_id IN (?)", []string{"ch_1FixtureCharge", "ch_1FixtureFailedCharge"},
+	).Delete(&payments.StripeEvent{})
+	tests := []struct {
+		name        string
+		fixture     string
+		wantErr     error
+		wantCredits float64
+	}{
+		// 4 of the 10 dollars were refunded
+		{"Refunded", "charge_refunded.json", nil, 4},
+		{"Duplicate", "charge_refunded.json", payments.ErrDuplicateEvent, 0},
+		// the dispute is limited to the credits not already refunded
+		{"DisputeCreated", "charge_dispute_created.json", nil, 6},
+		// credits were never granted for the failed charge
+		{"Failed", "charge_failed.json", nil, 0},
+		{"Unhandled", "customer_created.json", payments.ErrUnhandledEvent, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := loadEvent(t, tt.fixture)
+			before, err := um.GetCreditsForUser("testuser")
+			if err != nil {
+				t.Fatal(err)
+			}
+			processed, err := payments.NewManager(dbm.DB).ProcessStripeEvent(event)
+			if err != tt.wantErr {
+				t.Fatalf("ProcessStripeEvent() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if processed != nil {
+				if processed.Credits != tt.wantCredits {
+					t.Fatalf("removed %v credits, want %v", processed.Credits, tt.wantCredits)
+				}
+				// restore the credits of the test user
+				defer um.AddCredits("testuser", processed.Credits)
+			}
+			after, err := um.GetCreditsForUser("testuser")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed := before - after; removed != tt.wantCredits {
+				t.Fatalf("balance reduced by %v, want %v", removed, tt.wantCredits)
+			}
+		})
+	}
+}
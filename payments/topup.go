@@ -0,0 +1,138 @@
+package payments
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/gorm"
+	"github.com/stripe/stripe-go"
+)
+
+// TopUpInterval is the minimum time between automatic top up attempts for a user, so that
+// a card which is declined, or a balance which is spent quickly, isn't charged repeatedly
+var TopUpInterval = time.Hour
+
+// ErrTopUpRequiresAction is returned when an automatic top up can't be completed without
+// the user, for example as their bank requires them to authenticate the payment
+var ErrTopUpRequiresAction = errors.New("automatic top up requires authentication, please purchase credits manually")
+
+// AutoTopUp purchases credits for a user using a saved card whenever
+// their balance falls below a threshold
+type AutoTopUp struct {
+	gorm.Model
+	UserName string `gorm:"type:varchar(255);unique_index"`
+	// Threshold is the balance below which credits are purchased
+	Threshold float64
+	// AmountInCents is the value of the credits purchased with each top up
+	AmountInCents   int64
+	PaymentMethodID string `gorm:"type:varchar(255)"`
+	LastAttemptAt   *time.Time
+	// LastError is the reason the last top up failed
+	LastError string `gorm:"type:text"`
+}
+
+// EnableAutoTopUp is used to purchase credits worth amountInCents using a saved card
+// whenever the balance of a user falls below threshold. If automatic top ups are
+// already enabled, they are updated
+func (p *Processor) EnableAutoTopUp(username string, threshold float64, amountInCents int64, paymentMethod string) (*AutoTopUp, error) {
+	if _, err := p.ownedPaymentMethod(username, paymentMethod); err != nil {
+		return nil, err
+	}
+	topUp := &AutoTopUp{}
+	if err := p.db.Where(AutoTopUp{UserName: username}).Assign(map[string]interface{}{
+		"threshold":         threshold,
+		"amount_in_cents":   amountInCents,
+		"payment_method_id": paymentMethod,
+		"last_error":        "",
+	}).FirstOrCreate(topUp).Error; err != nil {
+		return nil, err
+	}
+	return topUp, nil
+}
+
+// DisableAutoTopUp is used to stop purchasing credits for a user automatically
+func (p *Processor) DisableAutoTopUp(username string) error {
+	return p.db.Unscoped().Where("user_name = ?", username).Delete(&AutoTopUp{}).Error
+}
+
+// FindAutoTopUp is used to find the automatic top up settings of a user
+func (p *Processor) FindAutoTopUp(username string) (*AutoTopUp, error) {
+	topUp := &AutoTopUp{}
+	if err := p.db.Where("user_name = ?", username).First(topUp).Error; err != nil {
+		return nil, err
+	}
+	return topUp, nil
+}
+
+// TopUp is used to purchase credits for a user if automatic top ups are enabled, and
+// their balance is below the threshold, returning the credits purchased. Payments are
+// made without the user present, so those requiring authentication fail with
+// ErrTopUpRequiresAction. Only one attempt is made every TopUpInterval
+func (p *Processor) TopUp(username string) (float64, error) {
+	topUp, err := p.FindAutoTopUp(username)
+	if err == gorm.ErrRecordNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	balance, err := models.NewUserManager(p.db).GetCreditsForUser(username)
+	if err != nil {
+		return 0, err
+	}
+	if balance >= topUp.Threshold {
+		return 0, nil
+	}
+	cust, err := p.findCustomer(username)
+	if err != nil {
+		return 0, err
+	}
+	// claim the attempt, so that concurrent requests only charge the user once
+	now := time.Now()
+	claim := p.db.Model(&AutoTopUp{}).Where(
+		"id = ? AND (last_attempt_at IS NULL OR last_attempt_at < ?)", topUp.ID, now.Add(-TopUpInterval),
+	).Update("last_attempt_at", now)
+	if claim.Error != nil {
+		return 0, claim.Error
+	}
+	if claim.RowsAffected == 0 {
+		return 0, nil
+	}
+	params := &stripe.PaymentIntentParams{
+		Amount:             stripe.Int64(topUp.AmountInCents),
+		Confirm:            stripe.Bool(true),
+		Currency:           stripe.String(string(stripe.CurrencyUSD)),
+		Customer:           stripe.String(cust.CustomerID),
+		Description:        stripe.String("temporal automatic credit top up"),
+		PaymentMethod:      stripe.String(topUp.PaymentMethodID),
+		PaymentMethodTypes: []*string{stripe.String(string(stripe.PaymentMethodTypeCard))},
+		// StatementDescriptor is what appears in their credit card billing report
+		StatementDescriptor: stripe.String("credit purchase"),
+		Params: stripe.Params{
+			Metadata: map[string]string{
+				"order_type": creditsOrderType,
+				"username":   username,
+				"top_up":     "true",
+			},
+		},
+	}
+	// the user isn't present to authenticate the payment
+	params.AddExtra("off_session", "true")
+	params.SetIdempotencyKey(fmt.Sprintf("top-up-%s-%d", username, now.Unix()))
+	intent, err := p.stripe.NewPaymentIntent(params)
+	if err == nil && intent.Status != stripe.PaymentIntentStatusSucceeded {
+		err = ErrTopUpRequiresAction
+	}
+	if err == nil {
+		err = p.credit(intent)
+	}
+	if err != nil {
+		p.db.Model(topUp).Update("last_error", err.Error())
+		return 0, err
+	}
+	if err := p.db.Model(topUp).Update("last_error", "").Error; err != nil {
+		return 0, err
+	}
+	return float64(intent.AmountReceived) / 100, nil
+}
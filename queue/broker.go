@@ -0,0 +1,329 @@
+package queue
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RTradeLtd/config/v2"
+	"github.com/streadway/amqp"
+)
+
+// Broker is the message broker our queues are built on. Messages are represented using
+// amqp types regardless of the implementation, and deliveries are acknowledged
+// through the broker they were received from
+type Broker interface {
+	// Acknowledger is used to ack, nack, and reject deliveries by their tag
+	amqp.Acknowledger
+	// Declare is used to declare a queue, along with the queues used to
+	// retry and dead-letter messages which fail processing
+	Declare(queue Queue) error
+	// Publish is used to publish a message to the named queue, waiting
+	// until ctx is done for the broker to confirm it
+	Publish(ctx context.Context, queue string, msg amqp.Publishing) error
+	// Retry is used to publish a message back onto the given queue after
+	// the delay used for the given attempt has elapsed
+	Retry(ctx context.Context, queue Queue, attempt int, msg amqp.Publishing) error
+	// Consume is used to start delivering messages from the given queue, with
+	// at most prefetch messages delivered and not yet acknowledged
+	Consume(queue Queue, consumer string, prefetch int) (<-chan amqp.Delivery, error)
+	// Cancel is used to stop delivering messages to the named consumer,
+	// closing its delivery channel once any buffered messages are received
+	Cancel(consumer string) error
+	// Get is used to retrieve a single message from the named queue, returning
+	// false if the queue is empty
+	Get(queue string) (amqp.Delivery, bool, error)
+	// Purge is used to remove all messages from the named queue,
+	// returning the number of messages which were removed
+	Purge(queue string) (int, error)
+	// NotifyClose registers a channel which receives an error when
+	// the broker connection is lost, and is closed when the broker is closed
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	// Close is used to close the broker connection
+	Close() error
+}
+
+var (
+	// ErrPublishTimeout is returned when the broker doesn't confirm a published message in time
+	ErrPublishTimeout = errors.New("timed out waiting for the broker to confirm the message")
+	// ErrPublishNacked is returned when the broker is unable to accept a published message
+	ErrPublishNacked = errors.New("message was rejected by the broker")
+)
+
+// MemoryScheme is the url scheme used to select the in-memory broker. Queues using
+// the same url share messages, so a memory broker only spans a single process
+const MemoryScheme = "memory://"
+
+// IsMemoryURL returns whether or not the given url selects the in-memory broker
+func IsMemoryURL(url string) bool {
+	return strings.HasPrefix(url, MemoryScheme)
+}
+
+// dialBroker is used to connect to the broker selected by the given url
+func dialBroker(url string, cfg *config.TemporalConfig) (Broker, error) {
+	if IsMemoryURL(url) {
+		return newMemoryClient(url), nil
+	}
+	return dialAMQP(url, cfg)
+}
+
+// amqpBroker is a Broker backed by rabbitmq. The channel is put into confirm mode,
+// so that we know published messages have been received by the server
+type amqpBroker struct {
+	connection *amqp.Connection
+	channel    *amqp.Channel
+	// mux serializes publishes, so that we may track the sequence
+	// number the server uses to confirm each message
+	mux     sync.Mutex
+	seq     uint64
+	pending map[uint64]chan bool
+}
+
+// dialAMQP is used to connect to rabbitmq, and open the channel we use
+func dialAMQP(url string, cfg *config.TemporalConfig) (*amqpBroker, error) {
+	conn, err := setupConnection(url, cfg)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := ch.Qos(10, 0, false); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	b := &amqpBroker{connection: conn, channel: ch, pending: make(map[uint64]chan bool)}
+	go b.confirm(ch.NotifyPublish(make(chan amqp.Confirmation, 100)))
+	return b, nil
+}
+
+// confirm is used to pass confirmations received from the server to the publishers
+// waiting on them. Once the channel is closed, outstanding publishes are failed
+func (b *amqpBroker) confirm(confirms chan amqp.Confirmation) {
+	for c := range confirms {
+		b.mux.Lock()
+		if confirmed, ok := b.pending[c.DeliveryTag]; ok {
+			confirmed <- c.Ack
+			delete(b.pending, c.DeliveryTag)
+		}
+		b.mux.Unlock()
+	}
+	b.mux.Lock()
+	for tag, confirmed := range b.pending {
+		close(confirmed)
+		delete(b.pending, tag)
+	}
+	b.mux.Unlock()
+}
+
+func setupConnection(connectionURL string, cfg *config.TemporalConfig) (*amqp.Connection, error) {
+	var (
+		conn *amqp.Connection
+		err  error
+	)
+	if cfg.RabbitMQ.TLSConfig.CACertFile == "" {
+		conn, err = amqp.Dial(connectionURL)
+	} else {
+		// see https://godoc.org/github.com/streadway/amqp#DialTLS for more information
+		tlsConfig := new(tls.Config)
+		tlsConfig.RootCAs = x509.NewCertPool()
+		ca, err := ioutil.ReadFile(cfg.RabbitMQ.TLSConfig.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		if ok := tlsConfig.RootCAs.AppendCertsFromPEM(ca); !ok {
+			return nil, errors.New("failed to successfully append cert file")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.RabbitMQ.TLSConfig.CertFile, cfg.RabbitMQ.TLSConfig.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+		conn, err = amqp.DialTLS(connectionURL, tlsConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Declare is used to declare the queue, the retry exchange, the delay queues bound
+// to it, and the dead letter queue. Delay queues hold messages for a period of time
+// using a per-queue ttl, after which they are dead-lettered back onto the queue
+func (b *amqpBroker) Declare(queue Queue) error {
+	// we declare our queues as durable so that even if rabbitmq server stops
+	// our messages won't be lost
+	if _, err := b.channel.QueueDeclare(
+		queue.String(), // name
+		true,           // durable
+		false,          // delete when unused
+		false,          // exclusive
+		false,          // no-wait
+		nil,            // arguments
+	); err != nil {
+		return err
+	}
+	if err := b.channel.ExchangeDeclare(
+		queue.RetryExchange(), // name
+		"direct",              // type
+		true,                  // durable
+		false,                 // auto-deleted
+		false,                 // internal
+		false,                 // no-wait
+		nil,                   // arguments
+	); err != nil {
+		return err
+	}
+	for attempt := 1; attempt < MaxAttempts; attempt++ {
+		if _, err := b.channel.QueueDeclare(
+			queue.delayQueue(attempt), // name
+			true,                      // durable
+			false,                     // delete when unused
+			false,                     // exclusive
+			false,                     // no-wait
+			amqp.Table{
+				"x-message-ttl":             int64(retryDelay(attempt) / time.Millisecond),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queue.String(),
+			},
+		); err != nil {
+			return err
+		}
+		if err := b.channel.QueueBind(
+			queue.delayQueue(attempt), // name
+			strconv.Itoa(attempt),     // routing key
+			queue.RetryExchange(),     // exchange
+			false,                     // no-wait
+			nil,                       // arguments
+		); err != nil {
+			return err
+		}
+	}
+	_, err := b.channel.QueueDeclare(
+		queue.DeadLetterQueue(), // name
+		true,                    // durable
+		false,                   // delete when unused
+		false,                   // exclusive
+		false,                   // no-wait
+		nil,                     // arguments
+	)
+	return err
+}
+
+// Publish is used to publish a message to the named queue through the default exchange
+func (b *amqpBroker) Publish(ctx context.Context, queue string, msg amqp.Publishing) error {
+	// the exchange is left empty, and becomes the default exchange
+	return b.publish(ctx, "", queue, msg)
+}
+
+// Retry is used to publish a message to the retry exchange, routing it
+// to the delay queue for the given attempt
+func (b *amqpBroker) Retry(ctx context.Context, queue Queue, attempt int, msg amqp.Publishing) error {
+	return b.publish(ctx, queue.RetryExchange(), strconv.Itoa(attempt), msg)
+}
+
+// publish is used to publish a message, and wait for the server to confirm it
+func (b *amqpBroker) publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	b.mux.Lock()
+	// the server numbers confirmations in the order messages are published, starting at 1
+	b.seq++
+	tag := b.seq
+	confirmed := make(chan bool, 1)
+	b.pending[tag] = confirmed
+	if err := b.channel.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		false,      // mandatory
+		false,      // immediate
+		msg,
+	); err != nil {
+		delete(b.pending, tag)
+		b.mux.Unlock()
+		return err
+	}
+	b.mux.Unlock()
+	select {
+	case ack, ok := <-confirmed:
+		if !ok {
+			return amqp.ErrClosed
+		}
+		if !ack {
+			return ErrPublishNacked
+		}
+		return nil
+	case <-ctx.Done():
+		b.mux.Lock()
+		delete(b.pending, tag)
+		b.mux.Unlock()
+		return ErrPublishTimeout
+	}
+}
+
+// Consume is used to start consuming messages from the given queue. We do not
+// auto-ack, as if a consumer dies we don't want the message to be lost
+func (b *amqpBroker) Consume(queue Queue, consumer string, prefetch int) (<-chan amqp.Delivery, error) {
+	if err := b.channel.Qos(prefetch, 0, false); err != nil {
+		return nil, err
+	}
+	return b.channel.Consume(
+		queue.String(), // queue
+		consumer,       // consumer
+		false,          // auto-ack
+		false,          // exclusive
+		false,          // no-local
+		false,          // no-wait
+		nil,            // args
+	)
+}
+
+// Cancel is used to stop delivering messages to the named consumer
+func (b *amqpBroker) Cancel(consumer string) error {
+	return b.channel.Cancel(consumer, false)
+}
+
+// Get is used to retrieve a single message from the named queue
+func (b *amqpBroker) Get(queue string) (amqp.Delivery, bool, error) {
+	return b.channel.Get(queue, false)
+}
+
+// Purge is used to remove all messages from the named queue
+func (b *amqpBroker) Purge(queue string) (int, error) {
+	return b.channel.QueuePurge(queue, false)
+}
+
+// Ack is used to acknowledge a delivery
+func (b *amqpBroker) Ack(tag uint64, multiple bool) error {
+	return b.channel.Ack(tag, multiple)
+}
+
+// Nack is used to negatively acknowledge a delivery
+func (b *amqpBroker) Nack(tag uint64, multiple, requeue bool) error {
+	return b.channel.Nack(tag, multiple, requeue)
+}
+
+// Reject is used to reject a delivery
+func (b *amqpBroker) Reject(tag uint64, requeue bool) error {
+	return b.channel.Reject(tag, requeue)
+}
+
+// NotifyClose is used to receive connection level errors. This covers all channel, and connection errors
+func (b *amqpBroker) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	return b.connection.NotifyClose(receiver)
+}
+
+// Close is used to close the connection, which also closes the channel
+func (b *amqpBroker) Close() error {
+	return b.connection.Close()
+}
@@ -0,0 +1,241 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RTradeLtd/config/v2"
+	"golang.org/x/crypto/sha3"
+)
+
+var (
+	// ErrTxPending is returned by a ChainClient when a transaction
+	// has not yet been included within a block
+	ErrTxPending = errors.New("transaction is pending")
+	// errNoPaymentEvent is returned when a transaction didn't emit a payment event from our contract
+	errNoPaymentEvent = errors.New("transaction did not emit a payment event")
+	// paymentEventTopic is the first topic of the event our payment contract emits once a payment is
+	// made, PaymentMade(address indexed payer, uint256 indexed paymentNumber, uint8 method, uint256 amount)
+	paymentEventTopic = eventTopic("PaymentMade(address,uint256,uint8,uint256)")
+)
+
+// ChainClient is used to query the state of transactions on an ethereum based
+// blockchain. It allows the payment confirmation consumer to be backed by
+// something other than a JSON-RPC node, such as a mock during testing
+type ChainClient interface {
+	// TransactionReceipt returns the receipt of a mined transaction, or
+	// ErrTxPending if the transaction has not been mined yet
+	TransactionReceipt(ctx context.Context, txHash string) (*TxReceipt, error)
+	// BlockNumber returns the number of the most recent block
+	BlockNumber(ctx context.Context) (uint64, error)
+}
+
+// TxReceipt is a minimal view of an ethereum transaction receipt
+type TxReceipt struct {
+	TxHash      string
+	From        string
+	To          string
+	BlockNumber uint64
+	Success     bool
+	Logs        []TxLog
+}
+
+// TxLog is an event emitted by a contract during a transaction
+type TxLog struct {
+	// Address is the contract which emitted the event
+	Address string `json:"address"`
+	// Topics are the hex encoded hash of the event signature, followed by its indexed arguments
+	Topics []string `json:"topics"`
+	// Data is the hex encoded abi encoding of the arguments which aren't indexed
+	Data string `json:"data"`
+}
+
+// paymentEvent is the decoded event our payment contract emits once a payment is made
+type paymentEvent struct {
+	Payer  string
+	Number *big.Int
+	Method uint8
+	Amount *big.Int
+}
+
+// findPaymentEvent is used to decode the payment event emitted by contract within receipt
+func findPaymentEvent(receipt *TxReceipt, contract string) (*paymentEvent, error) {
+	for _, entry := range receipt.Logs {
+		if !strings.EqualFold(entry.Address, contract) || len(entry.Topics) != 3 ||
+			!strings.EqualFold(entry.Topics[0], paymentEventTopic) {
+			continue
+		}
+		payer, err := decodeWord(entry.Topics[1])
+		if err != nil {
+			return nil, err
+		}
+		number, err := decodeWord(entry.Topics[2])
+		if err != nil {
+			return nil, err
+		}
+		data, err := hex.DecodeString(strings.TrimPrefix(entry.Data, "0x"))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) != 64 {
+			return nil, fmt.Errorf("payment event data is %v bytes, expected 64", len(data))
+		}
+		method := new(big.Int).SetBytes(data[:32])
+		if !method.IsUint64() || method.Uint64() > 255 {
+			return nil, errors.New("payment event method is not a uint8")
+		}
+		return &paymentEvent{
+			// addresses are the last 20 bytes of their word
+			Payer:  "0x" + hex.EncodeToString(payer[12:]),
+			Number: new(big.Int).SetBytes(number),
+			Method: uint8(method.Uint64()),
+			Amount: new(big.Int).SetBytes(data[32:]),
+		}, nil
+	}
+	return nil, errNoPaymentEvent
+}
+
+// decodeWord is used to decode a hex encoded 32 byte abi word
+func decodeWord(s string) ([]byte, error) {
+	word, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return nil, err
+	}
+	if len(word) != 32 {
+		return nil, fmt.Errorf("abi word is %v bytes, expected 32", len(word))
+	}
+	return word, nil
+}
+
+// eventTopic returns the hex encoded keccak256 hash of an event signature
+func eventTopic(signature string) string {
+	hash := sha3.NewLegacyKeccak256()
+	hash.Write([]byte(signature))
+	return "0x" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// rpcChainClient is a ChainClient that talks to an ethereum JSON-RPC endpoint
+type rpcChainClient struct {
+	url string
+	hc  *http.Client
+}
+
+// NewRPCChainClient is used to instantiate a ChainClient talking
+// to the ethereum JSON-RPC endpoint at the given url
+func NewRPCChainClient(url string) ChainClient {
+	return &rpcChainClient{url: url, hc: &http.Client{Timeout: time.Second * 30}}
+}
+
+// newChainClientFromConfig is used to create a ChainClient from the ethereum connection
+// settings of our configuration, preferring infura if it has been configured
+func newChainClientFromConfig(cfg *config.TemporalConfig) (ChainClient, error) {
+	conn := cfg.Ethereum.Connection
+	if conn.INFURA.URL != "" {
+		return NewRPCChainClient(conn.INFURA.URL), nil
+	}
+	if conn.RPC.IP != "" && conn.RPC.Port != "" {
+		return NewRPCChainClient(fmt.Sprintf("http://%s:%s", conn.RPC.IP, conn.RPC.Port)), nil
+	}
+	return nil, errors.New("no ethereum rpc connection configured")
+}
+
+type rpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// call is used to execute a JSON-RPC call, unmarshaling the result into out
+func (rc *rpcChainClient) call(ctx context.Context, out interface{}, method string, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(rpcRequest{JSONRPC: "2.0", ID: 1, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", rc.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := rc.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %v from ethereum rpc", resp.StatusCode)
+	}
+	var rpcResp rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return err
+	}
+	if rpcResp.Error != nil {
+		return fmt.Errorf("ethereum rpc error %v: %s", rpcResp.Error.Code, rpcResp.Error.Message)
+	}
+	return json.Unmarshal(rpcResp.Result, out)
+}
+
+// TransactionReceipt is used to retrieve the receipt for the given transaction
+func (rc *rpcChainClient) TransactionReceipt(ctx context.Context, txHash string) (*TxReceipt, error) {
+	var receipt *struct {
+		TransactionHash string  `json:"transactionHash"`
+		From            string  `json:"from"`
+		To              string  `json:"to"`
+		BlockNumber     string  `json:"blockNumber"`
+		Status          string  `json:"status"`
+		Logs            []TxLog `json:"logs"`
+	}
+	if err := rc.call(ctx, &receipt, "eth_getTransactionReceipt", txHash); err != nil {
+		return nil, err
+	}
+	// a null receipt means the transaction hasn't been mined
+	if receipt == nil || receipt.BlockNumber == "" {
+		return nil, ErrTxPending
+	}
+	blockNumber, err := parseHexUint(receipt.BlockNumber)
+	if err != nil {
+		return nil, err
+	}
+	return &TxReceipt{
+		TxHash:      receipt.TransactionHash,
+		From:        receipt.From,
+		To:          receipt.To,
+		BlockNumber: blockNumber,
+		Success:     receipt.Status == "0x1",
+		Logs:        receipt.Logs,
+	}, nil
+}
+
+// BlockNumber is used to retrieve the current block number
+func (rc *rpcChainClient) BlockNumber(ctx context.Context) (uint64, error) {
+	var number string
+	if err := rc.call(ctx, &number, "eth_blockNumber"); err != nil {
+		return 0, err
+	}
+	return parseHexUint(number)
+}
+
+// parseHexUint is used to parse a 0x prefixed hex quantity
+func parseHexUint(s string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+}
@@ -0,0 +1,133 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/RTradeLtd/Temporal/utils"
+	"github.com/RTradeLtd/database/v2/models"
+)
+
+func TestRPCChainClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		switch req.Method {
+		case "eth_blockNumber":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1b4"}`))
+		case "eth_getTransactionReceipt":
+			switch req.Params[0] {
+			case "0xpending":
+				w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":null}`))
+			case "0xfailed":
+				w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"transactionHash":"0xfailed","blockNumber":"0x10","status":"0x0"}}`))
+			case "0xsuccess":
+				w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"transactionHash":"0xsuccess","to":"0xabc","blockNumber":"0x10","status":"0x1"}}`))
+			default:
+				w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"invalid argument"}}`))
+			}
+		}
+	}))
+	defer srv.Close()
+	client := NewRPCChainClient(srv.URL)
+	number, err := client.BlockNumber(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number != 436 {
+		t.Fatalf("unexpected block number %v", number)
+	}
+	tests := []struct {
+		name        string
+		txHash      string
+		wantPending bool
+		wantSuccess bool
+		wantErr     bool
+	}{
+		{"Pending", "0xpending", true, false, true},
+		{"Failed", "0xfailed", false, false, false},
+		{"Success", "0xsuccess", false, true, false},
+		{"RPCError", "0xbad", false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt, err := client.TransactionReceipt(context.Background(), tt.txHash)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TransactionReceipt() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (err == ErrTxPending) != tt.wantPending {
+				t.Fatalf("TransactionReceipt() err = %v, wantPending %v", err, tt.wantPending)
+			}
+			if err != nil {
+				return
+			}
+			if receipt.BlockNumber != 16 {
+				t.Fatalf("unexpected receipt block number %v", receipt.BlockNumber)
+			}
+			if receipt.Success != tt.wantSuccess {
+				t.Fatalf("receipt success = %v, want %v", receipt.Success, tt.wantSuccess)
+			}
+		})
+	}
+}
+
+func TestValidatePaymentEvent(t *testing.T) {
+	const (
+		contract = "0x00000000000000000000000000000000000000aa"
+		sender   = "0x00000000000000000000000000000000000000bb"
+	)
+	payment := &models.Payments{
+		Number:         7,
+		DepositAddress: sender,
+		TxHash:         "0xtx",
+		ChargeAmount:   1.5,
+		Type:           "eth",
+	}
+	// word is used to abi encode n as a 32 byte word
+	word := func(n *big.Int) string {
+		return fmt.Sprintf("%064x", n)
+	}
+	payer, _ := new(big.Int).SetString(strings.TrimPrefix(sender, "0x"), 16)
+	amount := utils.FloatToBigInt(payment.ChargeAmount)
+	event := func(number, method int64, amount *big.Int) TxLog {
+		return TxLog{
+			Address: contract,
+			Topics:  []string{paymentEventTopic, "0x" + word(payer), "0x" + word(big.NewInt(number))},
+			Data:    "0x" + word(big.NewInt(method)) + word(amount),
+		}
+	}
+	tests := []struct {
+		name    string
+		from    string
+		log     TxLog
+		wantErr bool
+	}{
+		{"Valid", sender, event(7, 1, amount), false},
+		{"WrongSender", contract, event(7, 1, amount), true},
+		{"WrongNumber", sender, event(8, 1, amount), true},
+		{"WrongMethod", sender, event(7, 0, amount), true},
+		{"WrongAmount", sender, event(7, 1, big.NewInt(1)), true},
+		{"OtherContract", sender, TxLog{Address: sender, Topics: event(7, 1, amount).Topics, Data: event(7, 1, amount).Data}, true},
+		{"NoEvent", sender, TxLog{Address: contract, Topics: []string{"0x00"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := &TxReceipt{From: tt.from, To: contract, Success: true, Logs: []TxLog{tt.log}}
+			found, err := findPaymentEvent(receipt, contract)
+			if err == nil {
+				err = validatePaymentEvent(payment, receipt, found)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validatePaymentEvent() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
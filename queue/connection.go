@@ -0,0 +1,132 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	// PublishTimeout is the maximum amount of time spent publishing a message, including
+	// waiting for the broker to confirm it, and for us to reconnect if disconnected
+	PublishTimeout = time.Second * 10
+	// ErrDisconnected is returned when we are unable to reconnect to the broker in time
+	ErrDisconnected = errors.New("not connected to the message broker")
+	// reconnectBaseDelay is the delay before the first reconnection attempt,
+	// doubling with each subsequent attempt
+	reconnectBaseDelay = time.Second
+	// reconnectMaxDelay is the upper limit of the delay between reconnection attempts
+	reconnectMaxDelay = time.Second * 30
+)
+
+// connection returns our broker connection. If we are reconnecting, it
+// waits until we are connected again, or until ctx is done
+func (qm *Manager) connection(ctx context.Context) (Broker, error) {
+	for {
+		qm.mux.RLock()
+		broker, connected, closed := qm.broker, qm.connected, qm.closed
+		qm.mux.RUnlock()
+		if closed {
+			return nil, amqp.ErrClosed
+		}
+		if broker != nil {
+			return broker, nil
+		}
+		select {
+		case <-connected:
+		case <-ctx.Done():
+			return nil, ErrDisconnected
+		}
+	}
+}
+
+// publish is used to publish a message to the named queue, waiting for it to be confirmed
+func (qm *Manager) publish(queue string, msg amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+	broker, err := qm.connection(ctx)
+	if err != nil {
+		return err
+	}
+	return broker.Publish(ctx, queue, msg)
+}
+
+// retry is used to publish a message to be retried after the delay for the given attempt
+func (qm *Manager) retry(attempt int, msg amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+	broker, err := qm.connection(ctx)
+	if err != nil {
+		return err
+	}
+	return broker.Retry(ctx, qm.QueueName, attempt, msg)
+}
+
+// cancelConsumer is used to stop receiving messages from the queue
+func (qm *Manager) cancelConsumer() error {
+	broker, err := qm.connection(context.Background())
+	if err != nil {
+		return err
+	}
+	return broker.Cancel(qm.consumerTag)
+}
+
+// reconnect is used by publishers to re-establish their broker connection whenever
+// a connection error is received, retrying with an exponential backoff. While
+// reconnecting, publishes wait for us to be connected again
+func (qm *Manager) reconnect(errCh chan *amqp.Error) {
+	for {
+		msg, ok := <-errCh
+		if !ok {
+			// the connection was closed gracefully
+			return
+		}
+		qm.l.Errorw(
+			"a protocol connection error stopping rabbitmq was received, reconnecting",
+			"error", msg.Error())
+		qm.mux.Lock()
+		if qm.closed {
+			qm.mux.Unlock()
+			return
+		}
+		broker := qm.broker
+		qm.broker = nil
+		qm.connected = make(chan struct{})
+		qm.mux.Unlock()
+		// release anything still held by the lost connection
+		broker.Close()
+		delay := reconnectBaseDelay
+		for {
+			broker, err := dialBroker(qm.url, qm.cfg)
+			if err == nil {
+				qm.mux.Lock()
+				if qm.closed {
+					qm.mux.Unlock()
+					broker.Close()
+					return
+				}
+				qm.broker = broker
+				errCh = broker.NotifyClose(make(chan *amqp.Error, 1))
+				qm.ErrCh = errCh
+				close(qm.connected)
+				qm.mux.Unlock()
+				qm.l.Info("successfully re-established queue connection")
+				break
+			}
+			qm.l.Warnw(
+				"failed to reconnect to message broker",
+				"error", err.Error(),
+				"retry_in", delay.String())
+			select {
+			case <-time.After(delay):
+			case <-qm.done:
+				return
+			}
+			if delay = delay * 2; delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/config/v2"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+)
+
+func TestManager_Reconnect(t *testing.T) {
+	publishTimeout, baseDelay := PublishTimeout, reconnectBaseDelay
+	PublishTimeout, reconnectBaseDelay = time.Millisecond*200, time.Millisecond*10
+	defer func() { PublishTimeout, reconnectBaseDelay = publishTimeout, baseDelay }()
+	tests := []struct {
+		name    string
+		url     string
+		wantErr error
+	}{
+		{"Reconnects", "", nil},
+		{"Disconnected", "notarealprotocol://notarealurl", ErrDisconnected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := MemoryScheme + t.Name()
+			defer forgetMemoryBroker(url)
+			qm, err := New(IpfsPinQueue, url, true, true, &config.TemporalConfig{}, zap.NewNop().Sugar())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer qm.Close()
+			if tt.url != "" {
+				qm.url = tt.url
+			}
+			errCh := qm.ErrCh
+			errCh <- &amqp.Error{Code: 320, Reason: "connection forced", Server: true}
+			// wait for the connection error to be handled
+			for i := 0; ; i++ {
+				qm.mux.RLock()
+				handled := qm.broker == nil || qm.ErrCh != errCh
+				qm.mux.RUnlock()
+				if handled {
+					break
+				}
+				if i == 100 {
+					t.Fatal("timed out waiting for connection error to be handled")
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+			if err := qm.PublishMessage(IPFSPin{CID: testCID}); err != tt.wantErr {
+				t.Fatalf("PublishMessage() err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			d, ok, err := newMemoryClient(url).Get(IpfsPinQueue.String())
+			if err != nil || !ok {
+				t.Fatalf("expected published message, got ok %v err %v", ok, err)
+			}
+			if d.MessageId != "" || len(d.Body) == 0 {
+				t.Fatalf("unexpected message %+v", d)
+			}
+		})
+	}
+}
+
+func TestManager_Close(t *testing.T) {
+	url := MemoryScheme + t.Name()
+	defer forgetMemoryBroker(url)
+	qm, err := New(IpfsPinQueue, url, true, true, &config.TemporalConfig{}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := qm.Close(); err != amqp.ErrClosed {
+		t.Fatalf("expected closing twice to fail, got %v", err)
+	}
+	if err := qm.PublishMessage(IPFSPin{CID: testCID}); err != amqp.ErrClosed {
+		t.Fatalf("expected publishing after close to fail, got %v", err)
+	}
+}
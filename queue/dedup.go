@@ -0,0 +1,88 @@
+package queue
+
+import (
+	"fmt"
+
+	"github.com/RTradeLtd/gorm"
+	"github.com/streadway/amqp"
+)
+
+// ReplayHeader is the message header tracking how many times a
+// message has been replayed from the dead letter queue
+const ReplayHeader = "x-temporal-replay"
+
+// ProcessedMessage records a message which is being, or has been, processed. Messages
+// published with an id, such as by the outbox relay, may be published more than once,
+// so these records are used to detect and discard the duplicates
+type ProcessedMessage struct {
+	gorm.Model
+	// MessageKey is the id of the message, qualified by the number of times it was replayed
+	MessageKey string `gorm:"type:varchar(255);unique_index"`
+	Queue      string `gorm:"type:varchar(255)"`
+	// Done is whether processing finished, by the message succeeding, or being dead-lettered
+	Done bool
+}
+
+// TableName is used to store records in the processed_messages table
+func (ProcessedMessage) TableName() string {
+	return "processed_messages"
+}
+
+// MigrateProcessedMessages is used to create or update the processed messages table
+func MigrateProcessedMessages(db *gorm.DB) error {
+	return db.AutoMigrate(&ProcessedMessage{}).Error
+}
+
+// replays returns the number of times a message has been replayed from the dead letter queue
+func replays(d amqp.Delivery) int {
+	switch v := d.Headers[ReplayHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 0
+	}
+}
+
+// messageKey returns the key used to detect duplicates of a message. Replayed messages
+// are processed again, so the key includes the number of times it was replayed
+func messageKey(d amqp.Delivery) string {
+	return fmt.Sprintf("%s.%d", d.MessageId, replays(d))
+}
+
+// claim is used to record that a message is being processed, returning false if it is a
+// duplicate of a message which is being, or has been, processed. Retries only exist for
+// messages we claimed, and redeliveries resume messages whose processing was interrupted,
+// so these are processed unless the message is done. Messages without an id are always processed
+func (qm *Manager) claim(d amqp.Delivery) (bool, error) {
+	if qm.db == nil || d.MessageId == "" || attempts(d) > 0 {
+		return true, nil
+	}
+	key := messageKey(d)
+	createErr := qm.db.Create(&ProcessedMessage{MessageKey: key, Queue: qm.QueueName.String()}).Error
+	if createErr == nil {
+		return true, nil
+	}
+	var existing ProcessedMessage
+	if err := qm.db.Where("message_key = ?", key).First(&existing).Error; err != nil {
+		return false, createErr
+	}
+	return !existing.Done && d.Redelivered, nil
+}
+
+// settle is used to record that processing of a message finished
+func (qm *Manager) settle(d amqp.Delivery) {
+	if qm.db == nil || d.MessageId == "" {
+		return
+	}
+	if err := qm.db.Model(&ProcessedMessage{}).Where("message_key = ?", messageKey(d)).
+		Update("done", true).Error; err != nil {
+		qm.l.Errorw(
+			"failed to record message as processed",
+			"error", err.Error(),
+			"message_id", d.MessageId)
+	}
+}
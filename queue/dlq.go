@@ -0,0 +1,147 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DeadLetter is a message which failed processing and was sent to a dead letter queue
+type DeadLetter struct {
+	Body     []byte
+	Attempts int
+	Error    string
+	FailedAt time.Time
+	// Refunded is whether the cost of the message was refunded, in which case it isn't replayed
+	Refunded bool
+}
+
+// Queues returns all of the queues messages are consumed from
+func Queues() []Queue {
+	return []Queue{
+		IpfsPinQueue,
+		IpfsClusterPinQueue,
+		EmailSendQueue,
+		IpnsEntryQueue,
+		IpfsKeyCreationQueue,
+		EthPaymentConfirmationQueue,
+		DashPaymentConfirmationQueue,
+		WebhookDeliveryQueue,
+	}
+}
+
+// ParseQueue is used to convert a queue name to a Queue
+func ParseQueue(name string) (Queue, error) {
+	for _, q := range Queues() {
+		if q.String() == name {
+			return q, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not a valid queue", name)
+}
+
+// ListDeadLetters is used to inspect up to limit messages in the dead letter queue.
+// Messages are left on the queue
+func (qm *Manager) ListDeadLetters(limit int) ([]DeadLetter, error) {
+	broker, err := qm.connection(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	var (
+		letters []DeadLetter
+		last    *amqp.Delivery
+	)
+	for len(letters) < limit {
+		d, ok, err := broker.Get(qm.QueueName.DeadLetterQueue())
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		last = &d
+		letter := DeadLetter{Body: d.Body, Attempts: attempts(d), Refunded: refunded(d)}
+		if msg, ok := d.Headers[ErrorHeader].(string); ok {
+			letter.Error = msg
+		}
+		if ts, ok := d.Headers[FailedAtHeader].(int64); ok {
+			letter.FailedAt = time.Unix(ts, 0)
+		}
+		letters = append(letters, letter)
+	}
+	// return all the messages we retrieved back to the queue
+	if last != nil {
+		if err := last.Nack(true, true); err != nil {
+			return nil, err
+		}
+	}
+	return letters, nil
+}
+
+// ReplayDeadLetters is used to move up to limit messages from the dead letter queue
+// back onto the primary queue, resetting their attempt count. Messages which were
+// refunded are left on the dead letter queue, as processing them again would be free.
+// It returns the number of messages that were replayed
+func (qm *Manager) ReplayDeadLetters(limit int) (int, error) {
+	broker, err := qm.connection(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	var (
+		replayed int
+		skipped  []amqp.Delivery
+	)
+	// return the refunded messages we retrieved back to the queue
+	defer func() {
+		for _, d := range skipped {
+			d.Nack(false, true)
+		}
+	}()
+	for replayed < limit {
+		d, ok, err := broker.Get(qm.QueueName.DeadLetterQueue())
+		if err != nil {
+			return replayed, err
+		}
+		if !ok {
+			break
+		}
+		if refunded(d) {
+			skipped = append(skipped, d)
+			continue
+		}
+		headers := amqp.Table{}
+		for k, v := range d.Headers {
+			headers[k] = v
+		}
+		delete(headers, AttemptHeader)
+		// replayed messages are processed again, rather than discarded as duplicates
+		headers[ReplayHeader] = int32(replays(d) + 1)
+		if err := qm.publish(qm.QueueName.String(), amqp.Publishing{
+			Headers:      headers,
+			DeliveryMode: amqp.Persistent,
+			ContentType:  d.ContentType,
+			MessageId:    d.MessageId,
+			Body:         d.Body,
+		}); err != nil {
+			d.Nack(false, true)
+			return replayed, err
+		}
+		if err := d.Ack(false); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// PurgeDeadLetters is used to remove all messages from the dead letter queue,
+// returning the number of messages which were removed
+func (qm *Manager) PurgeDeadLetters() (int, error) {
+	broker, err := qm.connection(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	return broker.Purge(qm.QueueName.DeadLetterQueue())
+}
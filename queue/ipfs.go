@@ -37,24 +37,9 @@ func (qm *Manager) ProcessIPFSKeyCreation(ctx context.Context, wg *sync.WaitGrou
 	}
 	userManager := models.NewUserManager(qm.db)
 	qm.l.Info("processing ipfs key creation requests")
-	for {
-		select {
-		case d := <-msgs:
-			wg.Add(1)
-			go qm.processIPFSKeyCreation(d, wg, kbPrimary, kbBackup, userManager)
-		case <-ctx.Done():
-			qm.Close()
-			wg.Done()
-			return nil
-		case msg := <-qm.ErrCh:
-			qm.Close()
-			wg.Done()
-			qm.l.Errorw(
-				"a protocol connection error stopping rabbitmq was received",
-				"error", msg.Error())
-			return errors.New(ErrReconnect)
-		}
-	}
+	return qm.consume(ctx, wg, msgs, func(ctx context.Context, d amqp.Delivery) error {
+		return qm.processIPFSKeyCreation(ctx, d, kbPrimary, kbBackup, userManager)
+	})
 }
 
 // ProccessIPFSPins is used to process IPFS pin requests
@@ -78,34 +63,17 @@ func (qm *Manager) ProccessIPFSPins(ctx context.Context, wg *sync.WaitGroup, msg
 		return err
 	}
 	qm.l.Info("processing ipfs pins")
-	for {
-		select {
-		case d := <-msgs:
-			wg.Add(1)
-			go qm.processIPFSPin(d, wg, userManager, networkManager, uploadManager, qmCluster, ipfsManager)
-		case <-ctx.Done():
-			qm.Close()
-			wg.Done()
-			return nil
-		case msg := <-qm.ErrCh:
-			qm.Close()
-			wg.Done()
-			qm.l.Errorw(
-				"a protocol connection error stopping rabbitmq was received",
-				"error", msg.Error())
-			return errors.New(ErrReconnect)
-		}
-	}
+	return qm.consume(ctx, wg, msgs, func(ctx context.Context, d amqp.Delivery) error {
+		return qm.processIPFSPin(ctx, d, userManager, networkManager, uploadManager, qmCluster, ipfsManager)
+	})
 }
 
-func (qm *Manager) processIPFSPin(d amqp.Delivery, wg *sync.WaitGroup, usrm *models.UserManager, nm *models.HostedNetworkManager, upldm *models.UploadManager, qmCluster *Manager, ipfsManager *rtfs.IpfsManager) {
-	defer wg.Done()
+func (qm *Manager) processIPFSPin(ctx context.Context, d amqp.Delivery, usrm *models.UserManager, nm *models.HostedNetworkManager, upldm *models.UploadManager, qmCluster *Manager, ipfsManager *rtfs.IpfsManager) error {
 	qm.l.Info("new pin request detected")
 	pin := &IPFSPin{}
 	if err := json.Unmarshal(d.Body, pin); err != nil {
 		qm.l.Errorw("failed to unmarshal message", "error", err.Error())
-		d.Ack(false)
-		return
+		return Permanent(err)
 	}
 	// setup the default api connection
 	apiURL := qm.cfg.IPFS.APIConnection.Host + ":" + qm.cfg.IPFS.APIConnection.Port
@@ -115,16 +83,15 @@ func (qm *Manager) processIPFSPin(d amqp.Delivery, wg *sync.WaitGroup, usrm *mod
 		canAccess, err := usrm.CheckIfUserHasAccessToNetwork(pin.UserName, pin.NetworkName)
 		if err != nil {
 			qm.l.Errorw("failed to lookup private network in database", "error", err.Error())
-			d.Ack(false)
-			return
+			return Retryable(err)
 		}
 		if !canAccess {
+			err := errors.New("user does not have access to private network")
 			qm.l.Errorw(
 				"unauthorized private network access",
-				"error", errors.New("user does not have access to private network").Error(),
+				"error", err.Error(),
 				"user", pin.UserName)
-			d.Ack(false)
-			return
+			return Permanent(err)
 		}
 		apiURL = fmt.Sprintf("%s/network/%s/api", qm.cfg.Nexus.Host+":"+qm.cfg.Nexus.Delegator.Port, pin.NetworkName)
 		// connect to ipfs
@@ -135,8 +102,7 @@ func (qm *Manager) processIPFSPin(d amqp.Delivery, wg *sync.WaitGroup, usrm *mod
 				"error", err.Error(),
 				"user", pin.UserName,
 				"network", pin.NetworkName)
-			d.Ack(false)
-			return
+			return Retryable(err)
 		}
 	}
 	qm.l.Infow(
@@ -149,17 +115,19 @@ func (qm *Manager) processIPFSPin(d amqp.Delivery, wg *sync.WaitGroup, usrm *mod
 		"network", pin.NetworkName)
 	// pin the content
 	if err := ipfsManager.Pin(pin.CID); err != nil {
-		if pin.NetworkName == "public" {
-			qm.refundCredits(pin.UserName, "pin", pin.CreditCost)
+		// only refund once we have given up on pinning the content
+		if qm.finalAttempt(d) {
+			if pin.NetworkName == "public" {
+				qm.refund(ctx, d, pin.UserName, "pin", pin.CreditCost, err)
+			}
+			models.NewUsageManager(qm.db).ReduceDataUsage(pin.UserName, uint64(pin.Size))
 		}
-		models.NewUsageManager(qm.db).ReduceDataUsage(pin.UserName, uint64(pin.Size))
 		qm.l.Errorw(
 			"failed to pin hash to ipfs",
 			"error", err.Error(),
 			"user", pin.UserName,
 			"network", pin.NetworkName)
-		d.Ack(false)
-		return
+		return Retryable(err)
 	}
 	// cluster support for private networks isn't available yet
 	// as such, skip additional processing for cluster pins
@@ -173,8 +141,7 @@ func (qm *Manager) processIPFSPin(d amqp.Delivery, wg *sync.WaitGroup, usrm *mod
 			"fail to check database for upload",
 			"error", err.Error(),
 			"user", pin.UserName)
-		d.Ack(false)
-		return
+		return Retryable(err)
 	}
 	// check whether or not we have seen this content hash before to determine how database needs to be updated
 	if upload == nil {
@@ -192,29 +159,26 @@ func (qm *Manager) processIPFSPin(d amqp.Delivery, wg *sync.WaitGroup, usrm *mod
 			"failed to update database",
 			"error", err.Error(),
 			"user", pin.UserName)
+		return Retryable(err)
 	}
-	d.Ack(false)
-	return // we must return here in order to trigger the wg.Done() defer
+	return nil
 }
 
-func (qm *Manager) processIPFSKeyCreation(d amqp.Delivery, wg *sync.WaitGroup, kbPrimary *kaas.Client, kbBackup *kaas.Client, um *models.UserManager) {
-	defer wg.Done()
+func (qm *Manager) processIPFSKeyCreation(ctx context.Context, d amqp.Delivery, kbPrimary *kaas.Client, kbBackup *kaas.Client, um *models.UserManager) error {
 	qm.l.Info("new key creation request detected")
 	key := IPFSKeyCreation{}
 	if err := json.Unmarshal(d.Body, &key); err != nil {
 		qm.l.Errorw(
 			"failed to unmarshal message",
 			"error", err.Error())
-		d.Ack(false)
-		return
+		return Permanent(err)
 	}
 	// to prevent key name collision, we need to ensure that the keyname was prefixed with their username and a hyphen
 	// whenever a user creates a key, the API call will prepend their username and a hyphen before sending the message for processing
 	// this check ensures that the key was properly prefixed
 	if strings.Split(key.Name, "-")[0] != key.UserName {
 		qm.l.Errorf("invalid key name %s, must be prefixed with: %s-", key.Name, key.UserName)
-		d.Ack(false)
-		return
+		return Permanent(fmt.Errorf("invalid key name %s", key.Name))
 	}
 	var (
 		keyTypeInt int
@@ -235,13 +199,13 @@ func (qm *Manager) processIPFSKeyCreation(d amqp.Delivery, wg *sync.WaitGroup, k
 		// ed25519 keys use 256 bits, so regardless of what the user provides for bit size, hard set 256
 		bitsInt = 256
 	default:
+		err := fmt.Errorf("key must be ed25519 or rsa, not %s", key.Type)
 		qm.l.Errorw(
 			"invalid key type for creation request",
-			"error", fmt.Errorf("key must be ed25519 or rsa, not %s", key.Type),
+			"error", err.Error(),
 			"user", key.UserName,
 			"key_name", key.Name)
-		d.Ack(false)
-		return
+		return Permanent(err)
 	}
 	// generate the appropriate keypair
 	pk, _, err := ci.GenerateKeyPair(keyTypeInt, bitsInt)
@@ -251,8 +215,7 @@ func (qm *Manager) processIPFSKeyCreation(d amqp.Delivery, wg *sync.WaitGroup, k
 			"error", err.Error(),
 			"user", key.UserName,
 			"key_name", key.Name)
-		d.Ack(false)
-		return
+		return Retryable(err)
 	}
 	// retrieve a human friendly format, also verifying the key is a valid ipfs key
 	id, err := peer.IDFromPrivateKey(pk)
@@ -262,8 +225,7 @@ func (qm *Manager) processIPFSKeyCreation(d amqp.Delivery, wg *sync.WaitGroup, k
 			"error", err.Error(),
 			"user", key.UserName,
 			"Key_name", key.Name)
-		d.Ack(false)
-		return
+		return Permanent(err)
 	}
 	// convert the key to bytes to send to krab for processing
 	pkBytes, err := pk.Bytes()
@@ -273,24 +235,22 @@ func (qm *Manager) processIPFSKeyCreation(d amqp.Delivery, wg *sync.WaitGroup, k
 			"error", err.Error(),
 			"user", key.UserName,
 			"key_name", key.Name)
-		d.Ack(false)
-		return
+		return Permanent(err)
 	}
 
 	// store the key in local krab
-	if _, err := kbPrimary.PutPrivateKey(context.Background(), &pb.KeyPut{Name: key.Name, PrivateKey: pkBytes}); err != nil {
+	if _, err := kbPrimary.PutPrivateKey(ctx, &pb.KeyPut{Name: key.Name, PrivateKey: pkBytes}); err != nil {
 		qm.l.Errorw(
 			"failed to store key in primary krab",
 			"error", err.Error(),
 			"user", key.UserName,
 			"key_name", key.Name)
-		d.Ack(false)
-		return
+		return Retryable(err)
 	}
 	if !qm.dev {
 		// store the key in remote krab
 		// dont fail on fallback
-		if _, err := kbBackup.PutPrivateKey(context.Background(), &pb.KeyPut{Name: key.Name, PrivateKey: pkBytes}); err != nil {
+		if _, err := kbBackup.PutPrivateKey(ctx, &pb.KeyPut{Name: key.Name, PrivateKey: pkBytes}); err != nil {
 			qm.l.Warnw(
 				"failed to store key in krab",
 				"error", err.Error(),
@@ -298,19 +258,19 @@ func (qm *Manager) processIPFSKeyCreation(d amqp.Delivery, wg *sync.WaitGroup, k
 				"key_name", key.Name)
 		}
 	}
-	// doesn't need a refund, key was generated and stored in our keystore, but information not saved to db
+	// doesn't need a refund, key was generated and stored in our keystore, but information not saved to db.
+	// this is not retried, as doing so would generate a different key under the same name
 	if err := um.AddIPFSKeyForUser(key.UserName, key.Name, id.Pretty()); err != nil {
 		qm.l.Errorw(
 			"failed to update database",
 			"error", err.Error(),
 			"user", key.UserName,
 			"key_name", key.Name)
-	} else {
-		qm.l.Infow(
-			"successfully processed key creation request",
-			"user", key.UserName,
-			"key_name", key.Name)
+		return Permanent(err)
 	}
-	d.Ack(false)
-	return // we must return here in order to trigger the wg.Done() defer
+	qm.l.Infow(
+		"successfully processed key creation request",
+		"user", key.UserName,
+		"key_name", key.Name)
+	return nil
 }
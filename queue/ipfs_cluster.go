@@ -5,10 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"sync"
+	"time"
 
+	"github.com/RTradeLtd/Temporal/customer"
 	"github.com/RTradeLtd/Temporal/rtfscluster"
 	"github.com/RTradeLtd/database/v2/models"
 	"github.com/RTradeLtd/gorm"
+	"github.com/RTradeLtd/rtfs/v2"
 	"github.com/streadway/amqp"
 )
 
@@ -18,74 +21,65 @@ func (qm *Manager) ProcessIPFSClusterPins(ctx context.Context, wg *sync.WaitGrou
 	if err != nil {
 		return err
 	}
+	// customer objects are read from ipfs, and record the content users have been charged for
+	ipfsManager, err := rtfs.NewManager(qm.cfg.IPFS.APIConnection.Host+":"+qm.cfg.IPFS.APIConnection.Port, "", time.Minute*60)
+	if err != nil {
+		qm.l.Errorw("failed to initialize connection to ipfs", "error", err.Error())
+		return err
+	}
 	uploadManager := models.NewUploadManager(qm.db)
+	customerManager := customer.NewManager(models.NewUserManager(qm.db), ipfsManager)
 	qm.l.Info("processing ipfs cluster pin requests")
-	for {
-		select {
-		case d := <-msgs:
-			wg.Add(1)
-			go qm.processIPFSClusterPin(ctx, d, wg, clusterManager, uploadManager)
-		case <-ctx.Done():
-			qm.Close()
-			wg.Done()
-			return nil
-		case msg := <-qm.ErrCh:
-			qm.Close()
-			wg.Done()
-			qm.l.Errorw(
-				"a protocol connection error stopping rabbitmq was received",
-				"error", msg.Error())
-			return errors.New(ErrReconnect)
-		}
-	}
+	return qm.consume(ctx, wg, msgs, func(ctx context.Context, d amqp.Delivery) error {
+		return qm.processIPFSClusterPin(ctx, d, clusterManager, uploadManager, customerManager)
+	})
 }
 
-func (qm *Manager) processIPFSClusterPin(ctx context.Context, d amqp.Delivery, wg *sync.WaitGroup, cm *rtfscluster.ClusterManager, um *models.UploadManager) {
-	defer wg.Done()
+func (qm *Manager) processIPFSClusterPin(ctx context.Context, d amqp.Delivery, cm *rtfscluster.ClusterManager, um *models.UploadManager, custm *customer.Manager) error {
 	qm.l.Info("new cluster pin request detected")
 	clusterAdd := IPFSClusterPin{}
 	if err := json.Unmarshal(d.Body, &clusterAdd); err != nil {
 		qm.l.Errorw(
 			"failed to unmarshal message",
 			"error", err.Error())
-		d.Ack(false)
-		return
+		return Permanent(err)
 	}
 	if clusterAdd.NetworkName != "public" {
+		err := errors.New("private network clusters not supported")
 		qm.l.Errorw(
 			"private clustered networks not yet supported",
-			"error", errors.New("private network clusters not supported").Error(),
+			"error", err.Error(),
 			"cid", clusterAdd.CID,
 			"user", clusterAdd.UserName)
-		d.Ack(false)
-		return
+		return Permanent(err)
 	}
 	encodedCid, err := cm.DecodeHashString(clusterAdd.CID)
 	if err != nil {
-		qm.refundCredits(clusterAdd.UserName, "pin", clusterAdd.CreditCost)
+		qm.refund(ctx, d, clusterAdd.UserName, "pin", clusterAdd.CreditCost, err)
 		models.NewUsageManager(qm.db).ReduceDataUsage(clusterAdd.UserName, uint64(clusterAdd.Size))
 		qm.l.Errorw(
 			"bad cid format detected",
 			"error", err.Error(),
 			"cid", clusterAdd.CID,
 			"user", clusterAdd.UserName)
-		d.Ack(false)
-		return
+		return Permanent(err)
 	}
 	qm.l.Infow(
 		"pinning has to cluster",
 		"cid", clusterAdd.CID,
 		"user", clusterAdd.UserName)
 	if err = cm.Pin(ctx, encodedCid); err != nil {
-		qm.refundCredits(clusterAdd.UserName, "pin", clusterAdd.CreditCost)
-		models.NewUsageManager(qm.db).ReduceDataUsage(clusterAdd.UserName, uint64(clusterAdd.Size))
+		// only refund once we have given up on pinning the content
+		if qm.finalAttempt(d) {
+			qm.refund(ctx, d, clusterAdd.UserName, "pin", clusterAdd.CreditCost, err)
+			models.NewUsageManager(qm.db).ReduceDataUsage(clusterAdd.UserName, uint64(clusterAdd.Size))
+		}
 		qm.l.Errorw(
 			"failed to pin hash to cluster",
 			"error", err.Error(),
 			"cid", clusterAdd.CID,
 			"user", clusterAdd.UserName)
-		d.Ack(false)
-		return
+		return Retryable(err)
 	}
 	upload, err := um.FindUploadByHashAndUserAndNetwork(clusterAdd.UserName, clusterAdd.CID, clusterAdd.NetworkName)
 	if err != nil && err != gorm.ErrRecordNotFound {
@@ -94,8 +88,7 @@ func (qm *Manager) processIPFSClusterPin(ctx context.Context, d amqp.Delivery, w
 			"error", err.Error(),
 			"cid", clusterAdd.CID,
 			"user", clusterAdd.UserName)
-		d.Ack(false)
-		return
+		return Retryable(err)
 	}
 	if upload == nil {
 		_, err = um.NewUpload(clusterAdd.CID, "pin-cluster", models.UploadOptions{
@@ -111,12 +104,21 @@ func (qm *Manager) processIPFSClusterPin(ctx context.Context, d amqp.Delivery, w
 			"error", err.Error(),
 			"cid", clusterAdd.CID,
 			"user", clusterAdd.UserName)
-	} else {
-		qm.l.Infow(
-			"successfully processed cluster pin request",
+		return Retryable(err)
+	}
+	// content is only recorded against the customer object of the user once pinned, so that
+	// uploads which fail, and are refunded, aren't deduplicated against in the future. Failures
+	// are logged, as the only consequence is the user being charged in full for this content again
+	if _, err := custm.Update(clusterAdd.UserName, clusterAdd.CID); err != nil {
+		qm.l.Errorw(
+			"failed to update customer object",
+			"error", err.Error(),
 			"cid", clusterAdd.CID,
 			"user", clusterAdd.UserName)
 	}
-	d.Ack(false)
-	return // we must return here in order to trigger the wg.Done() defer
+	qm.l.Infow(
+		"successfully processed cluster pin request",
+		"cid", clusterAdd.CID,
+		"user", clusterAdd.UserName)
+	return nil
 }
@@ -45,44 +45,26 @@ func (qm *Manager) ProcessIPNSEntryCreationRequests(ctx context.Context, wg *syn
 	}
 	ipnsManager := models.NewIPNSManager(qm.db)
 	qm.l.Info("processing ipns entry creation requests")
-	for {
-		select {
-		case d := <-msgs:
-			wg.Add(1)
-			go qm.processIPNSEntryCreationRequest(d, wg, kbPrimary, kbBackup, publisher, ipnsManager)
-		case <-ctx.Done():
-			qm.Close()
-			wg.Done()
-			return nil
-		case msg := <-qm.ErrCh:
-			qm.Close()
-			wg.Done()
-			qm.l.Errorw(
-				"a protocol connection error stopping rabbitmq was received",
-				"error", msg.Error())
-			return errors.New(ErrReconnect)
-		}
-	}
+	return qm.consume(ctx, wg, msgs, func(ctx context.Context, d amqp.Delivery) error {
+		return qm.processIPNSEntryCreationRequest(ctx, d, kbPrimary, kbBackup, publisher, ipnsManager)
+	})
 }
 
-func (qm *Manager) processIPNSEntryCreationRequest(d amqp.Delivery, wg *sync.WaitGroup, kbPrimary *kaas.Client, kbBackup *kaas.Client, pub *rtns.Publisher, im *models.IpnsManager) {
-	defer wg.Done()
+func (qm *Manager) processIPNSEntryCreationRequest(ctx context.Context, d amqp.Delivery, kbPrimary *kaas.Client, kbBackup *kaas.Client, pub *rtns.Publisher, im *models.IpnsManager) error {
 	qm.l.Info("new ipns entry creation detected")
 	ie := IPNSEntry{}
 	if err := json.Unmarshal(d.Body, &ie); err != nil {
 		qm.l.Errorw(
 			"failed to unmarshal message",
 			"error", err.Error())
-		d.Ack(false)
-		return
+		return Permanent(err)
 	}
 	// temporarily do not process ipns creation requests for non public networks
 	if ie.NetworkName != "public" {
 		qm.l.Errorw(
 			"private networks not supported for ipns",
 			"user", ie.UserName)
-		d.Ack(false)
-		return
+		return Permanent(errors.New("private networks not supported for ipns"))
 	}
 	qm.l.Infow(
 		"publishing ipns entry",
@@ -94,7 +76,7 @@ func (qm *Manager) processIPNSEntryCreationRequest(d amqp.Delivery, wg *sync.Wai
 		err  error
 	)
 	// get the private key from krab to use with publishing
-	resp, err = kbPrimary.GetPrivateKey(context.Background(), &pb.KeyGet{Name: ie.Key})
+	resp, err = kbPrimary.GetPrivateKey(ctx, &pb.KeyGet{Name: ie.Key})
 	if err != nil {
 		qm.l.Warnw(
 			"failed to retrieve private key from priamry krab, attempting backup",
@@ -105,17 +87,18 @@ func (qm *Manager) processIPNSEntryCreationRequest(d amqp.Delivery, wg *sync.Wai
 		)
 		if !qm.dev {
 			var errCheck error
-			resp, errCheck = kbBackup.GetPrivateKey(context.Background(), &pb.KeyGet{Name: ie.Key})
+			resp, errCheck = kbBackup.GetPrivateKey(ctx, &pb.KeyGet{Name: ie.Key})
 			if errCheck != nil {
-				qm.refundCredits(ie.UserName, "ipns", ie.CreditCost)
+				if qm.finalAttempt(d) {
+					qm.refund(ctx, d, ie.UserName, "ipns", ie.CreditCost, errCheck)
+				}
 				qm.l.Errorw(
 					"failed to retrieve private key from backup krab",
 					"error", err.Error(),
 					"user", ie.UserName,
 					"key", ie.Key,
 					"cid", ie.CID)
-				d.Ack(false)
-				return
+				return Retryable(errCheck)
 			}
 		} else {
 			qm.l.Errorw(
@@ -124,37 +107,37 @@ func (qm *Manager) processIPNSEntryCreationRequest(d amqp.Delivery, wg *sync.Wai
 				"key", ie.Key,
 				"cid", ie.CID,
 			)
-			d.Ack(false)
-			return
+			return Retryable(err)
 		}
 	}
 	// unmarshal the key that was returned by krab
 	pk2, err := ci.UnmarshalPrivateKey(resp.PrivateKey)
 	if err != nil {
-		qm.refundCredits(ie.UserName, "ipns", ie.CreditCost)
+		qm.refund(ctx, d, ie.UserName, "ipns", ie.CreditCost, err)
 		qm.l.Errorw(
 			"failed to unmarshal private key",
 			"error", err.Error(),
 			"user", ie.UserName,
 			"key", ie.Key,
 			"cid", ie.CID)
-		d.Ack(false)
-		return
+		return Permanent(err)
 	}
 	// Note: context is used to pass in the experimental ttl value
 	// see https://discuss.ipfs.io/t/clarification-over-ttl-and-lifetime-for-ipns-records/4346 for more information
-	ctx := context.WithValue(context.Background(), ipnsPublishTTL, ie.TTL)
+	ctx = context.WithValue(ctx, ipnsPublishTTL, ie.TTL)
 	eol := time.Now().Add(ie.LifeTime)
 	if err := pub.PublishWithEOL(ctx, pk2, ie.CID, eol); err != nil {
-		qm.refundCredits(ie.UserName, "ipns", ie.CreditCost)
+		// only refund once we have given up on publishing the record
+		if qm.finalAttempt(d) {
+			qm.refund(ctx, d, ie.UserName, "ipns", ie.CreditCost, err)
+		}
 		qm.l.Errorw(
 			"failed to publish ipns entry",
 			"error", err.Error(),
 			"user", ie.UserName,
 			"key", ie.Key,
 			"cid", ie.CID)
-		d.Ack(false)
-		return
+		return Retryable(err)
 	}
 	// retrieve the peer id from the private key used to resolve the IPNS record
 	id, err := peer.IDFromPrivateKey(pk2)
@@ -166,8 +149,7 @@ func (qm *Manager) processIPNSEntryCreationRequest(d amqp.Delivery, wg *sync.Wai
 			"user", ie.UserName,
 			"key", ie.Key,
 			"cid", ie.CID)
-		d.Ack(false)
-		return
+		return Permanent(err)
 	}
 	// determine whether or not this ipns has been used, if so update record, otherwise create new one
 	if _, err = im.FindByIPNSHash(id.Pretty()); err != nil {
@@ -182,14 +164,12 @@ func (qm *Manager) processIPNSEntryCreationRequest(d amqp.Delivery, wg *sync.Wai
 			"user", ie.UserName,
 			"key", ie.Key,
 			"cid", ie.CID)
-	} else {
-		qm.l.Infow(
-			"successfully processed ipns entry creation request",
-			"user", ie.UserName,
-			"key", ie.Key,
-			"cid", ie.CID)
+		return Retryable(err)
 	}
-	d.Ack(false)
-	return // we must return here in order to trigger the wg.Done() defer
-
+	qm.l.Infow(
+		"successfully processed ipns entry creation request",
+		"user", ie.UserName,
+		"key", ie.Key,
+		"cid", ie.CID)
+	return nil
 }
@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/RTradeLtd/Temporal/jobs"
+	"github.com/streadway/amqp"
+)
+
+// jobMessage is used to extract the job id from any message which carries one
+type jobMessage struct {
+	JobID string `json:"job_id"`
+}
+
+// jobID returns the job id carried by a message, if any
+func jobID(d amqp.Delivery) string {
+	var msg jobMessage
+	if err := json.Unmarshal(d.Body, &msg); err != nil {
+		return ""
+	}
+	return msg.JobID
+}
+
+// updateJob is used to record a state transition of the job carried by a message.
+// Messages without a job id are ignored
+func (qm *Manager) updateJob(d amqp.Delivery, state jobs.State, reason string) {
+	id := jobID(d)
+	if qm.jobs == nil || id == "" {
+		return
+	}
+	if err := qm.jobs.UpdateState(id, state, reason); err != nil {
+		qm.l.Errorw(
+			"failed to update job state",
+			"error", err.Error(),
+			"job_id", id,
+			"state", state)
+	}
+}
+
+// refundKey is the context key of the flag recording whether the message being processed was refunded
+type refundKey struct{}
+
+// refund is used to refund the cost of a message which will no longer be
+// processed, marking its job as refunded. The refund is recorded in ctx, so
+// that the message is dead-lettered rather than retried
+func (qm *Manager) refund(ctx context.Context, d amqp.Delivery, username, callType string, cost float64, reason error) {
+	if cost == 0 {
+		return
+	}
+	if err := qm.refundCredits(username, callType, cost, jobID(d)); err != nil {
+		return
+	}
+	if wasRefunded, ok := ctx.Value(refundKey{}).(*bool); ok {
+		*wasRefunded = true
+	}
+	qm.updateJob(d, jobs.Refunded, reason.Error())
+	qm.notify(d, jobs.Refunded, reason.Error())
+}
@@ -3,7 +3,6 @@ package queue
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"sync"
 
 	"github.com/RTradeLtd/Temporal/mail"
@@ -18,51 +17,44 @@ func (qm *Manager) ProcessMailSends(ctx context.Context, wg *sync.WaitGroup, db
 		return err
 	}
 	qm.l.Info("processing email send requests")
-	for {
-		select {
-		case d := <-msgs:
-			wg.Add(1)
-			go qm.processMailSend(d, wg, mm)
-		case <-ctx.Done():
-			qm.Close()
-			wg.Done()
-			return nil
-		case msg := <-qm.ErrCh:
-			qm.Close()
-			wg.Done()
-			qm.l.Errorw(
-				"a protocol connection error stopping rabbitmq was received",
-				"error", msg.Error())
-			return errors.New(ErrReconnect)
-		}
-	}
+	return qm.consume(ctx, wg, msgs, func(ctx context.Context, d amqp.Delivery) error {
+		return qm.processMailSend(ctx, d, mm)
+	})
 }
 
-func (qm *Manager) processMailSend(d amqp.Delivery, wg *sync.WaitGroup, mm *mail.Manager) {
-	defer wg.Done()
+func (qm *Manager) processMailSend(ctx context.Context, d amqp.Delivery, mm *mail.Manager) error {
 	qm.l.Info("new email send request detected")
 	es := EmailSend{}
 	if err := json.Unmarshal(d.Body, &es); err != nil {
 		qm.l.Errorw(
 			"failed to unmarshal message",
 			"error", err.Error())
-		d.Ack(false)
-		return
+		return Permanent(err)
 	}
+	var (
+		failed  int
+		lastErr error
+	)
 	for k, v := range es.Emails {
 		_, err := mm.SendEmail(es.Subject, es.Content, es.ContentType, es.UserNames[k], v)
 		if err != nil {
+			failed++
+			lastErr = err
 			qm.l.Errorw(
 				"failed to send email",
 				"error", err.Error(),
 				"email", v,
 				"user", es.UserNames[k])
+			continue
 		}
 		qm.l.Infow(
 			"email sent",
 			"email", v,
 			"user", es.UserNames[k])
 	}
-	d.Ack(false)
-	return // we must return here in order to trigger the wg.Done() defer
+	// only retry if no emails were sent, to avoid sending duplicates
+	if failed > 0 && failed == len(es.Emails) {
+		return Retryable(lastErr)
+	}
+	return nil
 }
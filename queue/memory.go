@@ -0,0 +1,366 @@
+package queue
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// memoryBrokers contains the in-memory brokers of this process, keyed by url,
+// allowing publishers and consumers created separately to share messages
+var memoryBrokers = struct {
+	sync.Mutex
+	m map[string]*memoryBroker
+}{m: make(map[string]*memoryBroker)}
+
+// memoryBroker holds the queues of an in-memory broker. Messages are not persisted,
+// so they are lost when the process exits, which makes it only suitable for
+// small single binary deployments, and tests
+type memoryBroker struct {
+	mux     sync.Mutex
+	queues  map[string]*memoryQueue
+	unacked map[uint64]*memoryDelivery
+	tag     uint64
+}
+
+// memoryQueue is a fifo queue of messages, delivered to its consumers in turn
+type memoryQueue struct {
+	messages  []amqp.Delivery
+	consumers []*memoryConsumer
+	next      int
+}
+
+// memoryConsumer receives messages from a queue, with at most
+// prefetch messages delivered and not yet acknowledged
+type memoryConsumer struct {
+	tag        string
+	queue      string
+	client     *memoryClient
+	prefetch   int
+	unacked    int
+	deliveries chan amqp.Delivery
+}
+
+// memoryDelivery is a message which has been delivered and not yet acknowledged
+type memoryDelivery struct {
+	queue    string
+	client   *memoryClient
+	consumer *memoryConsumer
+	d        amqp.Delivery
+}
+
+// memoryClient is a connection to an in-memory broker, and implements Broker
+type memoryClient struct {
+	b         *memoryBroker
+	closed    bool
+	consumers map[string]*memoryConsumer
+	notify    []chan *amqp.Error
+}
+
+// newMemoryClient is used to connect to the in-memory broker for the given url, creating it if needed
+func newMemoryClient(url string) *memoryClient {
+	memoryBrokers.Lock()
+	defer memoryBrokers.Unlock()
+	b, ok := memoryBrokers.m[url]
+	if !ok {
+		b = &memoryBroker{
+			queues:  make(map[string]*memoryQueue),
+			unacked: make(map[uint64]*memoryDelivery),
+		}
+		memoryBrokers.m[url] = b
+	}
+	return &memoryClient{b: b, consumers: make(map[string]*memoryConsumer)}
+}
+
+// queue returns the named queue, creating it if it doesn't exist. Callers must hold the lock
+func (b *memoryBroker) queue(name string) *memoryQueue {
+	q, ok := b.queues[name]
+	if !ok {
+		q = &memoryQueue{}
+		b.queues[name] = q
+	}
+	return q
+}
+
+// publish is used to add a message to the end of the named queue
+func (b *memoryBroker) publish(queue string, msg amqp.Publishing) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	q := b.queue(queue)
+	q.messages = append(q.messages, amqp.Delivery{
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		RoutingKey:      queue,
+		Body:            msg.Body,
+	})
+	b.dispatch(queue)
+}
+
+// dispatch is used to deliver the messages of the named queue to consumers with capacity,
+// in turn. As the delivery channel of a consumer is buffered to its prefetch, sending
+// never blocks. Callers must hold the lock
+func (b *memoryBroker) dispatch(queue string) {
+	q := b.queue(queue)
+	for len(q.messages) > 0 {
+		var consumer *memoryConsumer
+		for i := 0; i < len(q.consumers); i++ {
+			c := q.consumers[(q.next+i)%len(q.consumers)]
+			if c.unacked < c.prefetch {
+				consumer = c
+				q.next = (q.next + i + 1) % len(q.consumers)
+				break
+			}
+		}
+		if consumer == nil {
+			return
+		}
+		d := b.deliver(queue, consumer.client, consumer)
+		d.ConsumerTag = consumer.tag
+		consumer.unacked++
+		consumer.deliveries <- d
+	}
+}
+
+// deliver is used to remove the first message from the named queue, and track it until
+// it is acknowledged. Callers must hold the lock, and ensure the queue isn't empty
+func (b *memoryBroker) deliver(queue string, client *memoryClient, consumer *memoryConsumer) amqp.Delivery {
+	q := b.queue(queue)
+	d := q.messages[0]
+	q.messages = q.messages[1:]
+	b.tag++
+	d.DeliveryTag = b.tag
+	d.Acknowledger = client
+	b.unacked[d.DeliveryTag] = &memoryDelivery{queue: queue, client: client, consumer: consumer, d: d}
+	return d
+}
+
+// settle is used to remove deliveries of the given client from those awaiting acknowledgement,
+// returning them in the order they were delivered. Callers must hold the lock
+func (b *memoryBroker) settle(client *memoryClient, tag uint64, multiple bool) []*memoryDelivery {
+	var settled []*memoryDelivery
+	for t, pending := range b.unacked {
+		if pending.client != client || t > tag || (!multiple && t != tag) {
+			continue
+		}
+		settled = append(settled, pending)
+		delete(b.unacked, t)
+		if pending.consumer != nil {
+			pending.consumer.unacked--
+		}
+	}
+	sort.Slice(settled, func(i, j int) bool {
+		return settled[i].d.DeliveryTag < settled[j].d.DeliveryTag
+	})
+	return settled
+}
+
+// requeue is used to return settled deliveries to the front of their queues, and
+// deliver messages to the consumers which now have capacity. Callers must hold the lock
+func (b *memoryBroker) requeue(settled []*memoryDelivery, requeue bool) {
+	queues := make(map[string]bool)
+	for i := len(settled) - 1; i >= 0; i-- {
+		pending := settled[i]
+		queues[pending.queue] = true
+		if !requeue {
+			continue
+		}
+		d := pending.d
+		d.Redelivered = true
+		d.DeliveryTag = 0
+		d.ConsumerTag = ""
+		d.Acknowledger = nil
+		q := b.queue(pending.queue)
+		q.messages = append([]amqp.Delivery{d}, q.messages...)
+	}
+	for queue := range queues {
+		b.dispatch(queue)
+	}
+}
+
+// Declare is used to declare the queue, and its dead letter queue. Retries
+// are delayed in process, so there are no delay queues to declare
+func (c *memoryClient) Declare(queue Queue) error {
+	c.b.mux.Lock()
+	defer c.b.mux.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.b.queue(queue.String())
+	c.b.queue(queue.DeadLetterQueue())
+	return nil
+}
+
+// Publish is used to publish a message to the named queue, creating it if it doesn't
+// exist. Messages are accepted immediately, so there is no confirmation to wait for
+func (c *memoryClient) Publish(ctx context.Context, queue string, msg amqp.Publishing) error {
+	if c.isClosed() {
+		return amqp.ErrClosed
+	}
+	c.b.publish(queue, msg)
+	return nil
+}
+
+// Retry is used to publish a message back onto the given queue once the
+// delay for the given attempt has elapsed
+func (c *memoryClient) Retry(ctx context.Context, queue Queue, attempt int, msg amqp.Publishing) error {
+	if c.isClosed() {
+		return amqp.ErrClosed
+	}
+	time.AfterFunc(retryDelay(attempt), func() {
+		c.b.publish(queue.String(), msg)
+	})
+	return nil
+}
+
+// Consume is used to start delivering messages from the given queue
+func (c *memoryClient) Consume(queue Queue, consumer string, prefetch int) (<-chan amqp.Delivery, error) {
+	if prefetch < 1 {
+		prefetch = 1
+	}
+	c.b.mux.Lock()
+	defer c.b.mux.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	mc := &memoryConsumer{
+		tag:        consumer,
+		queue:      queue.String(),
+		client:     c,
+		prefetch:   prefetch,
+		deliveries: make(chan amqp.Delivery, prefetch),
+	}
+	c.consumers[consumer] = mc
+	q := c.b.queue(queue.String())
+	q.consumers = append(q.consumers, mc)
+	c.b.dispatch(queue.String())
+	return mc.deliveries, nil
+}
+
+// Cancel is used to stop delivering messages to the named consumer. Messages
+// already delivered remain unacknowledged until they are acked or nacked
+func (c *memoryClient) Cancel(consumer string) error {
+	c.b.mux.Lock()
+	defer c.b.mux.Unlock()
+	c.cancel(consumer)
+	return nil
+}
+
+// cancel is used to remove a consumer from its queue. Callers must hold the lock
+func (c *memoryClient) cancel(consumer string) {
+	mc, ok := c.consumers[consumer]
+	if !ok {
+		return
+	}
+	delete(c.consumers, consumer)
+	q := c.b.queue(mc.queue)
+	for i, qc := range q.consumers {
+		if qc == mc {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	q.next = 0
+	close(mc.deliveries)
+}
+
+// Get is used to retrieve a single message from the named queue
+func (c *memoryClient) Get(queue string) (amqp.Delivery, bool, error) {
+	c.b.mux.Lock()
+	defer c.b.mux.Unlock()
+	if c.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+	if len(c.b.queue(queue).messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	return c.b.deliver(queue, c, nil), true, nil
+}
+
+// Purge is used to remove all messages from the named queue
+func (c *memoryClient) Purge(queue string) (int, error) {
+	c.b.mux.Lock()
+	defer c.b.mux.Unlock()
+	if c.closed {
+		return 0, amqp.ErrClosed
+	}
+	q := c.b.queue(queue)
+	purged := len(q.messages)
+	q.messages = nil
+	return purged, nil
+}
+
+// Ack is used to acknowledge a delivery, removing it from its queue
+func (c *memoryClient) Ack(tag uint64, multiple bool) error {
+	return c.Nack(tag, multiple, false)
+}
+
+// Nack is used to negatively acknowledge a delivery, returning it to
+// the front of its queue if requeue is set, otherwise it is discarded
+func (c *memoryClient) Nack(tag uint64, multiple, requeue bool) error {
+	c.b.mux.Lock()
+	defer c.b.mux.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.b.requeue(c.b.settle(c, tag, multiple), requeue)
+	return nil
+}
+
+// Reject is used to reject a single delivery
+func (c *memoryClient) Reject(tag uint64, requeue bool) error {
+	return c.Nack(tag, false, requeue)
+}
+
+// NotifyClose registers a channel which is closed when the client is closed. As
+// the broker is in process, the connection is never lost unexpectedly
+func (c *memoryClient) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.b.mux.Lock()
+	defer c.b.mux.Unlock()
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.notify = append(c.notify, receiver)
+	return receiver
+}
+
+// Close is used to cancel our consumers, and return any messages
+// we haven't acknowledged to their queues
+func (c *memoryClient) Close() error {
+	c.b.mux.Lock()
+	defer c.b.mux.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	for consumer := range c.consumers {
+		c.cancel(consumer)
+	}
+	c.b.requeue(c.b.settle(c, ^uint64(0), true), true)
+	c.closed = true
+	for _, receiver := range c.notify {
+		close(receiver)
+	}
+	c.notify = nil
+	return nil
+}
+
+// isClosed returns whether or not the client has been closed
+func (c *memoryClient) isClosed() bool {
+	c.b.mux.Lock()
+	defer c.b.mux.Unlock()
+	return c.closed
+}
@@ -0,0 +1,330 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+)
+
+func receive(t *testing.T, msgs <-chan amqp.Delivery) amqp.Delivery {
+	t.Helper()
+	select {
+	case d, ok := <-msgs:
+		if !ok {
+			t.Fatal("delivery channel closed")
+		}
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+	return amqp.Delivery{}
+}
+
+func expectNone(t *testing.T, msgs <-chan amqp.Delivery) {
+	t.Helper()
+	select {
+	case d := <-msgs:
+		t.Fatalf("unexpected delivery %s", d.Body)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+// forgetMemoryBroker removes the in-memory broker for url, so that tests run more than once start empty
+func forgetMemoryBroker(url string) {
+	memoryBrokers.Lock()
+	delete(memoryBrokers.m, url)
+	memoryBrokers.Unlock()
+}
+
+func TestIsMemoryURL(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want bool
+	}{
+		{"Memory", "memory://temporal", true},
+		{"AMQP", "amqp://127.0.0.1:5672", false},
+		{"Empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsMemoryURL(tt.url); got != tt.want {
+				t.Fatalf("IsMemoryURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryBroker(t *testing.T) {
+	publish := func(t *testing.T, b Broker, bodies ...string) {
+		t.Helper()
+		for _, body := range bodies {
+			if err := b.Publish(context.Background(), IpfsPinQueue.String(), amqp.Publishing{Body: []byte(body)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	tests := []struct {
+		name string
+		run  func(t *testing.T, pub, sub Broker)
+	}{
+		{"AckRemovesMessage", func(t *testing.T, pub, sub Broker) {
+			publish(t, pub, "1")
+			msgs, err := sub.Consume(IpfsPinQueue, "consumer", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := receive(t, msgs)
+			if string(d.Body) != "1" || d.RoutingKey != IpfsPinQueue.String() {
+				t.Fatalf("unexpected delivery %+v", d)
+			}
+			if err := d.Ack(false); err != nil {
+				t.Fatal(err)
+			}
+			expectNone(t, msgs)
+		}},
+		{"NackRequeues", func(t *testing.T, pub, sub Broker) {
+			publish(t, pub, "1", "2")
+			msgs, err := sub.Consume(IpfsPinQueue, "consumer", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := receive(t, msgs)
+			if err := d.Nack(false, true); err != nil {
+				t.Fatal(err)
+			}
+			d = receive(t, msgs)
+			if string(d.Body) != "1" || !d.Redelivered {
+				t.Fatalf("expected message 1 to be redelivered, got %+v", d)
+			}
+			if err := d.Reject(false); err != nil {
+				t.Fatal(err)
+			}
+			if d = receive(t, msgs); string(d.Body) != "2" {
+				t.Fatalf("expected message 2, got %s", d.Body)
+			}
+		}},
+		{"Prefetch", func(t *testing.T, pub, sub Broker) {
+			publish(t, pub, "1", "2", "3")
+			msgs, err := sub.Consume(IpfsPinQueue, "consumer", 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			receive(t, msgs)
+			d := receive(t, msgs)
+			expectNone(t, msgs)
+			if err := d.Ack(true); err != nil {
+				t.Fatal(err)
+			}
+			if d = receive(t, msgs); string(d.Body) != "3" {
+				t.Fatalf("expected message 3, got %s", d.Body)
+			}
+		}},
+		{"RoundRobin", func(t *testing.T, pub, sub Broker) {
+			msgs1, err := sub.Consume(IpfsPinQueue, "consumer1", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs2, err := pub.Consume(IpfsPinQueue, "consumer2", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			publish(t, pub, "1", "2")
+			if d := receive(t, msgs1); string(d.Body) != "1" {
+				t.Fatalf("expected message 1, got %s", d.Body)
+			}
+			if d := receive(t, msgs2); string(d.Body) != "2" {
+				t.Fatalf("expected message 2, got %s", d.Body)
+			}
+		}},
+		{"GetAndPurge", func(t *testing.T, pub, sub Broker) {
+			if _, ok, err := sub.Get(IpfsPinQueue.String()); err != nil || ok {
+				t.Fatalf("expected empty queue, got ok %v err %v", ok, err)
+			}
+			publish(t, pub, "1", "2", "3")
+			d, ok, err := sub.Get(IpfsPinQueue.String())
+			if err != nil || !ok {
+				t.Fatalf("expected message, got ok %v err %v", ok, err)
+			}
+			if err := d.Nack(false, true); err != nil {
+				t.Fatal(err)
+			}
+			purged, err := sub.Purge(IpfsPinQueue.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if purged != 3 {
+				t.Fatalf("expected 3 messages to be purged, got %v", purged)
+			}
+		}},
+		{"CancelClosesDeliveries", func(t *testing.T, pub, sub Broker) {
+			msgs, err := sub.Consume(IpfsPinQueue, "consumer", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sub.Cancel("consumer"); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := <-msgs; ok {
+				t.Fatal("expected delivery channel to be closed")
+			}
+			publish(t, pub, "1")
+			if _, ok, _ := pub.Get(IpfsPinQueue.String()); !ok {
+				t.Fatal("expected message to remain queued")
+			}
+		}},
+		{"CloseRequeues", func(t *testing.T, pub, sub Broker) {
+			notify := sub.NotifyClose(make(chan *amqp.Error))
+			publish(t, pub, "1")
+			msgs, err := sub.Consume(IpfsPinQueue, "consumer", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := receive(t, msgs)
+			if err := sub.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := <-notify; ok {
+				t.Fatal("expected close notification channel to be closed")
+			}
+			if err := d.Ack(false); err != amqp.ErrClosed {
+				t.Fatalf("expected ack after close to fail, got %v", err)
+			}
+			if _, ok, _ := pub.Get(IpfsPinQueue.String()); !ok {
+				t.Fatal("expected unacknowledged message to be requeued")
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := MemoryScheme + t.Name()
+			defer forgetMemoryBroker(url)
+			pub, sub := newMemoryClient(url), newMemoryClient(url)
+			defer pub.Close()
+			defer sub.Close()
+			tt.run(t, pub, sub)
+		})
+	}
+}
+
+func TestManager_MemoryBroker(t *testing.T) {
+	baseDelay := retryBaseDelay
+	retryBaseDelay = time.Millisecond
+	defer func() { retryBaseDelay = baseDelay }()
+	url := MemoryScheme + t.Name()
+	defer forgetMemoryBroker(url)
+	logger := zap.NewNop().Sugar()
+	publisher, err := New(IpfsPinQueue, url, true, true, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	consumer, err := New(IpfsPinQueue, url, false, true, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	msgs, err := consumer.broker.Consume(IpfsPinQueue, "consumer", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.PublishMessage(IPFSPin{CID: testCID}); err != nil {
+		t.Fatal(err)
+	}
+	// a retryable failure is redelivered after a delay
+	consumer.finish(receive(t, msgs), Retryable(errors.New("timeout")))
+	d := receive(t, msgs)
+	if attempts(d) != 1 {
+		t.Fatalf("expected 1 previous attempt, got %v", attempts(d))
+	}
+	// a permanent failure is dead-lettered
+	consumer.finish(d, Permanent(errors.New("bad message")))
+	expectNone(t, msgs)
+	letters, err := consumer.ListDeadLetters(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Attempts != 2 || letters[0].Error != "bad message" {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+	replayed, err := consumer.ReplayDeadLetters(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 1 {
+		t.Fatalf("expected 1 replayed message, got %v", replayed)
+	}
+	if d = receive(t, msgs); attempts(d) != 0 {
+		t.Fatalf("expected replayed message to have no attempts, got %v", attempts(d))
+	}
+	consumer.finish(d, nil)
+	if purged, err := consumer.PurgeDeadLetters(); err != nil || purged != 0 {
+		t.Fatalf("expected empty dead letter queue, got %v err %v", purged, err)
+	}
+}
+
+func TestManager_Refunded(t *testing.T) {
+	url := MemoryScheme + t.Name()
+	defer forgetMemoryBroker(url)
+	logger := zap.NewNop().Sugar()
+	publisher, err := New(IpfsPinQueue, url, true, true, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	consumer, err := New(IpfsPinQueue, url, false, true, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	consumer.SetWorkerOptions(WorkerOptions{})
+	msgs, err := consumer.broker.Consume(IpfsPinQueue, "consumer", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.PublishMessage(IPFSPin{CID: testCID}); err != nil {
+		t.Fatal(err)
+	}
+	// a retryable failure which was refunded is dead-lettered rather than retried
+	consumer.work(context.Background(), receive(t, msgs), func(ctx context.Context, d amqp.Delivery) error {
+		*ctx.Value(refundKey{}).(*bool) = true
+		return Retryable(errors.New("timeout"))
+	})
+	expectNone(t, msgs)
+	letters, err := consumer.ListDeadLetters(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || !letters[0].Refunded {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+	// refunded messages are never replayed
+	replayed, err := consumer.ReplayDeadLetters(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 0 {
+		t.Fatalf("expected no replayed messages, got %v", replayed)
+	}
+	expectNone(t, msgs)
+	// nor processed, should they be moved back onto the queue
+	d, ok, err := consumer.broker.Get(IpfsPinQueue.DeadLetterQueue())
+	if err != nil || !ok {
+		t.Fatalf("expected refunded message to remain dead-lettered, got %v err %v", ok, err)
+	}
+	d.Ack(false)
+	if err := publisher.publish(IpfsPinQueue.String(), amqp.Publishing{Headers: d.Headers, Body: d.Body}); err != nil {
+		t.Fatal(err)
+	}
+	consumer.work(context.Background(), receive(t, msgs), func(ctx context.Context, d amqp.Delivery) error {
+		t.Fatal("refunded message was processed")
+		return nil
+	})
+	if purged, err := consumer.PurgeDeadLetters(); err != nil || purged != 1 {
+		t.Fatalf("expected refunded message to be dead-lettered, got %v err %v", purged, err)
+	}
+}
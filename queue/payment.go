@@ -0,0 +1,368 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RTradeLtd/ChainRider-Go/dash"
+	"github.com/RTradeLtd/Temporal/ledger"
+	"github.com/RTradeLtd/Temporal/log"
+	"github.com/RTradeLtd/Temporal/payments"
+	"github.com/RTradeLtd/Temporal/utils"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/streadway/amqp"
+)
+
+var (
+	// paymentPollInterval is how often we check whether a payment has been received
+	paymentPollInterval = time.Minute
+	// paymentConfirmationTimeout is how long we wait for a payment before giving up
+	paymentConfirmationTimeout = time.Minute * 90
+	// ethConfirmationBlocks is the number of blocks that must be mined on top of
+	// the block containing a payment before we consider it confirmed
+	ethConfirmationBlocks uint64 = 12
+	// errPaymentTimeout is returned when a payment isn't confirmed in time
+	errPaymentTimeout = errors.New("timed out waiting for payment confirmation")
+	// errNoPaymentContract is returned when confirming an eth payment without a payment contract configured
+	errNoPaymentContract = errors.New("no payment contract configured")
+	// paymentMethods maps the type of a payment to the method our payment contract records it with
+	paymentMethods = map[string]uint8{"rtc": 0, "eth": 1}
+)
+
+// ProcessDashPayments is used to process dash payment confirmation requests
+func (qm *Manager) ProcessDashPayments(ctx context.Context, wg *sync.WaitGroup, msgs <-chan amqp.Delivery) error {
+	var networkVersion string
+	if qm.dev {
+		networkVersion = "testnet"
+	} else {
+		networkVersion = "main"
+	}
+	dc := dash.NewClient(&dash.ConfigOpts{
+		APIVersion:      "v1",
+		DigitalCurrency: "dash",
+		Blockchain:      networkVersion,
+		Token:           qm.cfg.APIKeys.ChainRider,
+	})
+	qmEmail, err := qm.newEmailPublisher()
+	if err != nil {
+		return err
+	}
+	paymentManager := models.NewPaymentManager(qm.db)
+	userManager := models.NewUserManager(qm.db)
+	qm.l.Info("processing dash payment confirmations")
+	return qm.consume(ctx, wg, msgs, func(ctx context.Context, d amqp.Delivery) error {
+		return qm.processDashPayment(ctx, d, dc, paymentManager, userManager, qmEmail)
+	})
+}
+
+// ProcessETHPayments is used to process ethereum and rtc payment confirmation requests
+func (qm *Manager) ProcessETHPayments(ctx context.Context, wg *sync.WaitGroup, msgs <-chan amqp.Delivery) error {
+	if qm.chain == nil {
+		chain, err := newChainClientFromConfig(qm.cfg)
+		if err != nil {
+			return err
+		}
+		qm.chain = chain
+	}
+	qmEmail, err := qm.newEmailPublisher()
+	if err != nil {
+		return err
+	}
+	paymentManager := models.NewPaymentManager(qm.db)
+	userManager := models.NewUserManager(qm.db)
+	qm.l.Info("processing eth payment confirmations")
+	return qm.consume(ctx, wg, msgs, func(ctx context.Context, d amqp.Delivery) error {
+		return qm.processETHPayment(ctx, d, paymentManager, userManager, qmEmail)
+	})
+}
+
+func (qm *Manager) processDashPayment(ctx context.Context, d amqp.Delivery, dc *dash.Client, pm *models.PaymentManager, um *models.UserManager, qmEmail *Manager) error {
+	qm.l.Info("new dash payment confirmation request detected")
+	dpc := DashPaymenConfirmation{}
+	if err := json.Unmarshal(d.Body, &dpc); err != nil {
+		qm.l.Errorw(
+			"failed to unmarshal message",
+			"error", err.Error())
+		return Permanent(err)
+	}
+	payment, err := pm.FindPaymentByNumber(dpc.UserName, dpc.PaymentNumber)
+	if err != nil {
+		qm.l.Errorw(
+			"failed to find payment",
+			"error", err.Error(),
+			"user", dpc.UserName,
+			"payment_number", dpc.PaymentNumber)
+		return Retryable(err)
+	}
+	// payment has already been processed, don't grant credits twice
+	if payment.Confirmed {
+		return nil
+	}
+	var inputTxHash string
+	// wait until the payment forward has received at least the charge amount
+	err = qm.waitForPayment(ctx, func() (bool, error) {
+		forward, err := dc.GetPaymentForwardByID(dpc.PaymentForwardID)
+		if err != nil {
+			return false, Retryable(err)
+		}
+		if forward.Error != "" {
+			return false, Retryable(errors.New(forward.Error))
+		}
+		var totalReceived float64
+		for _, tx := range forward.ProcessedTxs {
+			totalReceived = totalReceived + dash.DuffsToDash(float64(int64(tx.ReceivedAmountDuffs)))
+			inputTxHash = tx.InputTransactionHash
+		}
+		return totalReceived >= payment.ChargeAmount, nil
+	})
+	if err != nil {
+		// if we are shutting down, requeue the message so that it is redelivered
+		if ctx.Err() != nil {
+			return errRequeue
+		}
+		qm.l.Errorw(
+			"failed to confirm dash payment",
+			"error", err.Error(),
+			"user", dpc.UserName,
+			"payment_number", dpc.PaymentNumber)
+		return err
+	}
+	// replace our placeholder tx hash with the transaction that paid us
+	if inputTxHash != "" {
+		if payment, err = pm.UpdatePaymentTxHash(dpc.UserName, inputTxHash, dpc.PaymentNumber); err != nil {
+			qm.l.Errorw(
+				"failed to update payment tx hash",
+				"error", err.Error(),
+				"user", dpc.UserName,
+				"payment_number", dpc.PaymentNumber)
+			return Retryable(err)
+		}
+	}
+	return qm.confirmPayment(payment, pm, um, qmEmail)
+}
+
+func (qm *Manager) processETHPayment(ctx context.Context, d amqp.Delivery, pm *models.PaymentManager, um *models.UserManager, qmEmail *Manager) error {
+	qm.l.Info("new eth payment confirmation request detected")
+	epc := EthPaymentConfirmation{}
+	if err := json.Unmarshal(d.Body, &epc); err != nil {
+		qm.l.Errorw(
+			"failed to unmarshal message",
+			"error", err.Error())
+		return Permanent(err)
+	}
+	payment, err := pm.FindPaymentByNumber(epc.UserName, epc.PaymentNumber)
+	if err != nil {
+		qm.l.Errorw(
+			"failed to find payment",
+			"error", err.Error(),
+			"user", epc.UserName,
+			"payment_number", epc.PaymentNumber)
+		return Retryable(err)
+	}
+	// payment has already been processed, don't grant credits twice
+	if payment.Confirmed {
+		return nil
+	}
+	// without our contract, there is no way of knowing what a transaction paid for
+	contract := qm.cfg.Ethereum.Contracts.PaymentContractAddress
+	if contract == "" {
+		qm.l.Errorw(
+			"failed to confirm eth payment",
+			"error", errNoPaymentContract.Error(),
+			"user", epc.UserName,
+			"payment_number", epc.PaymentNumber)
+		return Permanent(errNoPaymentContract)
+	}
+	// wait until the transaction has been mined, and has enough confirmations
+	err = qm.waitForPayment(ctx, func() (bool, error) {
+		receipt, err := qm.chain.TransactionReceipt(ctx, payment.TxHash)
+		if err == ErrTxPending {
+			return false, nil
+		} else if err != nil {
+			return false, Retryable(err)
+		}
+		if !receipt.Success {
+			return false, Permanent(fmt.Errorf("transaction %s was reverted", payment.TxHash))
+		}
+		if !strings.EqualFold(receipt.To, contract) {
+			return false, Permanent(fmt.Errorf("transaction %s was not sent to the payment contract", payment.TxHash))
+		}
+		event, err := findPaymentEvent(receipt, contract)
+		if err != nil {
+			return false, Permanent(err)
+		}
+		if err := validatePaymentEvent(payment, receipt, event); err != nil {
+			return false, Permanent(err)
+		}
+		current, err := qm.chain.BlockNumber(ctx)
+		if err != nil {
+			return false, Retryable(err)
+		}
+		return current >= receipt.BlockNumber+ethConfirmationBlocks, nil
+	})
+	if err != nil {
+		// if we are shutting down, requeue the message so that it is redelivered
+		if ctx.Err() != nil {
+			return errRequeue
+		}
+		qm.l.Errorw(
+			"failed to confirm eth payment",
+			"error", err.Error(),
+			"user", epc.UserName,
+			"payment_number", epc.PaymentNumber,
+			"tx_hash", payment.TxHash)
+		return err
+	}
+	return qm.confirmPayment(payment, pm, um, qmEmail)
+}
+
+// validatePaymentEvent is used to ensure the payment event emitted by a transaction paid for
+// payment, having been sent by the address the payment was signed for, with the same
+// payment number, method and charge amount
+func validatePaymentEvent(payment *models.Payments, receipt *TxReceipt, event *paymentEvent) error {
+	if !strings.EqualFold(receipt.From, payment.DepositAddress) || !strings.EqualFold(event.Payer, payment.DepositAddress) {
+		return fmt.Errorf("transaction %s was not sent by the payment sender", payment.TxHash)
+	}
+	if event.Number.Cmp(big.NewInt(payment.Number)) != 0 {
+		return fmt.Errorf("transaction %s paid for payment number %s", payment.TxHash, event.Number)
+	}
+	if method, ok := paymentMethods[payment.Type]; !ok || event.Method != method {
+		return fmt.Errorf("transaction %s paid with method %v", payment.TxHash, event.Method)
+	}
+	if event.Amount.Cmp(utils.FloatToBigInt(payment.ChargeAmount)) != 0 {
+		return fmt.Errorf("transaction %s paid %s instead of the charge amount", payment.TxHash, event.Amount)
+	}
+	return nil
+}
+
+// waitForPayment is used to repeatedly check the status of a payment until check
+// returns true, an error occurs, or the payment confirmation timeout is reached
+func (qm *Manager) waitForPayment(ctx context.Context, check func() (bool, error)) error {
+	timeout := time.NewTimer(paymentConfirmationTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(paymentPollInterval)
+	defer ticker.Stop()
+	for {
+		confirmed, err := check()
+		if err != nil {
+			return err
+		}
+		if confirmed {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-timeout.C:
+			return Permanent(errPaymentTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// confirmPayment is used to mark a payment as confirmed, grant the user their credits
+// and send them a receipt through the email queue. The payment is confirmed within the
+// same transaction as the credits are granted, so a failure to do either is retried, and
+// a payment which is confirmed has always had its credits granted
+func (qm *Manager) confirmPayment(payment *models.Payments, pm *models.PaymentManager, um *models.UserManager, qmEmail *Manager) error {
+	tx := pm.DB.Begin()
+	if tx.Error != nil {
+		return Retryable(tx.Error)
+	}
+	// only confirm the payment if it isn't already, so that
+	// concurrent confirmations only grant credits once
+	confirm := tx.Model(&models.Payments{}).Where(
+		"id = ? AND confirmed = ?", payment.ID, false,
+	).Update("confirmed", true)
+	if confirm.Error != nil {
+		tx.Rollback()
+		qm.l.Errorw(
+			"failed to mark payment as confirmed",
+			"error", confirm.Error.Error(),
+			"user", payment.UserName,
+			"payment_number", payment.Number)
+		return Retryable(confirm.Error)
+	}
+	if confirm.RowsAffected == 0 {
+		tx.Rollback()
+		return nil
+	}
+	payment.Confirmed = true
+	if _, err := ledger.NewManager(tx).Credit(payment.UserName, payment.USDValue, ledger.Payment, payment.TxHash); err != nil {
+		tx.Rollback()
+		qm.l.Errorw(
+			"failed to grant credits",
+			"error", err.Error(),
+			"user", payment.UserName,
+			"payment_number", payment.Number,
+			"credits", payment.USDValue)
+		return Retryable(err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		qm.l.Errorw(
+			"failed to confirm payment",
+			"error", err.Error(),
+			"user", payment.UserName,
+			"payment_number", payment.Number)
+		return Retryable(err)
+	}
+	qm.l.Infow(
+		"successfully processed payment confirmation",
+		"user", payment.UserName,
+		"payment_number", payment.Number,
+		"blockchain", payment.Blockchain,
+		"credits", payment.USDValue)
+	user, err := um.FindByUserName(payment.UserName)
+	if err != nil {
+		qm.l.Errorw(
+			"failed to find user to send payment receipt",
+			"error", err.Error(),
+			"user", payment.UserName,
+			"payment_number", payment.Number)
+		return nil
+	}
+	if !user.EmailEnabled {
+		return nil
+	}
+	// receipts are sent by the email queue, so that a failure to send
+	// them is retried without confirming the payment again
+	subject, content, err := payments.Receipt(payment)
+	if err == nil {
+		err = qmEmail.PublishMessage(EmailSend{
+			Subject:     subject,
+			Content:     content,
+			ContentType: "text/html",
+			UserNames:   []string{user.UserName},
+			Emails:      []string{user.EmailAddress},
+		})
+	}
+	if err != nil {
+		qm.l.Errorw(
+			"failed to send payment receipt",
+			"error", err.Error(),
+			"user", payment.UserName,
+			"payment_number", payment.Number)
+	}
+	return nil
+}
+
+// newEmailPublisher is used to connect to the email send queue, allowing receipts
+// to be sent once payments are confirmed
+func (qm *Manager) newEmailPublisher() (*Manager, error) {
+	logger, err := log.NewLogger(qm.cfg.LogDir+"email_publisher.log", false)
+	if err != nil {
+		return nil, err
+	}
+	qmEmail, err := New(EmailSendQueue, qm.cfg.RabbitMQ.URL, true, qm.dev, qm.cfg, logger)
+	if err != nil {
+		qm.l.Errorw("failed to intialize email queue connection", "error", err.Error())
+		return nil, err
+	}
+	return qmEmail, nil
+}
@@ -2,13 +2,12 @@ package queue
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
 	"sync"
 
+	"github.com/RTradeLtd/Temporal/jobs"
+	"github.com/RTradeLtd/Temporal/webhooks"
 	"github.com/RTradeLtd/gorm"
 	"go.uber.org/zap"
 
@@ -16,12 +15,30 @@ import (
 	"github.com/streadway/amqp"
 )
 
-// New is used to instantiate a new connection to rabbitmq as a publisher or consumer
+// New is used to instantiate a new connection to the message broker as a publisher or consumer.
+// The broker is selected by the url, with urls using MemoryScheme selecting the in-memory broker.
+// Publishers reconnect to the broker whenever their connection is lost, while consumers
+// must be recreated, as they need to resume consuming messages
 func New(queue Queue, url string, publish, devMode bool, cfg *config.TemporalConfig, logger *zap.SugaredLogger) (*Manager, error) {
-	conn, err := setupConnection(url, cfg)
+	broker, err := dialBroker(url, cfg)
 	if err != nil {
 		return nil, err
 	}
+	qm, err := NewWithBroker(queue, broker, publish, devMode, logger)
+	if err != nil {
+		broker.Close()
+		return nil, err
+	}
+	qm.url, qm.cfg = url, cfg
+	if publish {
+		go qm.reconnect(qm.ErrCh)
+	}
+	return qm, nil
+}
+
+// NewWithBroker is used to instantiate a new queue manager using an existing broker connection.
+// As the manager is unable to dial the broker itself, it doesn't reconnect
+func NewWithBroker(queue Queue, broker Broker, publish, devMode bool, logger *zap.SugaredLogger) (*Manager, error) {
 	var queueType string
 	if publish {
 		queueType = "publish"
@@ -29,15 +46,17 @@ func New(queue Queue, url string, publish, devMode bool, cfg *config.TemporalCon
 		queueType = "consumer"
 	}
 	// create base queue manager
-	qm := Manager{connection: conn, QueueName: queue, l: logger.Named(queue.String() + "." + queueType), dev: devMode}
-	// open a channel
-	if err := qm.openChannel(); err != nil {
-		return nil, err
+	qm := Manager{
+		broker:    broker,
+		QueueName: queue,
+		l:         logger.Named(queue.String() + "." + queueType),
+		dev:       devMode,
+		done:      make(chan struct{}),
 	}
 	// if we aren't publishing, and are consuming
 	// setup a queue to receive messages on
 	if !publish {
-		if err = qm.declareQueue(); err != nil {
+		if err := qm.declareQueue(); err != nil {
 			return nil, err
 		}
 	}
@@ -46,87 +65,48 @@ func New(queue Queue, url string, publish, devMode bool, cfg *config.TemporalCon
 	return &qm, nil
 }
 
-func setupConnection(connectionURL string, cfg *config.TemporalConfig) (*amqp.Connection, error) {
-	var (
-		conn *amqp.Connection
-		err  error
-	)
-	if cfg.RabbitMQ.TLSConfig.CACertFile == "" {
-		conn, err = amqp.Dial(connectionURL)
-	} else {
-		// see https://godoc.org/github.com/streadway/amqp#DialTLS for more information
-		tlsConfig := new(tls.Config)
-		tlsConfig.RootCAs = x509.NewCertPool()
-		ca, err := ioutil.ReadFile(cfg.RabbitMQ.TLSConfig.CACertFile)
-		if err != nil {
-			return nil, err
-		}
-		if ok := tlsConfig.RootCAs.AppendCertsFromPEM(ca); !ok {
-			return nil, errors.New("failed to successfully append cert file")
-		}
-		cert, err := tls.LoadX509KeyPair(cfg.RabbitMQ.TLSConfig.CertFile, cfg.RabbitMQ.TLSConfig.KeyFile)
-		if err != nil {
-			return nil, err
-		}
-		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
-		conn, err = amqp.DialTLS(connectionURL, tlsConfig)
-	}
-	if err != nil {
-		return nil, err
-	}
-	return conn, nil
-}
-
-// OpenChannel is used to open a channel to the rabbitmq server
-func (qm *Manager) openChannel() error {
-	ch, err := qm.connection.Channel()
+// DeclareQueue is used to declare a queue for which messages will be sent to,
+// along with the queues used to retry and dead-letter failed messages
+func (qm *Manager) declareQueue() error {
+	broker, err := qm.connection(context.Background())
 	if err != nil {
 		return err
 	}
-	qm.l.Info("channel opened")
-	qm.channel = ch
-	return qm.channel.Qos(10, 0, false)
-}
-
-// DeclareQueue is used to declare a queue for which messages will be sent to
-func (qm *Manager) declareQueue() error {
-	// we declare the queue as durable so that even if rabbitmq server stops
-	// our messages won't be lost
-	q, err := qm.channel.QueueDeclare(
-		qm.QueueName.String(), // name
-		true,                  // durable
-		false,                 // delete when unused
-		false,                 // exclusive
-		false,                 // no-wait
-		nil,                   // arguments
-	)
-	if err != nil {
+	if err := broker.Declare(qm.QueueName); err != nil {
 		return err
 	}
 	qm.l.Info("queue declared")
-	qm.queue = &q
 	return nil
 }
 
-// ConsumeMessages is used to consume messages that are sent to the queue
-// Question, do we really want to ack messages that fail to be processed?
-// Perhaps the error was temporary, and we allow it to be retried?
+// ConsumeMessages is used to consume messages that are sent to the queue.
+// Messages that fail processing with a retryable error are retried with an
+// exponential backoff, otherwise they are sent to the dead letter queue
 func (qm *Manager) ConsumeMessages(ctx context.Context, wg *sync.WaitGroup, db *gorm.DB, cfg *config.TemporalConfig) error {
 	// embed database into queue manager
 	qm.db = db
 	// embed config into queue manager
 	qm.cfg = cfg
-	// we do not auto-ack, as if a consumer dies we don't want the message to be lost
-	// not specifying the consumer name uses an automatically generated id
-	msgs, err := qm.channel.Consume(
-		qm.QueueName.String(), // queue
-		"",                    // consumer
-		false,                 // auto-ack
-		false,                 // exclusive
-		false,                 // no-local
-		false,                 // no-wait
-		nil,                   // args
-	)
+	// track the status of jobs we process
+	qm.jobs = jobs.NewManager(db)
+	// notify webhook endpoints of the status of jobs we process
+	qm.webhooks = webhooks.NewManager(db)
+	if webhookQueue(qm.QueueName) {
+		if err := qm.declareWebhookQueue(); err != nil {
+			return err
+		}
+	}
+	// use the default worker options if they haven't been set
+	if qm.opts.Workers == 0 {
+		qm.SetWorkerOptions(WorkerOptions{})
+	}
+	// we name our consumer so that it may be cancelled when shutting down
+	qm.consumerTag = newConsumerTag(qm.QueueName)
+	broker, err := qm.connection(ctx)
+	if err != nil {
+		return err
+	}
+	msgs, err := broker.Consume(qm.QueueName, qm.consumerTag, qm.opts.Prefetch)
 	if err != nil {
 		return err
 	}
@@ -143,6 +123,12 @@ func (qm *Manager) ConsumeMessages(ctx context.Context, wg *sync.WaitGroup, db *
 		return qm.ProcessIPNSEntryCreationRequests(ctx, wg, msgs)
 	case IpfsClusterPinQueue:
 		return qm.ProcessIPFSClusterPins(ctx, wg, msgs)
+	case DashPaymentConfirmationQueue:
+		return qm.ProcessDashPayments(ctx, wg, msgs)
+	case EthPaymentConfirmationQueue:
+		return qm.ProcessETHPayments(ctx, wg, msgs)
+	case WebhookDeliveryQueue:
+		return qm.ProcessWebhookDeliveries(ctx, wg, msgs)
 	default:
 		return errors.New("invalid queue name")
 	}
@@ -154,30 +140,51 @@ func (qm *Manager) PublishMessage(body interface{}) error {
 	if err != nil {
 		return err
 	}
-	if err = qm.channel.Publish(
-		"",                    // exchange - this is left empty, and becomes the default exchange
-		qm.QueueName.String(), // routing key
-		false,                 // mandatory
-		false,                 // immediate
-		amqp.Publishing{
-			DeliveryMode: amqp.Persistent, // messages will persist through crashes, etc..
-			ContentType:  "text/plain",
-			Body:         bodyMarshaled,
-		},
-	); err != nil {
-		return err
-	}
-	return nil
+	return qm.PublishRaw(bodyMarshaled, "")
+}
+
+// PublishRaw is used to produce an already encoded message. The message id is optional,
+// and allows consumers to identify messages which may have been published more than once.
+// It returns once the broker has confirmed the message, or after PublishTimeout
+func (qm *Manager) PublishRaw(body []byte, messageID string) error {
+	return qm.publish(qm.QueueName.String(), amqp.Publishing{
+		DeliveryMode: amqp.Persistent, // messages will persist through crashes, etc..
+		ContentType:  "text/plain",
+		MessageId:    messageID,
+		Body:         body,
+	})
+}
+
+// SetChainClient is used to override the client used to check the status of
+// ethereum transactions. If not set, one is created from the ethereum connection configuration
+func (qm *Manager) SetChainClient(client ChainClient) {
+	qm.chain = client
 }
 
 // RegisterConnectionClosure is used to register a channel which we may receive
 // connection level errors. This covers all channel, and connection errors.
 func (qm *Manager) RegisterConnectionClosure() {
-	qm.ErrCh = qm.connection.NotifyClose(make(chan *amqp.Error))
+	qm.mux.Lock()
+	defer qm.mux.Unlock()
+	// the channel is buffered so that a lost connection can be reported even if nobody is listening
+	qm.ErrCh = qm.broker.NotifyClose(make(chan *amqp.Error, 1))
 }
 
-// Close is used to close our queue resources
+// Close is used to close our queue resources, and stop reconnecting
 func (qm *Manager) Close() error {
-	// closing the connection also closes the channel
-	return qm.connection.Close()
+	qm.mux.Lock()
+	if qm.closed {
+		qm.mux.Unlock()
+		return amqp.ErrClosed
+	}
+	qm.closed = true
+	if qm.done != nil {
+		close(qm.done)
+	}
+	broker := qm.broker
+	qm.mux.Unlock()
+	if broker == nil {
+		return nil
+	}
+	return broker.Close()
 }
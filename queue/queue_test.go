@@ -2,16 +2,22 @@ package queue
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/streadway/amqp"
 
+	"github.com/RTradeLtd/Temporal/jobs"
+	"github.com/RTradeLtd/Temporal/ledger"
 	"github.com/RTradeLtd/Temporal/log"
+	"github.com/RTradeLtd/Temporal/outbox"
+	"github.com/RTradeLtd/Temporal/webhooks"
 	"github.com/RTradeLtd/config/v2"
 	"github.com/RTradeLtd/database/v2"
 	"github.com/RTradeLtd/gorm"
+	"go.uber.org/zap"
 )
 
 const (
@@ -94,7 +100,8 @@ func TestRegisterChannelClosure(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	qmPublisher, err := New(IpfsPinQueue, testRabbitAddress, true, dev, cfg, logger)
+	// publishers reconnect when receiving connection errors, so we use a consumer
+	qmPublisher, err := New(IpfsPinQueue, testRabbitAddress, false, dev, cfg, logger)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -157,13 +164,78 @@ func TestQueue_RefundCredits(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := qmConsumer.refundCredits(tt.args.username, tt.args.callType, tt.args.cost); (err != nil) != tt.wantErr {
+			if err := qmConsumer.refundCredits(tt.args.username, tt.args.callType, tt.args.cost, ""); (err != nil) != tt.wantErr {
 				t.Fatal(err)
 			}
 		})
 	}
 }
 
+func TestQueue_Duplicates(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := loadDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := MemoryScheme + t.Name()
+	defer forgetMemoryBroker(url)
+	logger := zap.NewNop().Sugar()
+	publisher, err := New(IpfsPinQueue, url, true, true, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	consumer, err := New(IpfsPinQueue, url, false, true, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	consumer.db = db
+	consumer.SetWorkerOptions(WorkerOptions{})
+	msgs, err := consumer.broker.Consume(IpfsPinQueue, "consumer", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageID := "test-" + time.Now().String()
+	defer db.Unscoped().Where("message_key LIKE ?", messageID+"%").Delete(&ProcessedMessage{})
+	var processed int
+	handler := func(fail bool) func(context.Context, amqp.Delivery) error {
+		return func(ctx context.Context, d amqp.Delivery) error {
+			processed++
+			if fail {
+				return Permanent(errors.New("bad message"))
+			}
+			return nil
+		}
+	}
+	// a message published twice is only processed once
+	for i := 0; i < 2; i++ {
+		if err := publisher.PublishRaw([]byte(`{}`), messageID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	consumer.work(context.Background(), receive(t, msgs), handler(true))
+	consumer.work(context.Background(), receive(t, msgs), handler(true))
+	if processed != 1 {
+		t.Fatalf("expected message to be processed once, got %v", processed)
+	}
+	// unless it is replayed from the dead letter queue, which keeps its id
+	if replayed, err := consumer.ReplayDeadLetters(10); err != nil || replayed != 1 {
+		t.Fatalf("expected 1 replayed message, got %v err %v", replayed, err)
+	}
+	d := receive(t, msgs)
+	if d.MessageId != messageID {
+		t.Fatalf("expected replayed message to keep its id, got %s", d.MessageId)
+	}
+	consumer.work(context.Background(), d, handler(false))
+	if processed != 2 {
+		t.Fatalf("expected replayed message to be processed, got %v", processed)
+	}
+}
+
 func TestQueue_ConnectionClosure(t *testing.T) {
 	dev = true
 	logger, err := log.NewLogger("", true)
@@ -190,6 +262,7 @@ func TestQueue_ConnectionClosure(t *testing.T) {
 		{IpnsEntryQueue.String(), args{IpnsEntryQueue}},
 		{IpfsPinQueue.String(), args{IpfsPinQueue}},
 		{IpfsKeyCreationQueue.String(), args{IpfsKeyCreationQueue}},
+		{DashPaymentConfirmationQueue.String(), args{DashPaymentConfirmationQueue}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -721,5 +794,20 @@ func loadDatabase(cfg *config.TemporalConfig) (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := jobs.Migrate(dbm.DB); err != nil {
+		return nil, err
+	}
+	if err := webhooks.Migrate(dbm.DB); err != nil {
+		return nil, err
+	}
+	if err := outbox.Migrate(dbm.DB); err != nil {
+		return nil, err
+	}
+	if err := MigrateProcessedMessages(dbm.DB); err != nil {
+		return nil, err
+	}
+	if err := ledger.Migrate(dbm.DB); err != nil {
+		return nil, err
+	}
 	return dbm.DB, nil
 }
@@ -0,0 +1,219 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/jobs"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// AttemptHeader is the message header used to track how many
+	// times processing of a message has been attempted
+	AttemptHeader = "x-temporal-attempt"
+	// ErrorHeader is the message header containing the error
+	// which caused the last processing attempt to fail
+	ErrorHeader = "x-temporal-error"
+	// FailedAtHeader is the message header containing the unix
+	// timestamp of the last failed processing attempt
+	FailedAtHeader = "x-temporal-failed-at"
+	// RefundedHeader is the message header marking a message whose cost was refunded
+	// when it failed, so that it is never refunded, or processed for free, again
+	RefundedHeader = "x-temporal-refunded"
+)
+
+var (
+	// MaxAttempts is the number of times processing of a message
+	// is attempted before it is sent to the dead letter queue
+	MaxAttempts = 5
+	// retryBaseDelay is the delay before the first retry of a message,
+	// doubling with each subsequent attempt
+	retryBaseDelay = time.Second * 5
+	// retryMaxDelay is the upper limit of the delay between retries
+	retryMaxDelay = time.Minute * 10
+	// errRequeue is returned by handlers to requeue a message without
+	// counting it as an attempt, such as when we are shutting down
+	errRequeue = errors.New("requeue message")
+	// errRefunded is used to dead-letter messages which were refunded when they previously failed
+	errRefunded = errors.New("message was refunded")
+)
+
+// RetryExchange returns the name of the exchange used to delay retries of messages
+func (qt Queue) RetryExchange() string {
+	return qt.String() + ".retry"
+}
+
+// DeadLetterQueue returns the name of the queue containing messages which failed processing
+func (qt Queue) DeadLetterQueue() string {
+	return qt.String() + ".dead"
+}
+
+// delayQueue returns the name of the queue used to delay the given attempt
+func (qt Queue) delayQueue(attempt int) string {
+	return fmt.Sprintf("%s.retry.%d", qt.String(), attempt)
+}
+
+// RetryableError indicates a temporary failure, such as a timeout, after which
+// processing of a message should be attempted again
+type RetryableError struct {
+	Err error
+}
+
+func (re *RetryableError) Error() string { return re.Err.Error() }
+
+// PermanentError indicates a failure which will not be resolved by
+// retrying, such as a malformed message
+type PermanentError struct {
+	Err error
+}
+
+func (pe *PermanentError) Error() string { return pe.Err.Error() }
+
+// Retryable wraps err to indicate the message should be retried
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &RetryableError{Err: err}
+}
+
+// Permanent wraps err to indicate the message should not be retried
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// refundedError indicates the cost of a message was refunded after processing failed.
+// Refunded messages are never retried, as they would be processed for free
+type refundedError struct {
+	Err error
+}
+
+func (re *refundedError) Error() string { return re.Err.Error() }
+
+// IsRetryable returns whether or not err is a retryable error. Untyped errors
+// are considered permanent, as retrying them may duplicate side effects
+func IsRetryable(err error) bool {
+	_, ok := err.(*RetryableError)
+	return ok
+}
+
+// retryDelay returns the delay to use before the given attempt
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt; i++ {
+		delay = delay * 2
+		if delay >= retryMaxDelay {
+			return retryMaxDelay
+		}
+	}
+	return delay
+}
+
+// attempts returns the number of previously failed processing attempts of a message
+func attempts(d amqp.Delivery) int {
+	switch v := d.Headers[AttemptHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 0
+	}
+}
+
+// refunded returns whether or not the cost of a message was refunded when it previously failed
+func refunded(d amqp.Delivery) bool {
+	v, ok := d.Headers[RefundedHeader].(bool)
+	return ok && v
+}
+
+// finalAttempt returns whether or not a failure processing this message will
+// result in it being dead-lettered. Handlers use this to decide when to refund
+func (qm *Manager) finalAttempt(d amqp.Delivery) bool {
+	return attempts(d)+1 >= MaxAttempts
+}
+
+// finish is used to settle a message after processing. Successful messages are
+// acknowledged, retryable failures are retried after a delay, and
+// any other failures, or those which have exhausted their attempts, are dead-lettered.
+// Users are notified of failures, unless the message was refunded, as they have
+// already been notified of the refund
+func (qm *Manager) finish(d amqp.Delivery, err error) {
+	if err == nil {
+		qm.settle(d)
+		qm.updateJob(d, jobs.Succeeded, "")
+		qm.notify(d, jobs.Succeeded, "")
+		d.Ack(false)
+		return
+	}
+	if err == errRequeue {
+		qm.updateJob(d, jobs.Queued, "")
+		d.Nack(false, true)
+		return
+	}
+	var state jobs.State
+	attempt := attempts(d) + 1
+	_, wasRefunded := err.(*refundedError)
+	retry := !wasRefunded && IsRetryable(err) && attempt < MaxAttempts
+	if retry {
+		state = jobs.Queued
+		qm.l.Warnw(
+			"message processing failed, retrying",
+			"error", err.Error(),
+			"attempt", attempt,
+			"delay", retryDelay(attempt).String())
+	} else {
+		state = jobs.Failed
+		qm.l.Errorw(
+			"message processing failed, sending to dead letter queue",
+			"error", err.Error(),
+			"attempt", attempt)
+	}
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[AttemptHeader] = int32(attempt)
+	headers[ErrorHeader] = err.Error()
+	headers[FailedAtHeader] = time.Now().Unix()
+	if wasRefunded {
+		headers[RefundedHeader] = true
+	}
+	// retries keep the id of the message, so duplicates of it are still detected
+	msg := amqp.Publishing{
+		Headers:      headers,
+		DeliveryMode: amqp.Persistent,
+		ContentType:  d.ContentType,
+		MessageId:    d.MessageId,
+		Body:         d.Body,
+	}
+	var pubErr error
+	if retry {
+		pubErr = qm.retry(attempt, msg)
+	} else {
+		pubErr = qm.publish(qm.QueueName.DeadLetterQueue(), msg)
+	}
+	if pubErr != nil {
+		// leave the message on the queue so that it isn't lost
+		qm.l.Errorw(
+			"failed to publish message for retry, requeueing",
+			"error", pubErr.Error())
+		d.Nack(false, true)
+		return
+	}
+	if !retry {
+		qm.settle(d)
+	}
+	qm.updateJob(d, state, err.Error())
+	if state == jobs.Failed && !wasRefunded {
+		qm.notify(d, jobs.Failed, err.Error())
+	}
+	d.Ack(false)
+}
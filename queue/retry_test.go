@@ -0,0 +1,94 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		attempt int
+		want    time.Duration
+	}{
+		{"First", 1, retryBaseDelay},
+		{"Second", 2, retryBaseDelay * 2},
+		{"Fourth", 4, retryBaseDelay * 8},
+		{"Capped", 100, retryMaxDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryDelay(tt.attempt); got != tt.want {
+				t.Fatalf("retryDelay() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		want    int
+	}{
+		{"NoHeaders", nil, 0},
+		{"Int32", amqp.Table{AttemptHeader: int32(3)}, 3},
+		{"Int64", amqp.Table{AttemptHeader: int64(2)}, 2},
+		{"Invalid", amqp.Table{AttemptHeader: "1"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := attempts(amqp.Delivery{Headers: tt.headers}); got != tt.want {
+				t.Fatalf("attempts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	err := errors.New("error")
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"Retryable", Retryable(err), true},
+		{"Permanent", Permanent(err), false},
+		{"Untyped", err, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Fatalf("IsRetryable() = %v, want %v", got, tt.want)
+			}
+			if tt.err.Error() != err.Error() {
+				t.Fatal("wrapped error message changed")
+			}
+		})
+	}
+	if Retryable(nil) != nil || Permanent(nil) != nil {
+		t.Fatal("wrapping a nil error should return nil")
+	}
+}
+
+func TestParseQueue(t *testing.T) {
+	tests := []struct {
+		name    string
+		queue   string
+		wantErr bool
+	}{
+		{"Valid", IpfsPinQueue.String(), false},
+		{"DeadLetter", IpfsPinQueue.DeadLetterQueue(), true},
+		{"Invalid", "foo", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseQueue(tt.queue); (err != nil) != tt.wantErr {
+				t.Fatalf("ParseQueue() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
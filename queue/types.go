@@ -1,8 +1,12 @@
 package queue
 
 import (
+	"encoding/json"
+	"sync"
 	"time"
 
+	"github.com/RTradeLtd/Temporal/jobs"
+	"github.com/RTradeLtd/Temporal/webhooks"
 	"github.com/RTradeLtd/config/v2"
 	"github.com/RTradeLtd/gorm"
 	"go.uber.org/zap"
@@ -36,6 +40,8 @@ var (
 	EthPaymentConfirmationQueue Queue = "eth-payment-confirmation-queue"
 	// DashPaymentConfirmationQueue is a queue used to handle confirming dash payments
 	DashPaymentConfirmationQueue Queue = "dash-payment-confirmation-queue"
+	// WebhookDeliveryQueue is a queue used to deliver events to user registered webhook endpoints
+	WebhookDeliveryQueue Queue = "webhook-delivery-queue"
 	// AdminEmail is the email used to notify RTrade about any critical errors
 	AdminEmail = "temporal.reports@rtradetechnologies.com"
 	// IpfsPinFailedContent is a to-be formatted message sent on IPFS pin failures
@@ -58,16 +64,27 @@ var (
 	PaymentConfirmationFailedSubject = "Payment Confirmation Failed"
 	// PaymentConfirmationFailedContent is a content used when a payment confirmation failure occurs
 	PaymentConfirmationFailedContent = "Payment failed for content hash %s with error %s"
+	// PaymentConfirmedSubject is a subject used when a payment has been confirmed
+	PaymentConfirmedSubject = "TEMPORAL Payment Confirmed"
+	// PaymentConfirmedContent is a to-be formatted message sent to users when their payment has been confirmed
+	PaymentConfirmedContent = "Your %s payment (payment number %v) has been confirmed, and %v credits have been added to your account"
 	// ErrReconnect is an error emitted when a protocol connection error occurs
 	// It is used to signal reconnect of queue consumers and publishers
 	ErrReconnect = "protocol connection error, reconnect"
 )
 
-// Manager is a helper struct to interact with rabbitmq
+// Manager is a helper struct to interact with our message broker
 type Manager struct {
-	connection   *amqp.Connection
-	channel      *amqp.Channel
-	queue        *amqp.Queue
+	// inFlight is the number of messages being processed, and
+	// must be first in the struct to be 64-bit aligned for atomic access
+	inFlight int64
+	// mux guards our broker connection, which is replaced when publishers reconnect
+	mux          sync.RWMutex
+	broker       Broker
+	connected    chan struct{}
+	closed       bool
+	done         chan struct{}
+	url          string
 	l            *zap.SugaredLogger
 	db           *gorm.DB
 	cfg          *config.TemporalConfig
@@ -75,6 +92,15 @@ type Manager struct {
 	QueueName    Queue
 	ExchangeName string
 	dev          bool
+	// chain is used by the eth payment confirmation consumer
+	chain ChainClient
+	// jobs is used to record the status of messages carrying a job id
+	jobs *jobs.Manager
+	// webhooks is used to find the endpoints subscribed to events we emit
+	webhooks *webhooks.Manager
+	// opts configures how messages are consumed
+	opts        WorkerOptions
+	consumerTag string
 }
 
 // Queue Messages - These are used to format messages to send through rabbitmq
@@ -88,6 +114,7 @@ type IPFSKeyCreation struct {
 	Size        int     `json:"size"`
 	NetworkName string  `json:"network_name"`
 	CreditCost  float64 `json:"credit_cost"`
+	JobID       string  `json:"job_id,omitempty"`
 }
 
 // IPFSPin is a struct used when sending pin request
@@ -99,6 +126,7 @@ type IPFSPin struct {
 	CreditCost       float64 `json:"credit_cost"`
 	Size             int64   `json:"size"`
 	JWT              string  `json:"jwt,omitempty"`
+	JobID            string  `json:"job_id,omitempty"`
 }
 
 // IPFSClusterPin is a queue message used when sending a message to the cluster to pin content
@@ -109,6 +137,7 @@ type IPFSClusterPin struct {
 	HoldTimeInMonths int64   `json:"hold_time_in_months"`
 	Size             int64   `json:"size"`
 	CreditCost       float64 `json:"credit_cost"`
+	JobID            string  `json:"job_id,omitempty"`
 }
 
 // IPNSUpdate is our message for the ipns update queue
@@ -143,6 +172,7 @@ type IPNSEntry struct {
 	UserName    string        `json:"user_name"`
 	NetworkName string        `json:"network_name"`
 	CreditCost  float64       `json:"credit_cost"`
+	JobID       string        `json:"job_id,omitempty"`
 }
 
 // DashPaymenConfirmation is a message used to signal processing of a dash payment
@@ -157,3 +187,12 @@ type EthPaymentConfirmation struct {
 	UserName      string `json:"user_name"`
 	PaymentNumber int64  `json:"payment_number"`
 }
+
+// WebhookDelivery is a message used to deliver an event to a single webhook endpoint
+type WebhookDelivery struct {
+	EndpointID uint            `json:"endpoint_id"`
+	UserName   string          `json:"user_name"`
+	EventID    string          `json:"event_id"`
+	Event      webhooks.Event  `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+}
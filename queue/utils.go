@@ -1,17 +1,16 @@
 package queue
 
 import (
-	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/Temporal/ledger"
 )
 
-// refundCredits is used to refund a users credits. We do not check for errors,
-// as these are logged and manually corrected if they occur
-func (qm *Manager) refundCredits(username, callType string, cost float64) error {
+// refundCredits is used to refund a users credits, recording the refund against reference.
+// We do not check for errors, as these are logged and manually corrected if they occur
+func (qm *Manager) refundCredits(username, callType string, cost float64, reference string) error {
 	if cost == 0 {
 		return nil
 	}
-	um := models.NewUserManager(qm.db)
-	if _, err := um.AddCredits(username, cost); err != nil {
+	if _, err := ledger.NewManager(qm.db).Credit(username, cost, ledger.Refund, reference); err != nil {
 		qm.l.Errorw(
 			"failed to refund user credits",
 			"error", err.Error(),
@@ -0,0 +1,244 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/jobs"
+	"github.com/RTradeLtd/Temporal/webhooks"
+	"github.com/RTradeLtd/gorm"
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+// webhookTimeout is the maximum amount of time we wait for an endpoint to respond
+var webhookTimeout = time.Second * 15
+
+// webhookMessage is used to extract the fields describing a job from the
+// messages of queues which emit webhook events
+type webhookMessage struct {
+	JobID       string `json:"job_id"`
+	UserName    string `json:"user_name"`
+	CID         string `json:"cid"`
+	NetworkName string `json:"network_name"`
+	Key         string `json:"key"`
+}
+
+// webhookEvent returns the event emitted when a job processed by the given
+// queue transitions to state, if the queue emits webhook events
+func webhookEvent(queue Queue, state jobs.State) (webhooks.Event, bool) {
+	var prefix string
+	switch queue {
+	case IpfsPinQueue, IpfsClusterPinQueue:
+		prefix = "pin"
+	case IpnsEntryQueue:
+		prefix = "ipns"
+	default:
+		return "", false
+	}
+	event := webhooks.Event(prefix + "." + string(state))
+	return event, event.Valid()
+}
+
+// webhookQueue returns whether or not the given queue emits webhook events
+func webhookQueue(queue Queue) bool {
+	_, ok := webhookEvent(queue, jobs.Succeeded)
+	return ok
+}
+
+// declareWebhookQueue is used to declare the webhook delivery queue, so that
+// events we emit are not dropped if its consumer hasn't been started yet
+func (qm *Manager) declareWebhookQueue() error {
+	broker, err := qm.connection(context.Background())
+	if err != nil {
+		return err
+	}
+	return broker.Declare(WebhookDeliveryQueue)
+}
+
+// notify is used to emit a webhook event for the job carried by a message, publishing
+// a delivery to the webhook queue for each endpoint subscribed to the event. Webhooks
+// are best effort, so failures are logged rather than affecting processing of the message
+func (qm *Manager) notify(d amqp.Delivery, state jobs.State, reason string) {
+	event, ok := webhookEvent(qm.QueueName, state)
+	if !ok || qm.webhooks == nil {
+		return
+	}
+	var msg webhookMessage
+	if err := json.Unmarshal(d.Body, &msg); err != nil || msg.UserName == "" {
+		return
+	}
+	endpoints, err := qm.webhooks.FindEndpointsByEvent(msg.UserName, event)
+	if err != nil {
+		qm.l.Errorw(
+			"failed to find webhook endpoints",
+			"error", err.Error(),
+			"user", msg.UserName,
+			"event", event)
+		return
+	}
+	if len(endpoints) == 0 {
+		return
+	}
+	eventID := uuid.New().String()
+	payload, err := json.Marshal(webhooks.Payload{
+		ID:        eventID,
+		Type:      event,
+		CreatedAt: time.Now().UTC(),
+		Data: webhooks.PayloadData{
+			JobID:       msg.JobID,
+			UserName:    msg.UserName,
+			CID:         msg.CID,
+			NetworkName: msg.NetworkName,
+			Key:         msg.Key,
+			Reason:      reason,
+		},
+	})
+	if err != nil {
+		qm.l.Errorw("failed to marshal webhook payload", "error", err.Error())
+		return
+	}
+	for _, endpoint := range endpoints {
+		body, err := json.Marshal(WebhookDelivery{
+			EndpointID: endpoint.ID,
+			UserName:   msg.UserName,
+			EventID:    eventID,
+			Event:      event,
+			Payload:    payload,
+		})
+		if err != nil {
+			qm.l.Errorw("failed to marshal webhook delivery", "error", err.Error())
+			return
+		}
+		if err := qm.publish(WebhookDeliveryQueue.String(), amqp.Publishing{
+			DeliveryMode: amqp.Persistent,
+			ContentType:  "application/json",
+			Body:         body,
+		}); err != nil {
+			qm.l.Errorw(
+				"failed to publish webhook delivery",
+				"error", err.Error(),
+				"user", msg.UserName,
+				"endpoint", endpoint.ID,
+				"event", event)
+		}
+	}
+}
+
+// newWebhookClient returns the client used to deliver webhooks. Redirects are not
+// followed, as they could be used to reach addresses endpoints aren't allowed to target
+func newWebhookClient() *http.Client {
+	return &http.Client{
+		Timeout: webhookTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// ProcessWebhookDeliveries is used to deliver events to user registered webhook endpoints
+func (qm *Manager) ProcessWebhookDeliveries(ctx context.Context, wg *sync.WaitGroup, msgs <-chan amqp.Delivery) error {
+	client := newWebhookClient()
+	qm.l.Info("processing webhook deliveries")
+	return qm.consume(ctx, wg, msgs, func(ctx context.Context, d amqp.Delivery) error {
+		return qm.processWebhookDelivery(ctx, d, client)
+	})
+}
+
+func (qm *Manager) processWebhookDelivery(ctx context.Context, d amqp.Delivery, client *http.Client) error {
+	var msg WebhookDelivery
+	if err := json.Unmarshal(d.Body, &msg); err != nil {
+		qm.l.Errorw(
+			"failed to unmarshal message",
+			"error", err.Error())
+		return Permanent(err)
+	}
+	endpoint, err := qm.webhooks.FindEndpointByID(msg.EndpointID)
+	if err == gorm.ErrRecordNotFound {
+		// the endpoint has been removed since the event was emitted
+		qm.l.Infow(
+			"webhook endpoint no longer exists, skipping delivery",
+			"user", msg.UserName,
+			"endpoint", msg.EndpointID)
+		return nil
+	} else if err != nil {
+		qm.l.Errorw(
+			"failed to find webhook endpoint",
+			"error", err.Error(),
+			"user", msg.UserName,
+			"endpoint", msg.EndpointID)
+		return Retryable(err)
+	}
+	delivery := &webhooks.Delivery{
+		EndpointID: endpoint.ID,
+		UserName:   endpoint.UserName,
+		EventID:    msg.EventID,
+		Event:      msg.Event,
+		Attempt:    attempts(d) + 1,
+	}
+	status, err := qm.deliverWebhook(ctx, client, endpoint, msg)
+	if err != nil && ctx.Err() == context.Canceled {
+		// we are shutting down, so don't count this as an attempt
+		return errRequeue
+	}
+	delivery.StatusCode = status
+	delivery.Succeeded = err == nil
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	if recordErr := qm.webhooks.RecordDelivery(delivery); recordErr != nil {
+		qm.l.Errorw(
+			"failed to record webhook delivery",
+			"error", recordErr.Error(),
+			"user", endpoint.UserName,
+			"endpoint", endpoint.ID)
+	}
+	if err != nil {
+		qm.l.Warnw(
+			"failed to deliver webhook",
+			"error", err.Error(),
+			"user", endpoint.UserName,
+			"endpoint", endpoint.ID,
+			"event", msg.Event)
+		return Retryable(err)
+	}
+	qm.l.Infow(
+		"successfully delivered webhook",
+		"user", endpoint.UserName,
+		"endpoint", endpoint.ID,
+		"event", msg.Event)
+	return nil
+}
+
+// deliverWebhook is used to send a signed payload to an endpoint, returning
+// the status code of the response. Any non 2xx response is considered a failure
+func (qm *Manager) deliverWebhook(ctx context.Context, client *http.Client, endpoint *webhooks.Endpoint, msg WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(msg.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Temporal-Webhooks")
+	req.Header.Set(webhooks.EventHeader, string(msg.Event))
+	req.Header.Set(webhooks.DeliveryHeader, msg.EventID)
+	req.Header.Set(webhooks.SignatureHeader, webhooks.Sign(endpoint.Secret, time.Now(), msg.Payload))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// read a bounded amount of the body, so that the connection may be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,83 @@
+package queue
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/jobs"
+	"github.com/RTradeLtd/Temporal/webhooks"
+)
+
+func TestWebhookEvent(t *testing.T) {
+	tests := []struct {
+		name   string
+		queue  Queue
+		state  jobs.State
+		want   webhooks.Event
+		wantOk bool
+	}{
+		{"PinSucceeded", IpfsPinQueue, jobs.Succeeded, webhooks.PinSucceeded, true},
+		{"ClusterPinRefunded", IpfsClusterPinQueue, jobs.Refunded, webhooks.PinRefunded, true},
+		{"IPNSFailed", IpnsEntryQueue, jobs.Failed, webhooks.IPNSFailed, true},
+		{"Processing", IpfsPinQueue, jobs.Processing, "", false},
+		{"KeyCreation", IpfsKeyCreationQueue, jobs.Succeeded, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := webhookEvent(tt.queue, tt.state)
+			if ok != tt.wantOk {
+				t.Fatalf("webhookEvent() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && got != tt.want {
+				t.Fatalf("webhookEvent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManager_DeliverWebhook(t *testing.T) {
+	var (
+		secret  = "whsec_test"
+		payload = []byte(`{"id":"event","type":"pin.succeeded"}`)
+	)
+	tests := []struct {
+		name       string
+		status     int
+		wantStatus int
+		wantErr    bool
+	}{
+		{"OK", http.StatusOK, http.StatusOK, false},
+		{"NoContent", http.StatusNoContent, http.StatusNoContent, false},
+		{"ServerError", http.StatusInternalServerError, http.StatusInternalServerError, true},
+		{"Redirect", http.StatusMovedPermanently, http.StatusMovedPermanently, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				if err := webhooks.Verify(secret, r.Header.Get(webhooks.SignatureHeader), body, time.Minute); err != nil {
+					t.Error(err)
+				}
+				if r.Header.Get(webhooks.EventHeader) != string(webhooks.PinSucceeded) {
+					t.Error("bad event header")
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+			qm := &Manager{}
+			status, err := qm.deliverWebhook(context.Background(), newWebhookClient(),
+				&webhooks.Endpoint{URL: server.URL, Secret: secret},
+				WebhookDelivery{EventID: "event", Event: webhooks.PinSucceeded, Payload: payload})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("deliverWebhook() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if status != tt.wantStatus {
+				t.Fatalf("deliverWebhook() status = %v, want %v", status, tt.wantStatus)
+			}
+		})
+	}
+}
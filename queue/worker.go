@@ -0,0 +1,184 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/jobs"
+	"github.com/streadway/amqp"
+)
+
+// inFlight exposes the number of messages currently being processed, keyed by queue name
+var inFlight = expvar.NewMap("queue_in_flight")
+
+// WorkerOptions is used to configure how a consumer processes messages
+type WorkerOptions struct {
+	// Workers is the number of messages that are processed concurrently
+	Workers int
+	// Prefetch is the number of unacknowledged messages rabbitmq will deliver to us
+	Prefetch int
+	// MessageTimeout is the maximum amount of time spent processing a single message
+	MessageTimeout time.Duration
+	// DrainTimeout is the maximum amount of time we wait for in-flight
+	// messages to finish processing when shutting down
+	DrainTimeout time.Duration
+}
+
+// DefaultWorkerOptions returns the default worker options for the given queue
+func DefaultWorkerOptions(queue Queue) WorkerOptions {
+	opts := WorkerOptions{
+		Workers:        10,
+		Prefetch:       10,
+		MessageTimeout: time.Minute * 60,
+		DrainTimeout:   time.Second * 30,
+	}
+	switch queue {
+	case EthPaymentConfirmationQueue, DashPaymentConfirmationQueue:
+		// payment confirmations are long running, as they wait for the payment to be received
+		opts.Workers = 50
+		opts.Prefetch = 50
+		opts.MessageTimeout = paymentConfirmationTimeout + time.Minute*10
+	case EmailSendQueue:
+		opts.MessageTimeout = time.Minute * 5
+	case WebhookDeliveryQueue:
+		opts.MessageTimeout = webhookTimeout + time.Minute
+	}
+	return opts
+}
+
+// SetWorkerOptions is used to override the default worker options. Zero
+// values are replaced with the defaults for the queue being consumed
+func (qm *Manager) SetWorkerOptions(opts WorkerOptions) {
+	defaults := DefaultWorkerOptions(qm.QueueName)
+	if opts.Workers <= 0 {
+		opts.Workers = defaults.Workers
+	}
+	if opts.Prefetch <= 0 {
+		opts.Prefetch = defaults.Prefetch
+	}
+	if opts.MessageTimeout <= 0 {
+		opts.MessageTimeout = defaults.MessageTimeout
+	}
+	if opts.DrainTimeout <= 0 {
+		opts.DrainTimeout = defaults.DrainTimeout
+	}
+	qm.opts = opts
+}
+
+// InFlight returns the number of messages currently being processed
+func (qm *Manager) InFlight() int64 {
+	return atomic.LoadInt64(&qm.inFlight)
+}
+
+// newConsumerTag returns a unique tag identifying our consumer, allowing us to cancel it
+func newConsumerTag(queue Queue) string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%s-%d-%d", queue.String(), hostname, os.Getpid(), time.Now().UnixNano())
+}
+
+// consume is used to process messages with a bounded pool of workers until ctx is
+// cancelled, or a connection error is received. Shutdown happens in two phases, we first
+// stop receiving messages, and then wait for in-flight messages to finish processing, up
+// to the drain timeout, before closing our connection
+func (qm *Manager) consume(ctx context.Context, wg *sync.WaitGroup, msgs <-chan amqp.Delivery, handler func(context.Context, amqp.Delivery) error) error {
+	// handlers are given a context separate from ctx, so that they may
+	// finish processing messages when shutdown is requested
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+	workers := &sync.WaitGroup{}
+	for i := 0; i < qm.opts.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for d := range msgs {
+				qm.work(workCtx, d, handler)
+			}
+		}()
+	}
+	select {
+	case <-ctx.Done():
+		qm.l.Info("shutdown requested, no longer accepting messages")
+		if err := qm.cancelConsumer(); err != nil {
+			qm.l.Errorw("failed to cancel consumer", "error", err.Error())
+		}
+		qm.drain(workers, cancelWork)
+		qm.Close()
+		wg.Done()
+		return nil
+	case msg := <-qm.ErrCh:
+		// our connection is gone so messages can't be acknowledged, and
+		// will be redelivered. stop processing them as soon as possible
+		cancelWork()
+		qm.drain(workers, cancelWork)
+		qm.Close()
+		wg.Done()
+		qm.l.Errorw(
+			"a protocol connection error stopping rabbitmq was received",
+			"error", msg.Error())
+		return errors.New(ErrReconnect)
+	}
+}
+
+// work is used to process a single message, bounded by the message timeout
+func (qm *Manager) work(ctx context.Context, d amqp.Delivery, handler func(context.Context, amqp.Delivery) error) {
+	inFlight.Add(qm.QueueName.String(), 1)
+	atomic.AddInt64(&qm.inFlight, 1)
+	defer func() {
+		atomic.AddInt64(&qm.inFlight, -1)
+		inFlight.Add(qm.QueueName.String(), -1)
+	}()
+	// messages refunded when they previously failed would be processed for free
+	if refunded(d) {
+		qm.finish(d, &refundedError{errRefunded})
+		return
+	}
+	// messages may be published more than once, so discard those already being, or which were, processed
+	claimed, err := qm.claim(d)
+	if err != nil {
+		qm.finish(d, Retryable(err))
+		return
+	}
+	if !claimed {
+		qm.l.Warnw("discarding duplicate message", "message_id", d.MessageId)
+		d.Ack(false)
+		return
+	}
+	qm.updateJob(d, jobs.Processing, "")
+	msgCtx, cancel := context.WithTimeout(ctx, qm.opts.MessageTimeout)
+	defer cancel()
+	// handlers record refunds through the context, so the message isn't retried once refunded
+	var wasRefunded bool
+	msgCtx = context.WithValue(msgCtx, refundKey{}, &wasRefunded)
+	err = handler(msgCtx, d)
+	if err != nil && wasRefunded {
+		err = &refundedError{err}
+	}
+	qm.finish(d, err)
+}
+
+// drain is used to wait for workers to finish processing in-flight messages. If
+// they don't finish before the drain timeout, their contexts are cancelled
+func (qm *Manager) drain(workers *sync.WaitGroup, cancelWork context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(qm.opts.DrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		qm.l.Info("finished processing in-flight messages")
+	case <-timer.C:
+		qm.l.Warnw(
+			"timed out waiting for in-flight messages, cancelling",
+			"in_flight", qm.InFlight())
+		cancelWork()
+	}
+}
@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+)
+
+func TestManager_SetWorkerOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		queue Queue
+		opts  WorkerOptions
+		want  WorkerOptions
+	}{
+		{"Defaults", IpfsPinQueue, WorkerOptions{}, DefaultWorkerOptions(IpfsPinQueue)},
+		{"PaymentDefaults", EthPaymentConfirmationQueue, WorkerOptions{}, DefaultWorkerOptions(EthPaymentConfirmationQueue)},
+		{"Override", IpfsPinQueue,
+			WorkerOptions{Workers: 1, Prefetch: 2, MessageTimeout: time.Second, DrainTimeout: time.Minute},
+			WorkerOptions{Workers: 1, Prefetch: 2, MessageTimeout: time.Second, DrainTimeout: time.Minute}},
+		{"PartialOverride", EmailSendQueue,
+			WorkerOptions{Workers: 3},
+			WorkerOptions{Workers: 3, Prefetch: 10, MessageTimeout: time.Minute * 5, DrainTimeout: time.Second * 30}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qm := &Manager{QueueName: tt.queue}
+			qm.SetWorkerOptions(tt.opts)
+			if qm.opts != tt.want {
+				t.Fatalf("SetWorkerOptions() = %+v, want %+v", qm.opts, tt.want)
+			}
+		})
+	}
+	if DefaultWorkerOptions(DashPaymentConfirmationQueue).MessageTimeout <= paymentConfirmationTimeout {
+		t.Fatal("payment message timeout must exceed the payment confirmation timeout")
+	}
+}
+
+func TestManager_Work(t *testing.T) {
+	qm := &Manager{QueueName: IpfsPinQueue, l: zap.NewNop().Sugar()}
+	qm.SetWorkerOptions(WorkerOptions{MessageTimeout: time.Millisecond * 50})
+	var (
+		during   int64
+		deadline bool
+	)
+	qm.work(context.Background(), amqp.Delivery{}, func(ctx context.Context, d amqp.Delivery) error {
+		during = qm.InFlight()
+		<-ctx.Done()
+		deadline = ctx.Err() == context.DeadlineExceeded
+		return nil
+	})
+	if during != 1 {
+		t.Fatalf("expected 1 in-flight message while processing, got %v", during)
+	}
+	if !deadline {
+		t.Fatal("expected message context to time out")
+	}
+	if qm.InFlight() != 0 {
+		t.Fatalf("expected 0 in-flight messages after processing, got %v", qm.InFlight())
+	}
+}
@@ -82,3 +82,8 @@ func (cm *ClusterManager) Pin(ctx context.Context, cid gocid.Cid) error {
 	fmt.Println(status)
 	return nil
 }
+
+// Unpin is used to remove a pin from the cluster
+func (cm *ClusterManager) Unpin(ctx context.Context, cid gocid.Cid) error {
+	return cm.Client.Unpin(ctx, cid)
+}
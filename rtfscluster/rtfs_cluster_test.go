@@ -94,6 +94,37 @@ func TestClusterPin(t *testing.T) {
 	}
 }
 
+func TestClusterUnpin(t *testing.T) {
+	cm, err := rtfscluster.Initialize(context.Background(), nodeOneAPIAddr, nodePort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := cm.DecodeHashString(testPIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// restore the pin used by other tests
+	defer cm.Pin(context.Background(), decoded)
+	type args struct {
+		cid gocid.Cid
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{"Success", args{decoded}, false},
+		{"Failure", args{gocid.Cid{}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := cm.Unpin(context.Background(), tt.args.cid); (err != nil) != tt.wantErr {
+				t.Fatalf("Unpin() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestListPeers(t *testing.T) {
 	cm, err := rtfscluster.Initialize(context.Background(), nodeOneAPIAddr, nodePort)
 	if err != nil {
@@ -0,0 +1,3 @@
+// Package share provides management of expiring links sharing uploaded content with
+// people who don't have an account, along with a log of attempts to access each link
+package share
@@ -0,0 +1,296 @@
+package share
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/RTradeLtd/gorm"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/hkdf"
+)
+
+// sealingLabel is the label the key passphrases are sealed with is derived under, so
+// that it differs from any other key derived from the same secret, such as our jwt key
+const sealingLabel = "temporal share link passphrase"
+
+var (
+	// ErrRevoked is returned when accessing a link which has been revoked
+	ErrRevoked = errors.New("share link has been revoked")
+	// ErrExpired is returned when accessing a link which has expired
+	ErrExpired = errors.New("share link has expired")
+	// ErrDownloadLimit is returned when accessing a link which has reached its maximum number of downloads
+	ErrDownloadLimit = errors.New("share link has reached its download limit")
+	// ErrInvalidPassword is returned when accessing a password protected link with the wrong password
+	ErrInvalidPassword = errors.New("invalid share link password")
+)
+
+// Link shares content with anyone who has its token, until it expires
+type Link struct {
+	gorm.Model
+	UserName string `gorm:"type:varchar(255)" json:"user_name"`
+	// TokenHash is the sha256 hash of the token identifying the link, which is only
+	// revealed when the link is created
+	TokenHash   string `gorm:"type:varchar(255);unique_index" json:"-"`
+	Hash        string `gorm:"type:varchar(255)" json:"hash"`
+	NetworkName string `gorm:"type:varchar(255)" json:"network_name"`
+	// FileName is the name content is downloaded as, if any
+	FileName  string    `gorm:"type:varchar(255)" json:"file_name"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// MaxDownloads is the number of times the link may be downloaded, or 0 if unlimited
+	MaxDownloads int64 `json:"max_downloads"`
+	Downloads    int64 `json:"downloads"`
+	// PasswordHash is the bcrypt hash of the password protecting the link, if any
+	PasswordHash string `gorm:"type:varchar(255)" json:"-"`
+	// Passphrase is the sealed passphrase content is decrypted with as it is downloaded, if any
+	Passphrase string     `gorm:"type:text" json:"-"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// Protected returns whether the link is protected by a password
+func (l *Link) Protected() bool {
+	return l.PasswordHash != ""
+}
+
+// Encrypted returns whether content is decrypted as it is downloaded through the link
+func (l *Link) Encrypted() bool {
+	return l.Passphrase != ""
+}
+
+// Access is an attempt to download the content shared by a link
+type Access struct {
+	gorm.Model
+	LinkID    uint   `gorm:"index" json:"link_id"`
+	UserName  string `gorm:"type:varchar(255)" json:"user_name"`
+	IP        string `gorm:"type:varchar(255)" json:"ip"`
+	UserAgent string `gorm:"type:text" json:"user_agent"`
+	Granted   bool   `json:"granted"`
+	// Reason describes why access was denied
+	Reason string `gorm:"type:text" json:"reason,omitempty"`
+}
+
+// Options is used to configure a new link
+type Options struct {
+	Hash        string
+	NetworkName string
+	FileName    string
+	ExpiresAt   time.Time
+	// MaxDownloads is the number of times the link may be downloaded, or 0 if unlimited
+	MaxDownloads int64
+	// Password protects the link when not empty
+	Password string
+	// Passphrase is used to decrypt content as it is downloaded when not empty
+	Passphrase string
+}
+
+// Manager is used to manipulate share links, and their access logs in our database
+type Manager struct {
+	DB *gorm.DB
+	// key is used to seal passphrases stored in our database
+	key []byte
+}
+
+// NewManager is used to instantiate our share link manager. Passphrases are sealed
+// with a key derived from secret, which must be kept the same to open them again
+func NewManager(db *gorm.DB, secret string) *Manager {
+	key := make([]byte, 32)
+	// reading less than 255 hashes worth of key from hkdf never fails
+	io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte(sealingLabel)), key)
+	return &Manager{DB: db, key: key}
+}
+
+// Migrate is used to create or update the share link tables
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Link{}, &Access{}).Error
+}
+
+// NewLink is used to create a link sharing content on behalf of a user, returning the
+// link along with the token identifying it, which is never stored
+func (m *Manager) NewLink(username string, opts Options) (*Link, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	token := hex.EncodeToString(raw)
+	link := &Link{
+		UserName:     username,
+		TokenHash:    hashToken(token),
+		Hash:         opts.Hash,
+		NetworkName:  opts.NetworkName,
+		FileName:     opts.FileName,
+		ExpiresAt:    opts.ExpiresAt,
+		MaxDownloads: opts.MaxDownloads,
+	}
+	if opts.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, "", err
+		}
+		link.PasswordHash = string(hash)
+	}
+	if opts.Passphrase != "" {
+		sealed, err := m.seal(opts.Passphrase)
+		if err != nil {
+			return nil, "", err
+		}
+		link.Passphrase = sealed
+	}
+	if err := m.DB.Create(link).Error; err != nil {
+		return nil, "", err
+	}
+	return link, token, nil
+}
+
+// FindLinkByToken is used to find the link identified by token
+func (m *Manager) FindLinkByToken(token string) (*Link, error) {
+	var link Link
+	if err := m.DB.Where("token_hash = ?", hashToken(token)).First(&link).Error; err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// FindLinkByUserNameAndID is used to find a link belonging to a user
+func (m *Manager) FindLinkByUserNameAndID(username string, id uint) (*Link, error) {
+	var link Link
+	if err := m.DB.Where("user_name = ? AND id = ?", username, id).First(&link).Error; err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// FindLinksByUserName is used to find all links belonging to a user
+func (m *Manager) FindLinksByUserName(username string) ([]Link, error) {
+	var links []Link
+	if err := m.DB.Where("user_name = ?", username).Order("id").Find(&links).Error; err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// Revoke is used to revoke a link belonging to a user, preventing any further downloads
+func (m *Manager) Revoke(username string, id uint) (*Link, error) {
+	link, err := m.FindLinkByUserNameAndID(username, id)
+	if err != nil {
+		return nil, err
+	}
+	if link.RevokedAt != nil {
+		return link, nil
+	}
+	now := time.Now()
+	if err := m.DB.Model(link).Update("revoked_at", &now).Error; err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// Authorize is used to check a link may be downloaded as of now with password
+func (m *Manager) Authorize(link *Link, password string, now time.Time) error {
+	switch {
+	case link.RevokedAt != nil:
+		return ErrRevoked
+	case !now.Before(link.ExpiresAt):
+		return ErrExpired
+	case link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads:
+		return ErrDownloadLimit
+	}
+	if link.Protected() && bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)) != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// CountDownload is used to count a download of a link, returning ErrDownloadLimit if
+// the link has already reached its limit. Downloads are counted atomically, so
+// concurrent downloads can never exceed the limit
+func (m *Manager) CountDownload(link *Link) error {
+	result := m.DB.Model(&Link{}).Where(
+		"id = ? AND (max_downloads = 0 OR downloads < max_downloads)", link.ID,
+	).UpdateColumn("downloads", gorm.Expr("downloads + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrDownloadLimit
+	}
+	link.Downloads++
+	return nil
+}
+
+// Passphrase is used to open the sealed passphrase of a link
+func (m *Manager) Passphrase(link *Link) (string, error) {
+	return m.open(link.Passphrase)
+}
+
+// RecordAccess is used to record an attempt to download a link
+func (m *Manager) RecordAccess(access *Access) error {
+	return m.DB.Create(access).Error
+}
+
+// FindAccessesByLink is used to find the most recent attempts to download a link
+// belonging to a user. A limit of 0 returns all attempts
+func (m *Manager) FindAccessesByLink(username string, linkID uint, limit int) ([]Access, error) {
+	var accesses []Access
+	query := m.DB.Where("user_name = ? AND link_id = ?", username, linkID)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Order("created_at desc").Find(&accesses).Error; err != nil {
+		return nil, err
+	}
+	return accesses, nil
+}
+
+// seal is used to encrypt value with AES256-GCM, returning the nonce followed by the encrypted value
+func (m *Manager) seal(value string) (string, error) {
+	aead, err := m.aead()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(value), nil)), nil
+}
+
+// open is used to decrypt a value encrypted by seal
+func (m *Manager) open(sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	aead, err := m.aead()
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", errors.New("sealed value is too short")
+	}
+	value, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// aead returns the cipher used to seal values
+func (m *Manager) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(m.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// hashToken returns the hash of token stored in our database
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,132 @@
+package share
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testCfgPath = "../testenv/config.json"
+
+func TestManager_seal(t *testing.T) {
+	m := NewManager(nil, "secret")
+	sealed, err := m.seal("password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed == "password123" {
+		t.Fatal("value was not sealed")
+	}
+	if value, err := m.open(sealed); err != nil || value != "password123" {
+		t.Fatalf("open() = %v, %v", value, err)
+	}
+	if _, err := NewManager(nil, "other").open(sealed); err == nil {
+		t.Fatal("expected values sealed with another secret to not open")
+	}
+	// the secret, which may be our jwt key, is never used as the key itself
+	if digest := sha256.Sum256([]byte("secret")); bytes.Equal(m.key, digest[:]) || bytes.Equal(m.key, []byte("secret")) {
+		t.Fatal("expected key to be derived from secret")
+	}
+}
+
+func TestManager_Authorize(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		m       = NewManager(nil, "secret")
+		now     = time.Now()
+		expires = now.Add(time.Hour)
+	)
+	tests := []struct {
+		name     string
+		link     Link
+		password string
+		wantErr  error
+	}{
+		{"Valid", Link{ExpiresAt: expires}, "", nil},
+		{"Revoked", Link{ExpiresAt: expires, RevokedAt: &now}, "", ErrRevoked},
+		{"Expired", Link{ExpiresAt: now}, "", ErrExpired},
+		{"DownloadLimit", Link{ExpiresAt: expires, MaxDownloads: 2, Downloads: 2}, "", ErrDownloadLimit},
+		{"WithinDownloadLimit", Link{ExpiresAt: expires, MaxDownloads: 2, Downloads: 1}, "", nil},
+		{"Password", Link{ExpiresAt: expires, PasswordHash: string(hash)}, "password123", nil},
+		{"WrongPassword", Link{ExpiresAt: expires, PasswordHash: string(hash)}, "password", ErrInvalidPassword},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := m.Authorize(&tt.link, tt.password, now); err != tt.wantErr {
+				t.Fatalf("Authorize() err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestManager(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(dbm.DB, "secret")
+	link, token, err := m.NewLink("testuser", Options{
+		Hash:         "QmPY5iMFjNZKxRbUZZC85wXb9CFgNSyzAy1LxwL62D8VGr",
+		NetworkName:  "public",
+		ExpiresAt:    time.Now().Add(time.Hour),
+		MaxDownloads: 1,
+		Passphrase:   "password123",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.DB.Unscoped().Delete(link)
+	found, err := m.FindLinkByToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passphrase, err := m.Passphrase(found); err != nil || passphrase != "password123" {
+		t.Fatalf("Passphrase() = %v, %v", passphrase, err)
+	}
+	// downloads beyond the limit are never counted
+	if err := m.CountDownload(found); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CountDownload(found); err != ErrDownloadLimit {
+		t.Fatalf("CountDownload() err = %v, want %v", err, ErrDownloadLimit)
+	}
+	access := &Access{LinkID: link.ID, UserName: "testuser", IP: "127.0.0.1", Granted: true}
+	if err := m.RecordAccess(access); err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.DB.Unscoped().Delete(access)
+	accesses, err := m.FindAccessesByLink("testuser", link.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accesses) != 1 {
+		t.Fatalf("found %v accesses, want 1", len(accesses))
+	}
+	if _, err := m.Revoke("notthetestuser", link.ID); err == nil {
+		t.Fatal("expected links of other users to not be revocable")
+	}
+	if _, err := m.Revoke("testuser", link.ID); err != nil {
+		t.Fatal(err)
+	}
+	if found, err = m.FindLinkByToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Authorize(found, "", time.Now()); err != ErrRevoked {
+		t.Fatalf("Authorize() err = %v, want %v", err, ErrRevoked)
+	}
+}
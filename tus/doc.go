@@ -0,0 +1,3 @@
+// Package tus stages resumable uploads on local disk, tracking the offset of each upload
+// as chunks are received following the tus protocol, and expiring stale partial uploads
+package tus
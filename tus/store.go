@@ -0,0 +1,367 @@
+package tus
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotFound is returned when an upload doesn't exist, or belongs to another user
+	ErrNotFound = errors.New("upload not found")
+	// ErrOffsetMismatch is returned when a chunk doesn't start at the current offset of an upload
+	ErrOffsetMismatch = errors.New("chunk offset does not match the offset of the upload")
+	// ErrLocked is returned when using an upload which is already receiving a chunk, or being completed
+	ErrLocked = errors.New("upload is already in use")
+	// ErrComplete is returned when writing to an upload which has received all of its content
+	ErrComplete = errors.New("upload is already complete")
+	// ErrIncomplete is returned when completing an upload which hasn't received all of its content
+	ErrIncomplete = errors.New("upload is not complete")
+	// ErrTooLarge is returned when creating an upload larger than the maximum size
+	ErrTooLarge = errors.New("upload is larger than the maximum size")
+)
+
+// Options is used to configure the store
+type Options struct {
+	// Dir is the directory uploads are staged in
+	Dir string
+	// MaxSize is the largest upload, in bytes, which may be created
+	MaxSize int64
+	// Expiry is how long an upload may go without receiving a chunk before it is removed
+	Expiry time.Duration
+	// Interval is how often expired uploads are removed when running continuously
+	Interval time.Duration
+}
+
+// DefaultOptions returns the default store options
+func DefaultOptions() Options {
+	return Options{
+		Dir:      filepath.Join(os.TempDir(), "temporal-uploads"),
+		MaxSize:  10 << 30,
+		Expiry:   time.Hour * 24,
+		Interval: time.Hour,
+	}
+}
+
+// withDefaults returns opts with zero values replaced by their defaults
+func (opts Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if opts.Dir == "" {
+		opts.Dir = defaults.Dir
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaults.MaxSize
+	}
+	if opts.Expiry <= 0 {
+		opts.Expiry = defaults.Expiry
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaults.Interval
+	}
+	return opts
+}
+
+// Upload is the state of a single resumable upload
+type Upload struct {
+	ID       string `json:"id"`
+	UserName string `json:"user_name"`
+	// Size is the total length of the upload in bytes
+	Size int64 `json:"size"`
+	// Offset is the number of bytes received so far
+	Offset int64 `json:"offset"`
+	// Metadata is the decoded Upload-Metadata provided when the upload was created
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// Complete returns whether all of the content of the upload has been received
+func (u *Upload) Complete() bool {
+	return u.Offset == u.Size
+}
+
+// Store stages the content of resumable uploads on local disk. Each upload is
+// stored as a content file, and an info file recording its state. Uploads are
+// local to the API node they were created on
+type Store struct {
+	opts Options
+	l    *zap.SugaredLogger
+	// locked holds the ids of uploads currently receiving a chunk, or being completed
+	locked map[string]bool
+	mutex  sync.Mutex
+	// now is used to retrieve the current time, allowing it to be replaced in tests
+	now func() time.Time
+}
+
+// NewStore is used to instantiate our upload store, creating its directory if
+// needed. Zero value options are replaced with their defaults
+func NewStore(opts Options, logger *zap.SugaredLogger) (*Store, error) {
+	opts = opts.withDefaults()
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Store{
+		opts:   opts,
+		l:      logger.Named("tus"),
+		locked: make(map[string]bool),
+		now:    time.Now,
+	}, nil
+}
+
+// MaxSize returns the largest upload which may be created
+func (s *Store) MaxSize() int64 { return s.opts.MaxSize }
+
+// Expires returns when upload expires, unless it receives another chunk
+func (s *Store) Expires(upload *Upload) time.Time {
+	return upload.UpdatedAt.Add(s.opts.Expiry)
+}
+
+// Create is used to create an empty upload of size bytes for a user
+func (s *Store) Create(username string, size int64, metadata map[string]string) (*Upload, error) {
+	if size > s.opts.MaxSize {
+		return nil, ErrTooLarge
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := s.now()
+	upload := &Upload{
+		ID:        hex.EncodeToString(id),
+		UserName:  username,
+		Size:      size,
+		Metadata:  metadata,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	file, err := os.OpenFile(s.path(upload.ID, ".bin"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	if err := s.save(upload); err != nil {
+		os.Remove(s.path(upload.ID, ".bin"))
+		return nil, err
+	}
+	return upload, nil
+}
+
+// Get is used to retrieve the upload of a user
+func (s *Store) Get(username, id string) (*Upload, error) {
+	// ids are hex encoded, so anything else can't be an upload, and may be an attempt to escape our directory
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, ErrNotFound
+	}
+	data, err := ioutil.ReadFile(s.path(id, ".info"))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var upload Upload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, err
+	}
+	// don't reveal the existence of uploads belonging to other users
+	if upload.UserName != username {
+		return nil, ErrNotFound
+	}
+	return &upload, nil
+}
+
+// Write is used to append the chunk read from r to the upload of a user, provided the chunk starts
+// at the current offset of the upload. Content beyond the size of the upload is ignored. Should
+// reading r fail part way through, the content received is kept so the client may resume from it
+func (s *Store) Write(username, id string, offset int64, r io.Reader) (*Upload, error) {
+	if !s.lock(id) {
+		return nil, ErrLocked
+	}
+	defer s.unlock(id)
+	upload, err := s.Get(username, id)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Complete() {
+		return nil, ErrComplete
+	}
+	if offset != upload.Offset {
+		return nil, ErrOffsetMismatch
+	}
+	file, err := os.OpenFile(s.path(id, ".bin"), os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// discard anything written by a previous chunk which failed before its offset was saved
+	if err := file.Truncate(offset); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	written, copyErr := io.Copy(file, io.LimitReader(r, upload.Size-offset))
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	upload.Offset += written
+	upload.UpdatedAt = s.now()
+	if err := s.save(upload); err != nil {
+		return nil, err
+	}
+	return upload, copyErr
+}
+
+// Complete is used to process the content of the completed upload of a user with fn, removing
+// the upload once fn succeeds. Should fn fail, the upload is kept so processing may be retried
+func (s *Store) Complete(username, id string, fn func(upload *Upload, content io.Reader) error) error {
+	if !s.lock(id) {
+		return ErrLocked
+	}
+	defer s.unlock(id)
+	upload, err := s.Get(username, id)
+	if err != nil {
+		return err
+	}
+	if !upload.Complete() {
+		return ErrIncomplete
+	}
+	file, err := os.Open(s.path(id, ".bin"))
+	if err != nil {
+		return err
+	}
+	err = fn(upload, file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return s.remove(id)
+}
+
+// Remove is used to remove the upload of a user, and its content
+func (s *Store) Remove(username, id string) error {
+	if _, err := s.Get(username, id); err != nil {
+		return err
+	}
+	return s.remove(id)
+}
+
+// Expire is used to remove uploads which haven't received a chunk within the expiry
+func (s *Store) Expire() (int, error) {
+	infos, err := filepath.Glob(filepath.Join(s.opts.Dir, "*.info"))
+	if err != nil {
+		return 0, err
+	}
+	var (
+		expired int
+		cutoff  = s.now().Add(-s.opts.Expiry)
+	)
+	for _, info := range infos {
+		id := strings.TrimSuffix(filepath.Base(info), ".info")
+		data, err := ioutil.ReadFile(info)
+		if err != nil {
+			continue
+		}
+		var upload Upload
+		if err := json.Unmarshal(data, &upload); err != nil {
+			s.l.Errorw("failed to read upload", "error", err.Error(), "upload", id)
+			continue
+		}
+		if upload.UpdatedAt.After(cutoff) {
+			continue
+		}
+		// uploads in use are active, regardless of when they were last updated
+		if !s.lock(id) {
+			continue
+		}
+		err = s.remove(id)
+		s.unlock(id)
+		if err != nil {
+			s.l.Errorw("failed to remove expired upload", "error", err.Error(), "upload", id)
+			continue
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// Run is used to remove expired uploads every interval until ctx is cancelled
+func (s *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		expired, err := s.Expire()
+		if err != nil {
+			s.l.Errorw("failed to expire uploads", "error", err.Error())
+			continue
+		}
+		if expired > 0 {
+			s.l.Infow("expired uploads removed", "expired", expired)
+		}
+	}
+}
+
+// save is used to record the state of upload in its info file. The file
+// is replaced atomically, so a crash never leaves a partially written state
+func (s *Store) save(upload *Upload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	tmp := s.path(upload.ID, ".info.tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(upload.ID, ".info"))
+}
+
+// remove is used to remove the content, and info files of an upload
+func (s *Store) remove(id string) error {
+	if err := os.Remove(s.path(id, ".bin")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.path(id, ".info")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// path returns the path of the file with extension ext belonging to the upload id
+func (s *Store) path(id, ext string) string {
+	return filepath.Join(s.opts.Dir, id+ext)
+}
+
+// lock is used to mark an upload as in use, returning false if it already is
+func (s *Store) lock(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.locked[id] {
+		return false
+	}
+	s.locked[id] = true
+	return true
+}
+
+// unlock is used to mark an upload as no longer in use
+func (s *Store) unlock(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.locked, id)
+}
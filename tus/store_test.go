@@ -0,0 +1,138 @@
+package tus
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// failingReader returns its content, followed by an error rather than io.EOF
+type failingReader struct{ r io.Reader }
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func newTestStore(t *testing.T) *Store {
+	dir, err := ioutil.TempDir("", "tus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStore(Options{Dir: dir, MaxSize: 1024}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStore_Write(t *testing.T) {
+	s := newTestStore(t)
+	defer os.RemoveAll(s.opts.Dir)
+	if _, err := s.Create("testuser", 2048, nil); err != ErrTooLarge {
+		t.Fatalf("Create() err = %v, want %v", err, ErrTooLarge)
+	}
+	upload, err := s.Create("testuser", 10, map[string]string{"filename": "test.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		username   string
+		offset     int64
+		chunk      io.Reader
+		wantErr    bool
+		wantOffset int64
+	}{
+		{"OtherUser", "otheruser", 0, bytes.NewReader([]byte("hello")), true, -1},
+		{"WrongOffset", "testuser", 5, bytes.NewReader([]byte("hello")), true, -1},
+		{"First", "testuser", 0, bytes.NewReader([]byte("hello")), false, 5},
+		// content received before the connection failed is kept
+		{"Interrupted", "testuser", 5, &failingReader{bytes.NewReader([]byte("wo"))}, true, 7},
+		// content beyond the size of the upload is ignored
+		{"Last", "testuser", 7, bytes.NewReader([]byte("rldextra")), false, 10},
+		{"Complete", "testuser", 10, bytes.NewReader([]byte("more")), true, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Write(tt.username, upload.ID, tt.offset, tt.chunk)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Write() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			// uploads are only returned when content was written
+			if (got != nil) != (tt.wantOffset >= 0) {
+				t.Fatalf("Write() returned upload %+v", got)
+			}
+			if got != nil && got.Offset != tt.wantOffset {
+				t.Fatalf("offset = %v, want %v", got.Offset, tt.wantOffset)
+			}
+		})
+	}
+	// failed processing keeps the upload so it can be retried
+	if err := s.Complete("testuser", upload.ID, func(*Upload, io.Reader) error {
+		return errors.New("processing failed")
+	}); err == nil {
+		t.Fatal("expected processing error")
+	}
+	var content []byte
+	if err := s.Complete("testuser", upload.ID, func(u *Upload, r io.Reader) error {
+		content, err = ioutil.ReadAll(r)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "helloworld" {
+		t.Fatalf("content = %s, want helloworld", content)
+	}
+	if _, err := s.Get("testuser", upload.ID); err != ErrNotFound {
+		t.Fatalf("Get() err = %v, upload should be removed once completed", err)
+	}
+	// ids are never used to build paths outside of our directory
+	if _, err := s.Get("testuser", "../../etc/passwd"); err != ErrNotFound {
+		t.Fatalf("Get() err = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestStore_Expire(t *testing.T) {
+	s := newTestStore(t)
+	defer os.RemoveAll(s.opts.Dir)
+	now := time.Now()
+	s.now = func() time.Time { return now.Add(-s.opts.Expiry - time.Minute) }
+	stale, err := s.Create("testuser", 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return now }
+	active, err := s.Create("testuser", 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := s.Expire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != 1 {
+		t.Fatalf("expired %v uploads, want 1", expired)
+	}
+	if _, err := s.Get("testuser", stale.ID); err != ErrNotFound {
+		t.Fatalf("Get() err = %v, stale upload should be removed", err)
+	}
+	if _, err := s.Get("testuser", active.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove("testuser", active.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("testuser", active.ID); err != ErrNotFound {
+		t.Fatalf("Get() err = %v, upload should be removed", err)
+	}
+}
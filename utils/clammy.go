@@ -8,6 +8,9 @@ import (
 	clamd "github.com/baruwa-enterprise/clamd"
 )
 
+// ErrVirusFound is returned when scanned content is infected
+var ErrVirusFound = errors.New("virus found")
+
 // Shell is used to interact with clamav
 type Shell struct {
 	clam *clamd.Client
@@ -43,7 +46,7 @@ func (s *Shell) Scan(reader io.Reader) error {
 	}
 	for _, v := range resp {
 		if v.Status == "FOUND" {
-			return errors.New("virus found")
+			return ErrVirusFound
 		}
 	}
 	return nil
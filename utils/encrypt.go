@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// these must match the settings of crypto.EncryptManager, so that content
+	// encrypted as it is streamed can be decrypted in the same way
+	encryptKeyLen = 32
+	// EncryptSaltLen is the length of the salt stored after encrypted content
+	EncryptSaltLen = 32
+)
+
+// NewEncryptReader returns a reader which encrypts r with passphrase using AES256-CFB as it
+// is read, rather than holding all of r in memory. The output is the initialization vector,
+// followed by the encrypted content and the salt, as produced by crypto.EncryptManager
+func NewEncryptReader(r io.Reader, passphrase string) (io.Reader, error) {
+	salt := make([]byte, EncryptSaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, 4096, encryptKeyLen, sha512.New))
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	return io.MultiReader(
+		bytes.NewReader(iv),
+		&cipher.StreamReader{S: cipher.NewCFBEncrypter(block, iv), R: r},
+		bytes.NewReader(salt),
+	), nil
+}
+
+// EncryptionOverhead is the number of bytes encryption adds to content,
+// for the initialization vector, and the salt
+const EncryptionOverhead = aes.BlockSize + EncryptSaltLen
+
+// EncryptedOffset returns the offset of encrypted content to begin reading from, in order to
+// decrypt the content from offset. This is the start of the encrypted block preceding offset,
+// which is used as the initialization vector of the block offset is within
+func EncryptedOffset(offset int64) int64 {
+	return offset - offset%aes.BlockSize
+}
+
+// NewDecryptReader returns a reader which decrypts r, content encrypted with passphrase using
+// AES256-CFB, as it is read. As the salt is stored after the content it must be provided
+// separately. r must start at EncryptedOffset(offset) of the encrypted content, allowing
+// decryption to begin part way through the content, and must end before the salt
+func NewDecryptReader(r io.Reader, passphrase string, salt []byte, offset int64) (io.Reader, error) {
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, 4096, encryptKeyLen, sha512.New))
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(r, iv); err != nil {
+		return nil, err
+	}
+	reader := &cipher.StreamReader{S: cipher.NewCFBDecrypter(block, iv), R: r}
+	// skip the start of the block offset is within
+	if _, err := io.CopyN(ioutil.Discard, reader, offset%aes.BlockSize); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
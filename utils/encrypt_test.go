@@ -0,0 +1,89 @@
+package utils_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/RTradeLtd/Temporal/utils"
+	"github.com/RTradeLtd/crypto/v2"
+)
+
+func TestNewEncryptReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"Empty", []byte{}},
+		{"Small", []byte("hello world")},
+		// larger than the buffers used when reading
+		{"Large", bytes.Repeat([]byte("temporal"), 1<<16)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := utils.NewEncryptReader(bytes.NewReader(tt.content), "password123")
+			if err != nil {
+				t.Fatal(err)
+			}
+			encrypted, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.content) > 0 && bytes.Contains(encrypted, tt.content) {
+				t.Fatal("content was not encrypted")
+			}
+			// streamed content is decrypted in the same way as content encrypted in memory
+			decrypted, err := crypto.NewEncryptManager("password123").Decrypt(bytes.NewReader(encrypted))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, tt.content) {
+				t.Fatal("decrypted content does not match")
+			}
+		})
+	}
+}
+
+func TestNewDecryptReader(t *testing.T) {
+	content := bytes.Repeat([]byte("temporal"), 1<<12)
+	encrypted, err := crypto.NewEncryptManager("password123").Encrypt(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		salt = encrypted[len(encrypted)-32:]
+		size = int64(len(encrypted) - utils.EncryptionOverhead)
+	)
+	if size != int64(len(content)) {
+		t.Fatalf("decrypted size %v, want %v", size, len(content))
+	}
+	tests := []struct {
+		name   string
+		offset int64
+		length int64
+	}{
+		{"Whole", 0, size},
+		{"BlockAligned", 32, 100},
+		{"WithinBlock", 37, 11},
+		{"End", size - 5, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// read only the encrypted blocks needed, as when reading a range from ipfs
+			start := utils.EncryptedOffset(tt.offset)
+			end := int64(len(encrypted) - len(salt))
+			reader, err := utils.NewDecryptReader(bytes.NewReader(encrypted[start:end]), "password123", salt, tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := ioutil.ReadAll(io.LimitReader(reader, tt.length))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, content[tt.offset:tt.offset+tt.length]) {
+				t.Fatal("decrypted content does not match")
+			}
+		})
+	}
+}
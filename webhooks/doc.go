@@ -0,0 +1,3 @@
+// Package webhooks provides management of user registered webhook endpoints,
+// signing of the event payloads delivered to them, and a log of deliveries
+package webhooks
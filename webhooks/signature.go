@@ -0,0 +1,83 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader is the request header containing the signature of a delivered payload,
+	// formatted as t=<unix timestamp>,v1=<hex encoded hmac-sha256>
+	SignatureHeader = "X-Temporal-Signature"
+	// EventHeader is the request header containing the type of the delivered event
+	EventHeader = "X-Temporal-Event"
+	// DeliveryHeader is the request header containing the id of the delivered event
+	DeliveryHeader = "X-Temporal-Delivery"
+)
+
+var (
+	// ErrInvalidSignature is returned when a signature does not match its payload
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	// ErrSignatureExpired is returned when a signature is older than the allowed tolerance
+	ErrSignatureExpired = errors.New("webhook signature has expired")
+)
+
+// NewSecret is used to generate a secret for signing payloads
+func NewSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(secret), nil
+}
+
+// Sign is used to compute the signature header of a payload delivered at the given time.
+// The timestamp is included in the signed content to prevent replaying deliveries
+func Sign(secret string, timestamp time.Time, payload []byte) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", ts, computeMAC(secret, ts, payload))
+}
+
+// Verify is used by receivers to validate the signature header of a payload,
+// rejecting signatures older than tolerance. A tolerance of 0 disables the check
+func Verify(secret, header string, payload []byte, tolerance time.Duration) error {
+	var ts, mac string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return ErrInvalidSignature
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			mac = kv[1]
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || mac == "" {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(mac), []byte(computeMAC(secret, ts, payload))) {
+		return ErrInvalidSignature
+	}
+	if tolerance > 0 && time.Since(time.Unix(unix, 0)) > tolerance {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+func computeMAC(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
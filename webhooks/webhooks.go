@@ -0,0 +1,232 @@
+package webhooks
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/RTradeLtd/gorm"
+	"github.com/lib/pq"
+)
+
+// Event is the type of an event delivered to webhook endpoints
+type Event string
+
+const (
+	// PinSucceeded is emitted when content has been pinned
+	PinSucceeded Event = "pin.succeeded"
+	// PinFailed is emitted when content could not be pinned
+	PinFailed Event = "pin.failed"
+	// PinRefunded is emitted when the cost of a failed pin has been refunded
+	PinRefunded Event = "pin.refunded"
+	// IPNSSucceeded is emitted when an ipns record has been published
+	IPNSSucceeded Event = "ipns.succeeded"
+	// IPNSFailed is emitted when an ipns record could not be published
+	IPNSFailed Event = "ipns.failed"
+	// IPNSRefunded is emitted when the cost of a failed ipns publish has been refunded
+	IPNSRefunded Event = "ipns.refunded"
+)
+
+// Events is a list of all events which may be subscribed to
+var Events = []Event{
+	PinSucceeded, PinFailed, PinRefunded,
+	IPNSSucceeded, IPNSFailed, IPNSRefunded,
+}
+
+// Valid returns whether or not the event may be subscribed to
+func (e Event) Valid() bool {
+	for _, event := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Payload is the body delivered to webhook endpoints
+type Payload struct {
+	// ID uniquely identifies the event, allowing receivers to ignore duplicate deliveries
+	ID        string      `json:"id"`
+	Type      Event       `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      PayloadData `json:"data"`
+}
+
+// PayloadData describes the job an event was emitted for
+type PayloadData struct {
+	JobID       string `json:"job_id,omitempty"`
+	UserName    string `json:"user_name"`
+	CID         string `json:"cid,omitempty"`
+	NetworkName string `json:"network_name,omitempty"`
+	Key         string `json:"key,omitempty"`
+	// Reason describes why the job failed, or was refunded
+	Reason string `json:"reason,omitempty"`
+}
+
+// ValidateURL is used to check that a url may be registered as an endpoint. Endpoints
+// must use https unless insecure is set, and may not target local addresses
+func ValidateURL(raw string, insecure bool) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && insecure:
+	default:
+		return errors.New("webhook url must use https")
+	}
+	host := u.Hostname()
+	if host == "" {
+		return errors.New("webhook url must contain a host")
+	}
+	if strings.EqualFold(host, "localhost") {
+		return errors.New("webhook url may not target a local address")
+	}
+	if ip := net.ParseIP(host); ip != nil && !insecure &&
+		(ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || isPrivate(ip)) {
+		return errors.New("webhook url may not target a local address")
+	}
+	return nil
+}
+
+// isPrivate returns whether or not ip belongs to a private network
+func isPrivate(ip net.IP) bool {
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Endpoint is a url registered by a user to receive events
+type Endpoint struct {
+	gorm.Model
+	UserName string `gorm:"type:varchar(255)"`
+	URL      string `gorm:"type:text"`
+	// Secret is used to sign payloads delivered to the endpoint
+	Secret string `gorm:"type:varchar(255)" json:"-"`
+	// Events are the events the endpoint is subscribed to
+	Events pq.StringArray `gorm:"type:text[]"`
+}
+
+// Delivery is an attempt to deliver an event to an endpoint
+type Delivery struct {
+	gorm.Model
+	EndpointID uint   `gorm:"index"`
+	UserName   string `gorm:"type:varchar(255)"`
+	// EventID uniquely identifies the event, and is shared by all attempts to deliver it
+	EventID string `gorm:"type:varchar(255)"`
+	Event   Event  `gorm:"type:varchar(255)"`
+	Attempt int
+	// StatusCode is the http status code returned by the endpoint, or 0 if no response was received
+	StatusCode int
+	Succeeded  bool
+	// Error describes why the delivery failed
+	Error string `gorm:"type:text"`
+}
+
+// Manager is used to manipulate webhook endpoints and deliveries in our database
+type Manager struct {
+	DB *gorm.DB
+}
+
+// NewManager is used to instantiate our webhook manager
+func NewManager(db *gorm.DB) *Manager {
+	return &Manager{DB: db}
+}
+
+// Migrate is used to create or update the webhook tables
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(&Endpoint{}, &Delivery{}).Error
+}
+
+// NewEndpoint is used to register an endpoint, generating the secret used to sign its payloads
+func (m *Manager) NewEndpoint(username, url string, events []Event) (*Endpoint, error) {
+	secret, err := NewSecret()
+	if err != nil {
+		return nil, err
+	}
+	endpoint := &Endpoint{
+		UserName: username,
+		URL:      url,
+		Secret:   secret,
+	}
+	for _, event := range events {
+		endpoint.Events = append(endpoint.Events, string(event))
+	}
+	if err := m.DB.Create(endpoint).Error; err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+// FindEndpointByID is used to find an endpoint by its id
+func (m *Manager) FindEndpointByID(id uint) (*Endpoint, error) {
+	var endpoint Endpoint
+	if err := m.DB.Where("id = ?", id).First(&endpoint).Error; err != nil {
+		return nil, err
+	}
+	return &endpoint, nil
+}
+
+// FindEndpointByUserNameAndID is used to find an endpoint belonging to a user
+func (m *Manager) FindEndpointByUserNameAndID(username string, id uint) (*Endpoint, error) {
+	var endpoint Endpoint
+	if err := m.DB.Where("user_name = ? AND id = ?", username, id).First(&endpoint).Error; err != nil {
+		return nil, err
+	}
+	return &endpoint, nil
+}
+
+// FindEndpointsByUserName is used to find all endpoints belonging to a user
+func (m *Manager) FindEndpointsByUserName(username string) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	if err := m.DB.Where("user_name = ?", username).Order("id").Find(&endpoints).Error; err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// FindEndpointsByEvent is used to find the endpoints of a user subscribed to the given event
+func (m *Manager) FindEndpointsByEvent(username string, event Event) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	if err := m.DB.Where(
+		"user_name = ? AND ? = ANY(events)", username, string(event),
+	).Find(&endpoints).Error; err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// DeleteEndpoint is used to remove an endpoint belonging to a user
+func (m *Manager) DeleteEndpoint(username string, id uint) error {
+	endpoint, err := m.FindEndpointByUserNameAndID(username, id)
+	if err != nil {
+		return err
+	}
+	return m.DB.Delete(endpoint).Error
+}
+
+// RecordDelivery is used to record an attempt to deliver an event
+func (m *Manager) RecordDelivery(delivery *Delivery) error {
+	return m.DB.Create(delivery).Error
+}
+
+// FindDeliveriesByEndpoint is used to find the most recent delivery attempts to an
+// endpoint belonging to a user. A limit of 0 returns all deliveries
+func (m *Manager) FindDeliveriesByEndpoint(username string, endpointID uint, limit int) ([]Delivery, error) {
+	var deliveries []Delivery
+	query := m.DB.Where("user_name = ? AND endpoint_id = ?", username, endpointID)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Order("created_at desc").Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
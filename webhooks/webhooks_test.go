@@ -0,0 +1,143 @@
+package webhooks_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/Temporal/webhooks"
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2"
+)
+
+const testCfgPath = "../testenv/config.json"
+
+func TestVerify(t *testing.T) {
+	var (
+		secret  = "whsec_test"
+		payload = []byte(`{"type":"pin.succeeded"}`)
+		now     = time.Now()
+	)
+	tests := []struct {
+		name      string
+		header    string
+		payload   []byte
+		tolerance time.Duration
+		wantErr   error
+	}{
+		{"Valid", webhooks.Sign(secret, now, payload), payload, time.Minute, nil},
+		{"WrongSecret", webhooks.Sign("whsec_other", now, payload), payload, time.Minute, webhooks.ErrInvalidSignature},
+		{"ModifiedPayload", webhooks.Sign(secret, now, payload), []byte(`{}`), time.Minute, webhooks.ErrInvalidSignature},
+		{"Expired", webhooks.Sign(secret, now.Add(-time.Hour), payload), payload, time.Minute, webhooks.ErrSignatureExpired},
+		{"NoTolerance", webhooks.Sign(secret, now.Add(-time.Hour), payload), payload, 0, nil},
+		{"Malformed", "foo", payload, time.Minute, webhooks.ErrInvalidSignature},
+		{"MissingMAC", "t=1", payload, time.Minute, webhooks.ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := webhooks.Verify(secret, tt.header, tt.payload, tt.tolerance); err != tt.wantErr {
+				t.Fatalf("Verify() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		insecure bool
+		wantErr  bool
+	}{
+		{"HTTPS", "https://example.com/hook", false, false},
+		{"HTTP", "http://example.com/hook", false, true},
+		{"HTTPInsecure", "http://example.com/hook", true, false},
+		{"BadScheme", "ftp://example.com/hook", true, true},
+		{"NoHost", "https:///hook", false, true},
+		{"Localhost", "https://localhost/hook", false, true},
+		{"Loopback", "https://127.0.0.1/hook", false, true},
+		{"Private", "https://10.0.0.1/hook", false, true},
+		{"PrivateInsecure", "http://10.0.0.1/hook", true, false},
+		{"Public", "https://8.8.8.8/hook", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := webhooks.ValidateURL(tt.url, tt.insecure); (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateURL() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := webhooks.Migrate(dbm.DB); err != nil {
+		t.Fatal(err)
+	}
+	wm := webhooks.NewManager(dbm.DB)
+	endpoint, err := wm.NewEndpoint("testuser", "https://example.com/hook", []webhooks.Event{webhooks.PinSucceeded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.DB.Unscoped().Delete(endpoint)
+	if endpoint.Secret == "" {
+		t.Fatal("expected a secret to be generated")
+	}
+	tests := []struct {
+		name  string
+		event webhooks.Event
+		want  int
+	}{
+		{"Subscribed", webhooks.PinSucceeded, 1},
+		{"NotSubscribed", webhooks.IPNSFailed, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := wm.FindEndpointsByEvent("testuser", tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var matched int
+			for _, e := range found {
+				if e.ID == endpoint.ID {
+					matched++
+				}
+			}
+			if matched != tt.want {
+				t.Fatalf("found %v matching endpoints, want %v", matched, tt.want)
+			}
+		})
+	}
+	delivery := &webhooks.Delivery{
+		EndpointID: endpoint.ID,
+		UserName:   "testuser",
+		EventID:    "event",
+		Event:      webhooks.PinSucceeded,
+		Attempt:    1,
+		StatusCode: 200,
+		Succeeded:  true,
+	}
+	if err := wm.RecordDelivery(delivery); err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.DB.Unscoped().Delete(delivery)
+	deliveries, err := wm.FindDeliveriesByEndpoint("testuser", endpoint.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("found %v deliveries, want 1", len(deliveries))
+	}
+	if _, err := wm.FindEndpointByUserNameAndID("notthetestuser", endpoint.ID); err == nil {
+		t.Fatal("expected endpoints of other users to not be found")
+	}
+	if err := wm.DeleteEndpoint("testuser", endpoint.ID); err != nil {
+		t.Fatal(err)
+	}
+}